@@ -28,6 +28,13 @@ type Handler interface {
 	Complete(ctx *Context, rq *CompleterRequest)
 }
 
+// Handlers which help depends on runtime state (i.e. on list of possible
+// argument values) may implement this interface. Returned text is appended
+// to the help taken from schema
+type HandlerWithHelp interface {
+	Help(ctx *Context) string
+}
+
 // Helper mixins that can be embedded to avoid implementation of unsupported functions
 type HandlerWithoutCompletion struct {
 }
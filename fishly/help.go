@@ -174,7 +174,11 @@ func (rq *helpRq) writeHandler(descriptor *handlerDescriptor) {
 	rq.printUsage(optDescriptors)
 
 	if rq.verbose {
-		ioh.WriteString("help", schema.getHelp())
+		help := schema.getHelp()
+		if helpHandler, ok := descriptor.handler.(HandlerWithHelp); ok {
+			help += helpHandler.Help(rq.ctx)
+		}
+		ioh.WriteString("help", help)
 
 		// Dump options & arguments help
 		ioh.StartObject("options")
@@ -106,6 +106,7 @@ func (ctx *RexContext) registerCommands(cliCfg *fishly.Config) {
 
 	cliCfg.RegisterCommand(&incidentSeriesListCmd{}, "incident", "ls")
 	cliCfg.RegisterCommand(&incidentGetCmd{}, "incident", "get")
+	cliCfg.RegisterCommand(&incidentImportSeriesCmd{}, "incident", "import-csv")
 
 	if !ctx.isMonitor {
 		cliCfg.RegisterCommand(&incidentSetCmd{nextState: rexlib.IncCreated}, "incident", "update")
@@ -17,6 +17,8 @@ func (srv *SRVHostInfo) initialize() {
 	gob.Register(&hostinfo.HIDiskInfo{})
 	gob.Register(&hostinfo.HIProcInfo{})
 	gob.Register(&hostinfo.HIThreadInfo{})
+	gob.Register(&hostinfo.HINetInfo{})
+	gob.Register(&hostinfo.HICGroupInfo{})
 }
 
 type HIGetNexusArgs struct {
@@ -52,6 +54,8 @@ type hostinfoCmdOpt struct {
 var hostinfoSubsystems []string = []string{
 	"proc",
 	"disk",
+	"net",
+	"cgroup",
 }
 
 func (cmd *hostinfoCmd) NewOptions(ctx *fishly.Context) interface{} {
@@ -121,6 +125,31 @@ func (cmd *hostinfoCmd) writeObjectChildren(ioh *fishly.IOHandle, nexus *hostinf
 			ioh.WriteString("model", di.Model)
 			ioh.WriteFormattedValue("paths", strings.Join(di.Paths, "\n"), di.Paths)
 			ioh.EndObject()
+		case *hostinfo.HINetInfo:
+			ni := obj.Object.(*hostinfo.HINetInfo)
+			ioh.StartObject("hinet")
+			ioh.WriteString("name", name)
+			ioh.WriteString("address", ni.Address)
+			ioh.WriteRawValue("mtu", ni.MTU)
+			ioh.WriteRawValue("speed", ni.Speed)
+			ioh.WriteString("state", ni.State)
+			ioh.WriteString("master", ni.Master)
+			if opt.Stats {
+				ioh.WriteRawValue("rx_bytes", ni.RxBytes)
+				ioh.WriteRawValue("tx_bytes", ni.TxBytes)
+				ioh.WriteRawValue("rx_packets", ni.RxPackets)
+				ioh.WriteRawValue("tx_packets", ni.TxPackets)
+			}
+			ioh.EndObject()
+		case *hostinfo.HICGroupInfo:
+			cg := obj.Object.(*hostinfo.HICGroupInfo)
+			ioh.StartObject("hicgroup")
+			ioh.WriteString("name", name)
+			ioh.WriteString("path", cg.Path)
+			ioh.WriteString("hierarchy", cg.Hierarchy)
+			ioh.WriteRawValue("version", cg.Version)
+			ioh.WriteRawValue("nprocs", cg.NProcs)
+			ioh.EndObject()
 		case *hostinfo.HIProcInfo:
 			proc := obj.Object.(*hostinfo.HIProcInfo)
 			ioh.StartObject("process")
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 
 	"strings"
@@ -128,9 +129,26 @@ func (srv *SRVRex) ConfigureIncidentProvider(args *IncidentProviderArgs,
 	return
 }
 
+// Returns providers which are supported by operating system of rex daemon
+func (srv *SRVRex) GetProviders(args *struct{}, reply *[]provider.Info) (err error) {
+	*reply = nil
+	for _, info := range provider.List() {
+		if info.IsSupported() {
+			*reply = append(*reply, info)
+		}
+	}
+	return
+}
+
 // --------------
 // CLI
 
+// Returns providers supported by rex daemon
+func (ctx *RexContext) getProviders() (providers []provider.Info) {
+	ctx.client.Call("SRVRex.GetProviders", &struct{}{}, &providers)
+	return
+}
+
 // For auto-complete thingy
 func (ctx *RexContext) getIncidentNames(hostName string) (names []string) {
 	var incidents []rexlib.IncidentDescriptor
@@ -379,6 +397,9 @@ type incidentSetCmd struct {
 type incidentSetOpt struct {
 	TickInterval int    `opt:"t|tick,opt"`
 	Description  string `opt:"d|description,opt"`
+
+	// Maximum size of trace in megabytes
+	TraceLimit int `opt:"l|limit,opt"`
 }
 
 type incidentStopOpt struct {
@@ -433,6 +454,9 @@ func (cmd *incidentSetCmd) Execute(cliCtx *fishly.Context, rq *fishly.Request) (
 		if len(opt.Description) > 0 {
 			ctx.incident.Description = opt.Description
 		}
+		if opt.TraceLimit > 0 {
+			ctx.incident.TraceLimit = opt.TraceLimit
+		}
 	case rexlib.IncRunning:
 		// 'start'
 		ctx.incident.StartedAt = time.Now()
@@ -508,7 +532,59 @@ func (cmd *incidentProviderCmd) NewOptions(cliCtx *fishly.Context) interface{} {
 }
 
 func (cmd *incidentProviderCmd) Complete(cliCtx *fishly.Context, rq *fishly.CompleterRequest) {
-	// TODO
+	ctx := cliCtx.External.(*RexContext)
+	if rq.ArgIndex < 1 {
+		return
+	}
+
+	providers := ctx.getProviders()
+	if !cmd.isSet && rq.ArgIndex == 1 {
+		for _, info := range providers {
+			rq.AddOption(info.Name)
+		}
+		return
+	}
+
+	// Complete names of configuration steps of the provider
+	var name string
+	if cmd.isSet {
+		if ctx.refreshIncident() != nil || ctx.ProviderIndex < 0 ||
+			ctx.ProviderIndex >= len(ctx.incident.Providers) {
+			return
+		}
+		name = ctx.incident.Providers[ctx.ProviderIndex].Name
+	} else if opts, ok := rq.GetExistingOptions().(*incidentProviderOpt); ok {
+		name = opts.ProviderName
+	}
+
+	for _, info := range providers {
+		if info.Name != name {
+			continue
+		}
+		for _, step := range info.Steps {
+			rq.AddOption(step + "=")
+		}
+	}
+}
+
+func (cmd *incidentProviderCmd) Help(cliCtx *fishly.Context) string {
+	ctx := cliCtx.External.(*RexContext)
+	if ctx.client == nil {
+		return ""
+	}
+
+	help := bytes.NewBufferString("\n\nAvailable providers:\n")
+	for _, info := range ctx.getProviders() {
+		fmt.Fprintf(help, "  %-12s %s", info.Name, info.Description)
+		if len(info.OS) > 0 {
+			fmt.Fprintf(help, " (%s)", strings.Join(info.OS, ", "))
+		}
+		if len(info.Steps) > 0 {
+			fmt.Fprintf(help, "\n  %-12s steps: %s", "", strings.Join(info.Steps, ", "))
+		}
+		help.WriteRune('\n')
+	}
+	return help.String()
 }
 
 func (cmd *incidentProviderCmd) IsApplicable(cliCtx *fishly.Context) bool {
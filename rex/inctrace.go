@@ -3,14 +3,25 @@ package main
 import (
 	"fmt"
 
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"math"
+	"time"
+
 	"rexlib"
 
 	"fishly"
 	"tsfile"
+	"tsfile/importer"
+	"tsfile/query"
 )
 
 const (
 	eventsBatchSize = 32
+
+	followWaitTimeout = 5 * time.Second
 )
 
 // --------------
@@ -22,20 +33,56 @@ func (srv *SRVRex) GetEvents(args *rexlib.IncidentEventArgs, reply *rexlib.Incid
 		return
 	}
 
+	*reply, err = incident.GetEvents(args)
+	return
+}
+
+func (srv *SRVRex) FindEvents(args *rexlib.IncidentTimeRangeArgs, reply *rexlib.IncidentTimeRangeReply) (err error) {
+	incident, err := rexlib.Incidents.Get(args.Incident)
+	if err != nil {
+		return
+	}
+
 	trace, err := incident.GetTraceFile()
 	if err != nil {
 		return
 	}
 	defer trace.Put()
 
-	reply.Schema, err = trace.GetSchema(args.Tag)
+	reply.Start, reply.End, err = trace.FindEntryRange(args.Tag, args.From, args.To)
+	return
+}
+
+func (srv *SRVRex) WaitEvents(args *rexlib.IncidentWaitArgs, reply *tsfile.TSFileStats) (err error) {
+	incident, err := rexlib.Incidents.Get(args.Incident)
+	if err != nil {
+		return
+	}
+
+	*reply, err = incident.WaitTraceStats(args.Stats, args.Timeout)
+	return
+}
+
+func (srv *SRVRex) ImportSeries(args *rexlib.IncidentSeriesImportArgs,
+	reply *rexlib.IncidentSeriesImportReply) (err error) {
+	incident, err := rexlib.Incidents.Get(args.Incident)
 	if err != nil {
 		return
 	}
 
-	reply.Data = make([][]byte, args.Count)
+	*reply, err = incident.ImportSeries(args)
+	return
+}
 
-	return trace.GetEntries(args.Tag, reply.Data, args.Start)
+func (srv *SRVRex) GetRollup(args *rexlib.IncidentRollupArgs,
+	reply *rexlib.IncidentRollupReply) (err error) {
+	incident, err := rexlib.Incidents.Get(args.Incident)
+	if err != nil {
+		return
+	}
+
+	*reply, err = incident.GetRollup(args)
+	return
 }
 
 // --------------
@@ -91,16 +138,32 @@ type incidentGetCmd struct {
 }
 
 type incidentGetOpt struct {
+	// Time range relative to incident start, i.e. 10s or 1m30s
+	From string `opt:"f|from,opt"`
+	To   string `opt:"t|to,opt"`
+
+	// Keep waiting for new entries until incident is stopped
+	Follow bool `opt:"F|follow,opt"`
+
+	// Resolution of the series, i.e. 1s or 5m. If specified, entries of
+	// rollup series aggregated over such windows are returned
+	Resolution string `opt:"r|resolution,opt"`
+
+	// Filters on field values, i.e. cpu=1 or comm!=bash
+	Where []string `opt:"w|where,opt"`
+
+	// Aggregations of matching entries, i.e. count or avg(load), which are
+	// computed over intervals (i.e. 1s) or over the whole time range
+	Aggregate []string `opt:"a|aggregate,opt"`
+	Interval  string   `opt:"i|interval,opt"`
+
 	Series []string `arg:"1"`
 }
 
 type incidentGetSeries struct {
-	args  rexlib.IncidentEventArgs
-	reply rexlib.IncidentEventReply
-
-	name    string
-	count   uint
-	minTime tsfile.TSTimeStart
+	tag   tsfile.TSFPageTag
+	name  string
+	count uint
 
 	deserializer *tsfile.TSFDeserializer
 }
@@ -140,11 +203,20 @@ func (cmd *incidentGetCmd) Execute(cliCtx *fishly.Context, rq *fishly.Request) (
 	if err != nil {
 		return
 	}
+	if len(opts.Resolution) > 0 {
+		if opts.Follow {
+			return fmt.Errorf("Resolution cannot be used when following incident")
+		}
 
-	// Compute total number of events which we want to process
-	var evCount uint
-	for _, seriesData := range series {
-		evCount += seriesData.count
+		err = cmd.rollupSeriesData(ctx, series, opts.Resolution)
+		if err != nil {
+			return
+		}
+	}
+
+	args, err := cmd.newQueryArgs(ctx, series, opts)
+	if err != nil {
+		return
 	}
 
 	// Start output
@@ -154,21 +226,111 @@ func (cmd *incidentGetCmd) Execute(cliCtx *fishly.Context, rq *fishly.Request) (
 	}
 	defer ioh.CloseOutput()
 
+	if len(args.Aggregations) > 0 {
+		if opts.Follow {
+			return fmt.Errorf("Aggregations cannot be used when following incident")
+		}
+
+		return cmd.writeBuckets(ctx, ioh, args, opts.Aggregate)
+	}
+
 	ioh.StartObject("series")
-	for ; evCount > 0; evCount-- {
-		seriesData, err := cmd.getNextSeries(ctx, series)
+	for err == nil {
+		var count int
+		count, err = cmd.writeSeriesData(ctx, ioh, series, args)
+		if err != nil || count == args.Count {
+			// Query may have more entries, request next batch
+			continue
+		}
+		if !opts.Follow {
+			break
+		}
+
+		var evCount uint
+		evCount, err = cmd.waitSeriesData(ctx, series)
+		if evCount == 0 {
+			break
+		}
+	}
+	ioh.EndObject()
+
+	return
+}
+
+// Creates arguments of the query over series from options
+func (cmd *incidentGetCmd) newQueryArgs(ctx *RexContext, series []incidentGetSeries,
+	opts *incidentGetOpt) (args *rexlib.IncidentEventArgs, err error) {
+
+	args = &rexlib.IncidentEventArgs{
+		Incident: ctx.incident.Name,
+		Count:    eventsBatchSize,
+		Starts:   make([]int, len(series)),
+	}
+	for _, seriesData := range series {
+		args.Tags = append(args.Tags, seriesData.tag)
+	}
+
+	if len(opts.From) > 0 || len(opts.To) > 0 {
+		var from, to time.Duration = 0, time.Duration(math.MaxInt64)
+		if len(opts.From) > 0 {
+			from, err = time.ParseDuration(opts.From)
+			if err != nil {
+				return
+			}
+		}
+		if len(opts.To) > 0 {
+			to, err = time.ParseDuration(opts.To)
+			if err != nil {
+				return
+			}
+		}
+
+		args.From, args.To = tsfile.TSTimeStart(from), tsfile.TSTimeStart(to)
+	}
+
+	for _, expr := range opts.Where {
+		filter, err := query.ParseFilter(expr)
+		if err != nil {
+			return nil, err
+		}
+		args.Filters = append(args.Filters, filter)
+	}
+
+	for _, expr := range opts.Aggregate {
+		aggr, err := query.ParseAggregation(expr)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if seriesData == nil || len(seriesData.reply.Data) == 0 {
-			return fmt.Errorf("%d records are missing", evCount)
+		args.Aggregations = append(args.Aggregations, aggr)
+	}
+	if len(opts.Interval) > 0 {
+		interval, err := time.ParseDuration(opts.Interval)
+		if err != nil {
+			return nil, err
 		}
+		args.Window = int64(interval)
+	}
 
-		// Extract first entry and reset max time (to be recomputed)
-		buf := seriesData.reply.Data[0]
-		seriesData.reply.Data = seriesData.reply.Data[1:len(seriesData.reply.Data)]
-		seriesData.minTime = 0
+	return
+}
 
+// Writes next batch of entries matching query to output and returns number
+// of written entries
+func (cmd *incidentGetCmd) writeSeriesData(ctx *RexContext, ioh *fishly.IOHandle,
+	series []incidentGetSeries, args *rexlib.IncidentEventArgs) (int, error) {
+
+	var reply rexlib.IncidentEventReply
+	err := ctx.client.Call("SRVRex.GetEvents", args, &reply)
+	if err != nil {
+		return 0, err
+	}
+	args.Starts = reply.Starts
+
+	for i, buf := range reply.Data {
+		seriesData := &series[reply.Series[i]]
+		if seriesData.deserializer == nil {
+			seriesData.deserializer = tsfile.NewDeserializer(reply.Schemas[reply.Series[i]])
+		}
 		deserializer := seriesData.deserializer
 
 		ioh.StartObject("seriesEntry")
@@ -189,8 +351,82 @@ func (cmd *incidentGetCmd) Execute(cliCtx *fishly.Context, rq *fishly.Request) (
 		}
 		ioh.EndObject()
 	}
+
+	return len(reply.Data), nil
+}
+
+// Writes aggregated values of entries matching query to output
+func (cmd *incidentGetCmd) writeBuckets(ctx *RexContext, ioh *fishly.IOHandle,
+	args *rexlib.IncidentEventArgs, names []string) error {
+
+	var reply rexlib.IncidentEventReply
+	err := ctx.client.Call("SRVRex.GetEvents", args, &reply)
+	if err != nil {
+		return err
+	}
+
+	ioh.StartObject("seriesBuckets")
+	for _, bucket := range reply.Buckets {
+		ioh.StartObject("seriesBucket")
+		ioh.WriteFormattedValue("start_time", formatDuration(int64(bucket.Start)), bucket.Start)
+		for ai, value := range bucket.Values {
+			ioh.WriteRawValue(names[ai], value)
+		}
+		ioh.EndObject()
+	}
 	ioh.EndObject()
 
+	return nil
+}
+
+// Waits until tracer adds new entries to series and returns their number.
+// Returns zero if incident was stopped and no more entries are expected
+func (cmd *incidentGetCmd) waitSeriesData(ctx *RexContext, series []incidentGetSeries) (
+	evCount uint, err error) {
+
+	args := rexlib.IncidentWaitArgs{
+		Incident: ctx.incident.Name,
+		Timeout:  followWaitTimeout,
+	}
+	for _, seriesData := range series {
+		args.Stats.Series = append(args.Stats.Series, tsfile.TSFSeriesStats{
+			Tag:   seriesData.tag,
+			Name:  seriesData.name,
+			Count: seriesData.count,
+		})
+	}
+
+	for evCount == 0 {
+		// Check state before waiting, so we won't miss entries which were
+		// added right before stopping incident
+		err = ctx.refreshIncident()
+		if err != nil {
+			return
+		}
+		stopped := (ctx.incident.GetState() == rexlib.IncStopped)
+
+		var stats tsfile.TSFileStats
+		err = ctx.client.Call("SRVRex.WaitEvents", &args, &stats)
+		if err != nil {
+			return
+		}
+
+		for i := range series {
+			seriesData := &series[i]
+			for _, seriesStats := range stats.Series {
+				if seriesStats.Tag == seriesData.tag && seriesStats.Count > seriesData.count {
+					evCount += seriesStats.Count - seriesData.count
+					seriesData.count = seriesStats.Count
+					args.Stats.Series[i].Count = seriesStats.Count
+				}
+			}
+		}
+
+		if stopped {
+			break
+		}
+	}
+
 	return
 }
 
@@ -200,18 +436,17 @@ func (cmd *incidentGetCmd) newSeriesData(incident *rexlib.Incident, names []stri
 
 	for i, name := range names {
 		seriesData := &series[i]
-		seriesData.args.Incident = incident.Name
 		seriesData.name = name
 
 		for _, seriesStats := range incident.TraceStats.Series {
 			if name == seriesStats.Name {
-				seriesData.args.Tag = seriesStats.Tag
+				seriesData.tag = seriesStats.Tag
 				seriesData.count = seriesStats.Count
 				break
 			}
 		}
 
-		if seriesData.args.Tag == tsfile.TSFTagEmpty {
+		if seriesData.tag == tsfile.TSFTagEmpty {
 			return nil, fmt.Errorf("Series '%s' is not found", name)
 		}
 	}
@@ -219,57 +454,126 @@ func (cmd *incidentGetCmd) newSeriesData(incident *rexlib.Incident, names []stri
 	return
 }
 
-func (cmd *incidentGetCmd) getNextSeries(ctx *RexContext, series []incidentGetSeries) (
-	*incidentGetSeries, error) {
+// Replaces series with their rollups with requested resolution
+func (cmd *incidentGetCmd) rollupSeriesData(ctx *RexContext, series []incidentGetSeries,
+	resolution string) (err error) {
 
-	var mrSeriesIndex int
-	var mrSeriesTime tsfile.TSTimeStart
+	window, err := time.ParseDuration(resolution)
+	if err != nil {
+		return
+	}
 
-	for seriesIndex, _ := range series {
-		seriesData := &series[seriesIndex]
+	for i, _ := range series {
+		seriesData := &series[i]
 
-		if len(seriesData.reply.Data) == 0 {
-			// No more entries for this data series left
-			if uint(seriesData.args.Start) == seriesData.count {
-				continue
-			}
+		args := rexlib.IncidentRollupArgs{
+			Incident:   ctx.incident.Name,
+			Tag:        seriesData.tag,
+			Resolution: window,
+		}
 
-			// Limit amount of entries retrieved
-			seriesData.args.Count = int(seriesData.count) - seriesData.args.Start
-			if seriesData.args.Count > eventsBatchSize {
-				seriesData.args.Count = eventsBatchSize
-			}
+		var reply rexlib.IncidentRollupReply
+		err = ctx.client.Call("SRVRex.GetRollup", &args, &reply)
+		if err != nil {
+			return
+		}
 
-			// Retrieve some entries or fail
-			var reply rexlib.IncidentEventReply
-			err := ctx.client.Call("SRVRex.GetEvents", &seriesData.args, &reply)
-			if err != nil {
-				return nil, err
-			}
+		seriesData.tag = reply.Tag
+		seriesData.count = uint(reply.Count)
+	}
 
-			seriesData.reply.Schema = reply.Schema
-			seriesData.reply.Data = append(seriesData.reply.Data, reply.Data...)
-			seriesData.args.Start += len(reply.Data)
+	return
+}
 
-			if seriesData.deserializer == nil {
-				seriesData.deserializer = tsfile.NewDeserializer(reply.Schema)
-			}
-		}
+//
+// 'import-csv' subcommand -- imports series from local CSV or JSON file
+//
 
-		// Sort by time: extract it from top-level entry
-		if seriesData.minTime == 0 {
-			seriesData.minTime = seriesData.deserializer.GetStartTime(
-				seriesData.reply.Data[0])
-		}
+type incidentImportSeriesCmd struct {
+	fishly.HandlerWithoutCompletion
+}
+
+type incidentImportSeriesOpt struct {
+	// Format of the file: csv or json, if omitted, picked by extension
+	Format string `opt:"f|format,opt"`
+
+	// Name of the series, by default name of the file is used
+	Name string `opt:"n|name,opt"`
+
+	// Names of time columns and format of timestamps: s, ms, us, ns or
+	// time layout (by default nanoseconds or RFC3339 time)
+	StartTime  string `opt:"s|start,opt"`
+	EndTime    string `opt:"e|end,opt"`
+	TimeFormat string `opt:"t|timefmt,opt"`
+
+	// Timestamps are absolute, make them relative to incident start
+	Rebase bool `opt:"r|rebase,opt"`
+
+	Path string `arg:"1"`
+}
+
+func (cmd *incidentImportSeriesCmd) NewOptions(cliCtx *fishly.Context) interface{} {
+	return new(incidentImportSeriesOpt)
+}
+
+func (cmd *incidentImportSeriesCmd) IsApplicable(cliCtx *fishly.Context) bool {
+	ctx := cliCtx.External.(*RexContext)
+	if ctx.refreshIncident() != nil {
+		return false
+	}
 
-		if mrSeriesTime == 0 || seriesData.minTime < mrSeriesTime {
-			mrSeriesTime = seriesData.minTime
-			mrSeriesIndex = seriesIndex
+	return ctx.incident.GetState() != rexlib.IncCreated
+}
+
+func (cmd *incidentImportSeriesCmd) Execute(cliCtx *fishly.Context, rq *fishly.Request) (err error) {
+	ctx := cliCtx.External.(*RexContext)
+	opts := rq.Options.(*incidentImportSeriesOpt)
+
+	data, err := ioutil.ReadFile(opts.Path)
+	if err != nil {
+		return
+	}
+
+	ext := filepath.Ext(opts.Path)
+	args := rexlib.IncidentSeriesImportArgs{
+		Incident:   ctx.incident.Name,
+		Format:     opts.Format,
+		Data:       data,
+		Name:       opts.Name,
+		StartTime:  opts.StartTime,
+		EndTime:    opts.EndTime,
+		TimeFormat: opts.TimeFormat,
+		Rebase:     opts.Rebase,
+	}
+	if len(args.Format) == 0 {
+		args.Format = importer.FormatCSV
+		if ext == ".json" || ext == ".jsonl" {
+			args.Format = importer.FormatJSON
 		}
+	}
+	if len(args.Name) == 0 {
+		args.Name = strings.TrimSuffix(filepath.Base(opts.Path), ext)
+	}
 
+	var reply rexlib.IncidentSeriesImportReply
+	err = ctx.client.Call("SRVRex.ImportSeries", &args, &reply)
+	if err != nil {
+		return
+	}
+
+	ioh, err := rq.StartOutput(cliCtx, false)
+	if err != nil {
+		return
 	}
+	defer ioh.CloseOutput()
+
+	ioh.StartObject("seriesStats")
+	ioh.WriteRawValue("tag", reply.Tag)
+	ioh.WriteString("name", args.Name)
+	ioh.WriteRawValue("count", reply.Count)
+	ioh.EndObject()
 
-	return &series[mrSeriesIndex], nil
+	return ctx.refreshIncident()
 }
 
 func formatDuration(t int64) string {
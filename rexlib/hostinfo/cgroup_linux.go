@@ -0,0 +1,229 @@
+package hostinfo
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	procSelfMountInfoPath = "/proc/self/mountinfo"
+
+	// Name of the unified hierarchy in nexus
+	cgroupUnifiedName = "unified"
+)
+
+// Controllers which may be mounted as v1 hierarchies. Other super options
+// of cgroup mount are flags, except for named hierarchies (name=systemd)
+var cgroupControllers = map[string]bool{
+	"cpu": true, "cpuacct": true, "cpuset": true, "memory": true,
+	"devices": true, "freezer": true, "net_cls": true, "net_prio": true,
+	"blkio": true, "perf_event": true, "hugetlb": true, "pids": true,
+	"rdma": true, "misc": true,
+}
+
+// Mounted cgroup hierarchy
+type HICGroupHierarchy struct {
+	// Version of cgroups: 1 or 2 for unified hierarchy
+	Version int
+
+	// Controllers attached to the hierarchy
+	Controllers []string
+
+	// Path of the group in hierarchy which is mounted (not a "/" inside
+	// containers) and directory where it is mounted
+	Root       string
+	MountPoint string
+}
+
+// Returns name of the hierarchy as it is used in /proc/<pid>/cgroup, which
+// is empty for unified hierarchy
+func (hier *HICGroupHierarchy) Name() string {
+	if hier.Version == 2 {
+		return ""
+	}
+	return strings.Join(hier.Controllers, ",")
+}
+
+func (hier *HICGroupHierarchy) HasController(controller string) bool {
+	for _, item := range hier.Controllers {
+		if item == controller {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns directory of the group with the specified path in cgroup
+// filesystem or empty string if group is not visible in mounted hierarchy
+func (hier *HICGroupHierarchy) GetPath(group string) string {
+	group = path.Clean(group)
+	if hier.Root != "/" {
+		if group != hier.Root && !strings.HasPrefix(group, hier.Root+"/") {
+			return ""
+		}
+		group = strings.TrimPrefix(group, hier.Root)
+	}
+
+	return filepath.Join(hier.MountPoint, group)
+}
+
+// Reads list of the mounted cgroup hierarchies from mountinfo
+func ReadCGroupHierarchies() ([]HICGroupHierarchy, error) {
+	file, err := os.Open(procSelfMountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return parseCGroupMountInfo(file)
+}
+
+func parseCGroupMountInfo(reader io.Reader) (hierarchies []HICGroupHierarchy, err error) {
+	// Lines of mountinfo have format:
+	// id parent-id major:minor root mount-point options [tags] - type source super-options
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 5 || sep+3 >= len(fields) {
+			return hierarchies, fmt.Errorf("Invalid mountinfo line '%s'", scanner.Text())
+		}
+
+		hier := HICGroupHierarchy{
+			Root:       fields[3],
+			MountPoint: fields[4],
+		}
+		switch fields[sep+1] {
+		case "cgroup":
+			hier.Version = 1
+			for _, option := range strings.Split(fields[sep+3], ",") {
+				if cgroupControllers[option] || strings.HasPrefix(option, "name=") {
+					hier.Controllers = append(hier.Controllers, option)
+				}
+			}
+		case "cgroup2":
+			hier.Version = 2
+			controllers, _ := ioutil.ReadFile(filepath.Join(hier.MountPoint, "cgroup.controllers"))
+			hier.Controllers = strings.Fields(string(controllers))
+		default:
+			continue
+		}
+
+		trace(HITraceCGroup, "Found cgroup hierarchy v%d %v at %s", hier.Version,
+			hier.Controllers, hier.MountPoint)
+		hierarchies = append(hierarchies, hier)
+	}
+
+	return hierarchies, scanner.Err()
+}
+
+// Reads paths of the process in cgroup hierarchies keyed by hierarchy name
+func ReadProcCGroups(pid uint32) (map[string]string, error) {
+	file, err := os.Open(filepath.Join(procPath, fmt.Sprint(pid), "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return parseProcCGroups(file)
+}
+
+// Parses cgroup file in format hierarchy-id:controllers:path
+func parseProcCGroups(reader io.Reader) (map[string]string, error) {
+	cgroups := make(map[string]string)
+
+	buf := bufio.NewReader(reader)
+	for {
+		line, err := buf.ReadString('\n')
+
+		tokens := strings.SplitN(strings.TrimSpace(line), ":", 3)
+		if len(tokens) == 3 {
+			cgroups[tokens[1]] = tokens[2]
+		}
+
+		if err == io.EOF {
+			return cgroups, nil
+		}
+		if err != nil {
+			return cgroups, err
+		}
+	}
+}
+
+// Probes cgroup hierarchies and groups in them on linux
+type HICGroupProber struct {
+}
+
+func (prober *HICGroupProber) Probe(nexus *HIObject) error {
+	hierarchies, err := ReadCGroupHierarchies()
+	if err != nil {
+		trace(HITraceCGroup, "Error reading cgroup hierarchies: %v", err)
+		return err
+	}
+
+	for _, hier := range hierarchies {
+		name := hier.Name()
+		if hier.Version == 2 {
+			name = cgroupUnifiedName
+		}
+
+		info := &HICGroupInfo{
+			Path:        hier.Root,
+			Hierarchy:   name,
+			Version:     hier.Version,
+			Controllers: hier.Controllers,
+			FSPath:      hier.MountPoint,
+		}
+		prober.walkGroup(nexus.Attach(name, info), info)
+	}
+
+	return nil
+}
+
+// Recursively attaches child groups of the group
+func (prober *HICGroupProber) walkGroup(obj *HIObject, info *HICGroupInfo) {
+	if procs, err := ioutil.ReadFile(filepath.Join(info.FSPath, "cgroup.procs")); err == nil {
+		info.NProcs = strings.Count(string(procs), "\n")
+	}
+
+	groupDirs, err := ioutil.ReadDir(info.FSPath)
+	if err != nil {
+		trace(HITraceCGroup, "Error reading cgroup dir %s: %v", info.FSPath, err)
+		return
+	}
+
+	for _, groupDir := range groupDirs {
+		if !groupDir.IsDir() {
+			continue
+		}
+
+		name := groupDir.Name()
+		child := &HICGroupInfo{
+			Path:        path.Join(info.Path, name),
+			Hierarchy:   info.Hierarchy,
+			Version:     info.Version,
+			Controllers: info.Controllers,
+			FSPath:      filepath.Join(info.FSPath, name),
+		}
+		prober.walkGroup(obj.Attach(name, child), child)
+	}
+}
+
+func (prober *HICGroupProber) UpdateStats(nexus *HIObject) error {
+	// Statistics of groups are collected by cgroupstat provider
+	return nil
+}
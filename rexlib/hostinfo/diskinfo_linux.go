@@ -4,20 +4,27 @@ import (
 	"os"
 	"path/filepath"
 
+	"bufio"
 	"fmt"
+	"io"
 	"strings"
 
 	"regexp"
+	"time"
 )
 
 const (
-	sysBlockPath    = "/sys/block"
-	sysScsiHostPath = "/sys/class/scsi_host"
-	devDiskPath     = "/dev/disk"
-	devPath         = "/dev"
+	procDiskStatsPath = "/proc/diskstats"
+	sysBlockPath      = "/sys/block"
+	sysScsiHostPath   = "/sys/class/scsi_host"
+	devDiskPath       = "/dev/disk"
+	devPath           = "/dev"
 
 	defaultSectorSize = 512
 
+	// Sectors in diskstats are always 512 bytes regardless of device
+	diskStatsSectorSize = 512
+
 	diskMaximumPartitions = 256 // DISK_MAX_PARTS
 )
 
@@ -71,6 +78,9 @@ func (prober *HIDiskProber) Probe(nexus *HIObject) (err error) {
 
 	// TODO: LVM, btrfs...
 
+	// Read initial values of counters, so relative stats will be available
+	// after next update
+	prober.UpdateStats(nexus)
 	return
 }
 
@@ -225,6 +235,82 @@ func (diObj *HIObject) procSlaves(nexus *HIObject) {
 }
 
 func (prober *HIDiskProber) UpdateStats(nexus *HIObject) error {
-	// TODO implement me
+	stats, err := ReadDiskStats()
+	if err != nil {
+		trace(HITraceDisk, "Error reading %s: %v", procDiskStatsPath, err)
+		return err
+	}
+
+	now := time.Now()
+	for name, diObj := range nexus.Children {
+		counters, ok := stats[name]
+		if !ok {
+			continue
+		}
+
+		di := diObj.Object.(*HIDiskInfo)
+		if !di.statsTime.IsZero() {
+			di.normalizeStats(counters, now.Sub(di.statsTime))
+		}
+
+		di.counters = counters
+		di.statsTime = now
+	}
+
 	return nil
 }
+
+// Reads absolute counters of all block devices from diskstats keyed by
+// name of the device
+func ReadDiskStats() (map[string]HIDiskCounters, error) {
+	file, err := os.Open(procDiskStatsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return parseDiskStats(file)
+}
+
+func parseDiskStats(reader io.Reader) (map[string]HIDiskCounters, error) {
+	stats := make(map[string]HIDiskCounters)
+
+	buf := bufio.NewReader(reader)
+	for {
+		line, err := buf.ReadString('\n')
+		if len(strings.TrimSpace(line)) > 0 {
+			var major, minor, merged int64
+			var name string
+			var readTime, writeTime, ioTime, weightedIOTime int64
+			var counters HIDiskCounters
+
+			// Newer kernels append discard and flush stats to the line, but
+			// we're only interested in first 14 fields
+			_, err := fmt.Sscan(line, &major, &minor, &name,
+				&counters.Reads, &merged, &counters.ReadBytes, &readTime,
+				&counters.Writes, &merged, &counters.WriteBytes, &writeTime,
+				&counters.InFlight, &ioTime, &weightedIOTime)
+			if err != nil {
+				return stats, fmt.Errorf("Invalid diskstats line '%s': %v",
+					strings.TrimSpace(line), err)
+			}
+
+			counters.ReadBytes *= diskStatsSectorSize
+			counters.WriteBytes *= diskStatsSectorSize
+
+			counters.ReadTime = time.Duration(readTime) * time.Millisecond
+			counters.WriteTime = time.Duration(writeTime) * time.Millisecond
+			counters.IOTime = time.Duration(ioTime) * time.Millisecond
+			counters.WeightedIOTime = time.Duration(weightedIOTime) * time.Millisecond
+
+			stats[name] = counters
+		}
+
+		if err == io.EOF {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, err
+		}
+	}
+}
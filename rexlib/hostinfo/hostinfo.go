@@ -16,6 +16,8 @@ import (
 const (
 	HIProc = iota
 	HIDisk
+	HINet
+	HICGroup
 )
 
 // Subsystem states
@@ -66,6 +68,8 @@ type HIObject struct {
 var subsystems []hiSubSys = []hiSubSys{
 	hiSubSys{Id: HIProc, impl: new(HIProcessProber)},
 	hiSubSys{Id: HIDisk, impl: new(HIDiskProber)},
+	hiSubSys{Id: HINet, impl: new(HINetProber)},
+	hiSubSys{Id: HICGroup, impl: new(HICGroupProber)},
 }
 
 // Probes subsystem (if necessary) and returns nexus node. If devices
@@ -141,6 +145,10 @@ type HIProcInfo struct {
 	// Kernel threads
 	KernelThread bool
 
+	// Paths of the process in cgroup hierarchies keyed by comma-separated
+	// list of controllers (which is empty for unified hierarchy)
+	CGroups map[string]string
+
 	// TODO: support for mapping
 	// TODO: support for open files & working/root directories
 
@@ -155,6 +163,10 @@ type HIProcInfo struct {
 
 	// Actual absolute stats
 	rChar, wChar int64
+
+	// Absolute process-wide stats including exited threads
+	minFault, majFault int64
+	uTime, sTime       time.Duration
 }
 
 type HIThreadInfo struct {
@@ -176,6 +188,43 @@ type HIThreadInfo struct {
 	uTime, sTime       time.Duration
 }
 
+// Absolute statistics of the thread. Relative stats are computed between
+// two probes of the nexus, so consumers which collect statistics with their
+// own intervals (i.e. providers) should keep snapshots of counters instead
+type HIThreadCounters struct {
+	VCS, IVCS          int64
+	MinFault, MajFault int64
+	UTime, STime       time.Duration
+}
+
+func (ti *HIThreadInfo) Counters() HIThreadCounters {
+	return HIThreadCounters{
+		VCS:      ti.vcs,
+		IVCS:     ti.ivcs,
+		MinFault: ti.minFault,
+		MajFault: ti.majFault,
+		UTime:    ti.uTime,
+		STime:    ti.sTime,
+	}
+}
+
+// Absolute faults and cpu times of the process including threads which
+// already exited. Context switches are only accounted per thread, so they
+// are left zero
+func (pi *HIProcInfo) Counters() HIThreadCounters {
+	return HIThreadCounters{
+		MinFault: pi.minFault,
+		MajFault: pi.majFault,
+		UTime:    pi.uTime,
+		STime:    pi.sTime,
+	}
+}
+
+// Returns absolute amount of bytes read and written by the process
+func (pi *HIProcInfo) IOCounters() (rChar, wChar int64) {
+	return pi.rChar, pi.wChar
+}
+
 // DiskInfo types
 const (
 	// Unknown object (used internally)
@@ -221,6 +270,86 @@ type HIDiskInfo struct {
 
 	// Vendor and model name
 	Model string
+
+	// Relative stats (per second, since last gather interval)
+	ReadIOPS, WriteIOPS   int64
+	ReadBytes, WriteBytes int64
+
+	// Absolute stats (since boot)
+	counters  HIDiskCounters
+	statsTime time.Time
+}
+
+// Absolute I/O statistics of the block device as they are reported by
+// kernel. Times are total times spent by all requests
+type HIDiskCounters struct {
+	Reads, Writes         int64
+	ReadBytes, WriteBytes int64
+
+	ReadTime, WriteTime time.Duration
+
+	// Number of requests currently in flight, times device was busy
+	// and busy time weighted by number of requests in flight
+	InFlight       int64
+	IOTime         time.Duration
+	WeightedIOTime time.Duration
+}
+
+func (di *HIDiskInfo) Counters() HIDiskCounters {
+	return di.counters
+}
+
+type HINetInfo struct {
+	// Name of the interface (same as used in map)
+	Name string
+
+	// Hardware address, MTU and link speed in Mbit/s (-1 if unknown)
+	Address string
+	MTU     int64
+	Speed   int64
+
+	// Operational state of the interface (up, down, unknown...)
+	State string
+
+	// Name of the bonding or bridge interface this interface is enslaved to
+	Master string
+
+	// Relative stats (per second, since last gather interval)
+	RxBytes, TxBytes     int64
+	RxPackets, TxPackets int64
+
+	// Absolute stats (since interface creation)
+	counters  HINetCounters
+	statsTime time.Time
+}
+
+// Absolute statistics of the network interface
+type HINetCounters struct {
+	RxBytes, RxPackets, RxErrors, RxDrops int64
+	TxBytes, TxPackets, TxErrors, TxDrops int64
+}
+
+func (ni *HINetInfo) Counters() HINetCounters {
+	return ni.counters
+}
+
+// Control group. Root groups of hierarchies are attached to nexus
+// and keyed by hierarchy name, child groups are keyed by their base names
+type HICGroupInfo struct {
+	// Path of the group in hierarchy as it is shown in /proc/<pid>/cgroup
+	Path string
+
+	// Name of the hierarchy (its controllers or "unified" for cgroup v2),
+	// version of cgroups and controllers attached to hierarchy
+	Hierarchy   string
+	Version     int
+	Controllers []string
+
+	// Directory of the group in cgroup filesystem
+	FSPath string
+
+	// Number of processes which are members of the group
+	NProcs int
 }
 
 // Tracing
@@ -233,6 +362,7 @@ const (
 	HITraceCPU
 	HITraceNet
 	HITraceFS
+	HITraceCGroup
 )
 
 var TracingFlags = getTraceFlags()
@@ -263,6 +393,8 @@ func getTraceFlags() (flags int) {
 			flags |= HITraceNet
 		case "fs":
 			flags |= HITraceFS
+		case "cgroup":
+			flags |= HITraceCGroup
 		}
 	}
 	return
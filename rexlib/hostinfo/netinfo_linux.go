@@ -0,0 +1,140 @@
+package hostinfo
+
+import (
+	"os"
+	"path/filepath"
+
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"time"
+)
+
+const (
+	sysClassNetPath = "/sys/class/net"
+	procNetDevPath  = "/proc/net/dev"
+)
+
+// Probes network interfaces on linux
+type HINetProber struct {
+}
+
+func (prober *HINetProber) Probe(nexus *HIObject) (err error) {
+	walker, err := sysfsOpen(sysClassNetPath)
+	if err != nil {
+		trace(HITraceNet, "Error reading %s: %v", sysClassNetPath, err)
+		return
+	}
+
+	for walker.Next() {
+		name := walker.GetName()
+
+		netInfo := &HINetInfo{
+			Name:    name,
+			Address: walker.ReadLine("address"),
+			MTU:     walker.ReadInt("mtu", 10, 32, 0),
+			Speed:   walker.ReadInt("speed", 10, 32, -1),
+			State:   walker.ReadLine("operstate"),
+		}
+		if master := walker.ReadLink("master"); len(master) > 0 {
+			netInfo.Master = filepath.Base(master)
+		}
+
+		trace(HITraceNet, "Processing interface %s: addr=%s mtu=%d state=%s", name,
+			netInfo.Address, netInfo.MTU, netInfo.State)
+
+		nexus.Attach(name, netInfo)
+	}
+
+	// Interfaces enslaved to bonding or bridge are both visible at root and
+	// as children of their master
+	for name, niObj := range nexus.Children {
+		ni := niObj.Object.(*HINetInfo)
+		if masterObj, ok := nexus.Children[ni.Master]; ok {
+			masterObj.Children[name] = niObj
+
+			trace(HITraceNet, "Found slave %s for master %s", name, ni.Master)
+		}
+	}
+
+	// Read initial values of counters, so relative stats will be available
+	// after next update
+	prober.UpdateStats(nexus)
+	return
+}
+
+func (prober *HINetProber) UpdateStats(nexus *HIObject) error {
+	stats, err := ReadNetDevStats()
+	if err != nil {
+		trace(HITraceNet, "Error reading %s: %v", procNetDevPath, err)
+		return err
+	}
+
+	now := time.Now()
+	for name, niObj := range nexus.Children {
+		counters, ok := stats[name]
+		if !ok {
+			continue
+		}
+
+		ni := niObj.Object.(*HINetInfo)
+		if !ni.statsTime.IsZero() {
+			ni.normalizeStats(counters, now.Sub(ni.statsTime))
+		}
+
+		ni.counters = counters
+		ni.statsTime = now
+	}
+
+	return nil
+}
+
+// Reads absolute counters of all network interfaces keyed by name of
+// the interface
+func ReadNetDevStats() (map[string]HINetCounters, error) {
+	file, err := os.Open(procNetDevPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return parseNetDevStats(file)
+}
+
+func parseNetDevStats(reader io.Reader) (map[string]HINetCounters, error) {
+	stats := make(map[string]HINetCounters)
+
+	buf := bufio.NewReader(reader)
+	for {
+		line, err := buf.ReadString('\n')
+
+		// Skip two header lines which do not have colon after interface name
+		if index := strings.IndexByte(line, ':'); index > 0 && !strings.Contains(line, "|") {
+			var ui64 int64
+			var counters HINetCounters
+
+			name := strings.TrimSpace(line[:index])
+			_, err := fmt.Sscan(line[index+1:],
+				// bytes    packets    errs    drop    fifo frame compr mcast
+				&counters.RxBytes, &counters.RxPackets, &counters.RxErrors,
+				&counters.RxDrops, &ui64, &ui64, &ui64, &ui64,
+				// bytes    packets    errs    drop
+				&counters.TxBytes, &counters.TxPackets, &counters.TxErrors,
+				&counters.TxDrops)
+			if err != nil {
+				return stats, fmt.Errorf("Invalid statistics of interface '%s': %v", name, err)
+			}
+
+			stats[name] = counters
+		}
+
+		if err == io.EOF {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, err
+		}
+	}
+}
@@ -34,3 +34,27 @@ func (ti *HIThreadInfo) normalizeStats(prevTi *HIThreadInfo) {
 	ti.STime = time.Duration(normalizeStatistic(int64(prevTi.sTime), int64(ti.sTime), dt))
 	ti.UTime = time.Duration(normalizeStatistic(int64(prevTi.uTime), int64(ti.uTime), dt))
 }
+
+func (di *HIDiskInfo) normalizeStats(counters HIDiskCounters, dt time.Duration) {
+	if dt < time.Microsecond {
+		return
+	}
+
+	di.ReadIOPS = normalizeStatistic(di.counters.Reads, counters.Reads, dt)
+	di.WriteIOPS = normalizeStatistic(di.counters.Writes, counters.Writes, dt)
+
+	di.ReadBytes = normalizeStatistic(di.counters.ReadBytes, counters.ReadBytes, dt)
+	di.WriteBytes = normalizeStatistic(di.counters.WriteBytes, counters.WriteBytes, dt)
+}
+
+func (ni *HINetInfo) normalizeStats(counters HINetCounters, dt time.Duration) {
+	if dt < time.Microsecond {
+		return
+	}
+
+	ni.RxBytes = normalizeStatistic(ni.counters.RxBytes, counters.RxBytes, dt)
+	ni.TxBytes = normalizeStatistic(ni.counters.TxBytes, counters.TxBytes, dt)
+
+	ni.RxPackets = normalizeStatistic(ni.counters.RxPackets, counters.RxPackets, dt)
+	ni.TxPackets = normalizeStatistic(ni.counters.TxPackets, counters.TxPackets, dt)
+}
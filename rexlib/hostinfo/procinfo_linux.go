@@ -146,7 +146,9 @@ func (prober *HIProcessProber) Probe(nexus *HIObject) error {
 		}
 
 		pi.readCommandLine(basePath)
+		pi.readStat(basePath)
 		pi.readIOStat(basePath)
+		pi.readCGroups(basePath)
 
 		if prevPi != nil {
 			pi.normalizeStats(prevPi)
@@ -175,8 +177,9 @@ func (prober *HIProcessProber) readStatus(basePath string, pi *HIProcInfo) error
 	pi.PID = uint32(pfr.ReadInteger("Pid", 10, 32))
 	pi.PPID = uint32(pfr.ReadInteger("PPid", 10, 32))
 
-	// Check out for kernel threads
-	if pi.PPID == 0 || prober.kernelThreads[pi.PPID] {
+	// Check out for kernel threads. Both init and kthreadd have zero PPID,
+	// but only descendants of kthreadd are kernel threads
+	if (pi.PPID == 0 && pi.PID != 1) || prober.kernelThreads[pi.PPID] {
 		prober.kernelThreads[pi.PID] = true
 		pi.KernelThread = true
 		return pfr.lastError
@@ -196,6 +199,32 @@ func (prober *HIProcessProber) readStatus(basePath string, pi *HIProcInfo) error
 	return pfr.lastError
 }
 
+// Reads process-wide stat file which unlike stats of the tasks also accounts
+// faults and cpu times of the threads which already exited
+func (pi *HIProcInfo) readStat(basePath string) {
+	buf, err := ioutil.ReadFile(filepath.Join(basePath, "stat"))
+	if err != nil {
+		return
+	}
+
+	// Name of the process may contain spaces and parentheses, so skip it
+	// until the last closing parenthesis
+	fields := strings.Fields(string(buf[strings.LastIndexByte(string(buf), ')')+1:]))
+	if len(fields) < 13 {
+		trace(HITraceProc, "Unexpected number of fields in %s/stat: %d", basePath, len(fields))
+		return
+	}
+
+	// state ppid pgrp sess tty# tpgid flags minflt cminflt majflt cmajflt utime stime
+	pi.minFault, _ = strconv.ParseInt(fields[7], 10, 64)
+	pi.majFault, _ = strconv.ParseInt(fields[9], 10, 64)
+
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	pi.uTime = jiffiesToDuration(utime)
+	pi.sTime = jiffiesToDuration(stime)
+}
+
 func (pi *HIProcInfo) readIOStat(basePath string) {
 	file, err := os.Open(filepath.Join(basePath, "io"))
 	if err != nil {
@@ -209,6 +238,17 @@ func (pi *HIProcInfo) readIOStat(basePath string) {
 	pi.wChar = pfr.ReadInteger("wchar", 10, 64)
 }
 
+// Reads paths of the process in cgroup hierarchies
+func (pi *HIProcInfo) readCGroups(basePath string) {
+	file, err := os.Open(filepath.Join(basePath, "cgroup"))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	pi.CGroups, _ = parseProcCGroups(file)
+}
+
 // Reads list of threads associated with this process
 func (prober *HIProcessProber) readTaskList(basePath string,
 	pi *HIProcInfo, obj *HIObject) {
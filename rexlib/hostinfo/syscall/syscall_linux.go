@@ -2,6 +2,7 @@ package syscall
 
 /*
 #include <unistd.h>
+#include <time.h>
 #include <sys/types.h>
 */
 import "C"
@@ -15,3 +16,12 @@ func GetClkTck() (jiffiesPerSecond uint64) {
 	jiffiesPerSecond = uint64(sc_clk_tck)
 	return
 }
+
+/**
+ * Returns value of monotonic clock in nanoseconds
+ */
+func GetMonotonicTime() int64 {
+	var ts C.struct_timespec
+	C.clock_gettime(C.CLOCK_MONOTONIC, &ts)
+	return int64(ts.tv_sec)*1000000000 + int64(ts.tv_nsec)
+}
@@ -89,6 +89,10 @@ type Incident struct {
 	// Incident's scheduler ticks in milliseconds
 	TickInterval int `json:"tick"`
 
+	// Maximum size of the trace in megabytes for continuous monitoring. When
+	// it is reached, oldest entries are dropped. Zero means no limit
+	TraceLimit int `json:"trace_limit,omitempty"`
+
 	// Description of incident
 	Description string `json:"descr,omitempty"`
 
@@ -105,6 +109,12 @@ type Incident struct {
 	// Reference to open trace file for running incidents or opened file
 	// for completed incidents
 	trace *tsfile.TSFile
+
+	// Trace is open in read-write mode, so series could be added to it
+	traceWritable bool
+
+	// Reference to trace of completed incident mapped in read-only mode
+	mappedTrace *tsfile.TSFile
 }
 
 type IncidentDescriptor struct {
@@ -248,6 +258,10 @@ func (state *incidentsState) remove(names []string) (paths []string, err error)
 
 	for _, name := range names {
 		if incident, ok := state.cache[name]; ok {
+			incident.mtx.Lock()
+			incident.releaseMappedTrace()
+			incident.mtx.Unlock()
+
 			paths = append(paths, incident.path)
 			incident.path = ""
 			delete(state.cache, name)
@@ -315,6 +329,10 @@ func (incident *Incident) Merge(other *Incident) error {
 		incident.TickInterval = other.TickInterval
 	}
 
+	if other.TraceLimit > 0 {
+		incident.TraceLimit = other.TraceLimit
+	}
+
 	if other.Experiment != nil {
 		incident.Experiment = other.Experiment
 	}
@@ -462,6 +480,7 @@ func (handle *IncidentHandle) Close() {
 }
 
 func (incident *Incident) closeTraceFile() (err error) {
+	incident.releaseMappedTrace()
 	return incident.trace.Put()
 }
 
@@ -590,9 +609,9 @@ func (incident *Incident) doStop() {
 
 func (incident *Incident) initializeProvider(prov *IncidentProvider) (err error) {
 	// Re-initialize provider
-	prov.handle = incident.providerFactory(prov.Name)
-	if prov.handle == nil {
-		return fmt.Errorf("Unknown provider '%s'", prov.Name)
+	prov.handle, err = incident.providerFactory(prov.Name)
+	if err != nil {
+		return err
 	}
 
 	return incident.configureProvider(provider.ConfigureSetValue,
@@ -666,9 +685,10 @@ func (incident *Incident) createProvider(state *provider.ConfigurationState) (*I
 
 	// Create an implementation object or fail
 	prov.Name = state.Configuration[0].Values[0]
-	prov.handle = incident.providerFactory(prov.Name)
-	if prov.handle == nil {
-		return nil, fmt.Errorf("Unknown provider '%s'", prov.Name)
+	var err error
+	prov.handle, err = incident.providerFactory(prov.Name)
+	if err != nil {
+		return nil, err
 	}
 
 	// Add provider and update state
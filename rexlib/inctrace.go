@@ -2,6 +2,7 @@ package rexlib
 
 import (
 	"os"
+	"reflect"
 	"time"
 
 	"bytes"
@@ -10,49 +11,26 @@ import (
 	"path/filepath"
 
 	"tsfile"
+	"tsfile/importer"
+	"tsfile/query"
 )
 
 const (
 	defferedTraceCloseDelay time.Duration = 5 * time.Second
 )
 
-type incidentSeriesData struct {
-	// Initialized at creating incidentSeriesData
-	index int
-	tag   tsfile.TSFPageTag
-	count int
-
-	// Next extracted data buffer, its time and index
-	nextIndex int
-	nextTime  tsfile.TSTimeStart
-	next      []byte
-
-	// Reference to trace and flag saying that this is first series for this
-	// trace, hence it is owner of it and should release it
-	trace      *tsfile.TSFile
-	traceOwner bool
-
-	deserializer *tsfile.TSFDeserializer
-}
-
-type IncidentEvent struct {
-	IncidentIndex int
-	SeriesIndex   int
-
-	Buffer       []byte
-	Deserializer *tsfile.TSFDeserializer
-}
-
-type incidentSeriesDataReader struct {
-	series []incidentSeriesData
-}
-
 func (incident *Incident) createTraceFile() (err error) {
 	traceFile, err := os.Create(filepath.Join(incident.path, "trace.tsf"))
 	if err == nil {
+		// Incidents are often collected while system misbehaves, so keep
+		// checksums to detect pages damaged by crashes
 		incident.trace, err = tsfile.NewTSFile(traceFile,
-			tsfile.TSFFormatV2|tsfile.TSFFormatExt)
+			tsfile.TSFFormatV3|tsfile.TSFFormatExt|tsfile.TSFFormatChecksum)
+	}
+	if err == nil && incident.TraceLimit > 0 {
+		err = incident.trace.SetRetention(int64(incident.TraceLimit) << 20)
 	}
+	incident.traceWritable = err == nil
 
 	return
 }
@@ -69,16 +47,195 @@ func (incident *Incident) GetTraceFile() (tsf *tsfile.TSFile, err error) {
 	}
 
 	// Return first reference to trace file
-	err = incident.loadTraceFile()
+	err = incident.loadTraceFile(os.O_RDONLY)
 	return incident.trace, err
 }
 
-func (incident *Incident) loadTraceFile() (err error) {
-	traceFile, err := os.Open(filepath.Join(incident.path, "trace.tsf"))
+// Returns trace file which is open for writing, so new series could be added
+// to it. Completed traces are reopened in read-write mode, readers which got
+// the trace earlier keep their read-only references until they put them
+func (incident *Incident) getWritableTraceFile() (tsf *tsfile.TSFile, err error) {
+	incident.mtx.Lock()
+	defer incident.mtx.Unlock()
+
+	if incident.trace != nil && incident.traceWritable {
+		trace := incident.trace.Get()
+		if trace != nil {
+			return trace, nil
+		}
+	}
+
+	err = incident.loadTraceFile(os.O_RDWR)
+	return incident.trace, err
+}
+
+func (incident *Incident) loadTraceFile(flag int) (err error) {
+	traceFile, err := os.OpenFile(filepath.Join(incident.path, "trace.tsf"), flag, 0)
 	if err == nil {
 		incident.trace, err = tsfile.LoadTSFile(traceFile)
 	}
+	incident.traceWritable = err == nil && flag == os.O_RDWR
+
+	return
+}
+
+// Returns trace file mapped in read-only mode for completed incidents, which
+// is faster for repeated reads of the whole trace, or regular trace file if
+// incident is still running. Incident keeps its own reference to the mapping,
+// so it is reused by the following calls until it is released
+func (incident *Incident) GetMappedTraceFile() (tsf *tsfile.TSFile, err error) {
+	if incident.GetState() != IncStopped {
+		return incident.GetTraceFile()
+	}
+
+	incident.mtx.Lock()
+	defer incident.mtx.Unlock()
+
+	if incident.mappedTrace == nil {
+		traceFile, err := os.Open(filepath.Join(incident.path, "trace.tsf"))
+		if err != nil {
+			return nil, err
+		}
+		tsf, err := tsfile.LoadTSFileMapped(traceFile)
+		if err != nil {
+			traceFile.Close()
+			return nil, err
+		}
+		incident.mappedTrace = tsf
+	}
+
+	return incident.mappedTrace.Get(), nil
+}
+
+// Puts incident reference to mapped trace, so it is unmapped when callers of
+// GetMappedTraceFile() put their references. Call with incident.mtx held
+func (incident *Incident) releaseMappedTrace() {
+	if incident.mappedTrace != nil {
+		incident.mappedTrace.Put()
+		incident.mappedTrace = nil
+	}
+}
+
+// Waits until one of the series listed in known gets more entries than known
+// by caller or timeout expires and returns actual trace statistics
+func (incident *Incident) WaitTraceStats(known tsfile.TSFileStats,
+	timeout time.Duration) (stats tsfile.TSFileStats, err error) {
+
+	trace, err := incident.GetTraceFile()
+	if err != nil {
+		return
+	}
+	defer trace.Put()
+
+	// Subscribe to series starting from entries known to the caller and wait
+	// until one of them (or timer) is fired
+	cases := make([]reflect.SelectCase, 0, len(known.Series)+1)
+	for _, seriesStats := range known.Series {
+		sub, err := trace.Subscribe(seriesStats.Tag, int(seriesStats.Count))
+		if err != nil {
+			return stats, err
+		}
+		defer sub.Close()
+
+		cases = append(cases, reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(sub.C()),
+		})
+	}
 
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	cases = append(cases, reflect.SelectCase{
+		Dir:  reflect.SelectRecv,
+		Chan: reflect.ValueOf(timer.C),
+	})
+
+	reflect.Select(cases)
+	return trace.GetStats(), nil
+}
+
+// Imports external series into incident trace (see tsfile/importer)
+func (incident *Incident) ImportSeries(args *IncidentSeriesImportArgs) (
+	reply IncidentSeriesImportReply, err error) {
+	if incident.GetState() == IncCreated {
+		return reply, fmt.Errorf("Incident is not started, it has no trace")
+	}
+
+	trace, err := incident.getWritableTraceFile()
+	if err != nil {
+		return
+	}
+	defer trace.Put()
+
+	opts := importer.Options{
+		Format:     args.Format,
+		Name:       args.Name,
+		StartTime:  args.StartTime,
+		EndTime:    args.EndTime,
+		TimeFormat: args.TimeFormat,
+	}
+	if args.Rebase {
+		opts.BaseTime = incident.StartedAt.UnixNano()
+	}
+
+	reply.Tag, reply.Count, err = importer.Import(trace, bytes.NewReader(args.Data), &opts)
+	if err != nil {
+		return
+	}
+
+	incident.mtx.Lock()
+	defer incident.mtx.Unlock()
+
+	// Mapping doesn't contain imported series, so it has to be remapped
+	incident.releaseMappedTrace()
+	incident.TraceStats = trace.GetStats()
+	return reply, incident.save()
+}
+
+// Returns rollup of the series with requested resolution, builds it if it
+// doesn't exist yet (see tsfile/rollup.go)
+func (incident *Incident) GetRollup(args *IncidentRollupArgs) (
+	reply IncidentRollupReply, err error) {
+	switch incident.GetState() {
+	case IncCreated:
+		return reply, fmt.Errorf("Incident is not started, it has no trace")
+	case IncRunning:
+		// Rollups are not updated when new entries are added to source series
+		return reply, fmt.Errorf("Cannot build rollup while incident is running")
+	}
+
+	trace, err := incident.GetTraceFile()
+	if err != nil {
+		return
+	}
+
+	window := int64(args.Resolution)
+	reply.Tag = trace.FindRollup(args.Tag, window)
+	if reply.Tag == tsfile.TSFTagEmpty {
+		// Rollup has to be added to the trace, so reopen it for writing
+		trace.Put()
+		trace, err = incident.getWritableTraceFile()
+		if err != nil {
+			return
+		}
+		reply.Tag = trace.FindRollup(args.Tag, window)
+	}
+	defer trace.Put()
+
+	if reply.Tag == tsfile.TSFTagEmpty {
+		reply.Tag, err = trace.AddRollup(args.Tag, window)
+		if err != nil {
+			return
+		}
+
+		incident.mtx.Lock()
+		incident.releaseMappedTrace()
+		incident.TraceStats = trace.GetStats()
+		err = incident.save()
+		incident.mtx.Unlock()
+	}
+
+	reply.Count = trace.GetEntryCount(reply.Tag)
 	return
 }
 
@@ -129,94 +286,66 @@ func (handle *IncidentHandle) logTraceStatistics() {
 	handle.providerOutput.Log.Println(statBuf.String())
 }
 
-// Create incident series data reader for internal needs. It is similar to
-// reader implemented by rex binary, but doesn't need bulk load (as we don't
-// need RPC ops here), hence it has a bit simpler implementation
-func (reader *incidentSeriesDataReader) AddIncident(index int, incident *Incident) error {
+// Returns entries of incident series. If args contain query, entries of the
+// multiple series are merged, filtered or aggregated (see tsfile/query)
+func (incident *Incident) GetEvents(args *IncidentEventArgs) (
+	reply IncidentEventReply, err error) {
+
 	trace, err := incident.GetTraceFile()
 	if err != nil {
-		return err
+		return
+	}
+	defer trace.Put()
+
+	tags, starts := args.Tags, args.Starts
+	if len(tags) == 0 {
+		tags, starts = []tsfile.TSFPageTag{args.Tag}, []int{args.Start}
 	}
 
-	first := true
-	for tag, tagEnd := trace.GetDataTags(); tag < tagEnd; tag++ {
-		schema, err := trace.GetSchema(tag)
+	q := query.New()
+	for index, tag := range tags {
+		_, err = q.AddSeries(0, trace, tag)
 		if err != nil {
-			return err
+			return
+		}
+		if index < len(starts) {
+			q.SetStart(index, starts[index])
 		}
 
-		reader.series = append(reader.series, incidentSeriesData{
-			index:        index,
-			tag:          tag,
-			count:        trace.GetEntryCount(tag),
-			deserializer: tsfile.NewDeserializer(schema),
-
-			trace:      trace,
-			traceOwner: first,
-		})
-		reader.fetch(len(reader.series) - 1)
-		first = false
+		reply.Schemas = append(reply.Schemas, q.GetSchema(index))
 	}
+	reply.Schema = reply.Schemas[0]
 
-	return nil
-}
-
-func (reader *incidentSeriesDataReader) fetch(index int) error {
-	seriesData := &reader.series[index]
-	if seriesData.count > seriesData.nextIndex {
-		bufs := [][]byte{nil}
-		err := seriesData.trace.GetEntries(seriesData.tag, bufs, seriesData.nextIndex)
+	if args.To != 0 {
+		q.SetTimeRange(args.From, args.To)
+	}
+	for _, filter := range args.Filters {
+		err = q.AddFilter(filter)
 		if err != nil {
-			return err
+			return
 		}
-
-		seriesData.next = bufs[0]
-		seriesData.nextTime = seriesData.deserializer.GetStartTime(seriesData.next)
-		seriesData.nextIndex++
 	}
 
-	return nil
-}
+	if len(args.Aggregations) > 0 {
+		reply.Buckets, err = q.Aggregate(args.Window, args.Aggregations...)
+		return
+	}
 
-// Returns next item with smallest time. If no more items exist, returns nil
-// Note that returned buffer is invalidated on the next read operation,
-func (reader *incidentSeriesDataReader) Next() (IncidentEvent, error) {
-	var minTime tsfile.TSTimeStart
-	minIndex := -1
-	for index, seriesData := range reader.series {
-		if seriesData.count <= seriesData.nextIndex {
-			continue
+	for len(reply.Data) < args.Count {
+		event, err := q.Next()
+		if err != nil {
+			return reply, err
 		}
-		if minIndex < 0 || seriesData.nextTime < minTime {
-			minIndex = index
+		if event.Entry == nil {
+			break
 		}
-	}
-
-	if minIndex < 0 {
-		// No more valid entries are found, return nils
-		return IncidentEvent{}, nil
-	}
 
-	// Return current entry and fetch next one
-	seriesData := &reader.series[minIndex]
-	event := IncidentEvent{
-		IncidentIndex: seriesData.index,
-		SeriesIndex:   minIndex,
-		Buffer:        seriesData.next,
-		Deserializer:  seriesData.deserializer,
+		reply.Data = append(reply.Data, event.Entry)
+		reply.Series = append(reply.Series, event.Series)
 	}
-	return event, reader.fetch(minIndex)
-}
 
-func (reader *incidentSeriesDataReader) Put() (err error) {
-	for _, seriesData := range reader.series {
-		if seriesData.traceOwner {
-			err2 := seriesData.trace.Put()
-			if err2 != nil {
-				err = err2
-			}
-		}
+	for index := range tags {
+		reply.Starts = append(reply.Starts, q.Position(index))
 	}
-
 	return
 }
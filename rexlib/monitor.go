@@ -15,6 +15,7 @@ import (
 	"path/filepath"
 
 	"tsfile"
+	"tsfile/query"
 
 	"time"
 )
@@ -28,6 +29,7 @@ const (
 	sockDirectoryPermissions = 0700
 
 	importerEventBatchSize = 32
+	importerWaitTimeout    = 5 * time.Second
 )
 
 type RexHost struct {
@@ -66,11 +68,99 @@ type IncidentEventArgs struct {
 	// Entries range to retrieve
 	Start int
 	Count int
+
+	// Query over multiple series (see tsfile/query). If Tags are set,
+	// entries of these series starting with Starts are merged by start
+	// times and Tag and Start are ignored. Time range is applied only if
+	// To is non-zero
+	Tags    []tsfile.TSFPageTag
+	Starts  []int
+	From    tsfile.TSTimeStart
+	To      tsfile.TSTimeStart
+	Filters []query.Filter
+
+	// If aggregations are set, all entries matching query are aggregated
+	// over windows of the specified size (in nanoseconds) instead of
+	// returning Count entries
+	Aggregations []query.Aggregation
+	Window       int64
 }
 
 type IncidentEventReply struct {
 	Schema *tsfile.TSFSchemaHeader
 	Data   [][]byte
+
+	// For queries: schemas of queried series, index of the series per
+	// entry in Data and positions to resume query from
+	Schemas []*tsfile.TSFSchemaHeader
+	Series  []int
+	Starts  []int
+
+	Buckets []query.Bucket
+}
+
+type IncidentTimeRangeArgs struct {
+	// Input arguments: name of incident and page tag for series
+	Incident string
+	Tag      tsfile.TSFPageTag
+
+	// Range of start times [From; To) relative to incident's global time
+	From tsfile.TSTimeStart
+	To   tsfile.TSTimeStart
+}
+
+type IncidentTimeRangeReply struct {
+	// Range of entry indices [Start; End) matching time range
+	Start int
+	End   int
+}
+
+type IncidentWaitArgs struct {
+	// Input arguments: name of incident and statistics of series which
+	// caller waits for
+	Incident string
+	Stats    tsfile.TSFileStats
+
+	// Maximum time to wait for new entries
+	Timeout time.Duration
+}
+
+type IncidentSeriesImportArgs struct {
+	// Input arguments: name of incident and data of the series in one
+	// of the importer formats
+	Incident string
+	Format   string
+	Data     []byte
+
+	// Name of the new series and names of time columns (if empty,
+	// importer picks defaults)
+	Name      string
+	StartTime string
+	EndTime   string
+
+	// Format of timestamps (see importer.Options). If Rebase is set,
+	// timestamps are absolute and made relative to incident's global time
+	TimeFormat string
+	Rebase     bool
+}
+
+type IncidentSeriesImportReply struct {
+	Tag   tsfile.TSFPageTag
+	Count int
+}
+
+type IncidentRollupArgs struct {
+	// Input arguments: name of incident, page tag of the source series and
+	// requested resolution (aggregation window)
+	Incident   string
+	Tag        tsfile.TSFPageTag
+	Resolution time.Duration
+}
+
+type IncidentRollupReply struct {
+	// Page tag of the rollup series and number of entries in it
+	Tag   tsfile.TSFPageTag
+	Count int
 }
 
 var monState *RexMonitoringState
@@ -291,8 +381,9 @@ func (handle *IncidentHandle) runImporter() {
 		incident.TraceStats = handle.providerOutput.Trace.GetStats()
 		incident.save()
 
-		// No need for precise ticks in importer
-		time.Sleep(time.Duration(incident.TickInterval) * time.Millisecond)
+		if importing {
+			handle.waitMonitoredEvents()
+		}
 	}
 
 	incident.save()
@@ -323,6 +414,29 @@ func (handle *IncidentHandle) updateMonitoredIncident() IncState {
 	return incident.getStateNoLock()
 }
 
+// Waits until tracer commits new entries to the incident trace
+func (handle *IncidentHandle) waitMonitoredEvents() {
+	incident := handle.incident
+
+	args := IncidentWaitArgs{
+		Incident: incident.Name,
+		Stats:    incident.TraceStats,
+		Timeout:  importerWaitTimeout,
+	}
+
+	if len(args.Stats.Series) > 0 {
+		var stats tsfile.TSFileStats
+		err := handle.client.Call("SRVRex.WaitEvents", &args, &stats)
+		if err == nil {
+			return
+		}
+	}
+
+	// Tracer may not support waiting or there are no series yet, so fall
+	// back to polling. No need for precise ticks in importer
+	time.Sleep(time.Duration(incident.TickInterval) * time.Millisecond)
+}
+
 func (handle *IncidentHandle) importMonitoredSeries(index int,
 	seriesStats tsfile.TSFSeriesStats) (err error) {
 
@@ -0,0 +1,513 @@
+package cgroupstat
+
+import (
+	"fmt"
+	"os"
+
+	"bufio"
+	"io/ioutil"
+	"path/filepath"
+
+	"strconv"
+	"strings"
+
+	"time"
+
+	"reflect"
+
+	"rexlib/hostinfo"
+	"rexlib/provider"
+	"tsfile"
+)
+
+// Configuration steps. Groups are selected by their paths in hierarchies
+// or by pid of the member process which is resolved to paths of its groups
+// immediately, so only cgroup step is kept in configuration
+const (
+	stepCGroup = iota
+	stepPid
+
+	stepCount
+)
+
+var stepNames = []string{"cgroup", "pid"}
+
+// Controllers which statistics are collected. For cgroup v1 each of them
+// may be mounted to a separate hierarchy, if controller is not mounted,
+// unified hierarchy is used
+const (
+	ctlCPU = iota
+	ctlCPUAcct
+	ctlMemory
+	ctlBlkIO
+	ctlPids
+
+	ctlCount
+)
+
+var ctlNames = []string{"cpu", "cpuacct", "memory", "blkio", "pids"}
+
+// Entries of cgroupstat series. Memory and pids are current, other stats
+// are normalized to per-second values (nanoseconds per second for times)
+type cgroupStatEntry struct {
+	Start tsfile.TSTimeStart
+	End   tsfile.TSTimeEnd
+
+	Path tsfile.TSVarString
+
+	CPUUsage, CPUUser, CPUSystem int64
+	NrThrottled, ThrottledTime   int64
+
+	MemCurrent, MemAnon, MemFile int64
+	PgFault, PgMajFault          int64
+
+	IOReadBytes, IOWriteBytes int64
+	IOReads, IOWrites         int64
+
+	PidsCurrent int64
+}
+
+// Absolute values read from cgroup files
+type cgroupCounters struct {
+	cpuUsage, cpuUser, cpuSystem time.Duration
+	nrThrottled                  int64
+	throttledTime                time.Duration
+
+	memCurrent, memAnon, memFile int64
+	pgFault, pgMajFault          int64
+
+	ioReadBytes, ioWriteBytes int64
+	ioReads, ioWrites         int64
+
+	pidsCurrent int64
+}
+
+type CGroupStatProvider struct {
+	// Paths of selected groups
+	groups []string
+
+	// Hierarchies used for reading statistics of controllers resolved by
+	// Prepare(), nil if controller is not available
+	hierarchies [ctlCount]*hostinfo.HICGroupHierarchy
+
+	// ID of the corresponding schema
+	traceTag tsfile.TSFPageTag
+
+	// Last snapshot of counters
+	lastSnap map[string]*cgroupCounters
+	lastTime time.Time
+}
+
+func (prov *CGroupStatProvider) Configure(action provider.ConfigurationAction,
+	step *provider.ConfigurationStep) ([]*provider.ConfigurationStep, error) {
+
+	// Get current configuration
+	if action == provider.ConfigureGetValues {
+		if len(prov.groups) == 0 {
+			return nil, nil
+		}
+
+		return []*provider.ConfigurationStep{&provider.ConfigurationStep{
+			Name:   "cgroup",
+			Values: prov.groups,
+		}}, nil
+	}
+
+	if action == provider.ConfigureSetValue {
+		hierarchies, err := hostinfo.ReadCGroupHierarchies()
+		if err != nil {
+			return nil, err
+		}
+
+		var groups []string
+		switch provider.FindStep(step, stepNames, stepCGroup) {
+		case stepCGroup:
+			for _, group := range step.Values {
+				if !isGroupVisible(hierarchies, group) {
+					return []*provider.ConfigurationStep{step}, provider.ErrInvalidConfigurationValue
+				}
+				groups = append(groups, group)
+			}
+		case stepPid:
+			for _, pidStr := range step.Values {
+				pidGroups, err := getProcessGroups(hierarchies, pidStr)
+				if err != nil {
+					return []*provider.ConfigurationStep{step}, provider.ErrInvalidConfigurationValue
+				}
+				groups = append(groups, pidGroups...)
+			}
+		default:
+			return nil, provider.ErrInvalidConfigurationStep
+		}
+
+		prov.groups = provider.AppendUnique(prov.groups, groups...)
+	}
+
+	return provider.NewSteps(stepNames), nil
+}
+
+// Returns true if group exists in any of the hierarchies
+func isGroupVisible(hierarchies []hostinfo.HICGroupHierarchy, group string) bool {
+	if !strings.HasPrefix(group, "/") {
+		return false
+	}
+
+	for _, hier := range hierarchies {
+		groupPath := hier.GetPath(group)
+		if len(groupPath) == 0 {
+			continue
+		}
+		if _, err := os.Stat(groupPath); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns distinct paths of the groups of process in hierarchies which
+// have controllers used by provider
+func getProcessGroups(hierarchies []hostinfo.HICGroupHierarchy, pidStr string) ([]string, error) {
+	pid, err := strconv.ParseUint(pidStr, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	cgroups, err := hostinfo.ReadProcCGroups(uint32(pid))
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []string
+	for _, hier := range hierarchies {
+		if hier.Version == 1 && !hasAnyController(&hier) {
+			continue
+		}
+
+		group, ok := cgroups[hier.Name()]
+		if ok && !provider.HasValue(groups, group) {
+			groups = append(groups, group)
+		}
+	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("Process %d doesn't belong to any group", pid)
+	}
+	return groups, nil
+}
+
+func hasAnyController(hier *hostinfo.HICGroupHierarchy) bool {
+	for _, ctl := range ctlNames {
+		if hier.HasController(ctl) {
+			return true
+		}
+	}
+	return false
+}
+
+func (prov *CGroupStatProvider) Prepare(handle *provider.OutputHandle) (err error) {
+	if len(prov.groups) == 0 {
+		return fmt.Errorf("No groups are selected")
+	}
+
+	hierarchies, err := hostinfo.ReadCGroupHierarchies()
+	if err != nil {
+		return err
+	}
+	prov.resolveHierarchies(hierarchies)
+
+	prov.lastSnap = nil
+
+	schema, err := tsfile.NewStructSchema(reflect.TypeOf(cgroupStatEntry{}))
+	if err == nil {
+		schema, err = tsfile.NewSchema("cgroupstat", schema.Fields)
+	}
+	if err == nil {
+		prov.traceTag, err = handle.Trace.AddSchema(schema)
+	}
+	return
+}
+
+// Picks hierarchies for controllers. Controllers mounted as v1 hierarchies
+// are not available in unified hierarchy
+func (prov *CGroupStatProvider) resolveHierarchies(hierarchies []hostinfo.HICGroupHierarchy) {
+	var unified *hostinfo.HICGroupHierarchy
+	prov.hierarchies = [ctlCount]*hostinfo.HICGroupHierarchy{}
+
+	for index := range hierarchies {
+		hier := &hierarchies[index]
+		if hier.Version == 2 {
+			unified = hier
+			continue
+		}
+
+		for ctl, name := range ctlNames {
+			if hier.HasController(name) {
+				prov.hierarchies[ctl] = hier
+			}
+		}
+	}
+
+	if unified == nil {
+		return
+	}
+	for ctl := range prov.hierarchies {
+		if prov.hierarchies[ctl] == nil {
+			prov.hierarchies[ctl] = unified
+		}
+	}
+}
+
+func (prov *CGroupStatProvider) Finalize(handle *provider.OutputHandle) {
+
+}
+
+func (prov *CGroupStatProvider) Collect(handle *provider.OutputHandle) {
+	now := handle.Now
+	timeDelta := now.Sub(prov.lastTime)
+
+	snap := make(map[string]*cgroupCounters)
+	var entries []cgroupStatEntry
+	for _, group := range prov.groups {
+		counters := prov.readCounters(group)
+		if counters == nil {
+			continue
+		}
+		snap[group] = counters
+
+		// Not enough data for now
+		prevCounters, ok := prov.lastSnap[group]
+		if !ok {
+			continue
+		}
+
+		entry := cgroupStatEntry{
+			Start: tsfile.TSTimeStart(prov.lastTime.UnixNano() - handle.GlobalTime),
+			End:   tsfile.TSTimeEnd(now.UnixNano() - handle.GlobalTime),
+			Path:  tsfile.TSVarString(group),
+		}
+		entry.computeStats(prevCounters, counters, timeDelta)
+		entries = append(entries, entry)
+	}
+
+	if len(entries) > 0 {
+		err := handle.Trace.AddEntries(prov.traceTag, entries)
+		if err != nil {
+			handle.Log.Println(err)
+		}
+	}
+
+	prov.lastSnap = snap
+	prov.lastTime = now
+}
+
+// Reads counters of the group from all hierarchies. Returns nil if group
+// doesn't exist (i.e. container was stopped)
+func (prov *CGroupStatProvider) readCounters(group string) *cgroupCounters {
+	counters := new(cgroupCounters)
+	found := false
+
+	for ctl, hier := range prov.hierarchies {
+		if hier == nil {
+			continue
+		}
+
+		dir := hier.GetPath(group)
+		if len(dir) == 0 {
+			continue
+		}
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		found = true
+
+		if hier.Version == 2 {
+			counters.readV2(ctl, dir)
+		} else {
+			counters.readV1(ctl, dir)
+		}
+	}
+
+	if !found {
+		return nil
+	}
+	return counters
+}
+
+func (counters *cgroupCounters) readV1(ctl int, dir string) {
+	switch ctl {
+	case ctlCPU:
+		stat := readKeyValues(filepath.Join(dir, "cpu.stat"))
+		counters.nrThrottled = stat["nr_throttled"]
+		counters.throttledTime = time.Duration(stat["throttled_time"])
+	case ctlCPUAcct:
+		counters.cpuUsage = time.Duration(readValue(filepath.Join(dir, "cpuacct.usage")))
+
+		stat := readKeyValues(filepath.Join(dir, "cpuacct.stat"))
+		counters.cpuUser = provider.JiffiesToDuration(stat["user"])
+		counters.cpuSystem = provider.JiffiesToDuration(stat["system"])
+	case ctlMemory:
+		counters.memCurrent = readValue(filepath.Join(dir, "memory.usage_in_bytes"))
+
+		// Use hierarchical values which are consistent with cgroup v2
+		stat := readKeyValues(filepath.Join(dir, "memory.stat"))
+		counters.memAnon = stat["total_rss"]
+		counters.memFile = stat["total_cache"]
+		counters.pgFault = stat["total_pgfault"]
+		counters.pgMajFault = stat["total_pgmajfault"]
+	case ctlBlkIO:
+		counters.ioReadBytes, counters.ioWriteBytes = readBlkIOStat(
+			filepath.Join(dir, "blkio.throttle.io_service_bytes"))
+		counters.ioReads, counters.ioWrites = readBlkIOStat(
+			filepath.Join(dir, "blkio.throttle.io_serviced"))
+	case ctlPids:
+		counters.pidsCurrent = readValue(filepath.Join(dir, "pids.current"))
+	}
+}
+
+func (counters *cgroupCounters) readV2(ctl int, dir string) {
+	switch ctl {
+	case ctlCPU:
+		stat := readKeyValues(filepath.Join(dir, "cpu.stat"))
+		counters.nrThrottled = stat["nr_throttled"]
+		counters.throttledTime = time.Duration(stat["throttled_usec"]) * time.Microsecond
+	case ctlCPUAcct:
+		// There is no cpuacct controller in v2, usage is shown in cpu.stat
+		stat := readKeyValues(filepath.Join(dir, "cpu.stat"))
+		counters.cpuUsage = time.Duration(stat["usage_usec"]) * time.Microsecond
+		counters.cpuUser = time.Duration(stat["user_usec"]) * time.Microsecond
+		counters.cpuSystem = time.Duration(stat["system_usec"]) * time.Microsecond
+	case ctlMemory:
+		counters.memCurrent = readValue(filepath.Join(dir, "memory.current"))
+
+		stat := readKeyValues(filepath.Join(dir, "memory.stat"))
+		counters.memAnon = stat["anon"]
+		counters.memFile = stat["file"]
+		counters.pgFault = stat["pgfault"]
+		counters.pgMajFault = stat["pgmajfault"]
+	case ctlBlkIO:
+		counters.ioReadBytes, counters.ioWriteBytes,
+			counters.ioReads, counters.ioWrites = readIOStat(filepath.Join(dir, "io.stat"))
+	case ctlPids:
+		counters.pidsCurrent = readValue(filepath.Join(dir, "pids.current"))
+	}
+}
+
+// Computes statistics of the tick from two snapshots of counters
+func (entry *cgroupStatEntry) computeStats(prev, cur *cgroupCounters, dt time.Duration) {
+	entry.MemCurrent = cur.memCurrent
+	entry.MemAnon = cur.memAnon
+	entry.MemFile = cur.memFile
+	entry.PidsCurrent = cur.pidsCurrent
+
+	normalize := func(prevValue, value int64) int64 {
+		return provider.NormalizeRate(value-prevValue, dt)
+	}
+
+	entry.CPUUsage = normalize(int64(prev.cpuUsage), int64(cur.cpuUsage))
+	entry.CPUUser = normalize(int64(prev.cpuUser), int64(cur.cpuUser))
+	entry.CPUSystem = normalize(int64(prev.cpuSystem), int64(cur.cpuSystem))
+	entry.NrThrottled = normalize(prev.nrThrottled, cur.nrThrottled)
+	entry.ThrottledTime = normalize(int64(prev.throttledTime), int64(cur.throttledTime))
+
+	entry.PgFault = normalize(prev.pgFault, cur.pgFault)
+	entry.PgMajFault = normalize(prev.pgMajFault, cur.pgMajFault)
+
+	entry.IOReadBytes = normalize(prev.ioReadBytes, cur.ioReadBytes)
+	entry.IOWriteBytes = normalize(prev.ioWriteBytes, cur.ioWriteBytes)
+	entry.IOReads = normalize(prev.ioReads, cur.ioReads)
+	entry.IOWrites = normalize(prev.ioWrites, cur.ioWrites)
+}
+
+// Reads file with a single integer value. Values like "max" are read as 0
+func readValue(path string) int64 {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+
+	value, _ := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	return value
+}
+
+// Reads file in format "key value" per line
+func readKeyValues(path string) map[string]int64 {
+	values := make(map[string]int64)
+	readLines(path, func(fields []string) {
+		if len(fields) == 2 {
+			values[fields[0]], _ = strconv.ParseInt(fields[1], 10, 64)
+		}
+	})
+	return values
+}
+
+// Reads blkio file in format "major:minor Read|Write|... value" and returns
+// reads and writes summed over all devices
+func readBlkIOStat(path string) (reads, writes int64) {
+	readLines(path, func(fields []string) {
+		if len(fields) != 3 {
+			return
+		}
+
+		value, _ := strconv.ParseInt(fields[2], 10, 64)
+		switch fields[1] {
+		case "Read":
+			reads += value
+		case "Write":
+			writes += value
+		}
+	})
+	return
+}
+
+// Reads io.stat file in format "major:minor rbytes=N wbytes=N rios=N wios=N ..."
+// and returns values summed over all devices
+func readIOStat(path string) (readBytes, writeBytes, reads, writes int64) {
+	readLines(path, func(fields []string) {
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+
+			value, _ := strconv.ParseInt(kv[1], 10, 64)
+			switch kv[0] {
+			case "rbytes":
+				readBytes += value
+			case "wbytes":
+				writeBytes += value
+			case "rios":
+				reads += value
+			case "wios":
+				writes += value
+			}
+		}
+	})
+	return
+}
+
+func readLines(path string, handler func(fields []string)) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 0 {
+			handler(fields)
+		}
+	}
+}
+
+// Factory creating cgroupstat provider
+func Create() provider.Provider {
+	return new(CGroupStatProvider)
+}
+
+func init() {
+	provider.Register("cgroupstat", Create, provider.Info{
+		Description: "CPU, memory, I/O and pids accounting of cgroup v1/v2 groups",
+		OS:          []string{"linux"},
+		Steps:       stepNames,
+	})
+}
@@ -0,0 +1,166 @@
+package cgroupstat
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"time"
+
+	"testing"
+
+	"rexlib/hostinfo"
+	"rexlib/provider"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCGroupStatV2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroupstattest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"app/cpu.stat": "usage_usec 2000000\nuser_usec 1500000\nsystem_usec 500000\n" +
+			"nr_periods 10\nnr_throttled 2\nthrottled_usec 1000\n",
+		"app/memory.current": "1048576\n",
+		"app/memory.stat":    "anon 524288\nfile 262144\npgfault 100\npgmajfault 1\n",
+		"app/io.stat": "8:0 rbytes=4096 wbytes=8192 rios=1 wios=2 dbytes=0 dios=0\n" +
+			"8:16 rbytes=4096 wbytes=0 rios=1 wios=0 dbytes=0 dios=0\n",
+		"app/pids.current": "3\n",
+	})
+
+	prov := new(CGroupStatProvider)
+	prov.resolveHierarchies([]hostinfo.HICGroupHierarchy{
+		{Version: 2, Controllers: []string{"cpu", "memory", "io", "pids"},
+			Root: "/", MountPoint: dir},
+	})
+
+	prev := prov.readCounters("/app")
+	if prev == nil {
+		t.Fatal("Group is not found")
+	}
+	if prev.cpuUsage != 2*time.Second || prev.throttledTime != time.Millisecond ||
+		prev.memAnon != 524288 || prev.ioReadBytes != 8192 || prev.ioWrites != 2 ||
+		prev.pidsCurrent != 3 {
+		t.Errorf("Unexpected counters: %+v", prev)
+	}
+
+	if prov.readCounters("/nonexistent") != nil {
+		t.Error("Counters are read for nonexistent group")
+	}
+
+	writeFiles(t, dir, map[string]string{
+		"app/cpu.stat":       "usage_usec 3000000\nuser_usec 2000000\nsystem_usec 1000000\n",
+		"app/memory.stat":    "anon 524288\nfile 262144\npgfault 300\npgmajfault 1\n",
+		"app/io.stat":        "8:0 rbytes=12288 wbytes=8192 rios=3 wios=2\n",
+		"app/memory.current": "max\n",
+	})
+	cur := prov.readCounters("/app")
+
+	var entry cgroupStatEntry
+	entry.computeStats(prev, cur, 2*time.Second)
+	if entry.CPUUsage != int64(time.Second)/2 || entry.CPUUser != int64(time.Second)/4 ||
+		entry.PgFault != 100 || entry.IOReadBytes != 2048 || entry.MemCurrent != 0 {
+		t.Errorf("Unexpected stats: %+v", entry)
+	}
+}
+
+func TestCGroupStatManyCPUs(t *testing.T) {
+	// Group which used 256 CPUs for 100 days and throttled for the half
+	// of that time, 10 seconds later
+	const cpuCount = 256
+	usage := time.Duration(cpuCount) * 100 * 24 * time.Hour
+	prev := &cgroupCounters{cpuUsage: usage, cpuUser: usage, throttledTime: usage / 2,
+		ioReadBytes: 1 << 50}
+	cur := &cgroupCounters{cpuUsage: usage + cpuCount*10*time.Second,
+		cpuUser:       usage + cpuCount*10*time.Second,
+		throttledTime: usage/2 + cpuCount*5*time.Second,
+		ioReadBytes:   1<<50 + 1<<40}
+
+	var entry cgroupStatEntry
+	entry.computeStats(prev, cur, 10*time.Second)
+	if entry.CPUUsage != cpuCount*int64(time.Second) || entry.CPUUser != entry.CPUUsage ||
+		entry.ThrottledTime != entry.CPUUsage/2 || entry.IOReadBytes != (1<<40)/10 {
+		t.Errorf("Unexpected stats: %+v", entry)
+	}
+}
+
+func TestCGroupStatV1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroupstattest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"cpu/docker/app/cpuacct.usage":     "2000000000\n",
+		"cpu/docker/app/cpuacct.stat":      "user 150\nsystem 50\n",
+		"cpu/docker/app/cpu.stat":          "nr_periods 10\nnr_throttled 2\nthrottled_time 1000000\n",
+		"memory/app/memory.usage_in_bytes": "1048576\n",
+		"memory/app/memory.stat": "cache 0\nrss 0\ntotal_cache 262144\ntotal_rss 524288\n" +
+			"total_pgfault 100\n",
+		"blkio/docker/app/blkio.throttle.io_service_bytes": "8:0 Read 4096\n8:0 Write 8192\n" +
+			"8:0 Total 12288\n8:16 Read 4096\nTotal 16384\n",
+		"pids/docker/app/pids.current": "3\n",
+	})
+
+	prov := new(CGroupStatProvider)
+	prov.resolveHierarchies([]hostinfo.HICGroupHierarchy{
+		{Version: 1, Controllers: []string{"cpu", "cpuacct"}, Root: "/", MountPoint: dir + "/cpu"},
+		{Version: 1, Controllers: []string{"memory"}, Root: "/docker", MountPoint: dir + "/memory"},
+		{Version: 1, Controllers: []string{"blkio"}, Root: "/", MountPoint: dir + "/blkio"},
+		{Version: 1, Controllers: []string{"pids"}, Root: "/", MountPoint: dir + "/pids"},
+		{Version: 2, Root: "/", MountPoint: dir + "/unified"},
+	})
+	if prov.hierarchies[ctlCPUAcct].MountPoint != dir+"/cpu" {
+		t.Errorf("Unexpected hierarchy of cpuacct: %v", prov.hierarchies[ctlCPUAcct])
+	}
+
+	counters := prov.readCounters("/docker/app")
+	if counters == nil {
+		t.Fatal("Group is not found")
+	}
+	if counters.cpuUsage != 2*time.Second || counters.cpuUser != 150*time.Second/time.Duration(provider.JiffiesPerSecond) ||
+		counters.throttledTime != time.Millisecond || counters.memCurrent != 1048576 ||
+		counters.memFile != 262144 || counters.ioReadBytes != 8192 || counters.ioWriteBytes != 8192 ||
+		counters.pidsCurrent != 3 {
+		t.Errorf("Unexpected counters: %+v", counters)
+	}
+}
+
+func TestCGroupStatConfigure(t *testing.T) {
+	prov := new(CGroupStatProvider)
+
+	_, err := prov.Configure(provider.ConfigureSetValue,
+		&provider.ConfigurationStep{Name: "cgroup", Values: []string{"/nonexistent/group"}})
+	if err != provider.ErrInvalidConfigurationValue {
+		t.Errorf("Unexpected error for unknown group: %v", err)
+	}
+	_, err = prov.Configure(provider.ConfigureSetValue,
+		&provider.ConfigurationStep{Name: "pid", Values: []string{"abc"}})
+	if err != provider.ErrInvalidConfigurationValue {
+		t.Errorf("Unexpected error for invalid pid: %v", err)
+	}
+
+	_, err = prov.Configure(provider.ConfigureSetValue,
+		&provider.ConfigurationStep{Name: "pid", Values: []string{"1"}})
+	if err != nil {
+		t.Skipf("Cgroups are not available: %v", err)
+	}
+
+	steps, _ := prov.Configure(provider.ConfigureGetValues, nil)
+	if len(steps) != 1 || len(steps[0].Values) == 0 || steps[0].Name != "cgroup" {
+		t.Errorf("Unexpected configuration: %v", steps)
+	}
+}
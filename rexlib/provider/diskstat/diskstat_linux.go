@@ -0,0 +1,286 @@
+package diskstat
+
+import (
+	"fmt"
+
+	"sort"
+
+	"time"
+
+	"reflect"
+
+	"rexlib/hostinfo"
+	"rexlib/provider"
+	"tsfile"
+)
+
+// Configuration steps. Disks are selected by names or by any of their paths
+// known to hostinfo (aliases in /dev/disk, device mapper and md names).
+// Children of selected disks in hostinfo tree -- partitions and slaves of
+// volumes -- may be added by expand step
+const (
+	stepDisk = iota
+	stepExpand
+
+	stepCount
+)
+
+var stepNames = []string{"disk", "expand"}
+
+const (
+	expandPartitions = "partitions"
+	expandSlaves     = "slaves"
+)
+
+var expandValues = []string{expandPartitions, expandSlaves}
+
+// Entries of diskstat series. IOPS and throughput are per-second values,
+// service times are average times of requests completed during tick in
+// nanoseconds, queue depth is average number of requests in flight and
+// utilization is percentage of time device was busy
+type diskStatEntry struct {
+	Start tsfile.TSTimeStart
+	End   tsfile.TSTimeEnd
+
+	Name tsfile.TSVarString
+
+	ReadIOPS, WriteIOPS   int64
+	ReadBytes, WriteBytes int64
+
+	ReadServiceTime, WriteServiceTime int64
+
+	InFlight    int64
+	QueueDepth  float64
+	Utilization float64
+}
+
+type DiskStatProvider struct {
+	// Configured values of steps as they were passed by user
+	values [stepCount][]string
+
+	// Names of block devices resolved by Prepare()
+	disks []string
+
+	// ID of the corresponding schema
+	traceTag tsfile.TSFPageTag
+
+	// Last snapshot of counters
+	lastSnap map[string]hostinfo.HIDiskCounters
+	lastTime time.Time
+}
+
+func (prov *DiskStatProvider) Configure(action provider.ConfigurationAction,
+	step *provider.ConfigurationStep) ([]*provider.ConfigurationStep, error) {
+
+	// Get current configuration
+	if action == provider.ConfigureGetValues {
+		return provider.GetStepValues(stepNames, prov.values[:]), nil
+	}
+
+	nexus, err := hostinfo.GetNexus(hostinfo.HIDisk, false, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if action == provider.ConfigureSetValue {
+		stepIdx := provider.FindStep(step, stepNames, stepDisk)
+		if stepIdx < 0 {
+			return nil, provider.ErrInvalidConfigurationStep
+		}
+
+		for _, value := range step.Values {
+			if !checkValue(nexus, stepIdx, value) {
+				return []*provider.ConfigurationStep{step}, provider.ErrInvalidConfigurationValue
+			}
+		}
+
+		prov.values[stepIdx] = provider.AppendUnique(prov.values[stepIdx], step.Values...)
+	}
+
+	return prov.getOptions(nexus), nil
+}
+
+func checkValue(nexus *hostinfo.HIObject, stepIdx int, value string) bool {
+	switch stepIdx {
+	case stepDisk:
+		return findDisk(nexus, value) != nil
+	case stepExpand:
+		return provider.HasValue(expandValues, value)
+	}
+	return false
+}
+
+// Returns all steps in order they should be configured with disks and
+// expand modes which are not selected yet
+func (prov *DiskStatProvider) getOptions(nexus *hostinfo.HIObject) []*provider.ConfigurationStep {
+	steps := provider.NewSteps(stepNames)
+
+	for name := range nexus.Children {
+		if !provider.HasValue(prov.values[stepDisk], name) {
+			steps[stepDisk].Values = append(steps[stepDisk].Values, name)
+		}
+	}
+	sort.Strings(steps[stepDisk].Values)
+
+	for _, value := range expandValues {
+		if !provider.HasValue(prov.values[stepExpand], value) {
+			steps[stepExpand].Values = append(steps[stepExpand].Values, value)
+		}
+	}
+
+	return steps
+}
+
+func (prov *DiskStatProvider) Prepare(handle *provider.OutputHandle) (err error) {
+	if len(prov.values[stepDisk]) == 0 {
+		return fmt.Errorf("No disks are selected")
+	}
+
+	// Names of devices may change after reboot, so aliases are resolved
+	// only when incident is started
+	nexus, err := hostinfo.GetNexus(hostinfo.HIDisk, true, false)
+	if err != nil {
+		return err
+	}
+
+	prov.disks = nil
+	for _, value := range prov.values[stepDisk] {
+		diObj := findDisk(nexus, value)
+		if diObj == nil {
+			return fmt.Errorf("Disk '%s' is not found", value)
+		}
+
+		di := diObj.Object.(*hostinfo.HIDiskInfo)
+		prov.addDisk(di.Name)
+
+		for _, childObj := range diObj.Children {
+			child := childObj.Object.(*hostinfo.HIDiskInfo)
+			if child.Type == hostinfo.HIDTPartition {
+				if provider.HasValue(prov.values[stepExpand], expandPartitions) {
+					prov.addDisk(child.Name)
+				}
+			} else if provider.HasValue(prov.values[stepExpand], expandSlaves) {
+				prov.addDisk(child.Name)
+			}
+		}
+	}
+	sort.Strings(prov.disks)
+
+	prov.lastSnap = nil
+
+	schema, err := tsfile.NewStructSchema(reflect.TypeOf(diskStatEntry{}))
+	if err == nil {
+		schema, err = tsfile.NewSchema("diskstat", schema.Fields)
+	}
+	if err == nil {
+		prov.traceTag, err = handle.Trace.AddSchema(schema)
+	}
+	return
+}
+
+func (prov *DiskStatProvider) addDisk(name string) {
+	if !provider.HasValue(prov.disks, name) {
+		prov.disks = append(prov.disks, name)
+	}
+}
+
+func (prov *DiskStatProvider) Finalize(handle *provider.OutputHandle) {
+
+}
+
+func (prov *DiskStatProvider) Collect(handle *provider.OutputHandle) {
+	stats, err := hostinfo.ReadDiskStats()
+	if err != nil {
+		handle.LogLimited("%v", err)
+		return
+	}
+
+	now := handle.Now
+	timeDelta := now.Sub(prov.lastTime)
+
+	var entries []diskStatEntry
+	for _, name := range prov.disks {
+		counters, ok := stats[name]
+		if !ok {
+			continue
+		}
+
+		// Not enough data for now
+		prevCounters, ok := prov.lastSnap[name]
+		if !ok {
+			continue
+		}
+
+		entry := diskStatEntry{
+			Start: tsfile.TSTimeStart(prov.lastTime.UnixNano() - handle.GlobalTime),
+			End:   tsfile.TSTimeEnd(now.UnixNano() - handle.GlobalTime),
+			Name:  tsfile.TSVarString(name),
+		}
+		entry.computeStats(prevCounters, counters, timeDelta)
+		entries = append(entries, entry)
+	}
+
+	if len(entries) > 0 {
+		err = handle.Trace.AddEntries(prov.traceTag, entries)
+		if err != nil {
+			handle.Log.Println(err)
+		}
+	}
+
+	prov.lastSnap = stats
+	prov.lastTime = now
+}
+
+// Computes statistics of the tick from two snapshots of counters
+func (entry *diskStatEntry) computeStats(prev, cur hostinfo.HIDiskCounters, dt time.Duration) {
+	if dt < time.Microsecond {
+		return
+	}
+
+	reads := cur.Reads - prev.Reads
+	writes := cur.Writes - prev.Writes
+
+	entry.ReadIOPS = provider.NormalizeRate(reads, dt)
+	entry.WriteIOPS = provider.NormalizeRate(writes, dt)
+	entry.ReadBytes = provider.NormalizeRate(cur.ReadBytes-prev.ReadBytes, dt)
+	entry.WriteBytes = provider.NormalizeRate(cur.WriteBytes-prev.WriteBytes, dt)
+
+	if reads > 0 {
+		entry.ReadServiceTime = int64(cur.ReadTime-prev.ReadTime) / reads
+	}
+	if writes > 0 {
+		entry.WriteServiceTime = int64(cur.WriteTime-prev.WriteTime) / writes
+	}
+
+	entry.InFlight = cur.InFlight
+	entry.QueueDepth = float64(cur.WeightedIOTime-prev.WeightedIOTime) / float64(dt)
+	entry.Utilization = 100.0 * float64(cur.IOTime-prev.IOTime) / float64(dt)
+}
+
+// Finds disk in hostinfo by its name or one of its paths
+func findDisk(nexus *hostinfo.HIObject, value string) *hostinfo.HIObject {
+	if diObj, ok := nexus.Children[value]; ok {
+		return diObj
+	}
+
+	for _, diObj := range nexus.Children {
+		di := diObj.Object.(*hostinfo.HIDiskInfo)
+		if provider.HasValue(di.Paths, value) {
+			return diObj
+		}
+	}
+	return nil
+}
+
+// Factory creating diskstat provider
+func Create() provider.Provider {
+	return new(DiskStatProvider)
+}
+
+func init() {
+	provider.Register("diskstat", Create, provider.Info{
+		Description: "Block device IOPS, throughput, queue depth and service times from /proc/diskstats",
+		OS:          []string{"linux"},
+		Steps:       stepNames,
+	})
+}
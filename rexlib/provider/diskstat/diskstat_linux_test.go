@@ -0,0 +1,74 @@
+package diskstat
+
+import (
+	"time"
+
+	"testing"
+
+	"rexlib/hostinfo"
+	"rexlib/provider"
+)
+
+func TestDiskStatCompute(t *testing.T) {
+	prev := hostinfo.HIDiskCounters{
+		Reads:          100,
+		ReadBytes:      4096 * 100,
+		ReadTime:       100 * time.Millisecond,
+		IOTime:         time.Second,
+		WeightedIOTime: time.Second,
+	}
+	cur := hostinfo.HIDiskCounters{
+		Reads:          300,
+		ReadBytes:      4096 * 300,
+		ReadTime:       500 * time.Millisecond,
+		Writes:         10,
+		WriteBytes:     8192 * 10,
+		WriteTime:      20 * time.Millisecond,
+		InFlight:       2,
+		IOTime:         time.Second + 500*time.Millisecond,
+		WeightedIOTime: 4 * time.Second,
+	}
+
+	var entry diskStatEntry
+	entry.computeStats(prev, cur, 2*time.Second)
+
+	expected := diskStatEntry{
+		ReadIOPS:         100,
+		WriteIOPS:        5,
+		ReadBytes:        4096 * 100,
+		WriteBytes:       8192 * 5,
+		ReadServiceTime:  int64(2 * time.Millisecond),
+		WriteServiceTime: int64(2 * time.Millisecond),
+		InFlight:         2,
+		QueueDepth:       1.5,
+		Utilization:      25.0,
+	}
+	if entry != expected {
+		t.Errorf("Unexpected stats:\n%+v, expected\n%+v", entry, expected)
+	}
+}
+
+func TestDiskStatConfigure(t *testing.T) {
+	prov := new(DiskStatProvider)
+
+	_, err := prov.Configure(provider.ConfigureSetValue,
+		&provider.ConfigurationStep{Name: "disk", Values: []string{"/dev/nonexistent"}})
+	if err != provider.ErrInvalidConfigurationValue {
+		t.Errorf("Unexpected error for unknown disk: %v", err)
+	}
+
+	steps, err := prov.Configure(provider.ConfigureSetValue,
+		&provider.ConfigurationStep{Name: "expand", Values: []string{"partitions"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != stepCount || len(steps[stepExpand].Values) != 1 ||
+		steps[stepExpand].Values[0] != "slaves" {
+		t.Errorf("Unexpected options: %v", steps[stepExpand])
+	}
+
+	steps, _ = prov.Configure(provider.ConfigureGetValues, nil)
+	if len(steps) != 1 || steps[0].Name != "expand" {
+		t.Errorf("Unexpected configuration: %v", steps)
+	}
+}
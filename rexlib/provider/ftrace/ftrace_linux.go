@@ -0,0 +1,883 @@
+package ftrace
+
+import (
+	"fmt"
+	"os"
+
+	"bufio"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+
+	"time"
+
+	"encoding/binary"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+
+	"rexlib/provider"
+	"tsfile"
+
+	hisyscall "rexlib/hostinfo/syscall"
+)
+
+// Collects kernel tracepoints using ftrace. Provider creates its own
+// instance of the trace buffers in tracefs, so it doesn't interfere with
+// other ftrace users, enables selected events in it and reads binary
+// ring buffer pages from per-cpu trace_pipe_raw files. Schemas of the
+// series are generated from format files of events, so each event
+// produces a series named "subsystem:event"
+
+// Configuration steps. If no events are selected for subsystem, all
+// events of subsystem are enabled. Filter expressions are applied to
+// all selected events
+const (
+	stepSubsystem = iota
+	stepEvent
+	stepFilter
+
+	stepCount
+)
+
+var stepNames = []string{"subsystem", "event", "filter"}
+
+// Paths where tracefs is usually mounted
+var tracingPaths = []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"}
+
+// Counter of trace instances created by this process
+var instanceCount uint32
+
+// Types of ring buffer events (type_len field of event header)
+const (
+	rbTypeDataLong   = 0
+	rbTypePadding    = 29
+	rbTypeTimeExtend = 30
+	rbTypeTimeStamp  = 31
+
+	rbTypeLenMask = 0x1f
+	rbTimeShift   = 27
+)
+
+// Flags of commit field of ring buffer page
+const (
+	rbCommitMask    = (1 << 27) - 1
+	rbMissingEvents = 1 << 31
+)
+
+// Field of the event as described in the format file
+type eventField struct {
+	Name string
+	Type string
+
+	Offset int
+	Size   int
+	Signed bool
+
+	// Number of elements for arrays or 0 for scalar values
+	ArrayLength int
+}
+
+// Format of the event read from events/<subsystem>/<event>/format
+type eventFormat struct {
+	Name string
+	ID   uint16
+
+	Fields []eventField
+}
+
+// Layout of ring buffer page described by events/header_page
+type pageHeader struct {
+	commitOffset, commitSize int
+	dataOffset               int
+}
+
+// Layout of ring buffer page on 64-bit systems used if header_page
+// cannot be read
+var defaultPageHeader = pageHeader{commitOffset: 8, commitSize: 8, dataOffset: 16}
+
+// Kinds of decoded fields
+const (
+	// Value is copied as is, ints are kept in native byte order which
+	// is expected to be little-endian
+	fieldCopy = iota
+
+	// Dynamic arrays: event field contains 16-bit offset (relative to
+	// start of the event or end of the field) and 16-bit length of data
+	fieldDataLoc
+	fieldRelLoc
+)
+
+type decodedField struct {
+	kind int
+
+	srcOffset, srcSize int
+	dstOffset          int
+}
+
+// Converts raw events of the same type to entries of the series
+type eventDecoder struct {
+	name string
+	tag  tsfile.TSFPageTag
+
+	fields    []decodedField
+	entrySize int
+}
+
+// Trace buffer of a single cpu
+type cpuBuffer struct {
+	cpu int
+	fd  int
+}
+
+// Decoded event waiting to be written to the trace
+type tracedEvent struct {
+	time  int64
+	entry []byte
+}
+
+type FTraceProvider struct {
+	subsystems []string
+	events     []string
+	filters    []string
+
+	// Path to ftrace instance created by Prepare()
+	instancePath string
+
+	header   pageHeader
+	decoders map[uint16]*eventDecoder
+	buffers  []cpuBuffer
+
+	// Difference between wall time and monotonic clock used for
+	// trace timestamps
+	clockOffset int64
+}
+
+// Finds mount point of tracefs
+func findTracingPath() (string, error) {
+	for _, path := range tracingPaths {
+		if _, err := os.Stat(filepath.Join(path, "events")); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("Tracefs is not mounted")
+}
+
+func (prov *FTraceProvider) Configure(action provider.ConfigurationAction,
+	step *provider.ConfigurationStep) ([]*provider.ConfigurationStep, error) {
+
+	// Get current configuration
+	if action == provider.ConfigureGetValues {
+		return provider.GetStepValues(stepNames,
+			[][]string{prov.subsystems, prov.events, prov.filters}), nil
+	}
+
+	tracingPath, err := findTracingPath()
+	if action == provider.ConfigureSetValue {
+		if err != nil {
+			return nil, err
+		}
+
+		eventsPath := filepath.Join(tracingPath, "events")
+		switch provider.FindStep(step, stepNames, stepEvent) {
+		case stepSubsystem:
+			for _, subsystem := range step.Values {
+				if !isValidName(subsystem) || !isDir(filepath.Join(eventsPath, subsystem)) {
+					return []*provider.ConfigurationStep{step}, provider.ErrInvalidConfigurationValue
+				}
+			}
+			prov.subsystems = provider.AppendUnique(prov.subsystems, step.Values...)
+		case stepEvent:
+			var events []string
+			for _, event := range step.Values {
+				event = prov.resolveEvent(eventsPath, event)
+				if len(event) == 0 {
+					return []*provider.ConfigurationStep{step}, provider.ErrInvalidConfigurationValue
+				}
+				events = append(events, event)
+			}
+			for _, event := range events {
+				prov.subsystems = provider.AppendUnique(prov.subsystems,
+					event[:strings.IndexByte(event, ':')])
+				prov.events = provider.AppendUnique(prov.events, event)
+			}
+		case stepFilter:
+			for _, filter := range step.Values {
+				if len(strings.TrimSpace(filter)) == 0 {
+					return []*provider.ConfigurationStep{step}, provider.ErrInvalidConfigurationValue
+				}
+			}
+			prov.filters = append(prov.filters, step.Values...)
+		default:
+			return nil, provider.ErrInvalidConfigurationStep
+		}
+	}
+
+	steps := provider.NewSteps(stepNames)
+	if err != nil {
+		// Tracefs is not available, so we can't provide any hints
+		return steps, nil
+	}
+
+	eventsPath := filepath.Join(tracingPath, "events")
+	for _, subsystem := range listDirs(eventsPath) {
+		if !provider.HasValue(prov.subsystems, subsystem) {
+			steps[stepSubsystem].Values = append(steps[stepSubsystem].Values, subsystem)
+		}
+	}
+	for _, subsystem := range prov.subsystems {
+		for _, name := range listDirs(filepath.Join(eventsPath, subsystem)) {
+			event := subsystem + ":" + name
+			if !provider.HasValue(prov.events, event) {
+				steps[stepEvent].Values = append(steps[stepEvent].Values, event)
+			}
+		}
+	}
+	return steps, nil
+}
+
+// Resolves event name in form "subsystem:event" or "event" which is
+// looked up in selected subsystems. Returns empty string if event is
+// not found
+func (prov *FTraceProvider) resolveEvent(eventsPath, event string) string {
+	subsystems := prov.subsystems
+	if index := strings.IndexByte(event, ':'); index >= 0 {
+		subsystems = []string{event[:index]}
+		event = event[index+1:]
+	}
+	if !isValidName(event) {
+		return ""
+	}
+
+	for _, subsystem := range subsystems {
+		if !isValidName(subsystem) {
+			continue
+		}
+
+		_, err := os.Stat(filepath.Join(eventsPath, subsystem, event, "format"))
+		if err == nil {
+			return subsystem + ":" + event
+		}
+	}
+	return ""
+}
+
+func (prov *FTraceProvider) Prepare(handle *provider.OutputHandle) (err error) {
+	if len(prov.subsystems) == 0 {
+		return fmt.Errorf("No events are selected")
+	}
+
+	tracingPath, err := findTracingPath()
+	if err != nil {
+		return err
+	}
+
+	prov.instancePath = filepath.Join(tracingPath, "instances",
+		fmt.Sprintf("salsa-rex-%d-%d", os.Getpid(), atomic.AddUint32(&instanceCount, 1)))
+	if err = os.Mkdir(prov.instancePath, 0755); err != nil {
+		prov.instancePath = ""
+		return fmt.Errorf("Cannot create trace instance: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			prov.Finalize(handle)
+		}
+	}()
+
+	prov.header = defaultPageHeader
+	if file, err := os.Open(filepath.Join(tracingPath, "events", "header_page")); err == nil {
+		prov.header, err = parseHeaderPage(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Use monotonic clock instead of default local clock, so timestamps
+	// of events may be converted to wall time
+	err = writeFile(filepath.Join(prov.instancePath, "trace_clock"), "mono")
+	if err != nil {
+		return fmt.Errorf("Cannot set trace clock: %v", err)
+	}
+	prov.clockOffset = time.Now().UnixNano() - hisyscall.GetMonotonicTime()
+
+	eventsPath := filepath.Join(prov.instancePath, "events")
+	prov.decoders = make(map[uint16]*eventDecoder)
+	for _, event := range prov.resolveEnabledEvents(eventsPath) {
+		eventPath := filepath.Join(eventsPath, event[0], event[1])
+		err = prov.prepareEvent(handle, event[0], eventPath)
+		if err != nil {
+			return err
+		}
+
+		if len(prov.filters) > 0 {
+			err = writeFile(filepath.Join(eventPath, "filter"), prov.getFilter())
+			if err != nil {
+				return fmt.Errorf("Invalid filter for event %s:%s: %v", event[0], event[1], err)
+			}
+		}
+		err = writeFile(filepath.Join(eventPath, "enable"), "1")
+		if err != nil {
+			return fmt.Errorf("Cannot enable event %s:%s: %v", event[0], event[1], err)
+		}
+	}
+
+	perCPUPaths, _ := filepath.Glob(filepath.Join(prov.instancePath, "per_cpu", "cpu*"))
+	for _, cpuPath := range perCPUPaths {
+		cpu, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(cpuPath), "cpu"))
+		if err != nil {
+			continue
+		}
+
+		fd, err := syscall.Open(filepath.Join(cpuPath, "trace_pipe_raw"),
+			syscall.O_RDONLY|syscall.O_NONBLOCK, 0)
+		if err != nil {
+			return fmt.Errorf("Cannot open trace buffer of cpu %d: %v", cpu, err)
+		}
+		prov.buffers = append(prov.buffers, cpuBuffer{cpu: cpu, fd: fd})
+	}
+	return nil
+}
+
+// Returns pairs of subsystem and event names which should be enabled
+func (prov *FTraceProvider) resolveEnabledEvents(eventsPath string) (events [][2]string) {
+	for _, subsystem := range prov.subsystems {
+		prefix := subsystem + ":"
+
+		found := false
+		for _, event := range prov.events {
+			if strings.HasPrefix(event, prefix) {
+				events = append(events, [2]string{subsystem, event[len(prefix):]})
+				found = true
+			}
+		}
+		if found {
+			continue
+		}
+
+		for _, name := range listDirs(filepath.Join(eventsPath, subsystem)) {
+			events = append(events, [2]string{subsystem, name})
+		}
+	}
+	return
+}
+
+func (prov *FTraceProvider) getFilter() string {
+	if len(prov.filters) == 1 {
+		return prov.filters[0]
+	}
+	return "(" + strings.Join(prov.filters, ") && (") + ")"
+}
+
+// Reads format of the event and adds schema for its series
+func (prov *FTraceProvider) prepareEvent(handle *provider.OutputHandle,
+	subsystem, eventPath string) error {
+
+	file, err := os.Open(filepath.Join(eventPath, "format"))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	format, err := parseEventFormat(file)
+	if err != nil {
+		return fmt.Errorf("Error in format of event %s:%s: %v", subsystem,
+			filepath.Base(eventPath), err)
+	}
+
+	decoder, schema, err := newEventDecoder(subsystem+":"+format.Name, format)
+	if err == nil {
+		decoder.tag, err = handle.Trace.AddSchema(schema)
+	}
+	if err != nil {
+		return err
+	}
+
+	prov.decoders[format.ID] = decoder
+	return nil
+}
+
+func (prov *FTraceProvider) Finalize(handle *provider.OutputHandle) {
+	for _, buffer := range prov.buffers {
+		syscall.Close(buffer.fd)
+	}
+	prov.buffers = nil
+
+	if len(prov.instancePath) == 0 {
+		return
+	}
+
+	// Instance may only be removed when its buffers are not used
+	writeFile(filepath.Join(prov.instancePath, "events", "enable"), "0")
+	if err := syscall.Rmdir(prov.instancePath); err != nil {
+		handle.Log.Printf("Cannot remove trace instance %s: %v", prov.instancePath, err)
+	}
+	prov.instancePath = ""
+}
+
+func (prov *FTraceProvider) Collect(handle *provider.OutputHandle) {
+	events := make(map[*eventDecoder][]tracedEvent)
+	page := make([]byte, os.Getpagesize())
+
+	for _, buffer := range prov.buffers {
+		for {
+			n, err := syscall.Read(buffer.fd, page)
+			if err != nil {
+				if err != syscall.EAGAIN {
+					handle.LogLimited("Error reading trace buffer of cpu %d: %v", buffer.cpu, err)
+				}
+				break
+			}
+			if n == 0 {
+				break
+			}
+
+			missed, err := prov.header.parsePage(page[:n], func(ts uint64, payload []byte) {
+				if len(payload) < 2 {
+					return
+				}
+
+				decoder, ok := prov.decoders[binary.LittleEndian.Uint16(payload)]
+				if !ok {
+					return
+				}
+
+				eventTime := int64(ts) + prov.clockOffset - handle.GlobalTime
+				events[decoder] = append(events[decoder], tracedEvent{
+					time:  eventTime,
+					entry: decoder.decode(eventTime, buffer.cpu, payload),
+				})
+			})
+			if missed {
+				handle.LogLimited("Events were lost in trace buffer of cpu %d", buffer.cpu)
+			}
+			if err != nil {
+				handle.LogLimited("%v", err)
+			}
+		}
+	}
+
+	for decoder, decoderEvents := range events {
+		// Buffers are read one after another, so events of different cpus
+		// have to be ordered by their time. Events of a single cpu are
+		// already ordered and keep their order
+		sort.SliceStable(decoderEvents, func(i, j int) bool {
+			return decoderEvents[i].time < decoderEvents[j].time
+		})
+
+		entries := make([][]byte, len(decoderEvents))
+		for i, event := range decoderEvents {
+			entries[i] = event.entry
+		}
+
+		err := handle.Trace.AddEntries(decoder.tag, entries)
+		if err != nil {
+			handle.Log.Printf("Error writing events %s: %v", decoder.name, err)
+		}
+	}
+}
+
+// Parses event format file which looks like:
+//
+//	name: sched_wakeup
+//	ID: 316
+//	format:
+//		field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+//		...
+//		field:char comm[16];	offset:8;	size:16;	signed:0;
+//
+//	print fmt: "comm=%s pid=%d", REC->comm, REC->pid
+func parseEventFormat(reader io.Reader) (*eventFormat, error) {
+	format := new(eventFormat)
+	hasID := false
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "name:"):
+			format.Name = strings.TrimSpace(line[5:])
+		case strings.HasPrefix(line, "ID:"):
+			id, err := strconv.ParseUint(strings.TrimSpace(line[3:]), 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid event id '%s'", line)
+			}
+			format.ID = uint16(id)
+			hasID = true
+		case strings.HasPrefix(line, "field:"):
+			field, err := parseFormatField(line)
+			if err != nil {
+				return nil, err
+			}
+			format.Fields = append(format.Fields, field)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(format.Name) == 0 || !hasID {
+		return nil, fmt.Errorf("Event name or id is missing")
+	}
+	return format, nil
+}
+
+// Parses header_page which has same syntax of fields as event format
+func parseHeaderPage(reader io.Reader) (header pageHeader, err error) {
+	header.commitOffset = -1
+	header.dataOffset = -1
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "field:") {
+			continue
+		}
+
+		field, err := parseFormatField(line)
+		if err != nil {
+			return header, err
+		}
+		switch field.Name {
+		case "commit":
+			header.commitOffset = field.Offset
+			header.commitSize = field.Size
+		case "data":
+			header.dataOffset = field.Offset
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+
+	if header.commitOffset < 0 || header.dataOffset < 0 ||
+		(header.commitSize != 4 && header.commitSize != 8) {
+		return header, fmt.Errorf("Invalid layout of ring buffer page")
+	}
+	return
+}
+
+// Parses field line "field:type name[N];	offset:N;	size:N;	signed:N;"
+func parseFormatField(line string) (field eventField, err error) {
+	parts := strings.Split(line, ";")
+	decl := strings.TrimSpace(strings.TrimPrefix(parts[0], "field:"))
+
+	index := strings.LastIndexAny(decl, " \t")
+	if index < 0 {
+		return field, fmt.Errorf("Invalid field declaration '%s'", line)
+	}
+	field.Type = strings.TrimSpace(decl[:index])
+	field.Name = decl[index+1:]
+
+	if index := strings.IndexByte(field.Name, '['); index >= 0 {
+		length := strings.TrimSuffix(field.Name[index+1:], "]")
+		field.Name = field.Name[:index]
+
+		// Arrays with length specified as constant (i.e. TASK_COMM_LEN)
+		// are treated as arrays of the unknown length
+		field.ArrayLength, _ = strconv.Atoi(length)
+		if field.ArrayLength == 0 {
+			field.ArrayLength = -1
+		}
+	}
+
+	hasSize := false
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(strings.TrimSpace(part), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		value, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return field, fmt.Errorf("Invalid %s of field %s", kv[0], field.Name)
+		}
+
+		switch kv[0] {
+		case "offset":
+			field.Offset = value
+		case "size":
+			field.Size = value
+			hasSize = true
+		case "signed":
+			field.Signed = (value != 0)
+		}
+	}
+	if !hasSize {
+		return field, fmt.Errorf("Size of field %s is missing", field.Name)
+	}
+	return
+}
+
+// Creates decoder and schema of the series for the event. Fields which
+// are common for all events are omitted except for pid of the process
+// which triggered the event. Fields which cannot be represented in
+// TSFile (i.e. structures) are skipped too
+func newEventDecoder(name string, format *eventFormat) (*eventDecoder, *tsfile.TSFSchemaHeader, error) {
+	decoder := &eventDecoder{name: name}
+
+	fields := []tsfile.TSFSchemaField{
+		tsfile.NewStartTimeField(),
+		tsfile.NewEndTimeField(),
+		newIntField("cpu", 4),
+	}
+	addField := func(field tsfile.TSFSchemaField, decodedField decodedField) {
+		fields = append(fields, field)
+		decoder.fields = append(decoder.fields, decodedField)
+	}
+
+	for _, field := range format.Fields {
+		if strings.HasPrefix(field.Name, "common_") && field.Name != "common_pid" {
+			continue
+		}
+
+		decodedField := decodedField{
+			kind:      fieldCopy,
+			srcOffset: field.Offset,
+			srcSize:   field.Size,
+		}
+		switch {
+		case strings.HasPrefix(field.Type, "__data_loc "):
+			decodedField.kind = fieldDataLoc
+			addField(tsfile.NewVarStringField(field.Name), decodedField)
+		case strings.HasPrefix(field.Type, "__rel_loc "):
+			decodedField.kind = fieldRelLoc
+			addField(tsfile.NewVarStringField(field.Name), decodedField)
+		case field.ArrayLength != 0 && isCharType(field.Type):
+			addField(tsfile.NewField(field.Name,
+				reflect.ArrayOf(field.Size, reflect.TypeOf(byte(0)))), decodedField)
+		case field.ArrayLength > 0:
+			// Split arrays of integers into separate fields
+			elemSize := field.Size / field.ArrayLength
+			if !isIntSize(elemSize) {
+				continue
+			}
+
+			decodedField.srcSize = elemSize
+			for index := 0; index < field.ArrayLength; index++ {
+				addField(newIntField(fmt.Sprintf("%s_%d", field.Name, index), elemSize),
+					decodedField)
+				decodedField.srcOffset += elemSize
+			}
+		case field.ArrayLength == 0 && isIntSize(field.Size):
+			addField(newIntField(field.Name, field.Size), decodedField)
+		}
+	}
+
+	schema, err := tsfile.NewSchema(name, fields)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Skip time and cpu fields which are filled by decode()
+	for index := range decoder.fields {
+		decoder.fields[index].dstOffset = int(schema.Fields[index+3].Offset)
+	}
+	decoder.entrySize = int(schema.EntrySize)
+	return decoder, schema, nil
+}
+
+var intTypes = map[int]reflect.Type{
+	1: reflect.TypeOf(int8(0)),
+	2: reflect.TypeOf(int16(0)),
+	4: reflect.TypeOf(int32(0)),
+	8: reflect.TypeOf(int64(0)),
+}
+
+func newIntField(name string, size int) tsfile.TSFSchemaField {
+	return tsfile.NewField(name, intTypes[size])
+}
+
+func isCharType(typeName string) bool {
+	switch typeName {
+	case "char", "const char", "unsigned char", "signed char":
+		return true
+	}
+	return false
+}
+
+func isIntSize(size int) bool {
+	_, ok := intTypes[size]
+	return ok
+}
+
+// Converts payload of the raw event to entry with variable-length
+// strings appended after its fixed part
+func (decoder *eventDecoder) decode(eventTime int64, cpu int, payload []byte) []byte {
+	entry := make([]byte, decoder.entrySize)
+	binary.LittleEndian.PutUint64(entry, uint64(eventTime))
+	binary.LittleEndian.PutUint64(entry[8:], uint64(eventTime))
+	binary.LittleEndian.PutUint32(entry[16:], uint32(cpu))
+
+	var values [][]byte
+	for _, field := range decoder.fields {
+		end := field.srcOffset + field.srcSize
+		if end > len(payload) {
+			// Truncated event, leave fields empty
+			if field.kind != fieldCopy {
+				values = append(values, nil)
+			}
+			continue
+		}
+
+		switch field.kind {
+		case fieldCopy:
+			copy(entry[field.dstOffset:field.dstOffset+field.srcSize], payload[field.srcOffset:end])
+		case fieldDataLoc, fieldRelLoc:
+			loc := binary.LittleEndian.Uint32(payload[field.srcOffset:])
+			offset, length := int(loc&0xffff), int(loc>>16)
+			if field.kind == fieldRelLoc {
+				offset += end
+			}
+
+			var data []byte
+			if offset+length <= len(payload) {
+				data = payload[offset : offset+length]
+				if index := bytes.IndexByte(data, 0); index >= 0 {
+					data = data[:index]
+				}
+			}
+			values = append(values, data)
+		}
+	}
+
+	// Strings should be appended in order of fields
+	stringIndex := 0
+	for _, field := range decoder.fields {
+		if field.kind != fieldCopy {
+			entry = tsfile.EncodeVarString(entry, uint(field.dstOffset),
+				string(values[stringIndex]))
+			stringIndex++
+		}
+	}
+	return entry
+}
+
+// Walks events in the ring buffer page and calls handler with timestamp
+// and payload of each data event. Returns true if events were lost
+// before this page
+func (header *pageHeader) parsePage(page []byte,
+	handler func(ts uint64, payload []byte)) (missed bool, err error) {
+
+	if len(page) < header.dataOffset || len(page) < header.commitOffset+header.commitSize {
+		return false, fmt.Errorf("Truncated ring buffer page of %d bytes", len(page))
+	}
+
+	ts := binary.LittleEndian.Uint64(page)
+
+	var commit uint64
+	if header.commitSize == 8 {
+		commit = binary.LittleEndian.Uint64(page[header.commitOffset:])
+	} else {
+		commit = uint64(binary.LittleEndian.Uint32(page[header.commitOffset:]))
+	}
+	missed = (commit & rbMissingEvents) != 0
+
+	data := page[header.dataOffset:]
+	if size := int(commit & rbCommitMask); size <= len(data) {
+		data = data[:size]
+	} else {
+		return missed, fmt.Errorf("Invalid size of ring buffer page data %d", size)
+	}
+
+	for offset := 0; offset+4 <= len(data); {
+		eventHeader := binary.LittleEndian.Uint32(data[offset:])
+		typeLen := eventHeader & rbTypeLenMask
+		delta := uint64(eventHeader >> 5)
+		offset += 4
+
+		// All types except small data events have 32-bit value in array[0]
+		var value uint32
+		if typeLen == rbTypeDataLong || typeLen >= rbTypePadding {
+			if offset+4 > len(data) {
+				return missed, fmt.Errorf("Truncated ring buffer event at %d", offset)
+			}
+			value = binary.LittleEndian.Uint32(data[offset:])
+		}
+
+		var length int
+		switch typeLen {
+		case rbTypePadding:
+			if delta == 0 {
+				// Rest of the page is not used
+				return
+			}
+
+			// Discarded event
+			offset += int(value)
+			continue
+		case rbTypeTimeExtend:
+			ts += uint64(value)<<rbTimeShift + delta
+			offset += 4
+			continue
+		case rbTypeTimeStamp:
+			ts = uint64(value)<<rbTimeShift + delta
+			offset += 4
+			continue
+		case rbTypeDataLong:
+			offset += 4
+			length = (int(value) - 4 + 3) &^ 3
+		default:
+			length = int(typeLen) * 4
+		}
+
+		if length < 0 || offset+length > len(data) {
+			return missed, fmt.Errorf("Truncated ring buffer event at %d", offset)
+		}
+
+		ts += delta
+		handler(ts, data[offset:offset+length])
+		offset += length
+	}
+	return
+}
+
+// Checks that name of subsystem or event doesn't refer other directories
+func isValidName(name string) bool {
+	return len(name) > 0 && name != "." && name != ".." && !strings.ContainsRune(name, '/')
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// Returns names of subdirectories (subsystems or events)
+func listDirs(path string) (names []string) {
+	infos, _ := ioutil.ReadDir(path)
+	for _, info := range infos {
+		if info.IsDir() {
+			names = append(names, info.Name())
+		}
+	}
+	return
+}
+
+func writeFile(path, value string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(value)
+	return err
+}
+
+// Factory creating ftrace provider
+func Create() provider.Provider {
+	return new(FTraceProvider)
+}
+
+func init() {
+	provider.Register("ftrace", Create, provider.Info{
+		Description: "Kernel tracepoints collected from ftrace ring buffers",
+		OS:          []string{"linux"},
+		Steps:       stepNames,
+	})
+}
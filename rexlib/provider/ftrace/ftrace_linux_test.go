@@ -0,0 +1,284 @@
+package ftrace
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"syscall"
+
+	"testing"
+
+	"rexlib/provider"
+	"rexlib/provider/providertest"
+	"tsfile"
+)
+
+const schedSwitchFormat = `name: sched_switch
+ID: 316
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:char prev_comm[16];	offset:8;	size:16;	signed:1;
+	field:pid_t prev_pid;	offset:24;	size:4;	signed:1;
+	field:int prev_prio;	offset:28;	size:4;	signed:1;
+	field:long prev_state;	offset:32;	size:8;	signed:1;
+	field:char next_comm[16];	offset:40;	size:16;	signed:1;
+	field:pid_t next_pid;	offset:56;	size:4;	signed:1;
+	field:int next_prio;	offset:60;	size:4;	signed:1;
+
+print fmt: "prev_comm=%s prev_pid=%d prev_prio=%d prev_state=%s%s ==> next_comm=%s next_pid=%d next_prio=%d", REC->prev_comm, REC->prev_pid, REC->prev_prio, (REC->prev_state & ((((0x0000 | 0x0001 | 0x0002 | 0x0004 | 0x0008 | 0x0010 | 0x0020 | 0x0040) + 1) << 1) - 1)) ? __print_flags(REC->prev_state & ((((0x0000 | 0x0001 | 0x0002 | 0x0004 | 0x0008 | 0x0010 | 0x0020 | 0x0040) + 1) << 1) - 1), "|", { 0x0001, "S" }, { 0x0002, "D" }) : "R", REC->prev_state & (((0x0000 | 0x0001 | 0x0002 | 0x0004 | 0x0008 | 0x0010 | 0x0020 | 0x0040) + 1) << 1) ? "+" : "", REC->next_comm, REC->next_pid, REC->next_prio
+`
+
+const schedProcessExecFormat = `name: sched_process_exec
+ID: 309
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:__data_loc char[] filename;	offset:8;	size:4;	signed:1;
+	field:pid_t pid;	offset:12;	size:4;	signed:1;
+	field:pid_t old_pid;	offset:16;	size:4;	signed:1;
+
+print fmt: "filename=%s pid=%d old_pid=%d", __get_str(filename), REC->pid, REC->old_pid
+`
+
+const headerPageFormat = `	field: u64 timestamp;	offset:0;	size:8;	signed:0;
+	field: local_t commit;	offset:8;	size:8;	signed:1;
+	field: int overwrite;	offset:8;	size:1;	signed:1;
+	field: char data;	offset:16;	size:4080;	signed:1;
+`
+
+// Page recorded from trace_pipe_raw of cpu 0 (with zero padding cut off)
+// which contains the following events:
+//
+//	sched_switch bash:1234 ==> swapper/0:0
+//	time extend of 2^27 ns
+//	sched_process_exec /bin/true pid=1240
+//	discarded event
+//	sched_switch swapper/0:0 ==> true:1240 (in long format)
+var traceRawPage = "" +
+	"00ca9a3b00000000c800000000000000107d00003c010100d204000062617368" +
+	"000000000000000000000000d204000078000000010000000000000073776170" +
+	"7065722f30000000000000000000000078000000be0000000100000008190000" +
+	"35010000d804000014000a00d8040000d80400002f62696e2f74727565000000" +
+	"fd0000000c000000ffffffffffffffff40060000440000003c01010000000000" +
+	"737761707065722f300000000000000000000000780000000100000000000000" +
+	"74727565000000000000000000000000d804000078000000"
+
+func TestParseEventFormat(t *testing.T) {
+	format, err := parseEventFormat(strings.NewReader(schedSwitchFormat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format.Name != "sched_switch" || format.ID != 316 || len(format.Fields) != 11 {
+		t.Fatalf("Unexpected format: %+v", format)
+	}
+
+	field := format.Fields[4]
+	if field.Name != "prev_comm" || field.Type != "char" || field.ArrayLength != 16 ||
+		field.Offset != 8 || field.Size != 16 || !field.Signed {
+		t.Errorf("Unexpected field: %+v", field)
+	}
+
+	format, err = parseEventFormat(strings.NewReader(schedProcessExecFormat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	field = format.Fields[4]
+	if field.Name != "filename" || field.Type != "__data_loc char[]" || field.ArrayLength != 0 {
+		t.Errorf("Unexpected field: %+v", field)
+	}
+
+	_, err = parseEventFormat(strings.NewReader("name: broken\nformat:\n"))
+	if err == nil {
+		t.Error("Format without id is parsed")
+	}
+
+	header, err := parseHeaderPage(strings.NewReader(headerPageFormat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header != defaultPageHeader {
+		t.Errorf("Unexpected page header: %+v", header)
+	}
+}
+
+func TestParsePage(t *testing.T) {
+	page, _ := hex.DecodeString(traceRawPage)
+
+	var timestamps []uint64
+	var types []byte
+	missed, err := defaultPageHeader.parsePage(page, func(ts uint64, payload []byte) {
+		timestamps = append(timestamps, ts)
+		types = append(types, payload[0])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missed {
+		t.Error("Unexpected lost events")
+	}
+
+	expected := []uint64{1000001000, 1134218933, 1134218983}
+	if len(timestamps) != len(expected) {
+		t.Fatalf("Unexpected timestamps: %v", timestamps)
+	}
+	for i, ts := range expected {
+		if timestamps[i] != ts {
+			t.Errorf("Unexpected timestamp of event #%d: %d != %d", i, timestamps[i], ts)
+		}
+	}
+	if string(types) != "\x3c\x35\x3c" {
+		t.Errorf("Unexpected types of events: %v", types)
+	}
+
+	_, err = defaultPageHeader.parsePage(page[:100], func(ts uint64, payload []byte) {})
+	if err == nil {
+		t.Error("Truncated page is parsed")
+	}
+}
+
+// Entry of sched_switch series built from schedSwitchFormat
+type schedSwitchEntry struct {
+	Start, End        int64
+	CPU, CommonPid    int32
+	PrevComm          [16]byte
+	PrevPid, PrevPrio int32
+	PrevState         int64
+	NextComm          [16]byte
+	NextPid, NextPrio int32
+}
+
+// Creates provider which reads sched events from emulated per-cpu buffers
+// of trace instance each containing a single page
+func newTestProvider(t *testing.T, handle *provider.OutputHandle, pages ...[]byte) *FTraceProvider {
+	dir, err := ioutil.TempDir("", "ftracetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	files := map[string]string{
+		"sched_switch/format":       schedSwitchFormat,
+		"sched_process_exec/format": schedProcessExecFormat,
+	}
+	for cpu, page := range pages {
+		page = append(page, make([]byte, os.Getpagesize()-len(page))...)
+		files[fmt.Sprintf("per_cpu/cpu%d/trace_pipe_raw", cpu)] = string(page)
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prov := &FTraceProvider{
+		header:   defaultPageHeader,
+		decoders: make(map[uint16]*eventDecoder),
+	}
+	for _, event := range []string{"sched_switch", "sched_process_exec"} {
+		err := prov.prepareEvent(handle, "sched", filepath.Join(dir, event))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for cpu := range pages {
+		fd, err := syscall.Open(filepath.Join(dir, fmt.Sprintf("per_cpu/cpu%d/trace_pipe_raw", cpu)),
+			syscall.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prov.buffers = append(prov.buffers, cpuBuffer{cpu: cpu, fd: fd})
+	}
+	return prov
+}
+
+func TestFTraceCollect(t *testing.T) {
+	handle := providertest.NewOutputHandle(t, "ftrace")
+	tsf := handle.Trace
+	handle.GlobalTime = 1000000000
+
+	page, _ := hex.DecodeString(traceRawPage)
+	prov := newTestProvider(t, handle, page)
+	prov.Collect(handle)
+	prov.Finalize(handle)
+
+	type schedProcessExecEntry struct {
+		Start          tsfile.TSTimeStart
+		End            tsfile.TSTimeEnd
+		CPU, CommonPid int32
+		Filename       tsfile.TSVarString
+		Pid, OldPid    int32
+	}
+
+	switchEntries := make([]schedSwitchEntry, 2)
+	err := tsf.GetEntries(prov.decoders[316].tag, switchEntries, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if switchEntries[0].Start != 1000 || tsfile.DecodeCStr(switchEntries[0].PrevComm[:]) != "bash" ||
+		switchEntries[0].PrevPid != 1234 || switchEntries[0].PrevState != 1 {
+		t.Errorf("Unexpected entry: %+v", switchEntries[0])
+	}
+	if switchEntries[1].Start != 134218983 || tsfile.DecodeCStr(switchEntries[1].NextComm[:]) != "true" ||
+		switchEntries[1].NextPid != 1240 {
+		t.Errorf("Unexpected entry: %+v", switchEntries[1])
+	}
+
+	execEntries := make([]schedProcessExecEntry, 1)
+	err = tsf.GetEntries(prov.decoders[309].tag, execEntries, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if execEntries[0].Start != 134218933 || execEntries[0].Filename != "/bin/true" ||
+		execEntries[0].Pid != 1240 {
+		t.Errorf("Unexpected entry: %+v", execEntries[0])
+	}
+
+	schema, _ := tsf.GetSchema(prov.decoders[309].tag)
+	if name := tsfile.DecodeCStr(schema.Name[:]); name != "sched:sched_process_exec" {
+		t.Errorf("Unexpected series name %s", name)
+	}
+}
+
+func TestFTraceCollectMerge(t *testing.T) {
+	handle := providertest.NewOutputHandle(t, "ftrace")
+	handle.GlobalTime = 1000000000
+
+	// Second cpu has the same events which happened 500ns later, so its
+	// events should be interleaved with events of the first cpu
+	page0, _ := hex.DecodeString(traceRawPage)
+	page1, _ := hex.DecodeString(traceRawPage)
+	binary.LittleEndian.PutUint64(page1, binary.LittleEndian.Uint64(page1)+500)
+
+	prov := newTestProvider(t, handle, page0, page1)
+	prov.Collect(handle)
+	prov.Finalize(handle)
+
+	entries := make([]schedSwitchEntry, 4)
+	err := handle.Trace.GetEntries(prov.decoders[316].tag, entries, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []schedSwitchEntry{{Start: 1000, CPU: 0}, {Start: 1500, CPU: 1},
+		{Start: 134218983, CPU: 0}, {Start: 134219483, CPU: 1}}
+	for i, entry := range entries {
+		if entry.Start != expected[i].Start || entry.CPU != expected[i].CPU {
+			t.Errorf("Unexpected entry #%d: %+v", i, entry)
+		}
+	}
+}
@@ -0,0 +1,465 @@
+package logtail
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"bytes"
+	"path/filepath"
+
+	"regexp"
+	"strconv"
+	"strings"
+
+	"time"
+
+	"encoding/binary"
+	"math"
+	"reflect"
+
+	"rexlib/provider"
+	"tsfile"
+)
+
+// Follows application log and writes lines matching regular expression
+// as entries. Named groups of expression become fields of entries, group
+// named "time" is parsed as timestamp of the entry using time format (Go
+// layout or "unix" for seconds since epoch). If there is no timestamp in
+// lines, they are stamped with time of collection
+
+// Configuration steps. Path and regex only take one value, fields are
+// specified as name:type where type is one of int, float or string
+// (default type for groups which are not specified)
+const (
+	stepPath = iota
+	stepRegex
+	stepField
+	stepTimeFormat
+
+	stepCount
+)
+
+var stepNames = []string{"path", "regex", "field", "timefmt"}
+
+const (
+	timeGroupName  = "time"
+	timeFormatUnix = "unix"
+
+	// Longer lines are cut
+	maxLineLength = 64 * 1024
+
+	readBufferSize = 64 * 1024
+)
+
+// Types of fields
+const (
+	fieldString = iota
+	fieldInt
+	fieldFloat
+)
+
+var fieldTypeNames = []string{"string", "int", "float"}
+
+// Field of the entry extracted from named group
+type logField struct {
+	name      string
+	fieldType int
+
+	// Index of the group in submatches and offset of the field in entry
+	group  int
+	offset uint
+}
+
+type LogTailProvider struct {
+	// Configured values of steps as they were passed by user
+	values [stepCount][]string
+
+	regex *regexp.Regexp
+
+	// Fields of entries and index of time group (or -1) built by Prepare()
+	fields    []logField
+	timeGroup int
+	entrySize int
+
+	traceTag tsfile.TSFPageTag
+
+	// Currently followed file, its identity used to detect rotation and
+	// offset of data which is already read
+	file     *os.File
+	fileInfo os.FileInfo
+	offset   int64
+
+	// Incomplete last line of the file
+	pending []byte
+}
+
+func (prov *LogTailProvider) Configure(action provider.ConfigurationAction,
+	step *provider.ConfigurationStep) ([]*provider.ConfigurationStep, error) {
+
+	// Get current configuration
+	if action == provider.ConfigureGetValues {
+		return provider.GetStepValues(stepNames, prov.values[:]), nil
+	}
+
+	if action == provider.ConfigureSetValue {
+		stepIdx := provider.FindStep(step, stepNames, stepPath)
+		if stepIdx < 0 {
+			return nil, provider.ErrInvalidConfigurationStep
+		}
+
+		if err := prov.setValues(stepIdx, step.Values); err != nil {
+			return []*provider.ConfigurationStep{step}, err
+		}
+	}
+
+	return prov.getOptions(), nil
+}
+
+func (prov *LogTailProvider) setValues(stepIdx int, values []string) error {
+	switch stepIdx {
+	case stepPath, stepRegex, stepTimeFormat:
+		if len(values) != 1 {
+			return provider.ErrInvalidConfigurationValue
+		}
+	}
+
+	switch stepIdx {
+	case stepPath:
+		// File may not exist yet, but we should be able to follow it
+		if !filepath.IsAbs(values[0]) {
+			return provider.ErrInvalidConfigurationValue
+		}
+		if info, err := os.Stat(filepath.Dir(values[0])); err != nil || !info.IsDir() {
+			return provider.ErrInvalidConfigurationValue
+		}
+	case stepRegex:
+		regex, err := regexp.Compile(values[0])
+		if err != nil {
+			return provider.ErrInvalidConfigurationValue
+		}
+		prov.regex = regex
+
+		// Fields of the previous expression are not valid anymore
+		prov.values[stepField] = nil
+	case stepField:
+		if prov.regex == nil {
+			return provider.ErrInvalidConfigurationValue
+		}
+		for _, value := range values {
+			name, fieldType := parseFieldValue(value)
+			if fieldType < 0 || name == timeGroupName || prov.regex.SubexpIndex(name) < 0 {
+				return provider.ErrInvalidConfigurationValue
+			}
+		}
+
+		for _, value := range values {
+			prov.values[stepField] = appendField(prov.values[stepField], value)
+		}
+		return nil
+	case stepTimeFormat:
+		if len(values[0]) == 0 {
+			return provider.ErrInvalidConfigurationValue
+		}
+	}
+
+	prov.values[stepIdx] = values
+	return nil
+}
+
+// Parses field value in format name:type. Returns -1 as type if it is
+// not known
+func parseFieldValue(value string) (name string, fieldType int) {
+	name = value
+	typeName := fieldTypeNames[fieldString]
+	if index := strings.IndexByte(value, ':'); index >= 0 {
+		name, typeName = value[:index], value[index+1:]
+	}
+
+	for fieldType, fieldTypeName := range fieldTypeNames {
+		if typeName == fieldTypeName {
+			return name, fieldType
+		}
+	}
+	return name, -1
+}
+
+// Adds field value replacing previous value for the same field
+func appendField(values []string, value string) []string {
+	name, _ := parseFieldValue(value)
+	for index, item := range values {
+		if itemName, _ := parseFieldValue(item); itemName == name {
+			values[index] = value
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+// Returns all steps in order they should be configured. Named groups of
+// expression are suggested as fields
+func (prov *LogTailProvider) getOptions() []*provider.ConfigurationStep {
+	steps := provider.NewSteps(stepNames)
+
+	if prov.regex != nil {
+		for _, name := range prov.regex.SubexpNames() {
+			if len(name) == 0 || name == timeGroupName {
+				continue
+			}
+			for _, typeName := range fieldTypeNames {
+				steps[stepField].Values = append(steps[stepField].Values,
+					name+":"+typeName)
+			}
+		}
+	}
+	steps[stepTimeFormat].Values = []string{timeFormatUnix, time.RFC3339,
+		time.Stamp, "2006-01-02 15:04:05"}
+
+	return steps
+}
+
+func (prov *LogTailProvider) Prepare(handle *provider.OutputHandle) (err error) {
+	if len(prov.values[stepPath]) == 0 || prov.regex == nil {
+		return fmt.Errorf("Path and regex should be specified")
+	}
+
+	prov.timeGroup = prov.regex.SubexpIndex(timeGroupName)
+	if prov.timeGroup >= 0 && len(prov.values[stepTimeFormat]) == 0 {
+		return fmt.Errorf("Time format should be specified for group '%s'", timeGroupName)
+	}
+
+	schemaFields := []tsfile.TSFSchemaField{
+		tsfile.NewStartTimeField(),
+		tsfile.NewEndTimeField(),
+	}
+	prov.fields = nil
+	for group, name := range prov.regex.SubexpNames() {
+		if len(name) == 0 || group == prov.timeGroup {
+			continue
+		}
+
+		field := logField{name: name, fieldType: fieldString, group: group}
+		for _, value := range prov.values[stepField] {
+			if fieldName, fieldType := parseFieldValue(value); fieldName == name {
+				field.fieldType = fieldType
+			}
+		}
+
+		switch field.fieldType {
+		case fieldInt:
+			schemaFields = append(schemaFields, tsfile.NewField(name, reflect.TypeOf(int64(0))))
+		case fieldFloat:
+			schemaFields = append(schemaFields, tsfile.NewField(name, reflect.TypeOf(float64(0))))
+		default:
+			schemaFields = append(schemaFields, tsfile.NewVarStringField(name))
+		}
+		prov.fields = append(prov.fields, field)
+	}
+
+	schema, err := tsfile.NewSchema("logtail", schemaFields)
+	if err != nil {
+		return err
+	}
+	for index := range prov.fields {
+		prov.fields[index].offset = uint(schema.Fields[index+2].Offset)
+	}
+	prov.entrySize = int(schema.EntrySize)
+
+	prov.traceTag, err = handle.Trace.AddSchema(schema)
+	if err != nil {
+		return err
+	}
+
+	// Only lines which were written after incident is started are collected
+	prov.pending = nil
+	if err := prov.openFile(); err == nil {
+		prov.offset, err = prov.file.Seek(0, io.SeekEnd)
+		if err != nil {
+			prov.closeFile()
+		}
+	}
+	return nil
+}
+
+func (prov *LogTailProvider) Finalize(handle *provider.OutputHandle) {
+	prov.closeFile()
+}
+
+func (prov *LogTailProvider) Collect(handle *provider.OutputHandle) {
+	var lines [][]byte
+
+	// If file was rotated, read the rest of the old file and continue
+	// with the new file from its beginning
+	var err error
+	info, statErr := os.Stat(prov.values[stepPath][0])
+	if prov.file != nil && (statErr != nil || !os.SameFile(info, prov.fileInfo)) {
+		lines, err = prov.readLines(lines)
+		prov.closeFile()
+	} else if prov.file != nil && info.Size() < prov.offset {
+		// File was truncated (i.e. by copytruncate), so start over
+		prov.offset = 0
+		prov.pending = nil
+	}
+
+	// File may be not created yet after rotation
+	if err == nil && (prov.file != nil || prov.openFile() == nil) {
+		lines, err = prov.readLines(lines)
+	}
+	if err != nil {
+		handle.LogLimited("%v", err)
+	}
+	prov.writeLines(handle, lines)
+}
+
+func (prov *LogTailProvider) openFile() (err error) {
+	prov.file, err = os.Open(prov.values[stepPath][0])
+	if err != nil {
+		prov.file = nil
+		return
+	}
+
+	prov.fileInfo, err = prov.file.Stat()
+	if err != nil {
+		prov.closeFile()
+		return
+	}
+	prov.offset = 0
+	prov.pending = nil
+	return
+}
+
+func (prov *LogTailProvider) closeFile() {
+	if prov.file != nil {
+		prov.file.Close()
+	}
+	prov.file = nil
+	prov.fileInfo = nil
+}
+
+// Reads complete lines added to file since last read
+func (prov *LogTailProvider) readLines(lines [][]byte) ([][]byte, error) {
+	buf := make([]byte, readBufferSize)
+	for {
+		n, err := prov.file.ReadAt(buf, prov.offset)
+		prov.offset += int64(n)
+
+		data := buf[:n]
+		for len(data) > 0 {
+			index := bytes.IndexByte(data, '\n')
+			if index < 0 {
+				prov.appendPending(data)
+				break
+			}
+
+			prov.appendPending(data[:index])
+			lines = append(lines, prov.pending)
+			prov.pending = nil
+			data = data[index+1:]
+		}
+
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return lines, err
+		}
+	}
+}
+
+func (prov *LogTailProvider) appendPending(data []byte) {
+	if free := maxLineLength - len(prov.pending); len(data) > free {
+		data = data[:free]
+	}
+	prov.pending = append(prov.pending, data...)
+}
+
+func (prov *LogTailProvider) writeLines(handle *provider.OutputHandle, lines [][]byte) {
+	var entries [][]byte
+	var timeErrors int
+	var timeErr error
+	for _, line := range lines {
+		match := prov.regex.FindSubmatch(line)
+		if match == nil {
+			continue
+		}
+
+		entryTime := handle.Now
+		if prov.timeGroup >= 0 {
+			var err error
+			entryTime, err = parseTime(prov.values[stepTimeFormat][0],
+				string(match[prov.timeGroup]), handle.Now)
+			if err != nil {
+				timeErrors, timeErr = timeErrors+1, err
+				continue
+			}
+		}
+
+		entries = append(entries, prov.encodeEntry(entryTime.UnixNano()-handle.GlobalTime, match))
+	}
+	if timeErrors > 0 {
+		handle.LogLimited("Cannot parse time of %d lines: %v", timeErrors, timeErr)
+	}
+
+	if len(entries) > 0 {
+		err := handle.Trace.AddEntries(prov.traceTag, entries)
+		if err != nil {
+			handle.Log.Println(err)
+		}
+	}
+}
+
+// Creates raw entry from submatches of the line. Values which cannot be
+// parsed are written as zeroes
+func (prov *LogTailProvider) encodeEntry(entryTime int64, match [][]byte) []byte {
+	entry := make([]byte, prov.entrySize)
+	binary.LittleEndian.PutUint64(entry, uint64(entryTime))
+	binary.LittleEndian.PutUint64(entry[8:], uint64(entryTime))
+
+	for _, field := range prov.fields {
+		value := string(match[field.group])
+		switch field.fieldType {
+		case fieldInt:
+			i, _ := strconv.ParseInt(value, 10, 64)
+			binary.LittleEndian.PutUint64(entry[field.offset:], uint64(i))
+		case fieldFloat:
+			f, _ := strconv.ParseFloat(value, 64)
+			binary.LittleEndian.PutUint64(entry[field.offset:], math.Float64bits(f))
+		default:
+			entry = tsfile.EncodeVarString(entry, field.offset, value)
+		}
+	}
+	return entry
+}
+
+// Parses timestamp of the line. Formats which do not have year (like
+// syslog's) are assumed to be in current year
+func parseTime(format, value string, now time.Time) (time.Time, error) {
+	if format == timeFormatUnix {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return now, fmt.Errorf("Invalid unix timestamp '%s'", value)
+		}
+		return time.Unix(0, int64(seconds*float64(time.Second))), nil
+	}
+
+	t, err := time.ParseInLocation(format, value, time.Local)
+	if err != nil {
+		return now, err
+	}
+	if t.Year() == 0 {
+		t = t.AddDate(now.Year(), 0, 0)
+	}
+	return t, nil
+}
+
+// Factory creating logtail provider
+func Create() provider.Provider {
+	return new(LogTailProvider)
+}
+
+func init() {
+	provider.Register("logtail", Create, provider.Info{
+		Description: "Lines of application log matching regular expression",
+		Steps:       stepNames,
+	})
+}
@@ -0,0 +1,164 @@
+package logtail
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"time"
+
+	"testing"
+
+	"rexlib/provider"
+	"rexlib/provider/providertest"
+	"tsfile"
+)
+
+func TestLogTailConfigure(t *testing.T) {
+	prov := new(LogTailProvider)
+
+	invalidSteps := []*provider.ConfigurationStep{
+		{Name: "path", Values: []string{"relative.log"}},
+		{Name: "path", Values: []string{"/nonexistent/dir/app.log"}},
+		{Name: "regex", Values: []string{"(?P<broken"}},
+		{Name: "field", Values: []string{"latency:int"}},
+	}
+	for _, step := range invalidSteps {
+		_, err := prov.Configure(provider.ConfigureSetValue, step)
+		if err != provider.ErrInvalidConfigurationValue {
+			t.Errorf("Unexpected error for %v: %v", step, err)
+		}
+	}
+
+	steps, err := prov.Configure(provider.ConfigureSetValue, &provider.ConfigurationStep{
+		Name: "regex", Values: []string{`^(?P<time>\S+) (?P<method>\w+) (?P<latency>\d+)`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 4 || len(steps[2].Values) != 6 || steps[2].Values[0] != "method:string" {
+		t.Errorf("Unexpected options: %v", steps)
+	}
+
+	for _, value := range []string{"time:int", "unknown:int", "latency:bool"} {
+		_, err = prov.Configure(provider.ConfigureSetValue,
+			&provider.ConfigurationStep{Name: "field", Values: []string{value}})
+		if err != provider.ErrInvalidConfigurationValue {
+			t.Errorf("Unexpected error for field %s: %v", value, err)
+		}
+	}
+
+	for _, value := range []string{"latency:float", "latency:int"} {
+		_, err = prov.Configure(provider.ConfigureSetValue,
+			&provider.ConfigurationStep{Name: "field", Values: []string{value}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	steps, _ = prov.Configure(provider.ConfigureGetValues, nil)
+	if len(steps) != 2 || steps[1].Name != "field" || len(steps[1].Values) != 1 ||
+		steps[1].Values[0] != "latency:int" {
+		t.Errorf("Unexpected configuration: %v", steps)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2020, 5, 1, 0, 0, 0, 0, time.Local)
+
+	tm, err := parseTime(timeFormatUnix, "1588291200.5", now)
+	if err != nil || tm.UnixNano() != 1588291200500000000 {
+		t.Errorf("Unexpected time %v: %v", tm, err)
+	}
+
+	tm, err = parseTime(time.Stamp, "Apr 30 23:59:00", now)
+	if err != nil || tm.Year() != 2020 || tm.Month() != time.April {
+		t.Errorf("Unexpected time %v: %v", tm, err)
+	}
+
+	_, err = parseTime(time.RFC3339, "yesterday", now)
+	if err == nil {
+		t.Error("Invalid time is parsed")
+	}
+}
+
+func TestLogTailCollect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logtailtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logPath := filepath.Join(dir, "app.log")
+	appendLog := func(data string) {
+		file, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		file.WriteString(data)
+	}
+	appendLog("1000 GET 15 /old\n")
+
+	handle := providertest.NewOutputHandle(t, "logtail")
+	tsf := handle.Trace
+
+	prov := new(LogTailProvider)
+	for _, step := range []*provider.ConfigurationStep{
+		{Values: []string{logPath}},
+		{Name: "regex", Values: []string{`^(?P<time>\d+) (?P<method>\w+) (?P<latency>\d+)`}},
+		{Name: "field", Values: []string{"latency:int"}},
+		{Name: "timefmt", Values: []string{"unix"}},
+	} {
+		if _, err := prov.Configure(provider.ConfigureSetValue, step); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handle.Now = time.Unix(1000, 0)
+	handle.GlobalTime = int64(time.Second) * 1000
+	if err := prov.Prepare(handle); err != nil {
+		t.Fatal(err)
+	}
+
+	// Line written before start is skipped, incomplete line is postponed
+	appendLog("1001 GET 20 /index.html\nnot matching\n1002 POST 3")
+	prov.Collect(handle)
+	appendLog("5 /login\n")
+	prov.Collect(handle)
+
+	// Rotate log and write to the new file
+	appendLog("1003 GET 10 /rotated\n")
+	if err := os.Rename(logPath, logPath+".1"); err != nil {
+		t.Fatal(err)
+	}
+	prov.Collect(handle)
+	appendLog("1004 PUT 7 /new\n")
+	prov.Collect(handle)
+	prov.Finalize(handle)
+
+	type logTailEntry struct {
+		Start   tsfile.TSTimeStart
+		End     tsfile.TSTimeEnd
+		Method  tsfile.TSVarString
+		Latency int64
+	}
+	expected := []logTailEntry{
+		{Start: 1000000000, End: 1000000000, Method: "GET", Latency: 20},
+		{Start: 2000000000, End: 2000000000, Method: "POST", Latency: 35},
+		{Start: 3000000000, End: 3000000000, Method: "GET", Latency: 10},
+		{Start: 4000000000, End: 4000000000, Method: "PUT", Latency: 7},
+	}
+
+	entries := make([]logTailEntry, len(expected))
+	if err := tsf.GetEntries(prov.traceTag, entries, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i, entry := range entries {
+		if entry != expected[i] {
+			t.Errorf("Unexpected entry #%d: %+v", i, entry)
+		}
+	}
+	if tsf.GetEntryCount(prov.traceTag) != len(expected) {
+		t.Errorf("Unexpected number of entries: %d", tsf.GetEntryCount(prov.traceTag))
+	}
+}
@@ -0,0 +1,507 @@
+package netstat
+
+import (
+	"fmt"
+	"os"
+
+	"bufio"
+	"io"
+
+	"sort"
+	"strconv"
+	"strings"
+
+	"time"
+
+	"reflect"
+
+	"rexlib/hostinfo"
+	"rexlib/provider"
+	"tsfile"
+)
+
+const (
+	fSNMP     string = "/proc/net/snmp"
+	fSockStat string = "/proc/net/sockstat"
+)
+
+const (
+	srcNetDev = iota
+	srcSNMP
+	srcSockStat
+)
+
+type statistic struct {
+	source int
+	name   string
+
+	// Key of the value in snmp ("Tcp:ActiveOpens") or sockstat ("TCP:inuse")
+	key string
+
+	// Getter of the interface counter for netdev statistics
+	getter func(counters *hostinfo.HINetCounters) int64
+
+	cumulative bool
+}
+
+// List of statistics collectible by netstat provider. Interface statistics
+// from /proc/net/dev are written to netdev series with an entry per
+// interface, others are written to netstat series
+var stats = []statistic{
+	statistic{srcNetDev, "rx_bytes", "",
+		func(c *hostinfo.HINetCounters) int64 { return c.RxBytes }, true},
+	statistic{srcNetDev, "rx_packets", "",
+		func(c *hostinfo.HINetCounters) int64 { return c.RxPackets }, true},
+	statistic{srcNetDev, "rx_errs", "",
+		func(c *hostinfo.HINetCounters) int64 { return c.RxErrors }, true},
+	statistic{srcNetDev, "rx_drop", "",
+		func(c *hostinfo.HINetCounters) int64 { return c.RxDrops }, true},
+	statistic{srcNetDev, "tx_bytes", "",
+		func(c *hostinfo.HINetCounters) int64 { return c.TxBytes }, true},
+	statistic{srcNetDev, "tx_packets", "",
+		func(c *hostinfo.HINetCounters) int64 { return c.TxPackets }, true},
+	statistic{srcNetDev, "tx_errs", "",
+		func(c *hostinfo.HINetCounters) int64 { return c.TxErrors }, true},
+	statistic{srcNetDev, "tx_drop", "",
+		func(c *hostinfo.HINetCounters) int64 { return c.TxDrops }, true},
+
+	statistic{srcSNMP, "ip_in_receives", "Ip:InReceives", nil, true},
+	statistic{srcSNMP, "ip_in_discards", "Ip:InDiscards", nil, true},
+	statistic{srcSNMP, "ip_in_delivers", "Ip:InDelivers", nil, true},
+	statistic{srcSNMP, "ip_out_requests", "Ip:OutRequests", nil, true},
+	statistic{srcSNMP, "ip_out_discards", "Ip:OutDiscards", nil, true},
+
+	statistic{srcSNMP, "tcp_active_opens", "Tcp:ActiveOpens", nil, true},
+	statistic{srcSNMP, "tcp_passive_opens", "Tcp:PassiveOpens", nil, true},
+	statistic{srcSNMP, "tcp_attempt_fails", "Tcp:AttemptFails", nil, true},
+	statistic{srcSNMP, "tcp_estab_resets", "Tcp:EstabResets", nil, true},
+	statistic{srcSNMP, "tcp_curr_estab", "Tcp:CurrEstab", nil, false},
+	statistic{srcSNMP, "tcp_in_segs", "Tcp:InSegs", nil, true},
+	statistic{srcSNMP, "tcp_out_segs", "Tcp:OutSegs", nil, true},
+	statistic{srcSNMP, "tcp_retrans_segs", "Tcp:RetransSegs", nil, true},
+	statistic{srcSNMP, "tcp_in_errs", "Tcp:InErrs", nil, true},
+	statistic{srcSNMP, "tcp_out_rsts", "Tcp:OutRsts", nil, true},
+
+	statistic{srcSNMP, "udp_in_datagrams", "Udp:InDatagrams", nil, true},
+	statistic{srcSNMP, "udp_no_ports", "Udp:NoPorts", nil, true},
+	statistic{srcSNMP, "udp_in_errors", "Udp:InErrors", nil, true},
+	statistic{srcSNMP, "udp_out_datagrams", "Udp:OutDatagrams", nil, true},
+	statistic{srcSNMP, "udp_rcvbuf_errors", "Udp:RcvbufErrors", nil, true},
+	statistic{srcSNMP, "udp_sndbuf_errors", "Udp:SndbufErrors", nil, true},
+
+	statistic{srcSockStat, "sockets_used", "sockets:used", nil, false},
+	statistic{srcSockStat, "tcp_inuse", "TCP:inuse", nil, false},
+	statistic{srcSockStat, "tcp_orphan", "TCP:orphan", nil, false},
+	statistic{srcSockStat, "tcp_tw", "TCP:tw", nil, false},
+	statistic{srcSockStat, "tcp_alloc", "TCP:alloc", nil, false},
+	statistic{srcSockStat, "tcp_mem", "TCP:mem", nil, false},
+	statistic{srcSockStat, "udp_inuse", "UDP:inuse", nil, false},
+	statistic{srcSockStat, "udp_mem", "UDP:mem", nil, false},
+}
+
+// Configuration steps. Order of the steps is also a guide for
+// reordering them
+var stepNames = []string{"iface", "stat"}
+
+type NetStatProvider struct {
+	// Names of selected interfaces
+	ifaces []string
+
+	// List of indeces of statistics which has to be collected
+	stats []int
+
+	// Indeces of statistics split by series
+	ifaceStats  []int
+	globalStats []int
+
+	// IDs of the corresponding schemas
+	netDevTag tsfile.TSFPageTag
+	netTag    tsfile.TSFPageTag
+
+	// Last snapshot (for cumulative stats)
+	lastIfaceSnap  map[string]hostinfo.HINetCounters
+	lastGlobalSnap []int64
+	lastTime       time.Time
+}
+
+func (prov *NetStatProvider) Configure(action provider.ConfigurationAction,
+	step *provider.ConfigurationStep) ([]*provider.ConfigurationStep, error) {
+
+	// Get current configuration
+	if action == provider.ConfigureGetValues {
+		var steps []*provider.ConfigurationStep
+		if len(prov.ifaces) > 0 {
+			steps = append(steps, &provider.ConfigurationStep{
+				Name:   "iface",
+				Values: prov.ifaces,
+			})
+		}
+
+		statStep := &provider.ConfigurationStep{
+			Name:   "stat",
+			Values: make([]string, len(prov.stats)),
+		}
+		for i, statIdx := range prov.stats {
+			statStep.Values[i] = stats[statIdx].name
+		}
+
+		return append(steps, statStep), nil
+	}
+
+	nexus, err := hostinfo.GetNexus(hostinfo.HINet, false, false)
+	if err != nil {
+		return nil, err
+	}
+
+	ifaceStep := &provider.ConfigurationStep{Name: "iface"}
+	if step.CompareName("iface") {
+		ifaceStep = step
+	} else if step != nil && !step.EnsureName("stat") {
+		return nil, provider.ErrInvalidConfigurationStep
+	}
+
+	var newIfaces []string
+	var availableIfaces []string
+	for _, iface := range prov.ifaces {
+		ifaceStep.PopValue(iface)
+		newIfaces = append(newIfaces, iface)
+	}
+	for iface := range nexus.Children {
+		if provider.HasValue(prov.ifaces, iface) {
+			continue
+		}
+		if ifaceStep.PopValue(iface) {
+			newIfaces = append(newIfaces, iface)
+			continue
+		}
+
+		availableIfaces = append(availableIfaces, iface)
+	}
+	if !ifaceStep.CheckValues() {
+		return []*provider.ConfigurationStep{step}, provider.ErrInvalidConfigurationValue
+	}
+	sort.Strings(availableIfaces)
+
+	// Pick statistics in the same way sysstat does
+	statStep := &provider.ConfigurationStep{Name: "stat"}
+	if step != ifaceStep {
+		statStep = step
+	}
+
+	var newStats []int
+	var availableStatNames []string
+
+	statIdxOff := 0
+	for statIdx, stat := range stats {
+		if statIdxOff < len(prov.stats) && prov.stats[statIdxOff] == statIdx {
+			// This statistic was specified earlier, keep it in stats array
+			newStats = append(newStats, prov.stats[statIdxOff])
+			statIdxOff++
+			continue
+		}
+
+		if statStep.PopValue(stat.name) {
+			newStats = append(newStats, statIdx)
+			continue
+		}
+
+		// This statistic is neither new one, nor pre-existed, so it can
+		// be picked in future configuration steps
+		availableStatNames = append(availableStatNames, stat.name)
+	}
+	if !statStep.CheckValues() {
+		return []*provider.ConfigurationStep{step}, provider.ErrInvalidConfigurationValue
+	}
+
+	if action == provider.ConfigureSetValue {
+		prov.ifaces = newIfaces
+		prov.stats = newStats
+	}
+
+	return []*provider.ConfigurationStep{
+		&provider.ConfigurationStep{Name: "iface", Values: availableIfaces},
+		&provider.ConfigurationStep{Name: "stat", Values: availableStatNames},
+	}, nil
+}
+
+func (prov *NetStatProvider) Prepare(handle *provider.OutputHandle) (err error) {
+	prov.ifaceStats, prov.globalStats = nil, nil
+	for _, statIdx := range prov.stats {
+		if stats[statIdx].source == srcNetDev {
+			prov.ifaceStats = append(prov.ifaceStats, statIdx)
+		} else {
+			prov.globalStats = append(prov.globalStats, statIdx)
+		}
+	}
+
+	switch {
+	case len(prov.stats) == 0:
+		return fmt.Errorf("No statistics are selected")
+	case len(prov.ifaceStats) > 0 && len(prov.ifaces) == 0:
+		return fmt.Errorf("Interface statistics are selected, but no interfaces are given")
+	case len(prov.ifaceStats) == 0 && len(prov.ifaces) > 0:
+		return fmt.Errorf("Interfaces are selected, but no interface statistics are given")
+	}
+
+	prov.lastIfaceSnap = nil
+	prov.lastGlobalSnap = nil
+
+	// Generate TSF schemas for a slices we're going to provide. Interfaces
+	// are identified by index in the list of interfaces which labels are
+	// kept in the dictionary of the series
+	rType := reflect.TypeOf(int64(0))
+	if len(prov.ifaceStats) > 0 {
+		fields := []tsfile.TSFSchemaField{tsfile.NewEnumField("iface", rType)}
+		for _, statIdx := range prov.ifaceStats {
+			fields = append(fields, tsfile.NewField(stats[statIdx].name, rType))
+		}
+		fields = append(fields, tsfile.NewStartTimeField())
+		fields = append(fields, tsfile.NewEndTimeField())
+
+		prov.netDevTag, err = addSchema(handle, "netdev", fields)
+		if err != nil {
+			return
+		}
+
+		labels := make(tsfile.TSFEnumDictionary)
+		for index, iface := range prov.ifaces {
+			labels[int64(index)] = iface
+		}
+		err = handle.Trace.RegisterEnum(prov.netDevTag, "iface", labels)
+		if err != nil {
+			return
+		}
+	}
+
+	if len(prov.globalStats) > 0 {
+		var fields []tsfile.TSFSchemaField
+		for _, statIdx := range prov.globalStats {
+			fields = append(fields, tsfile.NewField(stats[statIdx].name, rType))
+		}
+		fields = append(fields, tsfile.NewStartTimeField())
+		fields = append(fields, tsfile.NewEndTimeField())
+
+		prov.netTag, err = addSchema(handle, "netstat", fields)
+	}
+	return
+}
+
+func addSchema(handle *provider.OutputHandle, name string,
+	fields []tsfile.TSFSchemaField) (tsfile.TSFPageTag, error) {
+	schema, err := tsfile.NewSchema(name, fields)
+	if err != nil {
+		return tsfile.TSFPageTag(0), err
+	}
+	return handle.Trace.AddSchema(schema)
+}
+
+func (prov *NetStatProvider) Finalize(handle *provider.OutputHandle) {
+
+}
+
+func (prov *NetStatProvider) Collect(handle *provider.OutputHandle) {
+	now := handle.Now
+	timeDelta := now.Sub(prov.lastTime)
+	startTime := prov.lastTime.UnixNano() - handle.GlobalTime
+	endTime := now.UnixNano() - handle.GlobalTime
+
+	if len(prov.ifaceStats) > 0 {
+		prov.collectInterfaces(handle, timeDelta, startTime, endTime)
+	}
+	if len(prov.globalStats) > 0 {
+		prov.collectGlobal(handle, timeDelta, startTime, endTime)
+	}
+
+	prov.lastTime = now
+}
+
+func (prov *NetStatProvider) collectInterfaces(handle *provider.OutputHandle,
+	timeDelta time.Duration, startTime, endTime int64) {
+
+	snap, err := hostinfo.ReadNetDevStats()
+	if err != nil {
+		handle.LogLimited("%v", err)
+		return
+	}
+
+	var entries [][]int64
+	for index, iface := range prov.ifaces {
+		counters, ok := snap[iface]
+		if !ok {
+			continue
+		}
+
+		// Not enough data for now
+		prevCounters, ok := prov.lastIfaceSnap[iface]
+		if !ok {
+			continue
+		}
+
+		values := make([]int64, 0, len(prov.ifaceStats)+3)
+		values = append(values, int64(index))
+		for _, statIdx := range prov.ifaceStats {
+			stat := &stats[statIdx]
+			values = append(values, normalizeStatistic(stat.cumulative,
+				stat.getter(&prevCounters), stat.getter(&counters), timeDelta))
+		}
+		values = append(values, startTime, endTime)
+
+		entries = append(entries, values)
+	}
+
+	if len(entries) > 0 {
+		err = handle.Trace.AddEntries(prov.netDevTag, entries)
+		if err != nil {
+			handle.Log.Println(err)
+		}
+	}
+
+	prov.lastIfaceSnap = snap
+}
+
+func (prov *NetStatProvider) collectGlobal(handle *provider.OutputHandle,
+	timeDelta time.Duration, startTime, endTime int64) {
+
+	var files [srcSockStat + 1]map[string]int64
+
+	// Current snapshot of absolute values
+	snap := make([]int64, len(prov.globalStats))
+	values := make([]int64, 0, len(prov.globalStats)+2)
+	for index, statIdx := range prov.globalStats {
+		stat := &stats[statIdx]
+
+		if files[stat.source] == nil {
+			var err error
+			files[stat.source], err = readStatFile(stat.source)
+			if err != nil {
+				handle.Log.Println(err)
+				return
+			}
+		}
+
+		value, ok := files[stat.source][stat.key]
+		if !ok {
+			handle.Log.Printf("Statistic %s is not supported by kernel", stat.name)
+			return
+		}
+		snap[index] = value
+
+		if stat.cumulative && len(prov.lastGlobalSnap) <= index {
+			// Not enough data for now
+			continue
+		}
+
+		var prevValue int64
+		if stat.cumulative {
+			prevValue = prov.lastGlobalSnap[index]
+		}
+		values = append(values, normalizeStatistic(stat.cumulative, prevValue, value, timeDelta))
+	}
+
+	if len(values) == len(prov.globalStats) {
+		// All values have been collected, time to write something to TSF
+		values = append(values, startTime, endTime)
+		err := handle.Trace.AddEntries(prov.netTag, [][]int64{values})
+		if err != nil {
+			handle.Log.Println(err)
+		}
+	}
+
+	prov.lastGlobalSnap = snap
+}
+
+// Normalize value as per-second value if it is cumulative
+func normalizeStatistic(cumulative bool, prevValue, value int64, timeDelta time.Duration) int64 {
+	if !cumulative {
+		return value
+	}
+	return provider.NormalizeRate(value-prevValue, timeDelta)
+}
+
+func readStatFile(source int) (map[string]int64, error) {
+	fileName := fSNMP
+	if source == srcSockStat {
+		fileName = fSockStat
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if source == srcSockStat {
+		return parseSockStat(file)
+	}
+	return parseSNMP(file)
+}
+
+// Parses snmp file which consists of pairs of lines: first line contains
+// names of the values and second contains values, both are prefixed with
+// name of the protocol
+func parseSNMP(reader io.Reader) (map[string]int64, error) {
+	values := make(map[string]int64)
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		header := strings.Fields(scanner.Text())
+		if !scanner.Scan() {
+			break
+		}
+		line := strings.Fields(scanner.Text())
+
+		if len(header) == 0 || len(line) != len(header) || line[0] != header[0] {
+			return values, fmt.Errorf("Invalid snmp line for %v", header)
+		}
+
+		proto := strings.TrimSuffix(header[0], ":")
+		for i := 1; i < len(header); i++ {
+			value, err := strconv.ParseInt(line[i], 10, 64)
+			if err != nil {
+				return values, err
+			}
+
+			values[proto+":"+header[i]] = value
+		}
+	}
+
+	return values, scanner.Err()
+}
+
+// Parses sockstat file in format "PROTO: key value key value"
+func parseSockStat(reader io.Reader) (map[string]int64, error) {
+	values := make(map[string]int64)
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		tokens := strings.Fields(scanner.Text())
+		if len(tokens) == 0 {
+			continue
+		}
+
+		proto := strings.TrimSuffix(tokens[0], ":")
+		for i := 1; i+1 < len(tokens); i += 2 {
+			value, err := strconv.ParseInt(tokens[i+1], 10, 64)
+			if err != nil {
+				return values, err
+			}
+
+			values[proto+":"+tokens[i]] = value
+		}
+	}
+
+	return values, scanner.Err()
+}
+
+// Factory creating netstat provider
+func Create() provider.Provider {
+	return new(NetStatProvider)
+}
+
+func init() {
+	provider.Register("netstat", Create, provider.Info{
+		Description: "Network interface, IP/TCP/UDP and socket statistics from /proc/net",
+		OS:          []string{"linux"},
+		Steps:       stepNames,
+	})
+}
@@ -0,0 +1,115 @@
+package netstat
+
+import (
+	"strings"
+	"time"
+
+	"testing"
+
+	"rexlib/provider"
+	"rexlib/provider/providertest"
+)
+
+func TestParseSNMP(t *testing.T) {
+	values, err := parseSNMP(strings.NewReader(
+		"Tcp: RtoAlgorithm RtoMin ActiveOpens CurrEstab\n" +
+			"Tcp: 1 200 28 4\n" +
+			"Udp: InDatagrams NoPorts\n" +
+			"Udp: 14 0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 6 || values["Tcp:ActiveOpens"] != 28 || values["Udp:InDatagrams"] != 14 {
+		t.Errorf("Unexpected values: %v", values)
+	}
+
+	_, err = parseSNMP(strings.NewReader("Tcp: RtoAlgorithm RtoMin\nTcp: 1\n"))
+	if err == nil {
+		t.Error("Mismatching snmp lines are parsed")
+	}
+}
+
+func TestParseSockStat(t *testing.T) {
+	values, err := parseSockStat(strings.NewReader(
+		"sockets: used 20\n" +
+			"TCP: inuse 6 orphan 0 tw 1 alloc 6 mem 3\n" +
+			"UDP: inuse 0 mem 0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 8 || values["sockets:used"] != 20 || values["TCP:mem"] != 3 {
+		t.Errorf("Unexpected values: %v", values)
+	}
+}
+
+func TestNetStatConfigure(t *testing.T) {
+	prov := new(NetStatProvider)
+
+	_, err := prov.Configure(provider.ConfigureSetValue,
+		&provider.ConfigurationStep{Name: "stat", Values: []string{"tcp_nonexistent"}})
+	if err != provider.ErrInvalidConfigurationValue {
+		t.Errorf("Unexpected error for unknown stat: %v", err)
+	}
+	_, err = prov.Configure(provider.ConfigureSetValue,
+		&provider.ConfigurationStep{Name: "iface", Values: []string{"nonexistent0"}})
+	if err != provider.ErrInvalidConfigurationValue {
+		t.Errorf("Unexpected error for unknown interface: %v", err)
+	}
+
+	steps, err := prov.Configure(provider.ConfigureSetValue,
+		&provider.ConfigurationStep{Name: "stat", Values: []string{"tcp_in_segs", "rx_bytes"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 2 || len(steps[1].Values) != len(stats)-2 {
+		t.Errorf("Unexpected options: %v", steps)
+	}
+
+	steps, _ = prov.Configure(provider.ConfigureGetValues, nil)
+	if len(steps) != 1 || len(steps[0].Values) != 2 || steps[0].Values[0] != "rx_bytes" {
+		t.Errorf("Unexpected configuration: %v", steps)
+	}
+}
+
+func TestNetStatCollect(t *testing.T) {
+	handle := providertest.NewOutputHandle(t, "netstat")
+	tsf := handle.Trace
+
+	prov := new(NetStatProvider)
+	_, err := prov.Configure(provider.ConfigureSetValue,
+		&provider.ConfigurationStep{Name: "stat", Values: []string{"tcp_curr_estab", "tcp_in_segs", "rx_bytes"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = prov.Configure(provider.ConfigureSetValue,
+		&provider.ConfigurationStep{Name: "iface", Values: []string{"lo"}})
+	if err != nil {
+		t.Skipf("Loopback interface is not available: %v", err)
+	}
+
+	now := handle.Now
+	if err := prov.Prepare(handle); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		handle.Now = now.Add(time.Duration(i) * time.Second)
+		prov.Collect(handle)
+	}
+	prov.Finalize(handle)
+
+	stats := tsf.GetStats()
+	if len(stats.Series) != 2 {
+		t.Fatalf("Unexpected series: %v", stats.Series)
+	}
+	for _, series := range stats.Series {
+		if series.Count != 2 {
+			t.Errorf("Unexpected number of entries in %s: %d", series.Name, series.Count)
+		}
+	}
+
+	schema, _ := tsf.GetSchema(prov.netDevTag)
+	if schema.Enums["iface"][0] != "lo" {
+		t.Errorf("Unexpected interface labels: %v", schema.Enums)
+	}
+}
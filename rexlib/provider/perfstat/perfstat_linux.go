@@ -0,0 +1,527 @@
+package perfstat
+
+import (
+	"fmt"
+	"os"
+
+	"io/ioutil"
+	"path/filepath"
+
+	"sort"
+	"strconv"
+	"strings"
+
+	"time"
+
+	"encoding/binary"
+	"reflect"
+	"syscall"
+	"unsafe"
+
+	"rexlib/provider"
+	"tsfile"
+)
+
+const (
+	procPath         = "/proc"
+	cpuOnline        = "/sys/devices/system/cpu/online"
+	perfParanoidPath = "/proc/sys/kernel/perf_event_paranoid"
+)
+
+// Configuration steps. Processes are selected by pids, threads are selected
+// by tids, but only for processes with known pids. If no processes are
+// selected, counters are collected system-wide. Order of the steps is also
+// a guide for reordering them
+const (
+	stepPid = iota
+	stepTid
+
+	stepCount
+)
+
+var stepNames = []string{"pid", "tid"}
+
+// Software counters of perf_event subsystem collected by provider. For
+// system-wide counters cpu-clock is used instead of task-clock
+const (
+	counterTaskClock = iota
+	counterContextSwitches
+	counterCPUMigrations
+	counterPageFaults
+
+	counterCount
+)
+
+// Values of perf_event_attr and perf_event_open() flags from
+// linux/perf_event.h
+const (
+	perfTypeSoftware = 1
+
+	perfCountSWCPUClock        = 0
+	perfCountSWTaskClock       = 1
+	perfCountSWPageFaults      = 2
+	perfCountSWContextSwitches = 3
+	perfCountSWCPUMigrations   = 4
+
+	perfAttrFlagExcludeKernel = 1 << 5
+	perfAttrFlagExcludeHV     = 1 << 6
+
+	perfFlagFDCloexec = 1 << 3
+)
+
+var counterConfigs = [counterCount]uint64{
+	perfCountSWTaskClock,
+	perfCountSWContextSwitches,
+	perfCountSWCPUMigrations,
+	perfCountSWPageFaults,
+}
+
+// Version 1 of perf_event_attr (PERF_ATTR_SIZE_VER1), fields which are not
+// used by provider are merged or omitted
+type perfEventAttr struct {
+	Type         uint32
+	Size         uint32
+	Config       uint64
+	SamplePeriod uint64
+	SampleType   uint64
+	ReadFormat   uint64
+	Flags        uint64
+	WakeupEvents uint32
+	BPType       uint32
+	Config1      uint64
+	Config2      uint64
+}
+
+// Entries of perfstat series. Process-wide entries have zero TID, system-wide
+// entries have both PID and TID set to -1. Counters are normalized to
+// per-second values (nanoseconds per second for clock)
+type perfStatEntry struct {
+	Start tsfile.TSTimeStart
+	End   tsfile.TSTimeEnd
+
+	PID, TID int32
+
+	TaskClock       int64
+	ContextSwitches int64
+	CPUMigrations   int64
+	PageFaults      int64
+}
+
+// Counters opened for a single thread or cpu, closed counters have fd -1
+type perfTask struct {
+	fds [counterCount]int
+}
+
+// Set of tasks which values are summed in a single entry
+type perfTarget struct {
+	pid, tid int32
+
+	// Tasks keyed by tid or cpu number
+	tasks map[int]*perfTask
+
+	// Values accumulated by threads which already exited, so sum
+	// of counters doesn't decrease
+	exited [counterCount]uint64
+
+	lastValues [counterCount]uint64
+}
+
+type PerfStatProvider struct {
+	// Configured values of steps as they were passed by user
+	values [stepCount][]string
+
+	targets []*perfTarget
+
+	// Flags of perf_event_attr, kernel may be excluded if access to
+	// kernel profiling is not allowed
+	attrFlags uint64
+
+	// Set when access to perf_event is denied and message was logged
+	accessDenied bool
+
+	traceTag tsfile.TSFPageTag
+
+	lastTime time.Time
+}
+
+func (prov *PerfStatProvider) Configure(action provider.ConfigurationAction,
+	step *provider.ConfigurationStep) ([]*provider.ConfigurationStep, error) {
+
+	// Get current configuration
+	if action == provider.ConfigureGetValues {
+		return provider.GetStepValues(stepNames, prov.values[:]), nil
+	}
+
+	if action == provider.ConfigureSetValue {
+		stepIdx := provider.FindStep(step, stepNames, stepPid)
+		if stepIdx < 0 {
+			return nil, provider.ErrInvalidConfigurationStep
+		}
+
+		for _, value := range step.Values {
+			if !prov.checkValue(stepIdx, value) {
+				return []*provider.ConfigurationStep{step}, provider.ErrInvalidConfigurationValue
+			}
+		}
+
+		prov.values[stepIdx] = provider.AppendUnique(prov.values[stepIdx], step.Values...)
+	}
+
+	return prov.getOptions(), nil
+}
+
+func (prov *PerfStatProvider) checkValue(stepIdx int, value string) bool {
+	switch stepIdx {
+	case stepPid:
+		pid, err := strconv.ParseUint(value, 10, 32)
+		return err == nil && pid > 0
+	case stepTid:
+		if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+			return false
+		}
+
+		// Thread should belong to one of the selected processes
+		return len(prov.findThreadProcess(value)) > 0
+	}
+	return false
+}
+
+// Returns pid of selected process which owns thread or empty string
+func (prov *PerfStatProvider) findThreadProcess(tid string) string {
+	for _, pid := range prov.values[stepPid] {
+		if _, err := os.Stat(filepath.Join(procPath, pid, "task", tid)); err == nil {
+			return pid
+		}
+	}
+	return ""
+}
+
+// Returns all steps in order they should be configured. Only threads of
+// selected processes are suggested as values
+func (prov *PerfStatProvider) getOptions() []*provider.ConfigurationStep {
+	steps := provider.NewSteps(stepNames)
+
+	for _, pid := range prov.values[stepPid] {
+		for _, tid := range listThreads(pid) {
+			tidStr := strconv.Itoa(tid)
+			if !provider.HasValue(prov.values[stepTid], tidStr) {
+				steps[stepTid].Values = append(steps[stepTid].Values, tidStr)
+			}
+		}
+	}
+
+	return steps
+}
+
+func (prov *PerfStatProvider) Prepare(handle *provider.OutputHandle) (err error) {
+	prov.attrFlags = 0
+	prov.accessDenied = false
+	prov.targets = nil
+	prov.lastTime = time.Time{}
+
+	if len(prov.values[stepPid]) == 0 {
+		cpus, err := readCPUList()
+		if err != nil {
+			return err
+		}
+
+		target := &perfTarget{pid: -1, tid: -1, tasks: make(map[int]*perfTask)}
+		for _, cpu := range cpus {
+			target.openTask(prov, handle, -1, cpu)
+		}
+		prov.targets = append(prov.targets, target)
+	}
+
+	for _, pidStr := range prov.values[stepPid] {
+		pid, _ := strconv.Atoi(pidStr)
+		target := &perfTarget{pid: int32(pid), tasks: make(map[int]*perfTask)}
+		target.refreshThreads(prov, handle)
+		prov.targets = append(prov.targets, target)
+	}
+
+	// Selected threads have separate counters and entries in addition to
+	// process-wide entries
+	for _, tidStr := range prov.values[stepTid] {
+		pid, _ := strconv.Atoi(prov.findThreadProcess(tidStr))
+		tid, _ := strconv.Atoi(tidStr)
+
+		target := &perfTarget{pid: int32(pid), tid: int32(tid), tasks: make(map[int]*perfTask)}
+		target.openTask(prov, handle, tid, -1)
+		prov.targets = append(prov.targets, target)
+	}
+
+	schema, err := tsfile.NewStructSchema(reflect.TypeOf(perfStatEntry{}))
+	if err == nil {
+		schema, err = tsfile.NewSchema("perfstat", schema.Fields)
+	}
+	if err == nil {
+		prov.traceTag, err = handle.Trace.AddSchema(schema)
+	}
+	if err != nil {
+		prov.Finalize(handle)
+	}
+	return
+}
+
+func (prov *PerfStatProvider) Finalize(handle *provider.OutputHandle) {
+	for _, target := range prov.targets {
+		for id, task := range target.tasks {
+			task.close()
+			delete(target.tasks, id)
+		}
+	}
+	prov.targets = nil
+}
+
+func (prov *PerfStatProvider) Collect(handle *provider.OutputHandle) {
+	now := handle.Now
+	timeDelta := now.Sub(prov.lastTime)
+
+	var entries []perfStatEntry
+	for _, target := range prov.targets {
+		if target.pid > 0 && target.tid == 0 {
+			target.refreshThreads(prov, handle)
+		}
+
+		values := target.readValues()
+		if !prov.lastTime.IsZero() && len(target.tasks) > 0 {
+			entry := perfStatEntry{
+				Start: tsfile.TSTimeStart(prov.lastTime.UnixNano() - handle.GlobalTime),
+				End:   tsfile.TSTimeEnd(now.UnixNano() - handle.GlobalTime),
+				PID:   target.pid,
+				TID:   target.tid,
+			}
+			entry.TaskClock = provider.NormalizeRate(int64(values[counterTaskClock]-
+				target.lastValues[counterTaskClock]), timeDelta)
+			entry.ContextSwitches = provider.NormalizeRate(int64(values[counterContextSwitches]-
+				target.lastValues[counterContextSwitches]), timeDelta)
+			entry.CPUMigrations = provider.NormalizeRate(int64(values[counterCPUMigrations]-
+				target.lastValues[counterCPUMigrations]), timeDelta)
+			entry.PageFaults = provider.NormalizeRate(int64(values[counterPageFaults]-
+				target.lastValues[counterPageFaults]), timeDelta)
+			entries = append(entries, entry)
+		}
+		target.lastValues = values
+	}
+
+	if len(entries) > 0 {
+		err := handle.Trace.AddEntries(prov.traceTag, entries)
+		if err != nil {
+			handle.Log.Println(err)
+		}
+	}
+
+	prov.lastTime = now
+}
+
+// Opens counters for threads of the process which were created since last
+// refresh and closes counters of exited threads
+func (target *perfTarget) refreshThreads(prov *PerfStatProvider, handle *provider.OutputHandle) {
+	tids := make(map[int]bool)
+	for _, tid := range listThreads(strconv.Itoa(int(target.pid))) {
+		tids[tid] = true
+		if _, ok := target.tasks[tid]; !ok {
+			target.openTask(prov, handle, tid, -1)
+		}
+	}
+
+	for tid, task := range target.tasks {
+		if tids[tid] {
+			continue
+		}
+
+		// Counters of exited thread are still readable
+		values := task.read()
+		for counter := range target.exited {
+			target.exited[counter] += values[counter]
+		}
+		task.close()
+		delete(target.tasks, tid)
+	}
+}
+
+// Opens all counters for the thread or cpu. If access to counters is
+// denied, target is left without task, but provider still runs
+func (target *perfTarget) openTask(prov *PerfStatProvider, handle *provider.OutputHandle,
+	tid, cpu int) {
+
+	task := new(perfTask)
+	for counter := range task.fds {
+		task.fds[counter] = -1
+	}
+
+	id := tid
+	if tid < 0 {
+		id = cpu
+	}
+
+	for counter, config := range counterConfigs {
+		if tid < 0 && config == perfCountSWTaskClock {
+			config = perfCountSWCPUClock
+		}
+
+		fd, err := prov.openCounter(config, tid, cpu)
+		if err != nil {
+			task.close()
+			prov.logOpenError(handle, tid, cpu, err)
+			return
+		}
+		task.fds[counter] = fd
+	}
+
+	target.tasks[id] = task
+}
+
+// Opens counter, if kernel profiling is not allowed by perf_event_paranoid,
+// retries without counting kernel activity
+func (prov *PerfStatProvider) openCounter(config uint64, tid, cpu int) (int, error) {
+	fd, err := perfEventOpen(config, prov.attrFlags, tid, cpu)
+	if (err == syscall.EACCES || err == syscall.EPERM) && prov.attrFlags == 0 {
+		fd, err = perfEventOpen(config, perfAttrFlagExcludeKernel|perfAttrFlagExcludeHV, tid, cpu)
+		if err == nil {
+			prov.attrFlags = perfAttrFlagExcludeKernel | perfAttrFlagExcludeHV
+		}
+	}
+	return fd, err
+}
+
+func (prov *PerfStatProvider) logOpenError(handle *provider.OutputHandle, tid, cpu int, err error) {
+	if err == syscall.ESRCH {
+		// Thread exited before we opened counters for it
+		return
+	}
+
+	if err == syscall.EACCES || err == syscall.EPERM {
+		if prov.accessDenied {
+			return
+		}
+		prov.accessDenied = true
+
+		paranoid, _ := ioutil.ReadFile(perfParanoidPath)
+		handle.Log.Printf("Access to perf_event is denied (perf_event_paranoid is %s), "+
+			"counters of some tasks are not collected", strings.TrimSpace(string(paranoid)))
+		return
+	}
+
+	if tid < 0 {
+		handle.LogLimited("Cannot open perf_event counters for cpu %d: %v", cpu, err)
+	} else {
+		handle.LogLimited("Cannot open perf_event counters for thread %d: %v", tid, err)
+	}
+}
+
+// Returns sum of the counters of all tasks including exited ones
+func (target *perfTarget) readValues() (values [counterCount]uint64) {
+	values = target.exited
+	for _, task := range target.tasks {
+		taskValues := task.read()
+		for counter := range values {
+			values[counter] += taskValues[counter]
+		}
+	}
+	return
+}
+
+func (task *perfTask) read() (values [counterCount]uint64) {
+	var buf [8]byte
+	for counter, fd := range task.fds {
+		if fd < 0 {
+			continue
+		}
+
+		n, err := syscall.Read(fd, buf[:])
+		if err == nil && n == len(buf) {
+			values[counter] = binary.LittleEndian.Uint64(buf[:])
+		}
+	}
+	return
+}
+
+func (task *perfTask) close() {
+	for counter, fd := range task.fds {
+		if fd >= 0 {
+			syscall.Close(fd)
+			task.fds[counter] = -1
+		}
+	}
+}
+
+// Opens software counter for the thread (tid >= 0, cpu = -1) or for all
+// tasks running on cpu (tid = -1, cpu >= 0)
+func perfEventOpen(config, flags uint64, tid, cpu int) (int, error) {
+	attr := perfEventAttr{
+		Type:   perfTypeSoftware,
+		Config: config,
+		Flags:  flags,
+	}
+	attr.Size = uint32(unsafe.Sizeof(attr))
+
+	fd, _, errno := syscall.Syscall6(syscall.SYS_PERF_EVENT_OPEN,
+		uintptr(unsafe.Pointer(&attr)), uintptr(tid), uintptr(cpu),
+		^uintptr(0), perfFlagFDCloexec, 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// Returns sorted thread ids of the process
+func listThreads(pid string) (tids []int) {
+	taskDirs, err := ioutil.ReadDir(filepath.Join(procPath, pid, "task"))
+	if err != nil {
+		return
+	}
+
+	for _, taskDir := range taskDirs {
+		if tid, err := strconv.Atoi(taskDir.Name()); err == nil {
+			tids = append(tids, tid)
+		}
+	}
+	sort.Ints(tids)
+	return
+}
+
+func readCPUList() ([]int, error) {
+	data, err := ioutil.ReadFile(cpuOnline)
+	if err != nil {
+		return nil, err
+	}
+	return parseCPUList(strings.TrimSpace(string(data)))
+}
+
+// Parses list of cpus in format "0-3,5"
+func parseCPUList(list string) (cpus []int, err error) {
+	for _, item := range strings.Split(list, ",") {
+		bounds := strings.SplitN(item, "-", 2)
+
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cpu list '%s'", list)
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil || last < first {
+				return nil, fmt.Errorf("Invalid cpu list '%s'", list)
+			}
+		}
+
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return
+}
+
+// Factory creating perfstat provider
+func Create() provider.Provider {
+	return new(PerfStatProvider)
+}
+
+func init() {
+	provider.Register("perfstat", Create, provider.Info{
+		Description: "Software perf_event counters of processes, threads or whole system",
+		OS:          []string{"linux"},
+		Steps:       stepNames,
+	})
+}
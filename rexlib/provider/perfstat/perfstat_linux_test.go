@@ -0,0 +1,100 @@
+package perfstat
+
+import (
+	"log"
+	"os"
+
+	"bytes"
+	"strconv"
+	"time"
+
+	"testing"
+
+	"rexlib/provider"
+	"rexlib/provider/providertest"
+)
+
+func TestParseCPUList(t *testing.T) {
+	cpus, err := parseCPUList("0-3,5,7-8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cpus) != 7 || cpus[3] != 3 || cpus[4] != 5 || cpus[6] != 8 {
+		t.Errorf("Unexpected cpus: %v", cpus)
+	}
+
+	for _, list := range []string{"", "0-", "3-1", "a"} {
+		if _, err := parseCPUList(list); err == nil {
+			t.Errorf("Invalid cpu list '%s' is parsed", list)
+		}
+	}
+}
+
+func TestPerfStatConfigure(t *testing.T) {
+	prov := new(PerfStatProvider)
+	pid := strconv.Itoa(os.Getpid())
+
+	_, err := prov.Configure(provider.ConfigureSetValue,
+		&provider.ConfigurationStep{Name: "tid", Values: []string{pid}})
+	if err != provider.ErrInvalidConfigurationValue {
+		t.Errorf("Thread is accepted without process: %v", err)
+	}
+
+	steps, err := prov.Configure(provider.ConfigureSetValue,
+		&provider.ConfigurationStep{Values: []string{pid}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 2 || !provider.HasValue(steps[1].Values, pid) {
+		t.Errorf("Unexpected options: %v", steps)
+	}
+
+	_, err = prov.Configure(provider.ConfigureSetValue,
+		&provider.ConfigurationStep{Name: "tid", Values: []string{pid}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps, _ = prov.Configure(provider.ConfigureGetValues, nil)
+	if len(steps) != 2 || steps[0].Name != "pid" || steps[1].Values[0] != pid {
+		t.Errorf("Unexpected configuration: %v", steps)
+	}
+}
+
+func TestPerfStatCollect(t *testing.T) {
+	handle := providertest.NewOutputHandle(t, "perfstat")
+	tsf := handle.Trace
+
+	prov := new(PerfStatProvider)
+	_, err := prov.Configure(provider.ConfigureSetValue,
+		&provider.ConfigurationStep{Name: "pid", Values: []string{strconv.Itoa(os.Getpid())}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logBuf bytes.Buffer
+	now := handle.Now
+	handle.Log = log.New(&logBuf, "perfstat: ", 0)
+	if err := prov.Prepare(handle); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		handle.Now = now.Add(time.Duration(i) * time.Second)
+		prov.Collect(handle)
+	}
+	prov.Finalize(handle)
+
+	// Access to perf_event may be denied, but provider should still work
+	if prov.accessDenied {
+		t.Skipf("Access to perf_event is denied: %s", logBuf.String())
+	}
+
+	entries := make([]perfStatEntry, 2)
+	if err := tsf.GetEntries(prov.traceTag, entries, 0); err != nil {
+		t.Fatal(err)
+	}
+	if entries[0].PID != int32(os.Getpid()) || entries[0].TID != 0 || entries[0].TaskClock <= 0 {
+		t.Errorf("Unexpected entry: %+v", entries[0])
+	}
+}
@@ -0,0 +1,387 @@
+package procstat
+
+import (
+	"fmt"
+	"os"
+
+	"io/ioutil"
+	"path/filepath"
+
+	"sort"
+	"strconv"
+	"strings"
+
+	"time"
+
+	"reflect"
+
+	"rexlib/hostinfo"
+	"rexlib/provider"
+	"tsfile"
+)
+
+const (
+	procPath = "/proc"
+
+	// Maximum length of the process name (TASK_COMM_LEN - 1)
+	maxExecNameLength = 15
+)
+
+// Configuration steps. Processes are selected by pids, execnames or cgroups,
+// threads are selected by tids, but only for processes with known pids.
+// Order of the steps is also a guide for reordering them
+const (
+	stepPid = iota
+	stepTid
+	stepExecName
+	stepCGroup
+
+	stepCount
+)
+
+var stepNames = []string{"pid", "tid", "execname", "cgroup"}
+
+// Entries of procstat series. Memory stats are current, other stats are
+// normalized to per-second values (nanoseconds per second for CPU time)
+type procStatEntry struct {
+	Start tsfile.TSTimeStart
+	End   tsfile.TSTimeEnd
+
+	PID      int32
+	ExecName tsfile.TSVarString
+
+	RSS, VSZ int64
+
+	RChar, WChar int64
+
+	MinFault, MajFault int64
+	VCS, IVCS          int64
+	UTime, STime       int64
+}
+
+// Entries of threadstat series written for each selected thread
+type threadStatEntry struct {
+	Start tsfile.TSTimeStart
+	End   tsfile.TSTimeEnd
+
+	PID, TID int32
+	Name     tsfile.TSVarString
+
+	MinFault, MajFault int64
+	VCS, IVCS          int64
+	UTime, STime       int64
+}
+
+// Snapshot of absolute counters of the process
+type procSnapshot struct {
+	rChar, wChar int64
+
+	// Process-wide counters and context switches of threads which already
+	// exited, so sum of context switches doesn't decrease
+	counters hostinfo.HIThreadCounters
+	exited   hostinfo.HIThreadCounters
+
+	threads map[uint32]hostinfo.HIThreadCounters
+}
+
+type ProcStatProvider struct {
+	// Configured values of steps as they were passed by user
+	values [stepCount][]string
+
+	// Sets of selected processes and threads built by Prepare()
+	pids      map[uint32]bool
+	tids      map[uint32]bool
+	execNames map[string]bool
+
+	prober *hostinfo.HIProcessProber
+
+	// IDs of the corresponding schemas
+	procTag, threadTag tsfile.TSFPageTag
+
+	// Last snapshot of selected processes
+	lastSnap map[uint32]*procSnapshot
+	lastTime time.Time
+}
+
+func (prov *ProcStatProvider) Configure(action provider.ConfigurationAction,
+	step *provider.ConfigurationStep) ([]*provider.ConfigurationStep, error) {
+
+	// Get current configuration
+	if action == provider.ConfigureGetValues {
+		return provider.GetStepValues(stepNames, prov.values[:]), nil
+	}
+
+	if action == provider.ConfigureSetValue {
+		stepIdx := provider.FindStep(step, stepNames, stepPid)
+		if stepIdx < 0 {
+			return nil, provider.ErrInvalidConfigurationStep
+		}
+
+		for _, value := range step.Values {
+			if !prov.checkValue(stepIdx, value) {
+				return []*provider.ConfigurationStep{step}, provider.ErrInvalidConfigurationValue
+			}
+		}
+
+		prov.values[stepIdx] = provider.AppendUnique(prov.values[stepIdx], step.Values...)
+	}
+
+	return prov.getOptions(), nil
+}
+
+func (prov *ProcStatProvider) checkValue(stepIdx int, value string) bool {
+	switch stepIdx {
+	case stepPid:
+		pid, err := strconv.ParseUint(value, 10, 32)
+		return err == nil && pid > 0
+	case stepTid:
+		if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+			return false
+		}
+
+		// Thread should belong to one of the selected processes
+		for _, pid := range prov.values[stepPid] {
+			if _, err := os.Stat(filepath.Join(procPath, pid, "task", value)); err == nil {
+				return true
+			}
+		}
+		return false
+	case stepExecName:
+		return len(value) > 0 && len(value) <= maxExecNameLength
+	case stepCGroup:
+		return strings.HasPrefix(value, "/")
+	}
+	return false
+}
+
+// Returns all steps in order they should be configured. Only threads of
+// selected processes are suggested as values
+func (prov *ProcStatProvider) getOptions() []*provider.ConfigurationStep {
+	steps := provider.NewSteps(stepNames)
+
+	for _, pid := range prov.values[stepPid] {
+		taskDirs, err := ioutil.ReadDir(filepath.Join(procPath, pid, "task"))
+		if err != nil {
+			continue
+		}
+
+		for _, taskDir := range taskDirs {
+			tid := taskDir.Name()
+			if !provider.HasValue(prov.values[stepTid], tid) {
+				steps[stepTid].Values = append(steps[stepTid].Values, tid)
+			}
+		}
+	}
+
+	return steps
+}
+
+func (prov *ProcStatProvider) Prepare(handle *provider.OutputHandle) (err error) {
+	if len(prov.values[stepPid]) == 0 && len(prov.values[stepExecName]) == 0 &&
+		len(prov.values[stepCGroup]) == 0 {
+		return fmt.Errorf("No processes are selected, specify pid, execname or cgroup")
+	}
+
+	prov.pids = parseIds(prov.values[stepPid])
+	prov.tids = parseIds(prov.values[stepTid])
+	prov.execNames = make(map[string]bool)
+	for _, execName := range prov.values[stepExecName] {
+		prov.execNames[execName] = true
+	}
+
+	prov.prober = new(hostinfo.HIProcessProber)
+	prov.lastSnap = nil
+
+	prov.procTag, err = addSchema(handle, "procstat", reflect.TypeOf(procStatEntry{}))
+	if err == nil && len(prov.tids) > 0 {
+		prov.threadTag, err = addSchema(handle, "threadstat", reflect.TypeOf(threadStatEntry{}))
+	}
+	return
+}
+
+func (prov *ProcStatProvider) Finalize(handle *provider.OutputHandle) {
+
+}
+
+func (prov *ProcStatProvider) Collect(handle *provider.OutputHandle) {
+	nexus := &hostinfo.HIObject{Children: make(map[string]*hostinfo.HIObject)}
+	err := prov.prober.Probe(nexus)
+	if err != nil {
+		handle.LogLimited("%v", err)
+		return
+	}
+
+	now := handle.Now
+	timeDelta := now.Sub(prov.lastTime)
+	start := tsfile.TSTimeStart(prov.lastTime.UnixNano() - handle.GlobalTime)
+	end := tsfile.TSTimeEnd(now.UnixNano() - handle.GlobalTime)
+
+	snap := make(map[uint32]*procSnapshot)
+	var procEntries []procStatEntry
+	var threadEntries []threadStatEntry
+
+	for _, procObj := range nexus.Children {
+		pi := procObj.Object.(*hostinfo.HIProcInfo)
+		if pi.PID == 0 || !prov.matchProcess(pi) {
+			continue
+		}
+
+		ps := &procSnapshot{
+			counters: pi.Counters(),
+			threads:  make(map[uint32]hostinfo.HIThreadCounters),
+		}
+		ps.rChar, ps.wChar = pi.IOCounters()
+		snap[pi.PID] = ps
+
+		// Statistics are computed as difference between snapshots, so
+		// processes which weren't seen earlier are only saved in snapshot.
+		// Threads which were created after last snapshot are accounted
+		// since their start
+		prevPs, ok := prov.lastSnap[pi.PID]
+		for _, threadObj := range procObj.Children {
+			ti := threadObj.Object.(*hostinfo.HIThreadInfo)
+			counters := ti.Counters()
+			ps.threads[ti.TID] = counters
+			ps.counters.VCS += counters.VCS
+			ps.counters.IVCS += counters.IVCS
+
+			if ok && prov.tids[ti.TID] {
+				delta := subCounters(counters, prevPs.threads[ti.TID])
+				entry := threadStatEntry{
+					Start: start,
+					End:   end,
+					PID:   int32(pi.PID),
+					TID:   int32(ti.TID),
+					Name:  tsfile.TSVarString(ti.Name),
+				}
+				entry.MinFault, entry.MajFault, entry.VCS, entry.IVCS,
+					entry.UTime, entry.STime = normalizeCounters(delta, timeDelta)
+				threadEntries = append(threadEntries, entry)
+			}
+		}
+		if !ok {
+			continue
+		}
+
+		// Context switches of the process are sums of thread counters, so
+		// counters of threads which exited since last snapshot are carried
+		// forward. Their switches after last snapshot are lost though
+		ps.exited = prevPs.exited
+		for tid, counters := range prevPs.threads {
+			if _, alive := ps.threads[tid]; !alive {
+				ps.exited.VCS += counters.VCS
+				ps.exited.IVCS += counters.IVCS
+			}
+		}
+		ps.counters.VCS += ps.exited.VCS
+		ps.counters.IVCS += ps.exited.IVCS
+
+		entry := procStatEntry{
+			Start:    start,
+			End:      end,
+			PID:      int32(pi.PID),
+			ExecName: tsfile.TSVarString(pi.ExecName),
+			RSS:      int64(pi.RSS),
+			VSZ:      int64(pi.VSZ),
+			RChar:    provider.NormalizeRate(ps.rChar-prevPs.rChar, timeDelta),
+			WChar:    provider.NormalizeRate(ps.wChar-prevPs.wChar, timeDelta),
+		}
+		entry.MinFault, entry.MajFault, entry.VCS, entry.IVCS,
+			entry.UTime, entry.STime = normalizeCounters(
+			subCounters(ps.counters, prevPs.counters), timeDelta)
+		procEntries = append(procEntries, entry)
+	}
+
+	// Order of processes in nexus is random, keep entries sorted by ids
+	sort.Slice(procEntries, func(i, j int) bool {
+		return procEntries[i].PID < procEntries[j].PID
+	})
+	sort.Slice(threadEntries, func(i, j int) bool {
+		return threadEntries[i].TID < threadEntries[j].TID
+	})
+
+	if len(procEntries) > 0 {
+		err = handle.Trace.AddEntries(prov.procTag, procEntries)
+	}
+	if err == nil && len(threadEntries) > 0 {
+		err = handle.Trace.AddEntries(prov.threadTag, threadEntries)
+	}
+	if err != nil {
+		handle.Log.Println(err)
+	}
+
+	prov.lastSnap = snap
+	prov.lastTime = now
+}
+
+// Returns true if process is selected by any of pid, execname or cgroup steps
+func (prov *ProcStatProvider) matchProcess(pi *hostinfo.HIProcInfo) bool {
+	if prov.pids[pi.PID] || prov.execNames[pi.ExecName] {
+		return true
+	}
+
+	for _, cgroup := range prov.values[stepCGroup] {
+		cgroup = strings.TrimSuffix(cgroup, "/")
+		for _, path := range pi.CGroups {
+			if path == cgroup || strings.HasPrefix(path, cgroup+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func addSchema(handle *provider.OutputHandle, name string, entryType reflect.Type) (
+	tsfile.TSFPageTag, error) {
+	// Struct schema is named after go type, so re-create it with series name
+	schema, err := tsfile.NewStructSchema(entryType)
+	if err == nil {
+		schema, err = tsfile.NewSchema(name, schema.Fields)
+	}
+	if err != nil {
+		return tsfile.TSFPageTag(0), err
+	}
+
+	return handle.Trace.AddSchema(schema)
+}
+
+func parseIds(values []string) map[uint32]bool {
+	ids := make(map[uint32]bool)
+	for _, value := range values {
+		// Values are already checked in Configure()
+		id, _ := strconv.ParseUint(value, 10, 32)
+		ids[uint32(id)] = true
+	}
+	return ids
+}
+
+func subCounters(c1, c2 hostinfo.HIThreadCounters) hostinfo.HIThreadCounters {
+	return hostinfo.HIThreadCounters{
+		VCS:      c1.VCS - c2.VCS,
+		IVCS:     c1.IVCS - c2.IVCS,
+		MinFault: c1.MinFault - c2.MinFault,
+		MajFault: c1.MajFault - c2.MajFault,
+		UTime:    c1.UTime - c2.UTime,
+		STime:    c1.STime - c2.STime,
+	}
+}
+
+func normalizeCounters(c hostinfo.HIThreadCounters, dt time.Duration) (
+	minFault, majFault, vcs, ivcs, uTime, sTime int64) {
+	return provider.NormalizeRate(c.MinFault, dt), provider.NormalizeRate(c.MajFault, dt),
+		provider.NormalizeRate(c.VCS, dt), provider.NormalizeRate(c.IVCS, dt),
+		provider.NormalizeRate(int64(c.UTime), dt), provider.NormalizeRate(int64(c.STime), dt)
+}
+
+// Factory creating procstat provider
+func Create() provider.Provider {
+	return new(ProcStatProvider)
+}
+
+func init() {
+	provider.Register("procstat", Create, provider.Info{
+		Description: "Per-process and per-thread memory, I/O, fault and CPU statistics from /proc",
+		OS:          []string{"linux"},
+		Steps:       stepNames,
+	})
+}
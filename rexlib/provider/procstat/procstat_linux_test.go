@@ -0,0 +1,164 @@
+package procstat
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+
+	"strconv"
+	"time"
+
+	"testing"
+
+	"rexlib/hostinfo"
+	"rexlib/provider"
+	"rexlib/provider/providertest"
+)
+
+func TestProcStatConfigure(t *testing.T) {
+	prov := new(ProcStatProvider)
+	pid := strconv.Itoa(os.Getpid())
+
+	// Threads can't be selected before process
+	_, err := prov.Configure(provider.ConfigureSetValue,
+		&provider.ConfigurationStep{Name: "tid", Values: []string{pid}})
+	if err != provider.ErrInvalidConfigurationValue {
+		t.Errorf("Unexpected error for tid without pid: %v", err)
+	}
+
+	steps, err := prov.Configure(provider.ConfigureSetValue,
+		&provider.ConfigurationStep{Values: []string{pid}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != stepCount || len(steps[stepTid].Values) == 0 {
+		t.Errorf("Threads of process are not suggested: %v", steps[stepTid])
+	}
+
+	_, err = prov.Configure(provider.ConfigureSetValue,
+		&provider.ConfigurationStep{Name: "tid", Values: []string{pid}})
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = prov.Configure(provider.ConfigureSetValue,
+		&provider.ConfigurationStep{Name: "cgroup", Values: []string{"user.slice"}})
+	if err != provider.ErrInvalidConfigurationValue {
+		t.Errorf("Unexpected error for relative cgroup: %v", err)
+	}
+	_, err = prov.Configure(provider.ConfigureSetValue,
+		&provider.ConfigurationStep{Name: "ppid", Values: []string{"1"}})
+	if err != provider.ErrInvalidConfigurationStep {
+		t.Errorf("Unexpected error for unknown step: %v", err)
+	}
+
+	steps, _ = prov.Configure(provider.ConfigureGetValues, nil)
+	if len(steps) != 2 || steps[0].Name != "pid" || steps[1].Name != "tid" {
+		t.Errorf("Unexpected configuration: %v", steps)
+	}
+}
+
+func TestProcStatMatchCGroup(t *testing.T) {
+	prov := new(ProcStatProvider)
+	prov.values[stepCGroup] = []string{"/system.slice/"}
+
+	pi := &hostinfo.HIProcInfo{CGroups: map[string]string{
+		"":    "/system.slice/sshd.service",
+		"cpu": "/",
+	}}
+	if !prov.matchProcess(pi) {
+		t.Error("Process in child cgroup is not matched")
+	}
+
+	pi.CGroups[""] = "/system.slice-other"
+	if prov.matchProcess(pi) {
+		t.Error("Process in sibling cgroup is matched")
+	}
+}
+
+func TestProcStatCollect(t *testing.T) {
+	handle := providertest.NewOutputHandle(t, "procstat")
+	tsf := handle.Trace
+
+	prov := new(ProcStatProvider)
+	pid := strconv.Itoa(os.Getpid())
+	prov.Configure(provider.ConfigureSetValue,
+		&provider.ConfigurationStep{Name: "pid", Values: []string{pid}})
+	prov.Configure(provider.ConfigureSetValue,
+		&provider.ConfigurationStep{Name: "tid", Values: []string{pid}})
+
+	now := handle.Now
+	if err := prov.Prepare(handle); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		handle.Now = now.Add(time.Duration(i) * time.Second)
+		prov.Collect(handle)
+	}
+	prov.Finalize(handle)
+
+	stats := tsf.GetStats()
+	if len(stats.Series) != 2 {
+		t.Fatalf("Unexpected series: %v", stats.Series)
+	}
+	for _, series := range stats.Series {
+		if series.Count != 2 {
+			t.Errorf("Unexpected number of entries in %s: %d", series.Name, series.Count)
+		}
+	}
+
+	entries := make([]procStatEntry, 1)
+	if err := tsf.GetEntries(prov.procTag, entries, 0); err != nil {
+		t.Fatal(err)
+	}
+	if entries[0].PID != int32(os.Getpid()) || entries[0].RSS == 0 {
+		t.Errorf("Unexpected entry: %v", entries[0])
+	}
+}
+
+func TestProcStatCollectExitedThread(t *testing.T) {
+	handle := providertest.NewOutputHandle(t, "procstat")
+
+	prov := new(ProcStatProvider)
+	prov.Configure(provider.ConfigureSetValue,
+		&provider.ConfigurationStep{Name: "pid", Values: []string{strconv.Itoa(os.Getpid())}})
+
+	now := handle.Now
+	if err := prov.Prepare(handle); err != nil {
+		t.Fatal(err)
+	}
+	prov.Collect(handle)
+
+	burnThread(300 * time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+
+	handle.Now = now.Add(time.Second)
+	prov.Collect(handle)
+	prov.Finalize(handle)
+
+	entries := make([]procStatEntry, 1)
+	if err := handle.Trace.GetEntries(prov.procTag, entries, 0); err != nil {
+		t.Fatal(err)
+	}
+	if cpuTime := time.Duration(entries[0].UTime + entries[0].STime); cpuTime < 200*time.Millisecond {
+		t.Errorf("CPU time of exited thread is not accounted: %v", cpuTime)
+	}
+}
+
+// Burns cpu in a thread which is terminated when locked goroutine exits. Main
+// thread is never terminated, so if goroutine got it, burn in another one
+func burnThread(d time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runtime.LockOSThread()
+		if syscall.Gettid() == os.Getpid() {
+			burnThread(d)
+			return
+		}
+
+		for start := time.Now(); time.Since(start) < d; {
+		}
+	}()
+	<-done
+}
@@ -2,19 +2,69 @@ package provider
 
 import (
 	"errors"
+	"fmt"
 	"log"
 
+	"runtime"
+	"sync"
 	"time"
 
 	"tsfile"
 )
 
+const (
+	// Interval during which repeated messages logged by LogLimited() from
+	// the same place are suppressed
+	logLimitInterval = time.Minute
+)
+
 type OutputHandle struct {
 	Trace *tsfile.TSFile
 	Log   *log.Logger
 
 	Now        time.Time
 	GlobalTime int64
+
+	// Times of last messages and number of suppressed messages keyed by
+	// callers of LogLimited()
+	logMu     sync.Mutex
+	logLimits map[uintptr]*logLimit
+}
+
+type logLimit struct {
+	lastTime   time.Time
+	suppressed int
+}
+
+// Logs message unless message from the same place was already logged during
+// last minute (i.e. errors which are repeated on every collection). Number
+// of suppressed messages is reported with the next logged message
+func (handle *OutputHandle) LogLimited(format string, v ...interface{}) {
+	pc, _, _, _ := runtime.Caller(1)
+
+	handle.logMu.Lock()
+	defer handle.logMu.Unlock()
+
+	if handle.logLimits == nil {
+		handle.logLimits = make(map[uintptr]*logLimit)
+	}
+	limit := handle.logLimits[pc]
+	if limit == nil {
+		limit = new(logLimit)
+		handle.logLimits[pc] = limit
+	} else if handle.Now.Sub(limit.lastTime) < logLimitInterval {
+		limit.suppressed++
+		return
+	}
+
+	msg := fmt.Sprintf(format, v...)
+	if limit.suppressed > 0 {
+		msg = fmt.Sprintf("%s (%d similar messages suppressed)", msg, limit.suppressed)
+	}
+	handle.Log.Print(msg)
+
+	limit.lastTime = handle.Now
+	limit.suppressed = 0
 }
 
 type ConfigurationAction int
@@ -114,6 +164,66 @@ func (step *ConfigurationStep) CheckValues() bool {
 	return len(step.Values) == 0
 }
 
+// Returns index of the step in the list of step names or -1 if step is
+// unknown. Anonymous values are attributed to the step with index defaultStep
+func FindStep(step *ConfigurationStep, names []string, defaultStep int) int {
+	for stepIdx, name := range names {
+		if step.CompareName(name) {
+			return stepIdx
+		}
+	}
+	if step.EnsureName(names[defaultStep]) {
+		return defaultStep
+	}
+	return -1
+}
+
+// Returns current configuration of provider as a list of steps which have
+// values. values are indexed by step index as names
+func GetStepValues(names []string, values [][]string) []*ConfigurationStep {
+	var steps []*ConfigurationStep
+	for stepIdx, name := range names {
+		if len(values[stepIdx]) == 0 {
+			continue
+		}
+
+		steps = append(steps, &ConfigurationStep{
+			Name:   name,
+			Values: values[stepIdx],
+		})
+	}
+	return steps
+}
+
+// Returns empty steps with specified names in order they should be configured
+func NewSteps(names []string) []*ConfigurationStep {
+	steps := make([]*ConfigurationStep, len(names))
+	for stepIdx, name := range names {
+		steps[stepIdx] = &ConfigurationStep{Name: name}
+	}
+	return steps
+}
+
+// Returns true if value is in the list of values
+func HasValue(values []string, value string) bool {
+	for _, item := range values {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Appends values which are not in the list of values yet
+func AppendUnique(values []string, newValues ...string) []string {
+	for _, value := range newValues {
+		if !HasValue(values, value) {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
 type Provider interface {
 	// Tries to configure provider and returns list of available
 	// options or error if step name is not valid. Step is only passed for
@@ -128,6 +238,16 @@ type Provider interface {
 	Collect(handle *OutputHandle)
 }
 
+// Converts increment of a cumulative counter collected during interval dt to
+// per-second rate. Increments may be large (i.e. CPU times in nanoseconds
+// summed over all CPUs), so floating point is used to avoid overflow
+func NormalizeRate(delta int64, dt time.Duration) int64 {
+	if dt < time.Microsecond {
+		return 0
+	}
+	return int64(float64(delta) * float64(time.Second) / float64(dt))
+}
+
 type ConfigurationState struct {
 	// -1 for new providers, >=0 for existing providers (as returned in
 	// IncidentProviderReply)
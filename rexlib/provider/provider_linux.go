@@ -0,0 +1,16 @@
+package provider
+
+import (
+	"time"
+
+	"rexlib/hostinfo/syscall"
+)
+
+// Number of jiffies (clock ticks) in a second used by CPU times in procfs
+var JiffiesPerSecond = int64(syscall.GetClkTck())
+
+// Converts CPU time in jiffies to duration. Times summed over many CPUs may
+// overflow when multiplied by a second, so floating point is used
+func JiffiesToDuration(jiffies int64) time.Duration {
+	return time.Duration(float64(jiffies) * float64(time.Second) / float64(JiffiesPerSecond))
+}
@@ -0,0 +1,18 @@
+package provider
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJiffiesToDuration(t *testing.T) {
+	// CPU time of 256 CPUs during 100 days overflows int64 in nanoseconds
+	// multiplied by a second
+	usage := 256 * 100 * 24 * time.Hour
+	if d := JiffiesToDuration(int64(usage/time.Second) * JiffiesPerSecond); d != usage {
+		t.Errorf("Unexpected CPU time: %v", d)
+	}
+	if d := JiffiesToDuration(JiffiesPerSecond / 2); d != time.Second/2 {
+		t.Errorf("Unexpected CPU time: %v", d)
+	}
+}
@@ -0,0 +1,84 @@
+package provider
+
+import (
+	"bytes"
+	"log"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStepHelpers(t *testing.T) {
+	names := []string{"pid", "tid"}
+	for _, tc := range []struct {
+		step     ConfigurationStep
+		expected int
+	}{
+		{ConfigurationStep{Name: "tid"}, 1},
+		{ConfigurationStep{}, 0},
+		{ConfigurationStep{Name: "cpu"}, -1},
+		{ConfigurationStep{NameSpace: "arg", Name: "pid"}, -1},
+	} {
+		if stepIdx := FindStep(&tc.step, names, 0); stepIdx != tc.expected {
+			t.Errorf("Unexpected index of step %v: %d", tc.step, stepIdx)
+		}
+	}
+
+	var values [2][]string
+	values[1] = AppendUnique(values[1], "10", "11", "10")
+	values[1] = AppendUnique(values[1], "11", "12")
+	if !reflect.DeepEqual(values[1], []string{"10", "11", "12"}) || !HasValue(values[1], "12") {
+		t.Errorf("Unexpected values: %v", values[1])
+	}
+
+	steps := GetStepValues(names, values[:])
+	if len(steps) != 1 || steps[0].Name != "tid" || len(steps[0].Values) != 3 {
+		t.Errorf("Unexpected configuration: %v", steps)
+	}
+	if steps = NewSteps(names); len(steps) != 2 || steps[1].Name != "tid" {
+		t.Errorf("Unexpected steps: %v", steps)
+	}
+}
+
+func TestNormalizeRate(t *testing.T) {
+	for _, tc := range []struct {
+		delta    int64
+		dt       time.Duration
+		expected int64
+	}{
+		{100, time.Second, 100},
+		{100, 2 * time.Second, 50},
+		{100, time.Nanosecond, 0},
+		// CPU time of 256 CPUs in nanoseconds collected over 60 seconds
+		// overflows int64 when multiplied by a second
+		{256 * 60 * int64(time.Second), 60 * time.Second, 256 * int64(time.Second)},
+		{math.MaxInt64 / 2, 10 * time.Second, math.MaxInt64 / 20},
+	} {
+		rate := NormalizeRate(tc.delta, tc.dt)
+		if math.Abs(float64(rate-tc.expected)) > float64(tc.expected)*1e-9 {
+			t.Errorf("Unexpected rate of %d over %v: %d, expected %d",
+				tc.delta, tc.dt, rate, tc.expected)
+		}
+	}
+}
+
+func TestLogLimited(t *testing.T) {
+	buf := new(bytes.Buffer)
+	handle := &OutputHandle{Log: log.New(buf, "", 0), Now: time.Now()}
+
+	for i := 0; i < 4; i++ {
+		if i == 3 {
+			handle.Now = handle.Now.Add(time.Minute)
+		}
+		handle.LogLimited("Error %d", i)
+		if i == 0 {
+			handle.LogLimited("Other error")
+		}
+	}
+
+	expected := "Error 0\nOther error\nError 3 (2 similar messages suppressed)\n"
+	if buf.String() != expected {
+		t.Errorf("Unexpected log: %q", buf.String())
+	}
+}
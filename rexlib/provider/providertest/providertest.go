@@ -0,0 +1,44 @@
+package providertest
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+
+	"testing"
+	"time"
+
+	"rexlib/provider"
+	"tsfile"
+)
+
+// Helpers for tests of providers
+
+// Creates output handle with trace in a temporary file which is closed and
+// removed when test completes. Log messages are prefixed with name of
+// the provider, time fields may be overridden by the test
+func NewOutputHandle(t *testing.T, name string) *provider.OutputHandle {
+	f, err := ioutil.TempFile("", name+"test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tsf, err := tsfile.NewTSFile(f, tsfile.TSFFormatV3|tsfile.TSFFormatExt)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		tsf.Put()
+		os.Remove(f.Name())
+	})
+
+	now := time.Now()
+	return &provider.OutputHandle{
+		Trace:      tsf,
+		Log:        log.New(os.Stderr, name+": ", log.LstdFlags),
+		Now:        now,
+		GlobalTime: now.UnixNano(),
+	}
+}
@@ -0,0 +1,120 @@
+package provider
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// Registry of providers. Providers register themselves with Register() in
+// init() of their packages, so linking package of a provider into binary
+// (i.e. by blank import) is enough to make it available in incidents.
+
+// Creates new instance of provider
+type Factory func() Provider
+
+// Metadata of registered provider
+type Info struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+
+	// Operating systems supported by provider (as in runtime.GOOS). If
+	// empty, provider is supported by all systems
+	OS []string `json:"os"`
+
+	// Names of the configuration steps accepted by provider
+	Steps []string `json:"steps"`
+}
+
+type registeredProvider struct {
+	info    Info
+	factory Factory
+}
+
+var registryMu sync.RWMutex
+var registry = make(map[string]*registeredProvider)
+
+// Registers provider factory with the specified name. Panics if provider
+// with such name is already registered
+func Register(name string, factory Factory, info Info) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic("provider: Register factory is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic("provider: Register called twice for provider " + name)
+	}
+
+	info.Name = name
+	registry[name] = &registeredProvider{info: info, factory: factory}
+}
+
+// Removes providers from registry, only used by tests
+func unregister(names ...string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	for _, name := range names {
+		delete(registry, name)
+	}
+}
+
+// Creates instance of registered provider
+func Create(name string) (Provider, error) {
+	registryMu.RLock()
+	prov, ok := registry[name]
+	registryMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown provider '%s'", name)
+	}
+	if !prov.info.IsSupported() {
+		return nil, fmt.Errorf("Provider '%s' is not supported on %s", name, runtime.GOOS)
+	}
+
+	return prov.factory(), nil
+}
+
+// Returns metadata of registered provider
+func Lookup(name string) (Info, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	prov, ok := registry[name]
+	if !ok {
+		return Info{}, false
+	}
+	return prov.info, true
+}
+
+// Returns metadata of all registered providers sorted by name
+func List() []Info {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	infos := make([]Info, 0, len(registry))
+	for _, prov := range registry {
+		infos = append(infos, prov.info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// Returns true if provider supports current operating system
+func (info *Info) IsSupported() bool {
+	if len(info.OS) == 0 {
+		return true
+	}
+	for _, os := range info.OS {
+		if os == runtime.GOOS {
+			return true
+		}
+	}
+	return false
+}
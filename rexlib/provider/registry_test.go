@@ -0,0 +1,58 @@
+package provider
+
+import (
+	"runtime"
+	"testing"
+)
+
+type dummyProvider struct {
+}
+
+func (prov *dummyProvider) Configure(action ConfigurationAction,
+	step *ConfigurationStep) ([]*ConfigurationStep, error) {
+	return nil, nil
+}
+func (prov *dummyProvider) Prepare(handle *OutputHandle) error { return nil }
+func (prov *dummyProvider) Finalize(handle *OutputHandle)      {}
+func (prov *dummyProvider) Collect(handle *OutputHandle)       {}
+
+func TestRegistry(t *testing.T) {
+	factory := func() Provider { return new(dummyProvider) }
+	defer unregister("dummy", "dummy-other-os")
+
+	Register("dummy", factory, Info{
+		Description: "Dummy provider",
+		Steps:       []string{"value"},
+	})
+	Register("dummy-other-os", factory, Info{
+		OS: []string{"no-" + runtime.GOOS},
+	})
+
+	info, ok := Lookup("dummy")
+	if !ok || info.Name != "dummy" || len(info.Steps) != 1 {
+		t.Errorf("Unexpected provider info: %v", info)
+	}
+	if infos := List(); len(infos) != 2 || infos[0].Name != "dummy" {
+		t.Errorf("Unexpected list of providers: %v", infos)
+	}
+
+	prov, err := Create("dummy")
+	if err != nil || prov == nil {
+		t.Errorf("Cannot create provider: %v", err)
+	}
+	_, err = Create("dummy-other-os")
+	if err == nil {
+		t.Error("Provider for other OS is created")
+	}
+	_, err = Create("unknown")
+	if err == nil {
+		t.Error("Unknown provider is created")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Duplicate provider is registered")
+		}
+	}()
+	Register("dummy", factory, Info{})
+}
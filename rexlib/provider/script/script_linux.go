@@ -0,0 +1,525 @@
+package script
+
+import (
+	"fmt"
+
+	"bytes"
+	"os/exec"
+
+	"sort"
+	"strconv"
+	"strings"
+
+	"time"
+
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+
+	"rexlib/provider"
+	"tsfile"
+)
+
+// Runs command each N ticks and records values printed by it as entries of
+// "script" series. Command is run asynchronously by shell, so it doesn't
+// block collection of other providers, and its result is written by one of
+// the next Collect() calls. Output is either "key=value" pairs separated by
+// spaces or newlines, or JSON object which nested objects are flattened
+// with "." as a separator. If fields are not specified, schema is built from
+// the first successful sample
+
+// Configuration steps. Command, format, interval and timeout only take one
+// value. Fields are specified as name:type where type is one of int, float
+// or string
+const (
+	stepCommand = iota
+	stepFormat
+	stepField
+	stepInterval
+	stepTimeout
+
+	stepCount
+)
+
+var stepNames = []string{"command", "format", "field", "interval", "timeout"}
+
+const (
+	formatKeyValue = "kv"
+	formatJSON     = "json"
+
+	defaultInterval = 10
+	defaultTimeout  = 5 * time.Second
+
+	// Stderr of the failed command is cut in log message
+	maxErrorOutput = 256
+)
+
+var formats = []string{formatKeyValue, formatJSON}
+
+// Types of fields
+const (
+	fieldString = iota
+	fieldInt
+	fieldFloat
+)
+
+var fieldTypeNames = []string{"string", "int", "float"}
+
+// Value printed by command and its type detected from output
+type sampleValue struct {
+	text      string
+	fieldType int
+}
+
+// Keys in order they were printed and their values
+type sample struct {
+	keys   []string
+	values map[string]sampleValue
+}
+
+type scriptField struct {
+	name      string
+	fieldType int
+	offset    uint
+}
+
+// Result of a single run of the command
+type runResult struct {
+	start   time.Time
+	elapsed time.Duration
+
+	output []byte
+	err    error
+}
+
+type ScriptProvider struct {
+	// Configured values of steps as they were passed by user
+	values [stepCount][]string
+
+	interval int
+	timeout  time.Duration
+
+	// Fields of the schema, empty until schema is added
+	fields    []scriptField
+	entrySize int
+	traceTag  tsfile.TSFPageTag
+
+	tick int
+
+	// Channel receiving result of the running command and channel which
+	// is closed to kill it (nil if command is not running)
+	results chan runResult
+	stop    chan struct{}
+}
+
+func (prov *ScriptProvider) Configure(action provider.ConfigurationAction,
+	step *provider.ConfigurationStep) ([]*provider.ConfigurationStep, error) {
+
+	// Get current configuration
+	if action == provider.ConfigureGetValues {
+		return provider.GetStepValues(stepNames, prov.values[:]), nil
+	}
+
+	if action == provider.ConfigureSetValue {
+		stepIdx := provider.FindStep(step, stepNames, stepCommand)
+		if stepIdx < 0 {
+			return nil, provider.ErrInvalidConfigurationStep
+		}
+
+		if !checkValues(stepIdx, step.Values) {
+			return []*provider.ConfigurationStep{step}, provider.ErrInvalidConfigurationValue
+		}
+
+		if stepIdx == stepField {
+			for _, value := range step.Values {
+				prov.values[stepField] = appendField(prov.values[stepField], value)
+			}
+		} else {
+			prov.values[stepIdx] = step.Values
+		}
+	}
+
+	steps := provider.NewSteps(stepNames)
+	steps[stepFormat].Values = formats
+	return steps, nil
+}
+
+func checkValues(stepIdx int, values []string) bool {
+	if stepIdx == stepField {
+		for _, value := range values {
+			name, fieldType := parseFieldValue(value)
+			if len(name) == 0 || fieldType < 0 {
+				return false
+			}
+		}
+		return len(values) > 0
+	}
+	if len(values) != 1 {
+		return false
+	}
+
+	value := values[0]
+	switch stepIdx {
+	case stepCommand:
+		return len(strings.TrimSpace(value)) > 0
+	case stepFormat:
+		return value == formatKeyValue || value == formatJSON
+	case stepInterval:
+		interval, err := strconv.Atoi(value)
+		return err == nil && interval > 0
+	case stepTimeout:
+		timeout, err := time.ParseDuration(value)
+		return err == nil && timeout > 0
+	}
+	return false
+}
+
+// Parses field value in format name:type. Returns -1 as type if it is
+// not known
+func parseFieldValue(value string) (name string, fieldType int) {
+	name = value
+	typeName := fieldTypeNames[fieldString]
+	if index := strings.IndexByte(value, ':'); index >= 0 {
+		name, typeName = value[:index], value[index+1:]
+	}
+
+	for fieldType, fieldTypeName := range fieldTypeNames {
+		if typeName == fieldTypeName {
+			return name, fieldType
+		}
+	}
+	return name, -1
+}
+
+// Adds field value replacing previous value for the same field
+func appendField(values []string, value string) []string {
+	name, _ := parseFieldValue(value)
+	for index, item := range values {
+		if itemName, _ := parseFieldValue(item); itemName == name {
+			values[index] = value
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+func (prov *ScriptProvider) Prepare(handle *provider.OutputHandle) (err error) {
+	if len(prov.values[stepCommand]) == 0 {
+		return fmt.Errorf("Command should be specified")
+	}
+
+	// Values are already checked in Configure()
+	prov.interval = defaultInterval
+	if len(prov.values[stepInterval]) > 0 {
+		prov.interval, _ = strconv.Atoi(prov.values[stepInterval][0])
+	}
+	prov.timeout = defaultTimeout
+	if len(prov.values[stepTimeout]) > 0 {
+		prov.timeout, _ = time.ParseDuration(prov.values[stepTimeout][0])
+	}
+
+	prov.tick = 0
+	prov.fields = nil
+	prov.results = make(chan runResult, 1)
+	prov.stop = nil
+
+	if len(prov.values[stepField]) == 0 {
+		// Schema will be built from the first sample
+		return nil
+	}
+
+	var smpl sample
+	for _, value := range prov.values[stepField] {
+		name, fieldType := parseFieldValue(value)
+		smpl.keys = append(smpl.keys, name)
+		if smpl.values == nil {
+			smpl.values = make(map[string]sampleValue)
+		}
+		smpl.values[name] = sampleValue{fieldType: fieldType}
+	}
+	return prov.addSchema(handle, &smpl)
+}
+
+// Adds schema with fields for all keys of the sample
+func (prov *ScriptProvider) addSchema(handle *provider.OutputHandle, smpl *sample) error {
+	schemaFields := []tsfile.TSFSchemaField{
+		tsfile.NewStartTimeField(),
+		tsfile.NewEndTimeField(),
+	}
+
+	var fields []scriptField
+	for _, key := range smpl.keys {
+		field := scriptField{name: key, fieldType: smpl.values[key].fieldType}
+		switch field.fieldType {
+		case fieldInt:
+			schemaFields = append(schemaFields, tsfile.NewField(key, reflect.TypeOf(int64(0))))
+		case fieldFloat:
+			schemaFields = append(schemaFields, tsfile.NewField(key, reflect.TypeOf(float64(0))))
+		default:
+			schemaFields = append(schemaFields, tsfile.NewVarStringField(key))
+		}
+		fields = append(fields, field)
+	}
+
+	schema, err := tsfile.NewSchema("script", schemaFields)
+	if err != nil {
+		return err
+	}
+	for index := range fields {
+		fields[index].offset = uint(schema.Fields[index+2].Offset)
+	}
+
+	prov.traceTag, err = handle.Trace.AddSchema(schema)
+	if err != nil {
+		return err
+	}
+
+	prov.fields = fields
+	prov.entrySize = int(schema.EntrySize)
+	return nil
+}
+
+func (prov *ScriptProvider) Finalize(handle *provider.OutputHandle) {
+	if prov.stop != nil {
+		// Command is killed unless it has already finished, handle its
+		// result anyway, so failure is reported
+		close(prov.stop)
+		result := <-prov.results
+		prov.stop = nil
+		prov.handleResult(handle, &result)
+	}
+}
+
+func (prov *ScriptProvider) Collect(handle *provider.OutputHandle) {
+	if prov.stop != nil {
+		select {
+		case result := <-prov.results:
+			prov.stop = nil
+			prov.handleResult(handle, &result)
+		default:
+		}
+	}
+
+	if prov.tick%prov.interval == 0 {
+		if prov.stop == nil {
+			prov.run(handle.Now)
+		} else {
+			handle.LogLimited("Command '%s' is still running, skipping run",
+				prov.values[stepCommand][0])
+		}
+	}
+	prov.tick++
+}
+
+// Starts command in background, its result will be sent to results channel
+func (prov *ScriptProvider) run(start time.Time) {
+	stop := make(chan struct{})
+	prov.stop = stop
+
+	go func() {
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command("/bin/sh", "-c", prov.values[stepCommand][0])
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+
+		// Run command in its own process group, so children of shell
+		// are killed too and do not keep output pipes open
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+		runStart := time.Now()
+		err := cmd.Start()
+		if err == nil {
+			var timedOut int32
+			kill := func() {
+				syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			}
+			timer := time.AfterFunc(prov.timeout, func() {
+				atomic.StoreInt32(&timedOut, 1)
+				kill()
+			})
+
+			done := make(chan struct{})
+			go func() {
+				select {
+				case <-stop:
+					kill()
+				case <-done:
+				}
+			}()
+
+			err = cmd.Wait()
+			timer.Stop()
+			close(done)
+
+			if atomic.LoadInt32(&timedOut) != 0 {
+				err = fmt.Errorf("timed out after %v", prov.timeout)
+			}
+		}
+		if err != nil && stderr.Len() > 0 {
+			output := bytes.TrimSpace(stderr.Bytes())
+			if len(output) > maxErrorOutput {
+				output = output[:maxErrorOutput]
+			}
+			err = fmt.Errorf("%v: %s", err, output)
+		}
+
+		prov.results <- runResult{
+			start:   start,
+			elapsed: time.Since(runStart),
+			output:  stdout.Bytes(),
+			err:     err,
+		}
+	}()
+}
+
+func (prov *ScriptProvider) handleResult(handle *provider.OutputHandle, result *runResult) {
+	command := prov.values[stepCommand][0]
+	if result.err != nil {
+		handle.Log.Printf("Command '%s' failed: %v", command, result.err)
+		return
+	}
+
+	var smpl *sample
+	var err error
+	if len(prov.values[stepFormat]) > 0 && prov.values[stepFormat][0] == formatJSON {
+		smpl, err = parseJSON(result.output)
+	} else {
+		smpl = parseKeyValue(result.output)
+	}
+	if err == nil && len(smpl.keys) == 0 {
+		err = fmt.Errorf("no values found")
+	}
+	if err == nil && prov.fields == nil {
+		err = prov.addSchema(handle, smpl)
+	}
+	if err != nil {
+		handle.Log.Printf("Invalid output of command '%s': %v", command, err)
+		return
+	}
+
+	start := result.start.UnixNano() - handle.GlobalTime
+	err = handle.Trace.AddEntries(prov.traceTag, [][]byte{
+		prov.encodeEntry(start, start+int64(result.elapsed), smpl)})
+	if err != nil {
+		handle.Log.Println(err)
+	}
+}
+
+// Creates raw entry from the sample. Missing values or values which cannot
+// be converted to type of the field are written as zeroes
+func (prov *ScriptProvider) encodeEntry(start, end int64, smpl *sample) []byte {
+	entry := make([]byte, prov.entrySize)
+	binary.LittleEndian.PutUint64(entry, uint64(start))
+	binary.LittleEndian.PutUint64(entry[8:], uint64(end))
+
+	for _, field := range prov.fields {
+		value := smpl.values[field.name].text
+		switch field.fieldType {
+		case fieldInt:
+			i, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				// Float values may be printed for integer fields
+				f, _ := strconv.ParseFloat(value, 64)
+				i = int64(f)
+			}
+			binary.LittleEndian.PutUint64(entry[field.offset:], uint64(i))
+		case fieldFloat:
+			f, _ := strconv.ParseFloat(value, 64)
+			binary.LittleEndian.PutUint64(entry[field.offset:], math.Float64bits(f))
+		default:
+			entry = tsfile.EncodeVarString(entry, field.offset, value)
+		}
+	}
+	return entry
+}
+
+// Parses "key=value" pairs separated by whitespace. Other words are ignored
+func parseKeyValue(output []byte) *sample {
+	smpl := &sample{values: make(map[string]sampleValue)}
+	for _, word := range strings.Fields(string(output)) {
+		index := strings.IndexByte(word, '=')
+		if index <= 0 {
+			continue
+		}
+
+		key, text := word[:index], word[index+1:]
+		smpl.add(key, sampleValue{text: text, fieldType: detectType(text)})
+	}
+	return smpl
+}
+
+// Parses JSON object. Nested objects are flattened, arrays and nulls are
+// ignored, booleans are converted to integers
+func parseJSON(output []byte) (*sample, error) {
+	decoder := json.NewDecoder(bytes.NewReader(output))
+	decoder.UseNumber()
+
+	var object map[string]interface{}
+	if err := decoder.Decode(&object); err != nil {
+		return nil, err
+	}
+
+	smpl := &sample{values: make(map[string]sampleValue)}
+	smpl.addJSONObject("", object)
+	return smpl, nil
+}
+
+func (smpl *sample) addJSONObject(prefix string, object map[string]interface{}) {
+	// Order of keys is lost by decoder, so keep them sorted
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		switch value := object[key].(type) {
+		case map[string]interface{}:
+			smpl.addJSONObject(prefix+key+".", value)
+		case json.Number:
+			smpl.add(prefix+key, sampleValue{text: value.String(),
+				fieldType: detectType(value.String())})
+		case string:
+			smpl.add(prefix+key, sampleValue{text: value, fieldType: fieldString})
+		case bool:
+			text := "0"
+			if value {
+				text = "1"
+			}
+			smpl.add(prefix+key, sampleValue{text: text, fieldType: fieldInt})
+		}
+	}
+}
+
+func (smpl *sample) add(key string, value sampleValue) {
+	if _, ok := smpl.values[key]; !ok {
+		smpl.keys = append(smpl.keys, key)
+	}
+	smpl.values[key] = value
+}
+
+func detectType(text string) int {
+	if _, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return fieldInt
+	}
+	if _, err := strconv.ParseFloat(text, 64); err == nil {
+		return fieldFloat
+	}
+	return fieldString
+}
+
+// Factory creating script provider
+func Create() provider.Provider {
+	return new(ScriptProvider)
+}
+
+func init() {
+	provider.Register("script", Create, provider.Info{
+		Description: "Values printed by command which is run periodically",
+		OS:          []string{"linux"},
+		Steps:       stepNames,
+	})
+}
@@ -0,0 +1,199 @@
+package script
+
+import (
+	"log"
+
+	"bytes"
+	"strings"
+	"time"
+
+	"testing"
+
+	"rexlib/provider"
+	"rexlib/provider/providertest"
+	"tsfile"
+)
+
+func TestParseKeyValue(t *testing.T) {
+	smpl := parseKeyValue([]byte("Total: 5 estab=3 closed=1\nratio=0.5 state=ok =broken\n"))
+	if strings.Join(smpl.keys, ",") != "estab,closed,ratio,state" {
+		t.Fatalf("Unexpected keys: %v", smpl.keys)
+	}
+	if smpl.values["estab"].fieldType != fieldInt || smpl.values["ratio"].fieldType != fieldFloat ||
+		smpl.values["state"] != (sampleValue{text: "ok", fieldType: fieldString}) {
+		t.Errorf("Unexpected values: %v", smpl.values)
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	smpl, err := parseJSON([]byte(`{"b": 2, "a": {"y": 1.5, "x": "str"}, "c": true, "d": [1], "e": null}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(smpl.keys, ",") != "a.x,a.y,b,c" {
+		t.Fatalf("Unexpected keys: %v", smpl.keys)
+	}
+	if smpl.values["a.y"].fieldType != fieldFloat || smpl.values["b"].fieldType != fieldInt ||
+		smpl.values["c"] != (sampleValue{text: "1", fieldType: fieldInt}) {
+		t.Errorf("Unexpected values: %v", smpl.values)
+	}
+
+	_, err = parseJSON([]byte("[1, 2]"))
+	if err == nil {
+		t.Error("JSON array is parsed")
+	}
+}
+
+func TestScriptConfigure(t *testing.T) {
+	prov := new(ScriptProvider)
+
+	invalidSteps := []*provider.ConfigurationStep{
+		{Name: "command", Values: []string{" "}},
+		{Name: "format", Values: []string{"xml"}},
+		{Name: "interval", Values: []string{"0"}},
+		{Name: "timeout", Values: []string{"10"}},
+		{Name: "field", Values: []string{"value:bool"}},
+	}
+	for _, step := range invalidSteps {
+		_, err := prov.Configure(provider.ConfigureSetValue, step)
+		if err != provider.ErrInvalidConfigurationValue {
+			t.Errorf("Unexpected error for %v: %v", step, err)
+		}
+	}
+
+	for _, step := range []*provider.ConfigurationStep{
+		{Values: []string{"echo value=1"}},
+		{Name: "field", Values: []string{"value:float", "name"}},
+		{Name: "field", Values: []string{"value:int"}},
+	} {
+		if _, err := prov.Configure(provider.ConfigureSetValue, step); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	steps, _ := prov.Configure(provider.ConfigureGetValues, nil)
+	if len(steps) != 2 || steps[0].Values[0] != "echo value=1" ||
+		strings.Join(steps[1].Values, ",") != "value:int,name" {
+		t.Errorf("Unexpected configuration: %v", steps)
+	}
+}
+
+// Runs provider until command finishes given number of times
+func runScript(t *testing.T, prov *ScriptProvider, handle *provider.OutputHandle, runs int) {
+	if err := prov.Prepare(handle); err != nil {
+		t.Fatal(err)
+	}
+	defer prov.Finalize(handle)
+
+	for i := 0; i < 500 && runs > 0; i++ {
+		handle.Now = time.Now()
+		if len(prov.results) > 0 {
+			// Result will be handled by this call to collect
+			runs--
+		}
+		prov.Collect(handle)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestScriptCollect(t *testing.T) {
+	handle := providertest.NewOutputHandle(t, "script")
+	tsf := handle.Trace
+
+	var logBuf bytes.Buffer
+	handle.Log = log.New(&logBuf, "script: ", 0)
+
+	prov := new(ScriptProvider)
+	for _, step := range []*provider.ConfigurationStep{
+		{Values: []string{`echo '{"conns": {"estab": 3}, "ratio": 0.25, "state": "ok"}'`}},
+		{Name: "format", Values: []string{"json"}},
+		{Name: "interval", Values: []string{"1"}},
+	} {
+		if _, err := prov.Configure(provider.ConfigureSetValue, step); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runScript(t, prov, handle, 2)
+
+	type scriptEntry struct {
+		Start tsfile.TSTimeStart
+		End   tsfile.TSTimeEnd
+		Estab int64
+		Ratio float64
+		State tsfile.TSVarString
+	}
+	entries := make([]scriptEntry, 2)
+	if err := tsf.GetEntries(prov.traceTag, entries, 0); err != nil {
+		t.Fatalf("%v: %s", err, logBuf.String())
+	}
+	for _, entry := range entries {
+		if entry.Estab != 3 || entry.Ratio != 0.25 || entry.State != "ok" ||
+			entry.Start <= 0 || int64(entry.End) < int64(entry.Start) {
+			t.Errorf("Unexpected entry: %+v", entry)
+		}
+	}
+}
+
+func TestScriptFailures(t *testing.T) {
+	handle := providertest.NewOutputHandle(t, "script")
+
+	var logBuf bytes.Buffer
+	handle.Log = log.New(&logBuf, "script: ", 0)
+
+	commands := map[string]string{
+		"sleep 10; echo value=1": "timed out",
+		"echo oops >&2; exit 3":  "exit status 3: oops",
+		"echo no values here":    "no values found",
+	}
+	for command, message := range commands {
+		logBuf.Reset()
+
+		prov := new(ScriptProvider)
+		for _, step := range []*provider.ConfigurationStep{
+			{Values: []string{command}},
+			{Name: "interval", Values: []string{"1000"}},
+			{Name: "timeout", Values: []string{"200ms"}},
+		} {
+			if _, err := prov.Configure(provider.ConfigureSetValue, step); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		start := time.Now()
+		runScript(t, prov, handle, 1)
+		if !strings.Contains(logBuf.String(), message) {
+			t.Errorf("Unexpected log for '%s': %s", command, logBuf.String())
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Errorf("Command '%s' was not killed", command)
+		}
+	}
+}
+
+func TestScriptFinalize(t *testing.T) {
+	handle := providertest.NewOutputHandle(t, "script")
+
+	var logBuf bytes.Buffer
+	handle.Log = log.New(&logBuf, "script: ", 0)
+
+	prov := new(ScriptProvider)
+	if _, err := prov.Configure(provider.ConfigureSetValue,
+		&provider.ConfigurationStep{Values: []string{"echo value=1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := prov.Prepare(handle); err != nil {
+		t.Fatal(err)
+	}
+
+	// Command finishes after the last collection, so its result is only
+	// handled by finalize
+	prov.Collect(handle)
+	for i := 0; i < 500 && len(prov.results) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	prov.Finalize(handle)
+
+	if count := handle.Trace.GetEntryCount(prov.traceTag); count != 1 {
+		t.Errorf("Unexpected number of entries: %d: %s", count, logBuf.String())
+	}
+}
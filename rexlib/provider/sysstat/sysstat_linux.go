@@ -9,6 +9,7 @@ import (
 	"strconv"
 	"strings"
 
+	"math"
 	"time"
 
 	"reflect"
@@ -18,14 +19,18 @@ import (
 )
 
 const (
-	fStat   string = "/proc/stat"
-	fVMStat string = "/proc/vmstat"
+	fStat    string = "/proc/stat"
+	fVMStat  string = "/proc/vmstat"
+	fMemInfo string = "/proc/meminfo"
+	fLoadAvg string = "/proc/loadavg"
 )
 
 const (
 	sstRaw = iota
 	sstJiffies
 	sstPages
+	sstKBytes
+	sstFloat
 )
 
 type statistic struct {
@@ -42,20 +47,108 @@ type statistic struct {
 
 // List of statistics collectible by sysstat provider. It is important
 // to maintain same order as in actual files because we want to read
-// data sequentally
-var stats = []statistic{
-	statistic{sstJiffies, "cpu_usr", fStat, "cpu", 0, false, true},
-	statistic{sstJiffies, "cpu_usr_nice", fStat, "cpu", 1, false, true},
-	statistic{sstJiffies, "cpu_sys", fStat, "cpu", 2, false, true},
+// data sequentally. Per-cpu statistics, vmstat and meminfo statistics
+// depend on the system and are added to the list by init()
+var stats []statistic
+
+var cpuStats = []statistic{
+	statistic{sstJiffies, "usr", fStat, "cpu", 0, false, true},
+	statistic{sstJiffies, "usr_nice", fStat, "cpu", 1, false, true},
+	statistic{sstJiffies, "sys", fStat, "cpu", 2, false, true},
+	statistic{sstJiffies, "idle", fStat, "cpu", 3, false, true},
+	statistic{sstJiffies, "iowait", fStat, "cpu", 4, false, true},
+	statistic{sstJiffies, "irq", fStat, "cpu", 5, false, true},
+	statistic{sstJiffies, "softirq", fStat, "cpu", 6, false, true},
+	statistic{sstJiffies, "steal", fStat, "cpu", 7, false, true},
+}
 
+var procStats = []statistic{
+	statistic{sstRaw, "intr", fStat, "intr", 0, false, true},
 	statistic{sstRaw, "ctxsw", fStat, "ctxt", 0, true, true},
 	statistic{sstRaw, "forks", fStat, "processes", 0, true, true},
 
 	statistic{sstRaw, "prun", fStat, "procs_running", 0, true, false},
 	statistic{sstRaw, "pwait", fStat, "procs_blocked", 0, true, false},
 
-	statistic{sstPages, "pgin", fVMStat, "pgpgin", 0, true, true},
-	statistic{sstPages, "pgout", fVMStat, "pgpgout", 0, true, true},
+	statistic{sstRaw, "softirq", fStat, "softirq", 0, false, true},
+}
+
+// Names of vmstat statistics which were supported by sysstat before all
+// vmstat values were added (pgpgin and pgpgout are actually in kilobytes)
+var vmStatAliases = map[string]statistic{
+	"pgpgin":  statistic{sstKBytes, "pgin", fVMStat, "pgpgin", 0, true, true},
+	"pgpgout": statistic{sstKBytes, "pgout", fVMStat, "pgpgout", 0, true, true},
+}
+
+// Most of the nr_* values in vmstat are gauges, but some are counters
+var vmStatCounters = map[string]bool{
+	"nr_dirtied": true,
+	"nr_written": true,
+}
+
+var loadAvgStats = []statistic{
+	statistic{sstFloat, "load1", fLoadAvg, "", 0, false, false},
+	statistic{sstFloat, "load5", fLoadAvg, "", 1, false, false},
+	statistic{sstFloat, "load15", fLoadAvg, "", 2, false, false},
+}
+
+var pageSize = int64(os.Getpagesize())
+
+func init() {
+	// Aggregate and per-cpu lines of /proc/stat go first. Aggregate
+	// statistics keep their names for compatibility (cpu_usr)
+	for _, cpu := range readKeys(fStat, "cpu") {
+		for _, stat := range cpuStats {
+			stat.key = cpu
+			stat.name = cpu + "_" + stat.name
+			stats = append(stats, stat)
+		}
+	}
+	stats = append(stats, procStats...)
+
+	for _, key := range readKeys(fVMStat, "") {
+		stat, ok := vmStatAliases[key]
+		if !ok {
+			stat = statistic{sstRaw, key, fVMStat, key, 0, true,
+				!strings.HasPrefix(key, "nr_") || vmStatCounters[key]}
+		}
+		stats = append(stats, stat)
+	}
+
+	// Memory sizes in meminfo are in kilobytes except for hugepage counters
+	for _, key := range readKeys(fMemInfo, "") {
+		name := strings.NewReplacer("(", "_", ")", "").Replace(strings.ToLower(key))
+		stat := statistic{sstRaw, "mem_" + strings.TrimSuffix(name, ":"),
+			fMemInfo, key, 0, true, false}
+		if strings.HasPrefix(key, "HugePages_") {
+			stat.lastInLine = true
+		} else {
+			stat.dataType = sstKBytes
+			stat.lastInLine = false
+		}
+		stats = append(stats, stat)
+	}
+
+	stats = append(stats, loadAvgStats...)
+}
+
+// Reads keys (first words of the lines) of the statistics file which
+// start with prefix
+func readKeys(fileName string, prefix string) (keys []string) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && strings.HasPrefix(fields[0], prefix) {
+			keys = append(keys, fields[0])
+		}
+	}
+	return
 }
 
 type SysStatProvider struct {
@@ -78,7 +171,8 @@ type statFileReader struct {
 	key   string
 	index int
 
-	lastStat *statistic
+	// Set when current line was read completely, so next key can be read
+	atLineStart bool
 
 	lastError error
 }
@@ -86,19 +180,18 @@ type statFileReader struct {
 func (sfr *statFileReader) ReadStatistic(stat *statistic) int64 {
 	if stat.fileName != sfr.fileName {
 		sfr.lastError = sfr.openFile(stat.fileName)
-		sfr.lastStat = nil
 	}
 
 	for sfr.key != stat.key && sfr.lastError == nil {
-		if sfr.lastStat != nil && !sfr.lastStat.lastInLine {
+		if !sfr.atLineStart {
 			// Ignore this line's contents (if we already reading file)
 			_, sfr.lastError = sfr.reader.ReadString('\n')
-			sfr.lastStat = nil
 		}
 		if sfr.lastError == nil {
 			sfr.key, sfr.lastError = sfr.reader.ReadString(' ')
 			sfr.key = strings.TrimRight(sfr.key, " ")
 			sfr.index = -1
+			sfr.atLineStart = false
 		}
 	}
 
@@ -116,6 +209,8 @@ func (sfr *statFileReader) ReadStatistic(stat *statistic) int64 {
 			continue
 		}
 
+		// Values may be aligned with spaces (as in meminfo)
+		strValue = strings.TrimLeft(strValue, " ")
 		if stat.lastInLine && strings.IndexByte(strValue, ' ') != -1 {
 			// We expected that there will be only sinle value in this line, but
 			// we found a space character, so raise an error
@@ -138,7 +233,14 @@ func (sfr *statFileReader) ReadStatistic(stat *statistic) int64 {
 		return -1
 	}
 
-	sfr.lastStat = stat
+	sfr.atLineStart = stat.lastInLine
+
+	// Float values are kept as their bits as they have same size as int64
+	// and could be written to the same entry
+	if stat.dataType == sstFloat {
+		value, _ := strconv.ParseFloat(strValue, 64)
+		return int64(math.Float64bits(value))
+	}
 
 	// Ignore this error, as we don't expect broken integers here
 	value, _ := strconv.ParseInt(strValue, 10, 64)
@@ -153,6 +255,9 @@ func (sfr *statFileReader) openFile(fileName string) (err error) {
 	if err == nil {
 		sfr.reader = bufio.NewReader(sfr.file)
 		sfr.fileName = fileName
+		sfr.key = ""
+		sfr.index = -1
+		sfr.atLineStart = true
 	}
 	return
 }
@@ -223,11 +328,16 @@ func (prov *SysStatProvider) Configure(action provider.ConfigurationAction,
 func (prov *SysStatProvider) Prepare(handle *provider.OutputHandle) (err error) {
 	// Generate TSF schema for a slice we're going to provide
 	rType := reflect.TypeOf(int64(0))
+	fType := reflect.TypeOf(float64(0))
 
 	var fields []tsfile.TSFSchemaField
 	for _, statIdx := range prov.stats {
 		stat := &stats[statIdx]
-		fields = append(fields, tsfile.NewField(stat.name, rType))
+		if stat.dataType == sstFloat {
+			fields = append(fields, tsfile.NewField(stat.name, fType))
+		} else {
+			fields = append(fields, tsfile.NewField(stat.name, rType))
+		}
 	}
 	fields = append(fields, tsfile.NewStartTimeField())
 	fields = append(fields, tsfile.NewEndTimeField())
@@ -260,17 +370,18 @@ func (prov *SysStatProvider) Collect(handle *provider.OutputHandle) {
 		stat := &stats[statIdx]
 		value := sfr.ReadStatistic(stat)
 		if sfr.lastError != nil {
-			// TODO ratelimit this message
-			handle.Log.Println(sfr.lastError)
+			handle.LogLimited("%v", sfr.lastError)
 			continue
 		}
 
-		// TODO Convert value depending on units
+		// Convert value to nanoseconds or bytes depending on units
 		switch stat.dataType {
 		case sstJiffies:
-			value = value
+			value = int64(provider.JiffiesToDuration(value))
 		case sstPages:
-			value = value
+			value = value * pageSize
+		case sstKBytes:
+			value = value * 1024
 		}
 
 		// Save absolute value
@@ -283,7 +394,7 @@ func (prov *SysStatProvider) Collect(handle *provider.OutputHandle) {
 				continue
 			}
 
-			value = int64(time.Second) * (value - prov.lastSnap[index]) / int64(timeDelta)
+			value = provider.NormalizeRate(value-prov.lastSnap[index], timeDelta)
 		}
 
 		values[index] = value
@@ -306,3 +417,11 @@ func (prov *SysStatProvider) Collect(handle *provider.OutputHandle) {
 func Create() provider.Provider {
 	return new(SysStatProvider)
 }
+
+func init() {
+	provider.Register("sysstat", Create, provider.Info{
+		Description: "System-wide and per-CPU times, scheduler, interrupt, paging and memory statistics and load averages from /proc",
+		OS:          []string{"linux"},
+		Steps:       []string{"stat"},
+	})
+}
@@ -1,10 +1,17 @@
 package sysstat
 
 import (
+	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 
 	"testing"
+	"time"
+
+	"rexlib/provider"
+	"rexlib/provider/providertest"
+	"tsfile"
 )
 
 func TestSFRSimpleStat(t *testing.T) {
@@ -29,3 +36,116 @@ func TestSFRSimpleStat(t *testing.T) {
 		t.Errorf("Invalid cpu_usr value: 1 expected, got %d", i)
 	}
 }
+
+func TestSFRMemInfoLoadAvg(t *testing.T) {
+	f, err := ioutil.TempFile("", "sysstattest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString("MemTotal:       16384 kB\nHugePages_Total:       4\nHugepagesize:    2048 kB\n")
+
+	var sfr statFileReader
+
+	memTotal := statistic{sstKBytes, "mem_memtotal", f.Name(), "MemTotal:", 0, false, false}
+	hpTotal := statistic{sstRaw, "mem_hugepages_total", f.Name(), "HugePages_Total:", 0, true, false}
+	hpSize := statistic{sstKBytes, "mem_hugepagesize", f.Name(), "Hugepagesize:", 0, false, false}
+
+	for _, tc := range []struct {
+		stat  *statistic
+		value int64
+	}{{&memTotal, 16384}, {&hpTotal, 4}, {&hpSize, 2048}} {
+		i := sfr.ReadStatistic(tc.stat)
+		if sfr.lastError != nil {
+			t.Error(sfr.lastError)
+		}
+		if i != tc.value {
+			t.Errorf("Invalid %s value: %d expected, got %d", tc.stat.name, tc.value, i)
+		}
+	}
+
+	f2, err := ioutil.TempFile("", "sysstattest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f2.Name())
+
+	f2.WriteString("0.07 0.25 1.50 2/73 24921\n")
+
+	load15 := statistic{sstFloat, "load15", f2.Name(), "", 2, false, false}
+	i := sfr.ReadStatistic(&load15)
+	if sfr.lastError != nil {
+		t.Error(sfr.lastError)
+	}
+	if value := math.Float64frombits(uint64(i)); value != 1.5 {
+		t.Errorf("Invalid load15 value: 1.5 expected, got %f", value)
+	}
+}
+
+func TestSysStatTable(t *testing.T) {
+	names := make(map[string]bool)
+	for _, stat := range stats {
+		if names[stat.name] {
+			t.Errorf("Duplicate statistic %s", stat.name)
+		}
+		names[stat.name] = true
+	}
+
+	for _, name := range []string{"cpu_usr", "cpu0_steal", "intr", "pgin", "pgfault",
+		"mem_memtotal", "load1"} {
+		if !names[name] {
+			t.Errorf("Statistic %s is missing", name)
+		}
+	}
+}
+
+func TestSysStatCollectManyCPUs(t *testing.T) {
+	f, err := ioutil.TempFile("", "sysstattest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	oldStats := stats
+	defer func() { stats = oldStats }()
+	stats = []statistic{
+		statistic{sstJiffies, "cpu_usr", f.Name(), "cpu", 0, false, true},
+	}
+
+	// 256 CPUs busy for 100 days, in nanoseconds such counter fits int64,
+	// but its product with a second doesn't
+	const cpuCount = 256
+	usr := int64(cpuCount) * 100 * 86400 * provider.JiffiesPerSecond
+	writeStat := func(usr int64) {
+		f.Truncate(0)
+		f.WriteAt([]byte(fmt.Sprintf("cpu  %d 0 0\n", usr)), 0)
+	}
+
+	handle := providertest.NewOutputHandle(t, "sysstat")
+	prov := &SysStatProvider{stats: []int{0}}
+	if err := prov.Prepare(handle); err != nil {
+		t.Fatal(err)
+	}
+
+	now := handle.Now
+	for i := 0; i < 3; i++ {
+		writeStat(usr + int64(i)*cpuCount*10*provider.JiffiesPerSecond)
+		handle.Now = now.Add(time.Duration(i) * 10 * time.Second)
+		prov.Collect(handle)
+	}
+
+	entries := make([]struct {
+		Usr   int64
+		Start tsfile.TSTimeStart
+		End   tsfile.TSTimeEnd
+	}, 2)
+	if err := handle.Trace.GetEntries(prov.traceTag, entries, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Usr != cpuCount*int64(time.Second) {
+			t.Errorf("Unexpected CPU usage: %d", entry.Usr)
+		}
+	}
+}
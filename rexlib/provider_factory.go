@@ -3,16 +3,19 @@ package rexlib
 import (
 	"rexlib/provider"
 
-	// actual providers
-	"rexlib/provider/sysstat"
+	// Built-in providers, they add themselves to provider registry. Other
+	// providers may be linked into binary the same way
+	_ "rexlib/provider/cgroupstat"
+	_ "rexlib/provider/diskstat"
+	_ "rexlib/provider/ftrace"
+	_ "rexlib/provider/logtail"
+	_ "rexlib/provider/netstat"
+	_ "rexlib/provider/perfstat"
+	_ "rexlib/provider/procstat"
+	_ "rexlib/provider/script"
+	_ "rexlib/provider/sysstat"
 )
 
-func (incident *Incident) providerFactory(provName string) provider.Provider {
-	var provHandle provider.Provider
-	switch provName {
-	case "sysstat":
-		provHandle = sysstat.Create()
-	}
-
-	return provHandle
+func (incident *Incident) providerFactory(provName string) (provider.Provider, error) {
+	return provider.Create(provName)
 }
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"tsfile"
+	"tsfile/query"
 	"yatima"
 )
 
@@ -105,7 +106,7 @@ func (handle *trainingHandle) prepareBaseModel() error {
 	handle.baseModel = yatima.NewBaseModel(Training.templates)
 
 	for _, incident := range handle.incidents {
-		trace, err := incident.GetTraceFile()
+		trace, err := incident.GetMappedTraceFile()
 		if err != nil {
 			return err
 		}
@@ -120,6 +121,13 @@ func (handle *trainingHandle) prepareBaseModel() error {
 			if err != nil {
 				return err
 			}
+			if schema.SourceTag != 0 {
+				// Rollups only duplicate their sources and are not read
+				// by training, but their groups keep indices of other
+				// groups matching tags
+				cluster.Groups = append(cluster.Groups, group)
+				continue
+			}
 
 			info := schema.Info()
 			for _, field := range info.Fields {
@@ -128,13 +136,17 @@ func (handle *trainingHandle) prepareBaseModel() error {
 				case tsfile.TSFFieldInt, tsfile.TSFFieldStartTime, tsfile.TSFFieldEndTime:
 					hint = yatima.RIORandom
 				case tsfile.TSFFieldEnumerable:
-					hint = yatima.RIOEnumerable
+					// Values of enumerables which do not have dictionary
+					// in trace file may be arbitrary, so only labeled
+					// enumerables are used as such
+					hint = yatima.RIORandom
+					if len(schema.Enums[field.FieldName]) > 0 {
+						hint = yatima.RIOEnumerable
+					}
 				}
 
 				group.Pins = append(group.Pins, yatima.Pin{
 					Name: field.FieldName,
-
-					// TODO support enumerables in tsfile
 					Hint: hint,
 				})
 			}
@@ -283,14 +295,18 @@ func (handle *trainingModelHandle) train(machine *yatima.Machine) {
 		Signature: handle.model.Signature(),
 	}
 
-	var reader incidentSeriesDataReader
-	defer reader.Put()
 	defer func(res *TrainingNetworkResult) {
 		handle.handle.resultsChan <- *res
 	}(&result)
 
+	// Merge all series of all incidents by time
+	q := query.New()
 	for index, incident := range handle.handle.incidents {
-		err := reader.AddIncident(index, incident)
+		trace, err := incident.GetMappedTraceFile()
+		if err == nil {
+			defer trace.Put()
+			err = q.AddFile(index, trace)
+		}
 		if err != nil {
 			result.Error = err.Error()
 			handle.handle.log.Printf("Cannot load incident %s: %v", incident.Name, err)
@@ -300,15 +316,20 @@ func (handle *trainingModelHandle) train(machine *yatima.Machine) {
 
 	// Main training loop: update machine state with each event
 	generator := handle.handle.newTimeGenerator()
-	event, err := reader.Next()
-	for event.Buffer != nil {
+	for {
+		event, err := q.Next()
 		if err != nil {
-			handle.handle.log.Printf("Error in %s: %v", handle.model.Signature(), *machine)
+			result.Error = err.Error()
+			handle.handle.log.Printf("Error in %s: %v", handle.model.Signature(), err)
+			return
+		}
+		if event.Entry == nil {
+			break
 		}
 
 		deserializer := event.Deserializer
 
-		startTime := deserializer.GetStartTime(event.Buffer)
+		startTime := deserializer.GetStartTime(event.Entry)
 		windowTime := generator.updateTime(int64(startTime))
 		if windowTime != 0 {
 			machine.WriteTime(windowTime, yatima.ActorTimeWindow)
@@ -318,14 +339,16 @@ func (handle *trainingModelHandle) train(machine *yatima.Machine) {
 			machine.WriteTime(int64(startTime), yatima.ActorTimeNone)
 		}
 
+		// Pin groups are created for each series of the trace in order
+		// of their tags (see prepareBaseModel)
 		inputs, base := handle.prog.FindInputs(yatima.PinIndex{
-			Cluster: uint32(event.IncidentIndex + 1),
-			Group:   uint32(event.SeriesIndex),
+			Cluster: uint32(event.Source + 1),
+			Group:   uint32(event.Tag - tsfile.TSFTagData),
 		})
 		if inputs != nil {
 			for _, input := range inputs {
 				// TODO string support
-				_, value := deserializer.GetInt64(event.Buffer, int(input.Pin))
+				_, value := deserializer.GetInt64(event.Entry, int(input.Pin))
 				machine.WriteInput(base, value)
 
 				base++
@@ -333,7 +356,6 @@ func (handle *trainingModelHandle) train(machine *yatima.Machine) {
 		}
 
 		machine.Run()
-		event, err = reader.Next()
 	}
 
 	machine.WriteTime(generator.nextTime, yatima.ActorTimeEnd)
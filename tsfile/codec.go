@@ -0,0 +1,235 @@
+package tsfile
+
+import (
+	"fmt"
+
+	"sync"
+
+	"encoding/binary"
+	"reflect"
+	"unsafe"
+)
+
+// Codecs -- fast encoding and decoding of entries without reflection.
+// encoding/binary walks over fields of each entry using reflect, which takes
+// most of the time in AddEntries() and GetEntries(). Instead, when slice of
+// Go structs is passed to them, a codec is generated for the struct type
+// once: it keeps offsets of the fields in Go struct and in raw entry, so
+// values are copied directly from memory. Entries encoded by codec are
+// identical to encoding/binary output, thus file format is not affected.
+//
+// Struct fields may be integers, floats, booleans and byte arrays (which are
+// types supported by NewStructSchema()), blank fields are zeroed like
+// encoding/binary does. If codec cannot be generated for a type (i.e. it has
+// nested structs), encoding/binary is used. Custom codecs may be registered
+// with RegisterCodec().
+
+type TSFCodec interface {
+	// Size of the encoded entry
+	EntrySize() int
+
+	// Encodes count entries of slice entries starting with index start
+	// into buf which should have size of count entries
+	Encode(buf []byte, entries interface{}, start, count int)
+
+	// Decodes count entries from buf into slice entries starting with
+	// index start
+	Decode(buf []byte, entries interface{}, start, count int)
+}
+
+const (
+	tsfCodecBytes = iota
+	tsfCodecUint16
+	tsfCodecUint32
+	tsfCodecUint64
+	tsfCodecBlank
+
+	// Maximum size of byte array field
+	maxCodecFieldSize = 1 << 16
+)
+
+type tsfFieldCodec struct {
+	kind int
+
+	// Offset of the field in Go struct and in entry
+	offset      uintptr
+	entryOffset int
+	size        int
+}
+
+type tsfStructCodec struct {
+	goType    reflect.Type
+	entrySize int
+	fields    []tsfFieldCodec
+}
+
+// Codecs per type of entry. Types for which codec cannot be generated are
+// kept with nil codec, so they are not re-checked
+var codecMu sync.RWMutex
+var codecs = make(map[reflect.Type]TSFCodec)
+
+// Registers custom codec for entries of goType
+func RegisterCodec(goType reflect.Type, codec TSFCodec) {
+	codecMu.Lock()
+	defer codecMu.Unlock()
+
+	codecs[goType] = codec
+}
+
+// Returns codec for entries of goType generating it if needed or nil if
+// encoding/binary should be used
+func getCodec(goType reflect.Type) TSFCodec {
+	codecMu.RLock()
+	codec, ok := codecs[goType]
+	codecMu.RUnlock()
+	if ok {
+		return codec
+	}
+
+	if goType.Kind() == reflect.Struct {
+		structCodec, err := NewStructCodec(goType)
+		if err == nil {
+			codec = structCodec
+		}
+	}
+
+	codecMu.Lock()
+	defer codecMu.Unlock()
+
+	codecs[goType] = codec
+	return codec
+}
+
+// Generates codec for Go structure
+func NewStructCodec(goStruct reflect.Type) (TSFCodec, error) {
+	if goStruct.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("Cannot generate codec for non-struct type")
+	}
+
+	codec := &tsfStructCodec{
+		goType: goStruct,
+		fields: make([]tsfFieldCodec, goStruct.NumField()),
+	}
+	for i := range codec.fields {
+		goField := goStruct.Field(i)
+		field := &codec.fields[i]
+
+		switch goField.Type.Kind() {
+		case reflect.Int8, reflect.Uint8, reflect.Bool:
+			field.kind, field.size = tsfCodecBytes, 1
+		case reflect.Int16, reflect.Uint16:
+			field.kind, field.size = tsfCodecUint16, 2
+		case reflect.Int32, reflect.Uint32, reflect.Float32:
+			field.kind, field.size = tsfCodecUint32, 4
+		case reflect.Int64, reflect.Uint64, reflect.Float64:
+			field.kind, field.size = tsfCodecUint64, 8
+		case reflect.Array:
+			switch goField.Type.Elem().Kind() {
+			case reflect.Int8, reflect.Uint8:
+				if goField.Type.Len() < maxCodecFieldSize {
+					field.kind, field.size = tsfCodecBytes, goField.Type.Len()
+				}
+			}
+		}
+		if field.size == 0 {
+			return nil, fmt.Errorf("Cannot generate codec for field %s of type %s",
+				goField.Name, goField.Type)
+		}
+
+		if goField.Name == "_" {
+			field.kind = tsfCodecBlank
+		}
+		field.offset = goField.Offset
+		field.entryOffset = codec.entrySize
+		codec.entrySize += field.size
+	}
+
+	return codec, nil
+}
+
+func (codec *tsfStructCodec) EntrySize() int {
+	return codec.entrySize
+}
+
+func (codec *tsfStructCodec) Encode(buf []byte, entries interface{}, start, count int) {
+	if count == 0 {
+		return
+	}
+
+	base := codec.getBase(entries, start, count)
+	stride := codec.goType.Size()
+	for i := 0; i < count; i++ {
+		entry := buf[i*codec.entrySize : (i+1)*codec.entrySize]
+		ptr := unsafe.Pointer(uintptr(base) + uintptr(i)*stride)
+
+		for fi := range codec.fields {
+			codec.fields[fi].encode(entry, ptr)
+		}
+	}
+}
+
+func (codec *tsfStructCodec) Decode(buf []byte, entries interface{}, start, count int) {
+	if count == 0 {
+		return
+	}
+
+	base := codec.getBase(entries, start, count)
+	stride := codec.goType.Size()
+	for i := 0; i < count; i++ {
+		entry := buf[i*codec.entrySize : (i+1)*codec.entrySize]
+		ptr := unsafe.Pointer(uintptr(base) + uintptr(i)*stride)
+
+		for fi := range codec.fields {
+			codec.fields[fi].decode(entry, ptr)
+		}
+	}
+}
+
+// Returns pointer to the first entry in slice which is processed by codec
+func (codec *tsfStructCodec) getBase(entries interface{}, start, count int) unsafe.Pointer {
+	value := reflect.ValueOf(entries)
+	if value.Kind() != reflect.Slice || value.Type().Elem() != codec.goType {
+		panic(fmt.Sprintf("Unexpected entries of type %T for codec of %s",
+			entries, codec.goType))
+	}
+	if start+count > value.Len() {
+		panic("Entries are out of range")
+	}
+	return unsafe.Pointer(value.Index(start).UnsafeAddr())
+}
+
+func (field *tsfFieldCodec) encode(entry []byte, ptr unsafe.Pointer) {
+	buf := entry[field.entryOffset : field.entryOffset+field.size]
+	ptr = unsafe.Pointer(uintptr(ptr) + field.offset)
+
+	switch field.kind {
+	case tsfCodecBytes:
+		copy(buf, (*[maxCodecFieldSize]byte)(ptr)[:field.size:field.size])
+	case tsfCodecUint16:
+		binary.LittleEndian.PutUint16(buf, *(*uint16)(ptr))
+	case tsfCodecUint32:
+		binary.LittleEndian.PutUint32(buf, *(*uint32)(ptr))
+	case tsfCodecUint64:
+		binary.LittleEndian.PutUint64(buf, *(*uint64)(ptr))
+	case tsfCodecBlank:
+		for i := range buf {
+			buf[i] = 0
+		}
+	}
+}
+
+func (field *tsfFieldCodec) decode(entry []byte, ptr unsafe.Pointer) {
+	buf := entry[field.entryOffset : field.entryOffset+field.size]
+	ptr = unsafe.Pointer(uintptr(ptr) + field.offset)
+
+	switch field.kind {
+	case tsfCodecBytes:
+		copy((*[maxCodecFieldSize]byte)(ptr)[:field.size:field.size], buf)
+	case tsfCodecUint16:
+		*(*uint16)(ptr) = binary.LittleEndian.Uint16(buf)
+	case tsfCodecUint32:
+		*(*uint32)(ptr) = binary.LittleEndian.Uint32(buf)
+	case tsfCodecUint64:
+		*(*uint64)(ptr) = binary.LittleEndian.Uint64(buf)
+	}
+}
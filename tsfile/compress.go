@@ -0,0 +1,280 @@
+package tsfile
+
+import (
+	"fmt"
+
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"compress/flate"
+	"encoding/binary"
+)
+
+// Compression of data pages (TSFFormatCompressed) -- full data pages are
+// transposed into columns, integer and time columns are encoded using
+// delta-of-delta encoding, while others are kept as is, and then the whole
+// page is compressed with deflate.
+//
+// Compressed page still occupies a single slot of pageSize bytes in file,
+// but it may keep up to maxCompressionRatio times more entries than the raw
+// page. Length of compressed data is stored in Size field of page header.
+// Pages are compressed right before writing them in preparePage()
+
+const (
+	maxCompressionRatio = 8
+
+	// Reserve for flate and encoding headers which is used to decide whether
+	// page have to be checked for fitting in pageSize. Delta encoding of
+	// small integers may take up to two times more space than raw values
+	compressionReserve = 64
+	maxEncodingRatio   = 2
+
+	// Page encoding modes
+	tsfEncodingRows    = 0
+	tsfEncodingColumns = 1
+)
+
+type tsfPageCodec struct {
+	fields    []TSFSchemaField
+	entrySize int
+	pageSize  int
+
+	// If fields do not cover whole entry, we cannot transpose it
+	columnar bool
+}
+
+func newPageCodec(schema *TSFSchemaHeader, pageSize uint32) *tsfPageCodec {
+	codec := &tsfPageCodec{
+		fields:    make([]TSFSchemaField, schema.FieldCount),
+		entrySize: int(schema.EntrySize),
+		pageSize:  int(pageSize),
+	}
+	copy(codec.fields, schema.Fields[:schema.FieldCount])
+
+	var size uint64
+	for _, field := range codec.fields {
+		size += field.Size
+	}
+	codec.columnar = (size == uint64(schema.EntrySize))
+
+	return codec
+}
+
+func (codec *tsfPageCodec) isDeltaField(field *TSFSchemaField) bool {
+	switch field.FieldType {
+	case TSFFieldInt, TSFFieldEnumerable, TSFFieldStartTime, TSFFieldEndTime:
+		switch field.Size {
+		case 1, 2, 4, 8:
+			return true
+		}
+	}
+	return false
+}
+
+// Encodes raw page buffer consisting of entries and compresses it
+func (codec *tsfPageCodec) encode(raw []byte) ([]byte, error) {
+	count := len(raw) / codec.entrySize
+	raw = raw[:count*codec.entrySize]
+
+	varBuf := make([]byte, binary.MaxVarintLen64)
+	encoded := bytes.NewBuffer(make([]byte, 0, len(raw)))
+
+	n := binary.PutUvarint(varBuf, uint64(count))
+	encoded.Write(varBuf[:n])
+
+	if !codec.columnar {
+		encoded.WriteByte(tsfEncodingRows)
+		encoded.Write(raw)
+	} else {
+		encoded.WriteByte(tsfEncodingColumns)
+		for fi := range codec.fields {
+			field := &codec.fields[fi]
+			if !codec.isDeltaField(field) {
+				for i := 0; i < count; i++ {
+					off := i*codec.entrySize + int(field.Offset)
+					encoded.Write(raw[off : off+int(field.Size)])
+				}
+				continue
+			}
+
+			var prevValue, prevDelta int64
+			for i := 0; i < count; i++ {
+				off := i*codec.entrySize + int(field.Offset)
+				value := decodeInt(raw[off:off+int(field.Size)], int(field.Size))
+
+				delta := value - prevValue
+				n := binary.PutVarint(varBuf, delta-prevDelta)
+				encoded.Write(varBuf[:n])
+
+				prevValue, prevDelta = value, delta
+			}
+		}
+	}
+
+	compressed := bytes.NewBuffer(make([]byte, 0, codec.pageSize))
+	writer, err := flate.NewWriter(compressed, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = writer.Write(encoded.Bytes())
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// Decompresses page and decodes it back into raw buffer of entries
+func (codec *tsfPageCodec) decode(data []byte) ([]byte, error) {
+	encoded, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decompress page: %v", err)
+	}
+
+	reader := bytes.NewReader(encoded)
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	mode, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, int(count)*codec.entrySize)
+	switch mode {
+	case tsfEncodingRows:
+		_, err = io.ReadFull(reader, raw)
+		if err != nil {
+			return nil, err
+		}
+	case tsfEncodingColumns:
+		for fi := range codec.fields {
+			field := &codec.fields[fi]
+			if !codec.isDeltaField(field) {
+				for i := 0; i < int(count); i++ {
+					off := i*codec.entrySize + int(field.Offset)
+					_, err = io.ReadFull(reader, raw[off:off+int(field.Size)])
+					if err != nil {
+						return nil, err
+					}
+				}
+				continue
+			}
+
+			var value, delta int64
+			for i := 0; i < int(count); i++ {
+				deltaOfDelta, err := binary.ReadVarint(reader)
+				if err != nil {
+					return nil, err
+				}
+
+				delta += deltaOfDelta
+				value += delta
+
+				off := i*codec.entrySize + int(field.Offset)
+				encodeInt(raw[off:off+int(field.Size)], int(field.Size), value)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Unknown page encoding %d", mode)
+	}
+
+	return raw, nil
+}
+
+// Returns upper estimate of compressed page size after appending count
+// entries to the page which compressed size is known. Encoding of the new
+// entries may grow up to maxEncodingRatio times, deflate only adds its
+// block headers which are covered by compressionReserve
+func (codec *tsfPageCodec) estimateSize(size, count int) int {
+	return size + maxEncodingRatio*count*codec.entrySize + compressionReserve
+}
+
+// Returns size of first count entries of page after compression
+func (codec *tsfPageCodec) compressedSize(raw []byte, count int) (int, error) {
+	data, err := codec.encode(raw[:count*codec.entrySize])
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Checks that entries appended to a compressed page fit into it and if not,
+// truncates page buffer to the largest number of new entries which fit. base
+// is number of entries in page before appending count entries. Page is only
+// recompressed when estimate of its size exceeds pageSize, so recompression
+// happens few times per page and not on every append
+func (page *tsfPage) fitCompressed(base, count int) (int, error) {
+	codec := page.codec
+	raw := page.buf.Bytes()
+
+	if codec.estimateSize(page.fitSize, base+count-page.fitCount) <= codec.pageSize {
+		return count, nil
+	}
+
+	size, err := codec.compressedSize(raw, base+count)
+	if err != nil {
+		return 0, err
+	}
+	if size <= codec.pageSize {
+		page.fitCount, page.fitSize = base+count, size
+		return count, nil
+	}
+
+	// Find maximum number of entries which fit using binary search
+	a, b := 0, count
+	for b > a {
+		med := a + (b-a+1)/2
+		size, err := codec.compressedSize(raw, base+med)
+		if err != nil {
+			return 0, err
+		}
+
+		if size <= codec.pageSize {
+			a = med
+			page.fitCount, page.fitSize = base+med, size
+		} else {
+			b = med - 1
+		}
+	}
+
+	if a == 0 && base == 0 {
+		return 0, fmt.Errorf("Entry of size %d is too big to be compressed", codec.entrySize)
+	}
+
+	page.buf.Truncate((base + a) * codec.entrySize)
+	page.full = true
+	return a, nil
+}
+
+// Sign-extends little-endian integer of specified size
+func decodeInt(buf []byte, size int) int64 {
+	switch size {
+	case 1:
+		return int64(int8(buf[0]))
+	case 2:
+		return int64(int16(binary.LittleEndian.Uint16(buf)))
+	case 4:
+		return int64(int32(binary.LittleEndian.Uint32(buf)))
+	}
+	return int64(binary.LittleEndian.Uint64(buf))
+}
+
+// Truncates integer to the specified size and stores it as little-endian
+func encodeInt(buf []byte, size int, value int64) {
+	switch size {
+	case 1:
+		buf[0] = uint8(value)
+	case 2:
+		binary.LittleEndian.PutUint16(buf, uint16(value))
+	case 4:
+		binary.LittleEndian.PutUint32(buf, uint32(value))
+	case 8:
+		binary.LittleEndian.PutUint64(buf, uint64(value))
+	}
+}
@@ -0,0 +1,219 @@
+package tsfile
+
+import (
+	"fmt"
+
+	"sync/atomic"
+
+	"encoding/binary"
+)
+
+// Enum dictionaries -- labels of values of enumerable fields. Writer
+// registers labels with RegisterEnum() and they are appended as records to
+// dictionary pages which are tagged with the tag of the series and have
+// TSFDictionaryPage flag. Like heap pages, dictionary pages are written each
+// time pages are written and keep size of their contents in Count field of
+// the page header. When file is loaded, dictionaries are collected into
+// Enums field of the schema header, so deserializers created from it return
+// labels instead of integer values.
+//
+// Dictionaries are replaced on each registration, so schema headers returned
+// by GetSchema() may keep using them without locking.
+
+// Labels of values of a single enumerable field
+type TSFEnumDictionary map[int64]string
+
+// On-disk header of dictionary record, followed by label
+type tsfEnumRecord struct {
+	FieldIndex uint16
+	Length     uint16
+	Value      int64
+}
+
+const (
+	enumRecordSize = 12
+
+	// Maximum length of the label
+	maxEnumLabelLength = 256
+)
+
+// Registers labels of values of enumerable field of series with the
+// specified tag. Labels of already registered values are replaced
+func (tsf *TSFile) RegisterEnum(tag TSFPageTag, fieldName string, values TSFEnumDictionary) error {
+	err := tsf.checkWritable()
+	if err != nil {
+		return err
+	}
+	if !tsf.formatFlags.hasExtents() {
+		return fmt.Errorf("Enum dictionaries are not supported by TSFile V1")
+	}
+
+	schema, err := tsf.GetSchema(tag)
+	if err != nil {
+		return err
+	}
+	fieldIndex := schema.findField(fieldName)
+	if fieldIndex < 0 {
+		return fmt.Errorf("Field '%s' is not found in schema", fieldName)
+	}
+	if schema.Fields[fieldIndex].FieldType != TSFFieldEnumerable {
+		return fmt.Errorf("Field '%s' is not enumerable", fieldName)
+	}
+
+	tsf.dictMu.Lock()
+	defer tsf.dictMu.Unlock()
+
+	// Re-read dictionary as it could be updated by concurrent registration
+	tsf.mu.RLock()
+	dict := tsf.schemas[tag.toSchemaId()].header.Enums[fieldName]
+	tsf.mu.RUnlock()
+
+	added := make(TSFEnumDictionary)
+	for value, label := range values {
+		if len(label) > maxEnumLabelLength {
+			label = label[:maxEnumLabelLength]
+		}
+		if oldLabel, ok := dict[value]; ok && oldLabel == label {
+			continue
+		}
+
+		record := encodeEnumRecord(uint16(fieldIndex), value, label)
+		page := tsf.getDictionaryPage(tag, len(record))
+
+		page.mu.Lock()
+		page.buf.Write(record)
+		page.dirty = true
+		page.pending = true
+		page.mu.Unlock()
+
+		added[value] = label
+	}
+
+	if len(added) > 0 {
+		tsf.mu.Lock()
+		tsf.schemas[tag.toSchemaId()].addEnumValues(fieldName, added)
+		tsf.mu.Unlock()
+	}
+	return nil
+}
+
+// Returns dictionary page of the series which has enough space for record
+// of the specified size or allocates a new one. Call with tsf.dictMu held
+func (tsf *TSFile) getDictionaryPage(tag TSFPageTag, size int) *tsfPage {
+	tsf.mu.RLock()
+	pageId := tsf.schemas[tag.toSchemaId()].dictPageId
+	tsf.mu.RUnlock()
+
+	if pageId != 0 {
+		page := tsf.tryGetPage(pageId)
+		if page != nil {
+			page.mu.Lock()
+			fits := page.buf.Len()+size <= int(tsf.pageSize)
+			if !fits {
+				page.full = true
+			}
+			page.mu.Unlock()
+
+			if fits {
+				return page
+			}
+			atomic.AddUint32(&tsf.fullPages, 1)
+		}
+	}
+
+	page, pageId := tsf.allocateDataPage(tag, TSFDictionaryPage)
+
+	tsf.mu.Lock()
+	tsf.schemas[tag.toSchemaId()].dictPageId = pageId
+	tsf.mu.Unlock()
+	return page
+}
+
+// Reads records from dictionary page and adds them to the dictionaries of
+// the series. Called when file is loaded after all schemas are loaded
+func (tsf *TSFile) loadDictionary(pageId TSFPageId) error {
+	hdr := tsf.pageHeaders[pageId]
+	schemaId := hdr.getTag().toSchemaId()
+	if !tsf.isValidSchemaId(schemaId) {
+		return fmt.Errorf("Dictionary of unknown series #%d", hdr.Tag)
+	}
+	schema := &tsf.schemas[schemaId]
+
+	page, err := tsf.readPage(pageId)
+	if err != nil {
+		return err
+	}
+
+	page.mu.Lock()
+	defer page.mu.Unlock()
+
+	buf := page.buf.Bytes()
+	if int(hdr.Count) > len(buf) {
+		return fmt.Errorf("Dictionary size %d exceeds page size", hdr.Count)
+	}
+	buf = buf[:hdr.Count]
+
+	values := make(map[string]TSFEnumDictionary)
+	for len(buf) > 0 {
+		if len(buf) < enumRecordSize {
+			return fmt.Errorf("Truncated dictionary record")
+		}
+
+		var record tsfEnumRecord
+		record.FieldIndex = binary.LittleEndian.Uint16(buf)
+		record.Length = binary.LittleEndian.Uint16(buf[2:])
+		record.Value = int64(binary.LittleEndian.Uint64(buf[4:]))
+		buf = buf[enumRecordSize:]
+
+		if int(record.FieldIndex) >= int(schema.header.FieldCount) {
+			return fmt.Errorf("Invalid field index %d in dictionary", record.FieldIndex)
+		}
+		if int(record.Length) > len(buf) {
+			return fmt.Errorf("Truncated dictionary label")
+		}
+
+		fieldName := DecodeCStr(schema.header.Fields[record.FieldIndex].FieldName[:])
+		if values[fieldName] == nil {
+			values[fieldName] = make(TSFEnumDictionary)
+		}
+		values[fieldName][record.Value] = string(buf[:record.Length])
+		buf = buf[record.Length:]
+	}
+
+	tsf.mu.Lock()
+	defer tsf.mu.Unlock()
+
+	for fieldName, dict := range values {
+		schema.addEnumValues(fieldName, dict)
+	}
+	return nil
+}
+
+// Replaces dictionary of the field with the dictionary which also contains
+// values. Call with tsf.mu held
+func (schema *tsfSchema) addEnumValues(fieldName string, values TSFEnumDictionary) {
+	enums := make(map[string]TSFEnumDictionary, len(schema.header.Enums)+1)
+	for name, dict := range schema.header.Enums {
+		enums[name] = dict
+	}
+
+	dict := make(TSFEnumDictionary, len(enums[fieldName])+len(values))
+	for value, label := range enums[fieldName] {
+		dict[value] = label
+	}
+	for value, label := range values {
+		dict[value] = label
+	}
+
+	enums[fieldName] = dict
+	schema.header.Enums = enums
+}
+
+func encodeEnumRecord(fieldIndex uint16, value int64, label string) []byte {
+	buf := make([]byte, enumRecordSize+len(label))
+	binary.LittleEndian.PutUint16(buf, fieldIndex)
+	binary.LittleEndian.PutUint16(buf[2:], uint16(len(label)))
+	binary.LittleEndian.PutUint64(buf[4:], uint64(value))
+	copy(buf[enumRecordSize:], label)
+	return buf
+}
@@ -0,0 +1,177 @@
+package export
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"encoding/json"
+
+	"tsfile"
+)
+
+// Columnar format -- a first line of the file is a JSON header which describes
+// series and its columns followed by raw data of the columns. Each column is
+// an array of count little-endian values of the specified size (strings are
+// zero-padded) which starts at offset bytes after the header line, so they
+// can be loaded directly, i.e. in numpy:
+//
+//		numpy.frombuffer(data, dtype='<i8', count=count, offset=offset)
+//
+// Column types match TSFile field types (see FieldTypeName()), except for
+// variable-length strings which are exported as strings padded to the size
+// of the longest string
+
+const (
+	ColumnarMagic = "TSFCOL"
+)
+
+type ColumnarHeader struct {
+	Magic string `json:"magic"`
+
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+
+	Columns []ColumnarColumn `json:"columns"`
+}
+
+type ColumnarColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Size uint   `json:"size"`
+
+	// Offset of the column data after header line
+	Offset uint64 `json:"offset"`
+}
+
+// Columnar exporter writes columns one after another directly to their final
+// offsets, so it doesn't buffer series but needs a pass over its entries for
+// each column. If series has variable-length strings, one more pass is done
+// before writing header to find sizes of the longest strings
+type columnarExporter struct {
+	writer *bufio.Writer
+
+	header       ColumnarHeader
+	fields       []tsfile.TSFSchemaFieldInfo
+	deserializer *tsfile.TSFDeserializer
+
+	// Index of the column which is written in the current pass (or -1 if
+	// sizes of strings are computed) and number of entries written in it
+	column int
+	count  int
+
+	strBuf []byte
+}
+
+func newColumnarExporter(w io.Writer) *columnarExporter {
+	return &columnarExporter{writer: bufio.NewWriter(w)}
+}
+
+func (exporter *columnarExporter) Begin(schema *tsfile.TSFSchemaHeader, count int) error {
+	info := schema.Info()
+
+	exporter.header = ColumnarHeader{
+		Magic:   ColumnarMagic,
+		Name:    info.Name,
+		Count:   count,
+		Columns: make([]ColumnarColumn, len(info.Fields)),
+	}
+	exporter.column = 0
+	for fi, field := range info.Fields {
+		column := ColumnarColumn{
+			Name: field.FieldName,
+			Type: FieldTypeName(field.FieldType),
+			Size: field.Size,
+		}
+		if field.FieldType == tsfile.TSFFieldVarString {
+			column.Type = FieldTypeName(tsfile.TSFFieldString)
+			column.Size = 1
+			exporter.column = -1
+		}
+		exporter.header.Columns[fi] = column
+	}
+
+	exporter.fields = info.Fields
+	exporter.deserializer = tsfile.NewDeserializer(schema)
+	exporter.count = 0
+	if exporter.column < 0 {
+		return nil
+	}
+	return exporter.writeHeader()
+}
+
+func (exporter *columnarExporter) Write(entry []byte) error {
+	if exporter.column < 0 {
+		for fi, field := range exporter.fields {
+			if field.FieldType == tsfile.TSFFieldVarString {
+				_, value := exporter.deserializer.Get(entry, fi)
+				column := &exporter.header.Columns[fi]
+				if uint(len(value.(string))) >= column.Size {
+					column.Size = uint(len(value.(string))) + 1
+				}
+			}
+		}
+		return nil
+	}
+
+	exporter.count++
+	field := exporter.fields[exporter.column]
+	if field.FieldType != tsfile.TSFFieldVarString {
+		_, err := exporter.writer.Write(entry[field.Offset : field.Offset+field.Size])
+		return err
+	}
+
+	// Write variable-length string as zero-padded fixed-size string
+	buf := exporter.strBuf[:exporter.header.Columns[exporter.column].Size]
+	for i := range buf {
+		buf[i] = 0
+	}
+	_, value := exporter.deserializer.Get(entry, exporter.column)
+	tsfile.EncodeCStr(value.(string), buf)
+
+	_, err := exporter.writer.Write(buf)
+	return err
+}
+
+func (exporter *columnarExporter) nextPass() (bool, error) {
+	if exporter.column < 0 {
+		if err := exporter.writeHeader(); err != nil {
+			return false, err
+		}
+	} else if exporter.count != exporter.header.Count {
+		return false, fmt.Errorf("Column '%s' has %d entries, %d expected",
+			exporter.header.Columns[exporter.column].Name, exporter.count,
+			exporter.header.Count)
+	}
+
+	exporter.column++
+	exporter.count = 0
+	return exporter.column < len(exporter.header.Columns), nil
+}
+
+func (exporter *columnarExporter) End() error {
+	return exporter.writer.Flush()
+}
+
+// Computes offsets of the columns and writes header line
+func (exporter *columnarExporter) writeHeader() error {
+	var offset, maxSize uint64
+	for ci := range exporter.header.Columns {
+		column := &exporter.header.Columns[ci]
+		column.Offset = offset
+		offset += uint64(exporter.header.Count) * uint64(column.Size)
+
+		if uint64(column.Size) > maxSize {
+			maxSize = uint64(column.Size)
+		}
+	}
+	exporter.strBuf = make([]byte, maxSize)
+
+	header, err := json.Marshal(&exporter.header)
+	if err != nil {
+		return err
+	}
+
+	_, err = exporter.writer.Write(append(header, '\n'))
+	return err
+}
@@ -0,0 +1,180 @@
+package export
+
+import (
+	"fmt"
+	"io"
+
+	"math"
+	"strconv"
+
+	"tsfile"
+)
+
+// Export of TSFile series to formats understood by other tools: CSV, JSON
+// Lines (an object per entry) and a simple columnar format (see columnar.go).
+// Field names and types are taken from schema of the series. Time fields are
+// exported as nanoseconds relative to the start of the trace
+
+const (
+	FormatCSV      = "csv"
+	FormatJSONL    = "jsonl"
+	FormatColumnar = "col"
+
+	exportBatchSize = 256
+)
+
+// List of supported formats
+var Formats = []string{FormatCSV, FormatJSONL, FormatColumnar}
+
+type Exporter interface {
+	// Starts exporting series with the specified schema and number of entries
+	Begin(schema *tsfile.TSFSchemaHeader, count int) error
+
+	// Writes single raw entry of the series
+	Write(entry []byte) error
+
+	// Finishes export and flushes all buffered data
+	End() error
+}
+
+// Exporters which write series column by column need to see all entries once
+// per column instead of buffering them. After each pass over entries nextPass()
+// is called which returns false when export is complete
+type multiPassExporter interface {
+	nextPass() (bool, error)
+}
+
+// Creates exporter of the specified format which writes to w
+func NewExporter(format string, w io.Writer) (Exporter, error) {
+	switch format {
+	case FormatCSV:
+		return newCSVExporter(w), nil
+	case FormatJSONL:
+		return newJSONLExporter(w), nil
+	case FormatColumnar:
+		return newColumnarExporter(w), nil
+	}
+
+	return nil, fmt.Errorf("Unknown export format '%s'", format)
+}
+
+// Exports all entries of series tag using exporter
+func ExportSeries(exporter Exporter, tsf *tsfile.TSFile, tag tsfile.TSFPageTag) error {
+	schema, err := tsf.GetSchema(tag)
+	if err != nil {
+		return err
+	}
+
+	count := tsf.GetEntryCount(tag)
+	err = exporter.Begin(schema, count)
+	if err != nil {
+		return err
+	}
+
+	for {
+		err = exportEntries(exporter, tsf, tag, count)
+		if err != nil {
+			return err
+		}
+
+		multiPass, ok := exporter.(multiPassExporter)
+		if !ok {
+			break
+		}
+		more, err := multiPass.nextPass()
+		if err != nil {
+			return err
+		}
+		if !more {
+			break
+		}
+	}
+
+	return exporter.End()
+}
+
+// Reads entries of the series by batches and passes them to exporter
+func exportEntries(exporter Exporter, tsf *tsfile.TSFile, tag tsfile.TSFPageTag, count int) error {
+	for start := 0; start < count; start += exportBatchSize {
+		entries := make([][]byte, exportBatchSize)
+		if start+len(entries) > count {
+			entries = entries[:count-start]
+		}
+
+		err := tsf.GetEntries(tag, entries, start)
+		if err != nil {
+			return fmt.Errorf("Cannot read entries #%d..%d: %v", start,
+				start+len(entries), err)
+		}
+
+		for _, entry := range entries {
+			err = exporter.Write(entry)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Finds series by its name or page tag and returns its tag
+func FindSeries(tsf *tsfile.TSFile, name string) (tsfile.TSFPageTag, error) {
+	for _, series := range tsf.GetStats().Series {
+		if series.Name == name || strconv.Itoa(int(series.Tag)) == name {
+			return series.Tag, nil
+		}
+	}
+
+	return tsfile.TSFTagEmpty, fmt.Errorf("Series '%s' is not found", name)
+}
+
+// Returns name of the field type as it is used in columnar header
+func FieldTypeName(fieldType int) string {
+	switch fieldType {
+	case tsfile.TSFFieldBoolean:
+		return "bool"
+	case tsfile.TSFFieldInt:
+		return "int"
+	case tsfile.TSFFieldFloat:
+		return "float"
+	case tsfile.TSFFieldString:
+		return "str"
+	case tsfile.TSFFieldVarString:
+		return "varstr"
+	case tsfile.TSFFieldStartTime:
+		return "start_time"
+	case tsfile.TSFFieldEndTime:
+		return "end_time"
+	case tsfile.TSFFieldEnumerable:
+		return "enum"
+	}
+
+	return "unknown"
+}
+
+// Formats deserialized value of the field as text
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+
+	return fmt.Sprint(value)
+}
+
+// Checks if float value can be represented in JSON
+func isFiniteFloat(value interface{}) bool {
+	switch v := value.(type) {
+	case float32:
+		return !math.IsNaN(float64(v)) && !math.IsInf(float64(v), 0)
+	case float64:
+		return !math.IsNaN(v) && !math.IsInf(v, 0)
+	}
+
+	return true
+}
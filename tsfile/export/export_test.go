@@ -0,0 +1,189 @@
+package export_test
+
+import (
+	"tsfile"
+	"tsfile/export" // PUT
+
+	"testing"
+
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+)
+
+type exportEntry struct {
+	Start tsfile.TSTimeStart
+	Value int32
+	Load  float64
+	Name  [8]byte
+}
+
+func newExportFile(t *testing.T, count int) (*tsfile.TSFile, tsfile.TSFPageTag) {
+	f, err := ioutil.TempFile("", "tsftest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(f.Name())
+
+	tsf, err := tsfile.NewTSFile(f, tsfile.TSFFormatV2|tsfile.TSFFormatExt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schema, _ := tsfile.NewStructSchema(reflect.TypeOf(exportEntry{}))
+	tag, err := tsf.AddSchema(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := make([]exportEntry, count)
+	for i := range entries {
+		entries[i] = exportEntry{
+			Start: tsfile.TSTimeStart(i * 1000),
+			Value: int32(i),
+			Load:  float64(i) / 2,
+		}
+		tsfile.EncodeCStr("cpu", entries[i].Name[:])
+	}
+	err = tsf.AddEntries(tag, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tsf, tag
+}
+
+func exportSeries(t *testing.T, format string, tsf *tsfile.TSFile, tag tsfile.TSFPageTag) []byte {
+	buf := bytes.NewBuffer(nil)
+	exporter, err := export.NewExporter(format, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = export.ExportSeries(exporter, tsf, tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExportCSV(t *testing.T) {
+	tsf, tag := newExportFile(t, 1000)
+	defer tsf.Put()
+
+	lines := strings.Split(string(exportSeries(t, export.FormatCSV, tsf, tag)), "\n")
+	if len(lines) != 1002 {
+		t.Errorf("Unexpected number of lines: %d", len(lines))
+	}
+	if lines[0] != "Start,Value,Load,Name" {
+		t.Errorf("Unexpected header: %s", lines[0])
+	}
+	if lines[4] != "3000,3,1.5,cpu" {
+		t.Errorf("Unexpected line: %s", lines[4])
+	}
+}
+
+func TestExportJSONL(t *testing.T) {
+	tsf, tag := newExportFile(t, 10)
+	defer tsf.Put()
+
+	lines := strings.Split(string(exportSeries(t, export.FormatJSONL, tsf, tag)), "\n")
+	if lines[1] != `{"Start":1000,"Value":1,"Load":0.5,"Name":"cpu"}` {
+		t.Errorf("Unexpected line: %s", lines[1])
+	}
+
+	var entry map[string]interface{}
+	err := json.Unmarshal([]byte(lines[9]), &entry)
+	if err != nil {
+		t.Error(err)
+	}
+	if entry["Value"] != float64(9) {
+		t.Errorf("Unexpected entry: %v", entry)
+	}
+}
+
+func TestExportColumnar(t *testing.T) {
+	N := 1000
+	tsf, tag := newExportFile(t, N)
+	defer tsf.Put()
+
+	data := exportSeries(t, export.FormatColumnar, tsf, tag)
+	eol := bytes.IndexByte(data, '\n')
+
+	var header export.ColumnarHeader
+	err := json.Unmarshal(data[:eol], &header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Count != N || len(header.Columns) != 4 {
+		t.Fatalf("Unexpected header: %v", header)
+	}
+
+	column := header.Columns[1]
+	if column.Name != "Value" || column.Type != "int" || column.Size != 4 {
+		t.Errorf("Unexpected column: %v", column)
+	}
+
+	data = data[eol+1:]
+	for i := 0; i < N; i++ {
+		off := column.Offset + uint64(i)*uint64(column.Size)
+		value := int32(binary.LittleEndian.Uint32(data[off:]))
+		if value != int32(i) {
+			t.Errorf("Unexpected value #%d: %d", i, value)
+			break
+		}
+	}
+
+	column = header.Columns[3]
+	if tsfile.DecodeCStr(data[column.Offset+uint64(column.Size):]) != "cpu" {
+		t.Errorf("Unexpected string column at %d", column.Offset)
+	}
+}
+
+func TestExportVarString(t *testing.T) {
+	type varStringEntry struct {
+		Start tsfile.TSTimeStart
+		Cmd   tsfile.TSVarString
+	}
+
+	tsf, _ := newExportFile(t, 0)
+	defer tsf.Put()
+
+	schema, _ := tsfile.NewStructSchema(reflect.TypeOf(varStringEntry{}))
+	tag, err := tsf.AddSchema(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tsf.AddEntries(tag, []varStringEntry{{0, "ls"}, {1000, "cat /etc/passwd"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(string(exportSeries(t, export.FormatCSV, tsf, tag)), "\n")
+	if lines[2] != "1000,cat /etc/passwd" {
+		t.Errorf("Unexpected line: %s", lines[2])
+	}
+
+	data := exportSeries(t, export.FormatColumnar, tsf, tag)
+	eol := bytes.IndexByte(data, '\n')
+
+	var header export.ColumnarHeader
+	err = json.Unmarshal(data[:eol], &header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	column := header.Columns[1]
+	if column.Type != "str" || column.Size != 16 {
+		t.Fatalf("Unexpected column: %v", column)
+	}
+
+	data = data[eol+1:]
+	if tsfile.DecodeCStr(data[column.Offset+uint64(column.Size):]) != "cat /etc/passwd" {
+		t.Errorf("Unexpected string column at %d", column.Offset)
+	}
+}
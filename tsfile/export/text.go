@@ -0,0 +1,109 @@
+package export
+
+import (
+	"bufio"
+	"io"
+
+	"encoding/csv"
+	"encoding/json"
+
+	"tsfile"
+)
+
+// CSV exporter -- writes header with field names followed by a row per entry
+type csvExporter struct {
+	writer       *csv.Writer
+	deserializer *tsfile.TSFDeserializer
+	row          []string
+}
+
+func newCSVExporter(w io.Writer) *csvExporter {
+	return &csvExporter{writer: csv.NewWriter(w)}
+}
+
+func (exporter *csvExporter) Begin(schema *tsfile.TSFSchemaHeader, count int) error {
+	info := schema.Info()
+
+	header := make([]string, len(info.Fields))
+	for fi, field := range info.Fields {
+		header[fi] = field.FieldName
+	}
+
+	exporter.deserializer = tsfile.NewDeserializer(schema)
+	exporter.row = make([]string, len(info.Fields))
+	return exporter.writer.Write(header)
+}
+
+func (exporter *csvExporter) Write(entry []byte) error {
+	for fi := range exporter.row {
+		_, value := exporter.deserializer.Get(entry, fi)
+		exporter.row[fi] = formatValue(value)
+	}
+
+	return exporter.writer.Write(exporter.row)
+}
+
+func (exporter *csvExporter) End() error {
+	exporter.writer.Flush()
+	return exporter.writer.Error()
+}
+
+// JSON Lines exporter -- writes an object per entry, fields are written in
+// the order of schema
+type jsonlExporter struct {
+	writer       *bufio.Writer
+	deserializer *tsfile.TSFDeserializer
+	names        [][]byte
+}
+
+func newJSONLExporter(w io.Writer) *jsonlExporter {
+	return &jsonlExporter{writer: bufio.NewWriter(w)}
+}
+
+func (exporter *jsonlExporter) Begin(schema *tsfile.TSFSchemaHeader, count int) error {
+	info := schema.Info()
+
+	exporter.deserializer = tsfile.NewDeserializer(schema)
+	exporter.names = make([][]byte, len(info.Fields))
+	for fi, field := range info.Fields {
+		name, err := json.Marshal(field.FieldName)
+		if err != nil {
+			return err
+		}
+		exporter.names[fi] = name
+	}
+
+	return nil
+}
+
+func (exporter *jsonlExporter) Write(entry []byte) error {
+	writer := exporter.writer
+
+	writer.WriteByte('{')
+	for fi, name := range exporter.names {
+		if fi > 0 {
+			writer.WriteByte(',')
+		}
+		writer.Write(name)
+		writer.WriteByte(':')
+
+		_, value := exporter.deserializer.Get(entry, fi)
+		if !isFiniteFloat(value) {
+			// NaN and infinities are not supported by JSON
+			value = nil
+		}
+
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		writer.Write(data)
+	}
+	writer.WriteString("}\n")
+
+	return nil
+}
+
+func (exporter *jsonlExporter) End() error {
+	return exporter.writer.Flush()
+}
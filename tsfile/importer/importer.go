@@ -0,0 +1,365 @@
+package importer
+
+import (
+	"fmt"
+	"io"
+
+	"encoding/binary"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"tsfile"
+)
+
+// Import of external time series from CSV and JSON into TSFile. Schema of the
+// series is either provided by caller or inferred from the data: columns which
+// only contain integers become int fields, numbers -- float fields, "true" and
+// "false" -- booleans, and the rest are strings long enough to keep longest
+// value or variable-length strings if values are too long. Time columns
+// become start and end time fields; their values are converted to nanoseconds
+// and may be rebased to a base time, so they will be relative to the start of
+// the trace (like incident's GlobalTime).
+
+const (
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+
+	// Numeric timestamps units. If time format is empty, numeric values are
+	// treated as nanoseconds and strings are parsed as RFC3339 time
+	TimeSeconds      = "s"
+	TimeMilliseconds = "ms"
+	TimeMicroseconds = "us"
+	TimeNanoseconds  = "ns"
+
+	// Default series name if neither options nor schema provide one
+	defaultSeriesName = "imported"
+
+	// Maximum size of string field in inferred schema (including
+	// terminating zero), longer values are kept as variable-length strings
+	maxStringSize = 256
+)
+
+// List of supported formats
+var Formats = []string{FormatCSV, FormatJSON}
+
+// Default names of time columns which are used if no column is specified
+// in options
+var defaultStartTimeColumns = []string{"start_time", "time", "timestamp"}
+var defaultEndTimeColumns = []string{"end_time"}
+
+type Options struct {
+	// Format of the input data: csv with a header row or json which is
+	// either an array of objects or a stream of objects (JSON Lines)
+	Format string
+
+	// Name of the series for inferred schema
+	Name string
+
+	// Schema of the series. Fields are matched with columns by names. If
+	// nil, schema is inferred from the data
+	Schema *tsfile.TSFSchemaHeader
+
+	// Names of the columns which contain start and end time of the entry
+	// (only used when schema is inferred)
+	StartTime string
+	EndTime   string
+
+	// Format of timestamps: one of the numeric units above or a layout
+	// accepted by time.Parse()
+	TimeFormat string
+
+	// Base time in nanoseconds which is subtracted from all timestamps
+	BaseTime int64
+}
+
+// Table of values read from input. Values are kept as strings until schema
+// is known, empty strings represent missing values
+type table struct {
+	columns []string
+	rows    [][]string
+}
+
+// Reads series from r, adds its schema and entries ordered by start time to
+// tsf and returns tag of the new series and number of imported entries
+func Import(tsf *tsfile.TSFile, r io.Reader, opts *Options) (tsfile.TSFPageTag, int, error) {
+	var data *table
+	var err error
+	switch opts.Format {
+	case FormatCSV:
+		data, err = readCSV(r)
+	case FormatJSON:
+		data, err = readJSON(r)
+	default:
+		err = fmt.Errorf("Unknown import format '%s'", opts.Format)
+	}
+	if err != nil {
+		return tsfile.TSFTagEmpty, 0, err
+	}
+
+	schema := opts.Schema
+	if schema == nil {
+		schema, err = inferSchema(data, opts)
+		if err != nil {
+			return tsfile.TSFTagEmpty, 0, err
+		}
+	}
+
+	// Encode all entries before adding schema, so malformed input
+	// doesn't leave an empty series in the file
+	entries, err := encodeEntries(schema, data, opts)
+	if err != nil {
+		return tsfile.TSFTagEmpty, 0, err
+	}
+
+	tag, err := tsf.AddSchema(schema)
+	if err != nil {
+		return tsfile.TSFTagEmpty, 0, err
+	}
+	if len(entries) > 0 {
+		err = tsf.AddEntries(tag, entries)
+	}
+	return tag, len(entries), err
+}
+
+// Infers schema of the series from table values
+func inferSchema(data *table, opts *Options) (*tsfile.TSFSchemaHeader, error) {
+	startColumn := findColumn(data, opts.StartTime, defaultStartTimeColumns)
+	endColumn := findColumn(data, opts.EndTime, defaultEndTimeColumns)
+	if startColumn < 0 {
+		return nil, fmt.Errorf("No start time column found in %v", data.columns)
+	}
+
+	fields := make([]tsfile.TSFSchemaField, len(data.columns))
+	for ci, column := range data.columns {
+		switch ci {
+		case startColumn:
+			fields[ci] = tsfile.TSFSchemaField{FieldType: tsfile.TSFFieldStartTime, Size: 8}
+		case endColumn:
+			fields[ci] = tsfile.TSFSchemaField{FieldType: tsfile.TSFFieldEndTime, Size: 8}
+		default:
+			fields[ci] = inferField(data, ci)
+		}
+
+		tsfile.EncodeCStr(column, fields[ci].FieldName[:])
+	}
+
+	name := opts.Name
+	if len(name) == 0 {
+		name = defaultSeriesName
+	}
+	return tsfile.NewSchema(name, fields)
+}
+
+// Finds index of the column with the specified name or, if name is empty,
+// with first of the default names. Returns -1 if not found
+func findColumn(data *table, name string, defaultNames []string) int {
+	names := defaultNames
+	if len(name) > 0 {
+		names = []string{name}
+	}
+
+	for _, name := range names {
+		for ci, column := range data.columns {
+			if column == name {
+				return ci
+			}
+		}
+	}
+	return -1
+}
+
+// Infers type of the column ci by checking all of its values
+func inferField(data *table, ci int) tsfile.TSFSchemaField {
+	isInt, isFloat, isBool := true, true, true
+	maxLength := 0
+	for _, row := range data.rows {
+		value := row[ci]
+		if len(value) == 0 {
+			continue
+		}
+
+		if isInt {
+			_, err := strconv.ParseInt(value, 10, 64)
+			isInt = err == nil
+		}
+		if isFloat {
+			_, err := strconv.ParseFloat(value, 64)
+			isFloat = err == nil
+		}
+		if isBool {
+			isBool = value == "true" || value == "false"
+		}
+		if len(value) > maxLength {
+			maxLength = len(value)
+		}
+	}
+
+	field := tsfile.TSFSchemaField{Size: 8}
+	switch {
+	case maxLength == 0 || isInt:
+		field.FieldType = tsfile.TSFFieldInt
+	case isFloat:
+		field.FieldType = tsfile.TSFFieldFloat
+	case isBool:
+		field.FieldType = tsfile.TSFFieldBoolean
+		field.Size = 4
+	case maxLength >= maxStringSize:
+		field = tsfile.NewVarStringField("")
+	default:
+		field.FieldType = tsfile.TSFFieldString
+		field.Size = uint64(maxLength + 1)
+	}
+	return field
+}
+
+// Encodes rows of the table as raw entries according to schema
+func encodeEntries(schema *tsfile.TSFSchemaHeader, data *table,
+	opts *Options) ([][]byte, error) {
+	info := schema.Info()
+
+	// Map schema fields to table columns
+	columns := make([]int, len(info.Fields))
+	for fi, field := range info.Fields {
+		columns[fi] = findColumn(data, field.FieldName, nil)
+		if columns[fi] < 0 {
+			return nil, fmt.Errorf("No column found for field '%s'", field.FieldName)
+		}
+	}
+
+	entries := make([][]byte, len(data.rows))
+	for ri, row := range data.rows {
+		entry := make([]byte, info.EntrySize)
+		for fi, field := range info.Fields {
+			if field.FieldType == tsfile.TSFFieldVarString {
+				entry = tsfile.EncodeVarString(entry, field.Offset, row[columns[fi]])
+				continue
+			}
+
+			buf := entry[field.Offset : field.Offset+field.Size]
+			err := encodeValue(buf, field.FieldType, row[columns[fi]], opts)
+			if err != nil {
+				return nil, fmt.Errorf("Error in row #%d, column '%s': %v",
+					ri+1, field.FieldName, err)
+			}
+		}
+
+		entries[ri] = entry
+	}
+
+	sortEntries(info, entries)
+	return entries, nil
+}
+
+// Orders entries by their start time (keeping order of rows with equal
+// times) as entries of series are searched by time (see tsfile/index.go)
+func sortEntries(info tsfile.TSFSchemaInfo, entries [][]byte) {
+	for _, field := range info.Fields {
+		if field.FieldType != tsfile.TSFFieldStartTime {
+			continue
+		}
+
+		off := field.Offset
+		sort.SliceStable(entries, func(i, j int) bool {
+			return int64(binary.LittleEndian.Uint64(entries[i][off:])) <
+				int64(binary.LittleEndian.Uint64(entries[j][off:]))
+		})
+		return
+	}
+}
+
+// Encodes single value into buf which has size of the field
+func encodeValue(buf []byte, fieldType int, value string, opts *Options) error {
+	if fieldType == tsfile.TSFFieldString {
+		tsfile.EncodeCStr(value, buf)
+		return nil
+	}
+	if len(value) == 0 {
+		// Missing value, keep zero
+		return nil
+	}
+
+	switch fieldType {
+	case tsfile.TSFFieldInt, tsfile.TSFFieldEnumerable:
+		i, err := strconv.ParseInt(value, 10, len(buf)*8)
+		if err != nil {
+			return err
+		}
+		return encodeInt(buf, uint64(i))
+	case tsfile.TSFFieldFloat:
+		f, err := strconv.ParseFloat(value, len(buf)*8)
+		if err != nil {
+			return err
+		}
+		if len(buf) == 4 {
+			return encodeInt(buf, uint64(math.Float32bits(float32(f))))
+		}
+		return encodeInt(buf, math.Float64bits(f))
+	case tsfile.TSFFieldBoolean:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		return encodeInt(buf, uint64(tsfile.FromBoolean(b)))
+	case tsfile.TSFFieldStartTime, tsfile.TSFFieldEndTime:
+		t, err := parseTime(value, opts.TimeFormat)
+		if err != nil {
+			return err
+		}
+		return encodeInt(buf, uint64(t-opts.BaseTime))
+	}
+
+	return fmt.Errorf("Unsupported field type %d", fieldType)
+}
+
+func encodeInt(buf []byte, value uint64) error {
+	switch len(buf) {
+	case 1:
+		buf[0] = uint8(value)
+	case 2:
+		binary.LittleEndian.PutUint16(buf, uint16(value))
+	case 4:
+		binary.LittleEndian.PutUint32(buf, uint32(value))
+	case 8:
+		binary.LittleEndian.PutUint64(buf, value)
+	default:
+		return fmt.Errorf("Unsupported field size %d", len(buf))
+	}
+	return nil
+}
+
+// Parses timestamp and returns it in nanoseconds
+func parseTime(value string, format string) (int64, error) {
+	var unit int64
+	switch format {
+	case TimeSeconds:
+		unit = int64(time.Second)
+	case TimeMilliseconds:
+		unit = int64(time.Millisecond)
+	case TimeMicroseconds:
+		unit = int64(time.Microsecond)
+	case TimeNanoseconds:
+		unit = 1
+	case "":
+		if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return i, nil
+		}
+
+		t, err := time.Parse(time.RFC3339Nano, value)
+		return t.UnixNano(), err
+	default:
+		t, err := time.Parse(format, value)
+		return t.UnixNano(), err
+	}
+
+	// Numeric timestamps may be fractional, i.e. seconds with microseconds
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return i * unit, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(f * float64(unit)), nil
+}
@@ -0,0 +1,194 @@
+package importer_test
+
+import (
+	"tsfile"
+	"tsfile/importer" // PUT
+
+	"testing"
+
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+)
+
+func newImportFile(t *testing.T) *tsfile.TSFile {
+	f, err := ioutil.TempFile("", "tsftest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(f.Name())
+
+	tsf, err := tsfile.NewTSFile(f, tsfile.TSFFormatV2|tsfile.TSFFormatExt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tsf
+}
+
+func importData(t *testing.T, tsf *tsfile.TSFile, data string,
+	opts *importer.Options) []map[string]interface{} {
+	tag, count, err := importer.Import(tsf, strings.NewReader(data), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schema, err := tsf.GetSchema(tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deserializer := tsfile.NewDeserializer(schema)
+
+	entries := make([][]byte, count)
+	err = tsf.GetEntries(tag, entries, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := make([]map[string]interface{}, count)
+	for ei, entry := range entries {
+		values[ei] = make(map[string]interface{})
+		for fi := 0; fi < deserializer.Len(); fi++ {
+			name, value := deserializer.Get(entry, fi)
+			values[ei][name] = value
+		}
+	}
+	return values
+}
+
+func TestImportCSV(t *testing.T) {
+	tsf := newImportFile(t)
+	defer tsf.Put()
+
+	values := importData(t, tsf, `time,cpu,load,state
+1000,0,0.5,idle
+2000,1,1,running
+`, &importer.Options{Format: importer.FormatCSV, Name: "cpu"})
+
+	expected := []map[string]interface{}{
+		{"time": tsfile.TSTimeStart(1000), "cpu": int64(0),
+			"load": float64(0.5), "state": "idle"},
+		{"time": tsfile.TSTimeStart(2000), "cpu": int64(1),
+			"load": float64(1), "state": "running"},
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Unexpected entries: %v", values)
+	}
+
+	stats := tsf.GetStats()
+	if stats.Series[0].Name != "cpu" {
+		t.Errorf("Unexpected series name: %s", stats.Series[0].Name)
+	}
+}
+
+func TestImportJSON(t *testing.T) {
+	tsf := newImportFile(t)
+	defer tsf.Put()
+
+	data := `{"ts": "2017-01-01T00:00:01Z", "end": "2017-01-01T00:00:02Z", "ok": true}
+{"ts": "2017-01-01T00:00:03Z", "end": "2017-01-01T00:00:04Z", "ok": false, "tags": [1]}`
+
+	values := importData(t, tsf, data, &importer.Options{
+		Format:    importer.FormatJSON,
+		StartTime: "ts",
+		EndTime:   "end",
+		BaseTime:  1483228800000000000,
+	})
+	if len(values) != 2 {
+		t.Fatalf("Unexpected number of entries: %d", len(values))
+	}
+
+	expected := map[string]interface{}{
+		"ts": tsfile.TSTimeStart(3000000000), "end": tsfile.TSTimeEnd(4000000000),
+		"ok": false, "tags": "[1]",
+	}
+	if !reflect.DeepEqual(values[1], expected) {
+		t.Errorf("Unexpected entry: %v", values[1])
+	}
+	if values[0]["tags"] != "" {
+		t.Errorf("Missing value is not empty: %v", values[0])
+	}
+
+	// Same data as an array
+	values = importData(t, tsf, "["+strings.Replace(data, "\n", ",", 1)+"]",
+		&importer.Options{Format: importer.FormatJSON, StartTime: "ts"})
+	if len(values) != 2 || values[0]["ts"] != tsfile.TSTimeStart(1483228801000000000) {
+		t.Errorf("Unexpected entries: %v", values)
+	}
+}
+
+func TestImportSchema(t *testing.T) {
+	type S struct {
+		Start tsfile.TSTimeStart
+		Value int32
+	}
+
+	tsf := newImportFile(t)
+	defer tsf.Put()
+
+	schema, _ := tsfile.NewStructSchema(reflect.TypeOf(S{}))
+	opts := &importer.Options{
+		Format:     importer.FormatCSV,
+		Schema:     schema,
+		TimeFormat: importer.TimeMilliseconds,
+	}
+
+	values := importData(t, tsf, "Value,Start,Extra\n5,1.5,x\n", opts)
+	if len(values) != 1 || values[0]["Start"] != tsfile.TSTimeStart(1500000) ||
+		values[0]["Value"] != int32(5) {
+		t.Errorf("Unexpected entries: %v", values)
+	}
+
+	_, _, err := importer.Import(tsf, strings.NewReader("Value,Start\nx,1\n"), opts)
+	if err == nil {
+		t.Errorf("Invalid value is imported")
+	}
+
+	_, _, err = importer.Import(tsf, strings.NewReader("Value\n1\n"), opts)
+	if err == nil {
+		t.Errorf("Missing column is imported")
+	}
+	if len(tsf.GetStats().Series) != 1 {
+		t.Errorf("Failed import left series in file")
+	}
+}
+
+func TestImportVarString(t *testing.T) {
+	tsf := newImportFile(t)
+	defer tsf.Put()
+
+	command := strings.Repeat("a", 1000)
+	values := importData(t, tsf, "time,pid,command\n1,100,"+command+"\n2,101,ls\n",
+		&importer.Options{Format: importer.FormatCSV})
+
+	if len(values) != 2 || values[0]["command"] != command || values[1]["command"] != "ls" {
+		t.Errorf("Unexpected entries: %v", values)
+	}
+}
+
+func TestImportUnordered(t *testing.T) {
+	tsf := newImportFile(t)
+	defer tsf.Put()
+
+	values := importData(t, tsf, "time,id\n3000,0\n1000,1\n2000,2\n1000,3\n",
+		&importer.Options{Format: importer.FormatCSV})
+
+	expected := []map[string]interface{}{
+		{"time": tsfile.TSTimeStart(1000), "id": int64(1)},
+		{"time": tsfile.TSTimeStart(1000), "id": int64(3)},
+		{"time": tsfile.TSTimeStart(2000), "id": int64(2)},
+		{"time": tsfile.TSTimeStart(3000), "id": int64(0)},
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Entries are not ordered by time: %v", values)
+	}
+
+	tag := tsf.GetStats().Series[0].Tag
+	start, end, err := tsf.FindEntryRange(tag, 1500, 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start != 2 || end != 3 {
+		t.Errorf("Unexpected range of entries: [%d; %d)", start, end)
+	}
+}
@@ -0,0 +1,141 @@
+package importer
+
+import (
+	"fmt"
+	"io"
+
+	"encoding/csv"
+	"encoding/json"
+)
+
+// Reads CSV data, first row should contain names of the columns
+func readCSV(r io.Reader) (*table, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("CSV header is missing")
+	}
+
+	return &table{columns: records[0], rows: records[1:]}, nil
+}
+
+// Reads JSON data which is either an array of objects or a sequence of
+// objects. Columns are ordered in order of first appearance of keys
+func readJSON(r io.Reader) (*table, error) {
+	data := new(table)
+	columnIndex := make(map[string]int)
+
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+
+	token, err := decoder.Token()
+	if err == io.EOF {
+		return data, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	isArray := token == json.Delim('[')
+	for {
+		if isArray {
+			if !decoder.More() {
+				break
+			}
+
+			token, err = decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+		}
+		if token != json.Delim('{') {
+			return nil, fmt.Errorf("Expected object at offset %d", decoder.InputOffset())
+		}
+
+		row, err := readJSONObject(decoder, data, columnIndex)
+		if err != nil {
+			return nil, err
+		}
+		data.rows = append(data.rows, row)
+
+		if !isArray {
+			token, err = decoder.Token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Rows read before new columns were found are shorter than columns
+	for ri, row := range data.rows {
+		for len(row) < len(data.columns) {
+			row = append(row, "")
+		}
+		data.rows[ri] = row
+	}
+	return data, nil
+}
+
+// Reads single object (which opening brace is already consumed by decoder)
+// as a row, adding new keys to the list of columns
+func readJSONObject(decoder *json.Decoder, data *table,
+	columnIndex map[string]int) ([]string, error) {
+	row := make([]string, len(data.columns))
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		key := token.(string)
+
+		var value interface{}
+		err = decoder.Decode(&value)
+		if err != nil {
+			return nil, err
+		}
+
+		ci, ok := columnIndex[key]
+		if !ok {
+			ci = len(data.columns)
+			columnIndex[key] = ci
+			data.columns = append(data.columns, key)
+		}
+		for len(row) <= ci {
+			row = append(row, "")
+		}
+
+		row[ci], err = formatJSONValue(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Consume closing brace
+	_, err := decoder.Token()
+	return row, err
+}
+
+func formatJSONValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return fmt.Sprint(v), nil
+	}
+
+	// Nested objects and arrays are kept as JSON strings
+	data, err := json.Marshal(value)
+	return string(data), err
+}
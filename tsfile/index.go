@@ -0,0 +1,244 @@
+package tsfile
+
+import (
+	"fmt"
+
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// Time index -- allows to seek series by start time of the entries instead of
+// their indices. Entries of a single series are expected to be written in order
+// of their start times, so we binary search pages using their ranges of times
+// (which are lazily loaded and cached in pageIndex), and then binary search
+// entries inside the page
+
+// Finds index of the first entry in series which start time is not less than
+// t. If all entries are older than t, returns number of entries in series
+func (tsf *TSFile) FindEntryByTime(tag TSFPageTag, t TSTimeStart) (int, error) {
+	field, err := tsf.getStartTimeField(tag)
+	if err != nil {
+		return -1, err
+	}
+
+	start, end, err := tsf.findPageRangeByTime(tag, t, field)
+	if err != nil {
+		return -1, err
+	}
+
+	// Binary search entry inside page range
+	for end > start {
+		med := start + (end-start)/2
+		entryTime, err := tsf.getEntryTime(tag, med, field)
+		if err != nil {
+			return -1, err
+		}
+
+		if entryTime < t {
+			start = med + 1
+		} else {
+			end = med
+		}
+	}
+
+	return start, nil
+}
+
+// Returns range of entry indices [start; end) which start times are
+// within [from; to) time range
+func (tsf *TSFile) FindEntryRange(tag TSFPageTag, from, to TSTimeStart) (int, int, error) {
+	start, err := tsf.FindEntryByTime(tag, from)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	end, err := tsf.FindEntryByTime(tag, to)
+	if err != nil {
+		return -1, -1, err
+	}
+	if end < start {
+		end = start
+	}
+
+	return start, end, nil
+}
+
+// Gets raw entries of type tag which start times are within [from; to) range
+func (tsf *TSFile) GetEntriesInRange(tag TSFPageTag, from, to TSTimeStart) ([][]byte, error) {
+	start, end, err := tsf.FindEntryRange(tag, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([][]byte, end-start)
+	if len(entries) > 0 {
+		err = tsf.GetEntries(tag, entries, start)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// Returns start time field of schema or error if series doesn't have one
+func (tsf *TSFile) getStartTimeField(tag TSFPageTag) (TSFSchemaField, error) {
+	schema, err := tsf.GetSchema(tag)
+	if err != nil {
+		return TSFSchemaField{}, err
+	}
+
+	for fieldId := 0; fieldId < int(schema.FieldCount); fieldId++ {
+		if schema.Fields[fieldId].FieldType == TSFFieldStartTime {
+			return schema.Fields[fieldId], nil
+		}
+	}
+
+	return TSFSchemaField{}, fmt.Errorf("Schema #%d doesn't have start time field",
+		tag.toSchemaId())
+}
+
+// Reads start time of entry of series with specified index
+func (tsf *TSFile) getSeriesTime(tag TSFPageTag, index int) (TSTimeStart, error) {
+	field, err := tsf.getStartTimeField(tag)
+	if err != nil {
+		return 0, err
+	}
+	return tsf.getEntryTime(tag, index, field)
+}
+
+// Reads start time of entry with specified index
+func (tsf *TSFile) getEntryTime(tag TSFPageTag, index int, field TSFSchemaField) (TSTimeStart, error) {
+	pageId, byteOffset, err := tsf.findDataPage(tag, index)
+	if err != nil {
+		return 0, err
+	}
+
+	page, err := tsf.readPage(pageId)
+	if err != nil {
+		return 0, err
+	}
+
+	return page.readTime(byteOffset + int64(field.Offset))
+}
+
+// Narrows range of entries [start; end) which may contain first entry with
+// start time t using time ranges of pages
+func (tsf *TSFile) findPageRangeByTime(tag TSFPageTag, t TSTimeStart,
+	field TSFSchemaField) (int, int, error) {
+
+	count := tsf.GetEntryCount(tag)
+	if !tsf.formatFlags.hasExtents() {
+		// Pages in V1 are aligned by entries, so binary search over all
+		// entries is good enough for it
+		return 0, count, nil
+	}
+
+	a, b := 0, tsf.getPageIndexCount(tag.toSchemaId())
+	for b > a {
+		med := a + (b-a)/2
+		next, start, pageCount, minTime, maxTime, err := tsf.findNonEmptyPage(
+			tag, med, b, field)
+		if err != nil {
+			return -1, -1, err
+		}
+
+		switch {
+		case pageCount == 0:
+			// No pages in [med; b) are referring entries
+			b = med
+		case t > maxTime:
+			a = next + 1
+		case t <= minTime:
+			b = med
+		default:
+			return start, start + pageCount, nil
+		}
+	}
+
+	if a < tsf.getPageIndexCount(tag.toSchemaId()) {
+		start, _, _, _, err := tsf.getPageTimeRange(tag, a, field)
+		return start, start, err
+	}
+	return count, count, nil
+}
+
+// Skips pages which are not referring any entries (which are allocated
+// concurrently or being filled) starting with idx-th element of page index
+// and returns time range of the first non-empty page before end-th element
+func (tsf *TSFile) findNonEmptyPage(tag TSFPageTag, idx, end int, field TSFSchemaField) (
+	next, start, count int, minTime, maxTime TSTimeStart, err error) {
+
+	for next = idx; next < end; next++ {
+		start, count, minTime, maxTime, err = tsf.getPageTimeRange(tag, next, field)
+		if err != nil || count > 0 {
+			return
+		}
+	}
+	return
+}
+
+func (tsf *TSFile) getPageIndexCount(schemaId TSFSchemaId) int {
+	tsf.mu.RLock()
+	defer tsf.mu.RUnlock()
+
+	return len(tsf.schemas[schemaId].pageIndex)
+}
+
+// Returns starting entry, number of entries and range of start times for
+// page which is referred by idx-th element of page index. Loads page to
+// determine range if it is not cached yet
+func (tsf *TSFile) getPageTimeRange(tag TSFPageTag, idx int, field TSFSchemaField) (
+	start, count int, minTime, maxTime TSTimeStart, err error) {
+
+	tsf.mu.RLock()
+	pageIndex := tsf.schemas[tag.toSchemaId()].pageIndex[idx]
+	pageId := pageIndex.pageId
+	pageCount := atomic.LoadUint32(&tsf.pageHeaders[pageId].Count)
+	start = int(atomic.LoadUint32(&tsf.schemas[tag.toSchemaId()].pageIndex[idx].start))
+	tsf.mu.RUnlock()
+
+	count = int(pageCount)
+	if count == 0 {
+		return
+	}
+	if pageIndex.timeCount == pageCount {
+		return start, count, pageIndex.minTime, pageIndex.maxTime, nil
+	}
+
+	page, err := tsf.readPage(pageId)
+	if err != nil {
+		return
+	}
+
+	// Entries in series are ordered by time, so we only need first and last
+	// entries to get range of times
+	entrySize := int64(tsf.getEntrySize(tag.toSchemaId()))
+	minTime, err = page.readTime(int64(field.Offset))
+	if err == nil {
+		maxTime, err = page.readTime(int64(count-1)*entrySize + int64(field.Offset))
+	}
+	if err != nil {
+		return
+	}
+
+	tsf.mu.Lock()
+	defer tsf.mu.Unlock()
+
+	cached := &tsf.schemas[tag.toSchemaId()].pageIndex[idx]
+	cached.minTime, cached.maxTime = minTime, maxTime
+	cached.timeCount = pageCount
+	return
+}
+
+// Reads time value at offset off of the page
+func (page *tsfPage) readTime(off int64) (TSTimeStart, error) {
+	page.mu.Lock()
+	defer page.mu.Unlock()
+
+	buf := page.buf.Bytes()
+	if off < 0 || off+8 > int64(len(buf)) {
+		return 0, fmt.Errorf("Time at offset %d is beyond page size %d", off, len(buf))
+	}
+
+	return TSTimeStart(binary.LittleEndian.Uint64(buf[off:])), nil
+}
@@ -0,0 +1,75 @@
+package tsfile
+
+import (
+	"testing"
+
+	"io/ioutil"
+	"os"
+	"reflect"
+)
+
+func TestFindEntryByTimeEmptyPage(t *testing.T) {
+	type S struct {
+		T TSTimeStart
+		I int64
+	}
+
+	f, err := ioutil.TempFile("", "tsftest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	tsf, err := NewTSFile(f, TSFFormatV2|TSFFormatExt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tsf.Put()
+
+	schema, err := NewStructSchema(reflect.TypeOf(S{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := tsf.AddSchema(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	N := 2000
+	entries := make([]S, N)
+	for i := range entries {
+		entries[i] = S{T: TSTimeStart(i * 10), I: int64(i)}
+	}
+	if err = tsf.AddEntries(tag, entries); err != nil {
+		t.Fatal(err)
+	}
+
+	// Allocate page which doesn't refer any entries and move it to the middle
+	// of page index, so binary search hits it first
+	tsf.allocateDataPage(tag, 0)
+
+	tsf.mu.Lock()
+	pageIndex := tsf.schemas[tag.toSchemaId()].pageIndex
+	med := (len(pageIndex) - 1) / 2
+	emptyPage := pageIndex[len(pageIndex)-1]
+	emptyPage.start = pageIndex[med].start
+	copy(pageIndex[med+1:], pageIndex[med:len(pageIndex)-1])
+	pageIndex[med] = emptyPage
+	tsf.mu.Unlock()
+
+	for _, tc := range []struct {
+		t     TSTimeStart
+		index int
+	}{
+		{0, 0}, {5, 1}, {10000, 1000}, {15005, 1501},
+		{19990, N - 1}, {19995, N},
+	} {
+		index, err := tsf.FindEntryByTime(tag, tc.t)
+		if err != nil {
+			t.Error(err)
+		}
+		if index != tc.index {
+			t.Errorf("Unexpected index for time %d: %d != %d", tc.t, index, tc.index)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package tsfile
+
+import (
+	"fmt"
+
+	"encoding/binary"
+	"math"
+)
+
+// Schema mapping -- allows to combine series which schema has evolved, i.e.
+// when provider gained new fields. Fields of the source schema are matched
+// with fields of the target schema by names and types: fields which are
+// missing in source are filled with default values (zeroes unless default is
+// set by SetDefault()) and fields which are missing in target are dropped.
+// Integer and float fields may have different sizes, strings are truncated
+// to the size of target field.
+//
+// Mapping works on raw entries with resolved variable-length strings (like
+// ones returned by GetEntries()), so it is used by MergeFile() and may be used
+// by readers which need entries of older series in the layout of newer ones.
+
+type TSFSchemaMapping struct {
+	from, to *TSFSchemaHeader
+
+	// Mapping per field of target schema
+	fields []tsfFieldMapping
+
+	// Deserializer of source entries used to get variable-length strings
+	deserializer *TSFDeserializer
+
+	// Schemas are the same, entries do not need to be converted
+	identical bool
+}
+
+type tsfFieldMapping struct {
+	// Index of the field in source schema or -1 if it is missing
+	source int
+
+	// Raw value (or string for variable-length strings) which is used
+	// if field is missing in source
+	defaultValue []byte
+}
+
+// Creates mapping of entries of from schema to entries of to schema. Returns
+// error if fields with the same name have different types or if schemas do
+// not have common fields
+func NewSchemaMapping(from, to *TSFSchemaHeader) (*TSFSchemaMapping, error) {
+	mapping := &TSFSchemaMapping{
+		from:         from,
+		to:           to,
+		fields:       make([]tsfFieldMapping, to.FieldCount),
+		deserializer: NewDeserializer(from),
+		identical:    from.Validate(to) == nil,
+	}
+
+	matched := 0
+	for fi := range mapping.fields {
+		field := &to.Fields[fi]
+		fieldMapping := &mapping.fields[fi]
+		fieldMapping.source = from.findField(DecodeCStr(field.FieldName[:]))
+		if fieldMapping.source < 0 {
+			fieldMapping.defaultValue = make([]byte, field.Size)
+			if field.FieldType == TSFFieldVarString {
+				fieldMapping.defaultValue = nil
+			}
+			continue
+		}
+
+		fromField := &from.Fields[fieldMapping.source]
+		if fromField.FieldType != field.FieldType {
+			return nil, fmt.Errorf("Cannot map field %s: type mismatch: (%d, %d)",
+				DecodeCStr(field.FieldName[:]), fromField.FieldType, field.FieldType)
+		}
+		matched++
+	}
+
+	if matched == 0 {
+		return nil, fmt.Errorf("Schemas %s and %s do not have common fields",
+			DecodeCStr(from.Name[:]), DecodeCStr(to.Name[:]))
+	}
+	return mapping, nil
+}
+
+// Returns true if schemas are the same and entries can be copied as is
+func (mapping *TSFSchemaMapping) Identical() bool {
+	return mapping.identical
+}
+
+// Returns names of the fields of target schema which are filled with
+// default values
+func (mapping *TSFSchemaMapping) Missing() (names []string) {
+	for fi, fieldMapping := range mapping.fields {
+		if fieldMapping.source < 0 {
+			names = append(names, DecodeCStr(mapping.to.Fields[fi].FieldName[:]))
+		}
+	}
+	return
+}
+
+// Sets default value of the field missing in source schema. Value should be
+// integer, float, boolean or string depending on type of the field
+func (mapping *TSFSchemaMapping) SetDefault(name string, value interface{}) error {
+	fi := mapping.to.findField(name)
+	if fi < 0 {
+		return fmt.Errorf("Field '%s' is not found in schema", name)
+	}
+
+	field := &mapping.to.Fields[fi]
+	fieldMapping := &mapping.fields[fi]
+	if fieldMapping.source >= 0 {
+		return fmt.Errorf("Field '%s' is not missing in source schema", name)
+	}
+
+	buf := make([]byte, field.Size)
+	switch v := value.(type) {
+	case int, int8, int16, int32, int64:
+		if !isIntField(field) {
+			return fmt.Errorf("Field '%s' is not an integer", name)
+		}
+		encodeInt(buf, int(field.Size), toInt64(value))
+	case float32, float64:
+		if field.FieldType != TSFFieldFloat {
+			return fmt.Errorf("Field '%s' is not a float", name)
+		}
+		encodeFloat(buf, toFloat64(value))
+	case bool:
+		if field.FieldType != TSFFieldBoolean {
+			return fmt.Errorf("Field '%s' is not a boolean", name)
+		}
+		binary.LittleEndian.PutUint32(buf, uint32(FromBoolean(v)))
+	case string:
+		switch field.FieldType {
+		case TSFFieldString:
+			EncodeCStr(v, buf)
+		case TSFFieldVarString:
+			buf = []byte(v)
+		default:
+			return fmt.Errorf("Field '%s' is not a string", name)
+		}
+	default:
+		return fmt.Errorf("Unsupported default value of type %T", value)
+	}
+
+	fieldMapping.defaultValue = buf
+	return nil
+}
+
+// Converts raw entry of source schema to the raw entry of target schema
+func (mapping *TSFSchemaMapping) Map(entry []byte) []byte {
+	out := make([]byte, mapping.to.EntrySize)
+	for fi, fieldMapping := range mapping.fields {
+		field := &mapping.to.Fields[fi]
+		if field.FieldType == TSFFieldVarString {
+			value := string(fieldMapping.defaultValue)
+			if fieldMapping.source >= 0 {
+				_, str := mapping.deserializer.Get(entry, fieldMapping.source)
+				value = str.(string)
+			}
+
+			out = EncodeVarString(out, uint(field.Offset), value)
+			continue
+		}
+
+		buf := out[field.Offset : field.Offset+field.Size]
+		if fieldMapping.source < 0 {
+			copy(buf, fieldMapping.defaultValue)
+			continue
+		}
+
+		fromField := &mapping.from.Fields[fieldMapping.source]
+		value := entry[fromField.Offset : fromField.Offset+fromField.Size]
+		switch {
+		case isIntField(field):
+			encodeInt(buf, int(field.Size), decodeInt(value, int(fromField.Size)))
+		case field.FieldType == TSFFieldFloat:
+			encodeFloat(buf, decodeFloat(value))
+		default:
+			copy(buf, value)
+			if field.FieldType == TSFFieldString && len(value) > len(buf) {
+				buf[len(buf)-1] = 0
+			}
+		}
+	}
+
+	return out
+}
+
+// Returns index of the field with the specified name or -1
+func (schema *TSFSchemaHeader) findField(name string) int {
+	for fi := 0; fi < int(schema.FieldCount); fi++ {
+		if DecodeCStr(schema.Fields[fi].FieldName[:]) == name {
+			return fi
+		}
+	}
+	return -1
+}
+
+func isIntField(field *TSFSchemaField) bool {
+	switch field.FieldType {
+	case TSFFieldInt, TSFFieldEnumerable, TSFFieldStartTime, TSFFieldEndTime:
+		return true
+	}
+	return false
+}
+
+// Decodes float of size of buf
+func decodeFloat(buf []byte) float64 {
+	if len(buf) == 4 {
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(buf)))
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(buf))
+}
+
+// Encodes float into buf which has size of the field
+func encodeFloat(buf []byte, value float64) {
+	if len(buf) == 4 {
+		binary.LittleEndian.PutUint32(buf, math.Float32bits(float32(value)))
+		return
+	}
+	binary.LittleEndian.PutUint64(buf, math.Float64bits(value))
+}
@@ -0,0 +1,132 @@
+package tsfile
+
+import (
+	"fmt"
+	"os"
+
+	"bytes"
+	"io"
+
+	"sync/atomic"
+)
+
+// Mapped files -- read-only mode for completed traces. The whole file is
+// mapped into memory, so uncompressed data pages are not read into page cache
+// but refer mapping directly, and GetEntries() with [][]byte argument returns
+// slices of the mapping without copying them. This avoids thrashing of page
+// cache when the same trace is scanned many times (i.e. by training). Such
+// slices are only valid until last reference to the file is put.
+//
+// Header, schema and heap pages and compressed data pages are still read
+// through page cache (from the mapping). Checksum of each mapped page is only
+// verified once. File cannot be modified while mapped and changes made to the
+// file by other TSFile objects after it was mapped are not visible. Only
+// supported by V2 and V3.
+
+// Loads existing TS file in read-only mode by mapping it into memory
+func LoadTSFileMapped(file *os.File) (*TSFile, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return nil, fmt.Errorf("Cannot map empty file")
+	}
+
+	mapping, err := mapFile(file, info.Size())
+	if err != nil {
+		return nil, fmt.Errorf("Cannot map file: %v", err)
+	}
+
+	tsf := newTSFile(file)
+	tsf.mapping = mapping
+
+	err = tsf.load()
+	if err == nil && !tsf.formatFlags.hasExtents() {
+		err = fmt.Errorf("Mapping is not supported by TSFile V1")
+	}
+	if err != nil {
+		unmapFile(mapping)
+		return nil, err
+	}
+
+	tsf.mappedChecked = make([]uint32, loadPageId(&tsf.pageCount))
+	return tsf, nil
+}
+
+func (tsf *TSFile) isMapped() bool {
+	return tsf.mapping != nil
+}
+
+func (tsf *TSFile) checkWritable() error {
+	if tsf.isMapped() {
+		return fmt.Errorf("File is mapped in read-only mode")
+	}
+	return nil
+}
+
+// Copies contents of the page from mapping into buf
+func (tsf *TSFile) readMappedData(pageId TSFPageId, buf []byte) (int, error) {
+	off := tsf.getPageOffset(pageId)
+	if off >= int64(len(tsf.mapping)) {
+		return 0, io.EOF
+	}
+	return copy(buf, tsf.mapping[off:]), nil
+}
+
+// Returns data page which buffer refers mapping or nil if page should be read
+// through page cache
+func (tsf *TSFile) readMappedPage(pageId TSFPageId) (*tsfPage, error) {
+	tsf.mu.RLock()
+	defer tsf.mu.RUnlock()
+
+	if pageId == 0 || pageId >= loadPageId(&tsf.pageCount) {
+		return nil, nil
+	}
+	hdr := &tsf.pageHeaders[pageId]
+	if hdr.Flags != 0 || !hdr.getTag().isDataTag() || hdr.Size > 0 {
+		return nil, nil
+	}
+
+	size := int64(hdr.Count) * int64(tsf.getEntrySizeImpl(hdr.getTag().toSchemaId()))
+	off := tsf.getPageOffset(pageId)
+	if off+size > int64(len(tsf.mapping)) {
+		return nil, fmt.Errorf("Page %d is beyond the end of mapped file", pageId)
+	}
+	buf := tsf.mapping[off : off+size : off+size]
+
+	checked := int(pageId) < len(tsf.mappedChecked) &&
+		atomic.LoadUint32(&tsf.mappedChecked[pageId]) != 0
+	if !checked {
+		err := tsf.checkPageChecksum(pageId, hdr, buf)
+		if err != nil {
+			return nil, err
+		}
+		if int(pageId) < len(tsf.mappedChecked) {
+			atomic.StoreUint32(&tsf.mappedChecked[pageId], 1)
+		}
+	}
+
+	page := new(tsfPage)
+	page.buf = bytes.NewBuffer(buf)
+	page.size = tsf.getPageSize(pageId)
+	page.count = hdr.Count
+	page.diskCount = hdr.Count
+	page.full = true
+	page.mapped = true
+	return page, nil
+}
+
+// Unmaps file when last reference to it is put
+func (tsf *TSFile) unmap() error {
+	tsf.mu.Lock()
+	defer tsf.mu.Unlock()
+
+	if !tsf.isMapped() {
+		return nil
+	}
+
+	err := unmapFile(tsf.mapping)
+	tsf.mapping = nil
+	return err
+}
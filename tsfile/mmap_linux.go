@@ -0,0 +1,14 @@
+package tsfile
+
+import (
+	"os"
+	"syscall"
+)
+
+func mapFile(file *os.File, size int64) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func unmapFile(mapping []byte) error {
+	return syscall.Munmap(mapping)
+}
@@ -0,0 +1,187 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+
+	"tsfile"
+)
+
+// Aggregations -- count, sum, min, max and avg of numeric fields over
+// entries matching query. Entries are grouped by windows of start times, so
+// aggregation of several series works like rollups (see tsfile/rollup.go)
+// built on the fly. Entries of series which do not have the field are not
+// accounted by aggregation of that field.
+
+const (
+	AggrCount = "count"
+	AggrSum   = "sum"
+	AggrMin   = "min"
+	AggrMax   = "max"
+	AggrAvg   = "avg"
+)
+
+type Aggregation struct {
+	Func string
+
+	// Name of the field. If it is empty, count aggregation counts
+	// all entries
+	Field string
+}
+
+// Aggregated values of entries which start times are within window
+// starting at Start. Values and Counts are kept per aggregation, values of
+// aggregations which didn't account any entries are zero
+type Bucket struct {
+	Start  tsfile.TSTimeStart
+	Values []float64
+	Counts []int
+}
+
+// Location of the aggregated field in series, kind is -1 if series doesn't
+// have such field
+type aggregationField struct {
+	kind         int
+	offset, size uint64
+}
+
+// Parses aggregation expression like "avg(load)" or "count"
+func ParseAggregation(expr string) (aggr Aggregation, err error) {
+	aggr.Func = expr
+	if index := strings.IndexByte(expr, '('); index > 0 {
+		if !strings.HasSuffix(expr, ")") {
+			return aggr, fmt.Errorf("Invalid aggregation '%s': missing parenthesis", expr)
+		}
+
+		aggr.Func = expr[:index]
+		aggr.Field = strings.TrimSpace(expr[index+1 : len(expr)-1])
+	}
+
+	switch aggr.Func {
+	case AggrCount:
+	case AggrSum, AggrMin, AggrMax, AggrAvg:
+		if len(aggr.Field) == 0 {
+			return aggr, fmt.Errorf("Aggregation '%s' requires field", aggr.Func)
+		}
+	default:
+		return aggr, fmt.Errorf("Unknown aggregation '%s'", aggr.Func)
+	}
+	return
+}
+
+// Reads all remaining entries of query and aggregates them over windows
+// of the specified size in nanoseconds. If window is zero, all entries are
+// aggregated into a single bucket
+func (q *Query) Aggregate(window int64, aggregations ...Aggregation) ([]Bucket, error) {
+	// Resolve fields of aggregations in all series
+	fields := make([][]aggregationField, len(q.series))
+	for index := range q.series {
+		fields[index] = make([]aggregationField, len(aggregations))
+		for ai, aggr := range aggregations {
+			field, err := newAggregationField(q.series[index].schema, aggr)
+			if err != nil {
+				return nil, err
+			}
+			fields[index][ai] = field
+		}
+	}
+
+	var buckets []Bucket
+	var bucket *Bucket
+	var bucketEnd tsfile.TSTimeStart
+	for {
+		event, err := q.Next()
+		if err != nil {
+			return nil, err
+		}
+		if event.Entry == nil {
+			break
+		}
+
+		startTime := event.Deserializer.GetStartTime(event.Entry)
+		if bucket == nil || (window > 0 && startTime >= bucketEnd) {
+			start := startTime
+			if window > 0 {
+				start = q.from + (startTime-q.from)/tsfile.TSTimeStart(window)*
+					tsfile.TSTimeStart(window)
+				bucketEnd = start + tsfile.TSTimeStart(window)
+			}
+
+			buckets = append(buckets, Bucket{
+				Start:  start,
+				Values: make([]float64, len(aggregations)),
+				Counts: make([]int, len(aggregations)),
+			})
+			bucket = &buckets[len(buckets)-1]
+		}
+
+		for ai, aggr := range aggregations {
+			field := &fields[event.Series][ai]
+			if field.kind < 0 {
+				continue
+			}
+
+			var value float64
+			switch field.kind {
+			case filterInt:
+				value = float64(decodeInt(event.Entry[field.offset : field.offset+field.size]))
+			case filterFloat:
+				value = decodeFloat(event.Entry[field.offset : field.offset+field.size])
+			}
+
+			bucket.Counts[ai]++
+			count := bucket.Counts[ai]
+			switch aggr.Func {
+			case AggrCount:
+				bucket.Values[ai] = float64(count)
+			case AggrSum:
+				bucket.Values[ai] += value
+			case AggrMin:
+				if count == 1 || value < bucket.Values[ai] {
+					bucket.Values[ai] = value
+				}
+			case AggrMax:
+				if count == 1 || value > bucket.Values[ai] {
+					bucket.Values[ai] = value
+				}
+			case AggrAvg:
+				bucket.Values[ai] += (value - bucket.Values[ai]) / float64(count)
+			}
+		}
+	}
+
+	return buckets, nil
+}
+
+func newAggregationField(schema *tsfile.TSFSchemaHeader, aggr Aggregation) (
+	field aggregationField, err error) {
+	if len(aggr.Field) == 0 {
+		// Entries are only counted, value is not needed
+		return aggregationField{kind: filterString}, nil
+	}
+
+	field.kind = -1
+	for fi := 0; fi < int(schema.FieldCount); fi++ {
+		schemaField := &schema.Fields[fi]
+		if tsfile.DecodeCStr(schemaField.FieldName[:]) != aggr.Field {
+			continue
+		}
+
+		field.offset, field.size = schemaField.Offset, schemaField.Size
+		switch schemaField.FieldType {
+		case tsfile.TSFFieldInt, tsfile.TSFFieldBoolean,
+			tsfile.TSFFieldStartTime, tsfile.TSFFieldEndTime:
+			field.kind = filterInt
+		case tsfile.TSFFieldFloat:
+			field.kind = filterFloat
+		default:
+			if aggr.Func != AggrCount {
+				return field, fmt.Errorf("Cannot aggregate non-numeric field '%s'", aggr.Field)
+			}
+			field.kind = filterString
+		}
+		break
+	}
+
+	return field, nil
+}
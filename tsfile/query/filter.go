@@ -0,0 +1,273 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"encoding/binary"
+	"math"
+
+	"tsfile"
+)
+
+// Filters -- predicates on values of fields. Filter compares value of the
+// field with constant which should be integer, float, boolean or string
+// (labels may be used for enumerable fields, see tsfile/enum.go). Filters
+// are passed over RPC, so operators are kept as strings.
+
+type Filter struct {
+	Field string
+	Op    string
+	Value interface{}
+}
+
+const (
+	filterEq = iota
+	filterNe
+	filterLt
+	filterLe
+	filterGt
+	filterGe
+)
+
+// Operators are ordered so longer operators are matched first
+var filterOps = []string{"!=", "<=", ">=", "=", "<", ">"}
+
+var filterOpCodes = map[string]int{
+	"=":  filterEq,
+	"!=": filterNe,
+	"<":  filterLt,
+	"<=": filterLe,
+	">":  filterGt,
+	">=": filterGe,
+}
+
+const (
+	filterInt = iota
+	filterFloat
+	filterString
+	filterVarString
+)
+
+// Filter resolved for series: type of comparison and location of the field
+type seriesFilter struct {
+	kind int
+	op   int
+
+	index        int
+	offset, size uint64
+
+	intValue   int64
+	floatValue float64
+	strValue   string
+}
+
+// Parses filter expression like "cpu=1" or "name!=bash"
+func ParseFilter(expr string) (filter Filter, err error) {
+	for _, op := range filterOps {
+		index := strings.Index(expr, op)
+		if index <= 0 {
+			continue
+		}
+
+		filter.Field = strings.TrimSpace(expr[:index])
+		filter.Op = op
+		filter.Value = parseFilterValue(strings.TrimSpace(expr[index+len(op):]))
+		return
+	}
+
+	return filter, fmt.Errorf("Invalid filter '%s': operator is missing", expr)
+}
+
+func parseFilterValue(str string) interface{} {
+	if i, err := strconv.ParseInt(str, 0, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(str, 64); err == nil {
+		return f
+	}
+	if b, err := strconv.ParseBool(str); err == nil {
+		return b
+	}
+	if unquoted, err := strconv.Unquote(str); err == nil {
+		return unquoted
+	}
+	return str
+}
+
+func getFilterOp(op string) (int, error) {
+	code, ok := filterOpCodes[op]
+	if !ok {
+		return -1, fmt.Errorf("Unknown filter operator '%s'", op)
+	}
+	return code, nil
+}
+
+// Resolves filter for series with the specified schema. Returns false if
+// series doesn't have the field or no entries of the series may match it
+func newSeriesFilter(schema *tsfile.TSFSchemaHeader, filter Filter) (sf seriesFilter, ok bool, err error) {
+	sf.op, err = getFilterOp(filter.Op)
+	if err != nil {
+		return
+	}
+
+	sf.index = -1
+	for fi := 0; fi < int(schema.FieldCount); fi++ {
+		if tsfile.DecodeCStr(schema.Fields[fi].FieldName[:]) == filter.Field {
+			sf.index = fi
+			break
+		}
+	}
+	if sf.index < 0 {
+		return sf, false, nil
+	}
+
+	field := &schema.Fields[sf.index]
+	sf.offset, sf.size = field.Offset, field.Size
+
+	switch field.FieldType {
+	case tsfile.TSFFieldInt, tsfile.TSFFieldBoolean, tsfile.TSFFieldEnumerable,
+		tsfile.TSFFieldStartTime, tsfile.TSFFieldEndTime:
+		sf.kind = filterInt
+		switch value := filter.Value.(type) {
+		case int, int8, int16, int32, int64:
+			sf.intValue = toInt64(value)
+		case bool:
+			if value {
+				sf.intValue = 1
+			}
+		case string:
+			if field.FieldType != tsfile.TSFFieldEnumerable {
+				return sf, false, fmt.Errorf("Field '%s' is not a string", filter.Field)
+			}
+
+			// Find value of the label, if it is not registered, none of
+			// entries may have it
+			found := false
+			for intValue, label := range schema.Enums[filter.Field] {
+				if label == value {
+					sf.intValue, found = intValue, true
+					break
+				}
+			}
+			if !found {
+				return sf, sf.op == filterNe, nil
+			}
+			if sf.op != filterEq && sf.op != filterNe {
+				return sf, false, fmt.Errorf("Labels of field '%s' are not ordered", filter.Field)
+			}
+		default:
+			return sf, false, fmt.Errorf("Cannot compare integer field '%s' with %T",
+				filter.Field, filter.Value)
+		}
+	case tsfile.TSFFieldFloat:
+		sf.kind = filterFloat
+		switch value := filter.Value.(type) {
+		case int, int8, int16, int32, int64:
+			sf.floatValue = float64(toInt64(value))
+		case float32:
+			sf.floatValue = float64(value)
+		case float64:
+			sf.floatValue = value
+		default:
+			return sf, false, fmt.Errorf("Cannot compare float field '%s' with %T",
+				filter.Field, filter.Value)
+		}
+	case tsfile.TSFFieldString, tsfile.TSFFieldVarString:
+		sf.kind = filterString
+		if field.FieldType == tsfile.TSFFieldVarString {
+			sf.kind = filterVarString
+		}
+
+		value, isString := filter.Value.(string)
+		if !isString {
+			value = fmt.Sprint(filter.Value)
+		}
+		sf.strValue = value
+	default:
+		return sf, false, fmt.Errorf("Unsupported type of field '%s'", filter.Field)
+	}
+
+	return sf, true, nil
+}
+
+func (sf *seriesFilter) match(entry []byte, deserializer *tsfile.TSFDeserializer) bool {
+	var cmp int
+	switch sf.kind {
+	case filterInt:
+		value := decodeInt(entry[sf.offset : sf.offset+sf.size])
+		switch {
+		case value < sf.intValue:
+			cmp = -1
+		case value > sf.intValue:
+			cmp = 1
+		}
+	case filterFloat:
+		value := decodeFloat(entry[sf.offset : sf.offset+sf.size])
+		switch {
+		case value < sf.floatValue:
+			cmp = -1
+		case value > sf.floatValue:
+			cmp = 1
+		}
+	case filterString:
+		cmp = strings.Compare(tsfile.DecodeCStr(entry[sf.offset:sf.offset+sf.size]), sf.strValue)
+	case filterVarString:
+		_, value := deserializer.Get(entry, sf.index)
+		cmp = strings.Compare(value.(string), sf.strValue)
+	}
+
+	switch sf.op {
+	case filterEq:
+		return cmp == 0
+	case filterNe:
+		return cmp != 0
+	case filterLt:
+		return cmp < 0
+	case filterLe:
+		return cmp <= 0
+	case filterGt:
+		return cmp > 0
+	case filterGe:
+		return cmp >= 0
+	}
+	return false
+}
+
+// Decodes signed integer of size of buf
+func decodeInt(buf []byte) int64 {
+	switch len(buf) {
+	case 1:
+		return int64(int8(buf[0]))
+	case 2:
+		return int64(int16(binary.LittleEndian.Uint16(buf)))
+	case 4:
+		return int64(int32(binary.LittleEndian.Uint32(buf)))
+	}
+	return int64(binary.LittleEndian.Uint64(buf))
+}
+
+// Decodes float of size of buf
+func decodeFloat(buf []byte) float64 {
+	if len(buf) == 4 {
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(buf)))
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(buf))
+}
+
+func toInt64(value interface{}) int64 {
+	switch v := value.(type) {
+	case int:
+		return int64(v)
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case int64:
+		return v
+	}
+	return 0
+}
@@ -0,0 +1,311 @@
+package query
+
+import (
+	"fmt"
+
+	"tsfile"
+)
+
+// Query engine over series of one or more TSFiles. Query reads entries of the
+// added series in batches, filters them by time range and predicates on
+// field values (see filter.go) and merges them in the order of start times,
+// so readers of multiple series, i.e. training which reads all series of
+// incident traces or 'incident get' command, share the same implementation.
+// Matched entries may also be aggregated over time windows (see
+// aggregate.go).
+//
+// Query doesn't hold references to files, caller should keep them until
+// query is no longer used.
+
+const (
+	// Number of entries read from series at once
+	queryBatchSize = 64
+)
+
+// Entry returned by query
+type Event struct {
+	// Index of the source passed to AddSeries() or AddFile(), index of
+	// series in query and its tag in source file
+	Source int
+	Series int
+	Tag    tsfile.TSFPageTag
+
+	// Raw entry which is valid until the next call to Next() and
+	// deserializer for it
+	Entry        []byte
+	Deserializer *tsfile.TSFDeserializer
+}
+
+type querySeries struct {
+	source int
+	tsf    *tsfile.TSFile
+	tag    tsfile.TSFPageTag
+
+	schema       *tsfile.TSFSchemaHeader
+	deserializer *tsfile.TSFDeserializer
+
+	// Range of entries [next; end) which are not read yet
+	next, end int
+
+	// Entries which were read but not returned yet. If head is set,
+	// the first entry matches query and its start time is headTime
+	entries  [][]byte
+	head     bool
+	headTime tsfile.TSTimeStart
+
+	// Series doesn't have fields used by filters, so none of its entries
+	// may match query
+	excluded bool
+	filters  []seriesFilter
+}
+
+type Query struct {
+	series []querySeries
+
+	// Time range [from; to) of entries
+	from, to  tsfile.TSTimeStart
+	timeRange bool
+
+	filters []Filter
+
+	// Query is prepared when the first entry is requested. After that
+	// series, filters and time range cannot be changed
+	prepared bool
+}
+
+func New() *Query {
+	return new(Query)
+}
+
+// Adds series with the specified tag from file tsf to query and returns
+// its index. source is used to distinguish files in returned events
+func (q *Query) AddSeries(source int, tsf *tsfile.TSFile, tag tsfile.TSFPageTag) (int, error) {
+	if q.prepared {
+		return -1, fmt.Errorf("Cannot add series to a running query")
+	}
+
+	schema, err := tsf.GetSchema(tag)
+	if err != nil {
+		return -1, err
+	}
+
+	q.series = append(q.series, querySeries{
+		source:       source,
+		tsf:          tsf,
+		tag:          tag,
+		schema:       schema,
+		deserializer: tsfile.NewDeserializer(schema),
+		end:          tsf.GetEntryCount(tag),
+	})
+	return len(q.series) - 1, nil
+}
+
+// Adds all series of file tsf to query in the order of their tags. Rollups
+// are skipped as they duplicate entries of their source series, they may be
+// added using AddSeries()
+func (q *Query) AddFile(source int, tsf *tsfile.TSFile) error {
+	for tag, tagEnd := tsf.GetDataTags(); tag < tagEnd; tag++ {
+		schema, err := tsf.GetSchema(tag)
+		if err != nil {
+			return err
+		}
+		if schema.SourceTag != 0 {
+			continue
+		}
+
+		_, err = q.AddSeries(source, tsf, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Limits entries to ones which start time is within [from; to) range.
+// Series which do not have start time field are not read
+func (q *Query) SetTimeRange(from, to tsfile.TSTimeStart) error {
+	if q.prepared {
+		return fmt.Errorf("Cannot change time range of a running query")
+	}
+
+	q.from, q.to = from, to
+	q.timeRange = true
+	return nil
+}
+
+// Adds filter to query. Entries of series which do not have field used in
+// filter do not match query
+func (q *Query) AddFilter(filter Filter) error {
+	if q.prepared {
+		return fmt.Errorf("Cannot add filter to a running query")
+	}
+
+	_, err := getFilterOp(filter.Op)
+	if err != nil {
+		return err
+	}
+
+	q.filters = append(q.filters, filter)
+	return nil
+}
+
+// Sets index of the first entry of series which should be read. Used to
+// resume query from the position returned by Position()
+func (q *Query) SetStart(series int, start int) error {
+	if q.prepared {
+		return fmt.Errorf("Cannot change start of a running query")
+	}
+	if series >= len(q.series) {
+		return fmt.Errorf("Series #%d is not in query", series)
+	}
+
+	q.series[series].next = start
+	return nil
+}
+
+// Returns index of the next entry of series which wasn't returned yet
+func (q *Query) Position(series int) int {
+	seriesData := &q.series[series]
+	return seriesData.next - len(seriesData.entries)
+}
+
+// Returns number of series in query
+func (q *Query) Len() int {
+	return len(q.series)
+}
+
+// Returns schema of the series
+func (q *Query) GetSchema(series int) *tsfile.TSFSchemaHeader {
+	return q.series[series].schema
+}
+
+// Returns next entry with the smallest start time among all series. If no
+// more entries match query, returns event with nil entry
+func (q *Query) Next() (Event, error) {
+	if !q.prepared {
+		err := q.prepare()
+		if err != nil {
+			return Event{}, err
+		}
+	}
+
+	var minTime tsfile.TSTimeStart
+	minIndex := -1
+	for index := range q.series {
+		seriesData := &q.series[index]
+
+		ok, err := seriesData.fetch()
+		if err != nil {
+			return Event{}, err
+		}
+		if !ok {
+			continue
+		}
+
+		if minIndex < 0 || seriesData.headTime < minTime {
+			minIndex, minTime = index, seriesData.headTime
+		}
+	}
+
+	if minIndex < 0 {
+		return Event{}, nil
+	}
+
+	seriesData := &q.series[minIndex]
+	event := Event{
+		Source:       seriesData.source,
+		Series:       minIndex,
+		Tag:          seriesData.tag,
+		Entry:        seriesData.entries[0],
+		Deserializer: seriesData.deserializer,
+	}
+
+	seriesData.entries = seriesData.entries[1:]
+	seriesData.head = false
+	return event, nil
+}
+
+// Resolves time range and filters for each series
+func (q *Query) prepare() error {
+	for index := range q.series {
+		seriesData := &q.series[index]
+
+		if q.timeRange {
+			if seriesData.deserializer.StartTimeIndex < 0 {
+				seriesData.excluded = true
+				continue
+			}
+
+			start, end, err := seriesData.tsf.FindEntryRange(seriesData.tag, q.from, q.to)
+			if err != nil {
+				return err
+			}
+			if start > seriesData.next {
+				seriesData.next = start
+			}
+			seriesData.end = end
+		}
+
+		for _, filter := range q.filters {
+			sf, ok, err := newSeriesFilter(seriesData.schema, filter)
+			if err != nil {
+				return fmt.Errorf("Invalid filter for series #%d: %v", index, err)
+			}
+			if !ok {
+				seriesData.excluded = true
+				break
+			}
+			seriesData.filters = append(seriesData.filters, sf)
+		}
+	}
+
+	q.prepared = true
+	return nil
+}
+
+// Reads entries of series until one that matches query is found. Returns
+// false if there are no such entries left
+func (seriesData *querySeries) fetch() (bool, error) {
+	if seriesData.excluded {
+		return false, nil
+	}
+
+	for !seriesData.head {
+		if len(seriesData.entries) == 0 {
+			count := seriesData.end - seriesData.next
+			if count <= 0 {
+				return false, nil
+			}
+			if count > queryBatchSize {
+				count = queryBatchSize
+			}
+
+			entries := make([][]byte, count)
+			err := seriesData.tsf.GetEntries(seriesData.tag, entries, seriesData.next)
+			if err != nil {
+				return false, err
+			}
+
+			seriesData.entries = entries
+			seriesData.next += count
+		}
+
+		if seriesData.match(seriesData.entries[0]) {
+			seriesData.head = true
+			seriesData.headTime = seriesData.deserializer.GetStartTime(seriesData.entries[0])
+			break
+		}
+		seriesData.entries = seriesData.entries[1:]
+	}
+
+	return true, nil
+}
+
+func (seriesData *querySeries) match(entry []byte) bool {
+	for fi := range seriesData.filters {
+		if !seriesData.filters[fi].match(entry, seriesData.deserializer) {
+			return false
+		}
+	}
+	return true
+}
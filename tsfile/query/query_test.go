@@ -0,0 +1,234 @@
+package query_test
+
+import (
+	"tsfile"
+	"tsfile/query" // PUT
+
+	"testing"
+
+	"io/ioutil"
+	"os"
+	"reflect"
+)
+
+type cpuEntry struct {
+	Start tsfile.TSTimeStart
+	Cpu   int32
+	Load  float64
+}
+
+type procEntry struct {
+	Start tsfile.TSTimeStart
+	Pid   int32
+	Name  tsfile.TSVarString
+}
+
+func newQueryFile(t *testing.T, entries ...interface{}) *tsfile.TSFile {
+	f, err := ioutil.TempFile("", "tsftest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(f.Name())
+
+	tsf, err := tsfile.NewTSFile(f, tsfile.TSFFormatV2|tsfile.TSFFormatExt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, seriesEntries := range entries {
+		schema, _ := tsfile.NewStructSchema(reflect.TypeOf(seriesEntries).Elem())
+		tag, err := tsf.AddSchema(schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = tsf.AddEntries(tag, seriesEntries)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tsf
+}
+
+// Reads all events from query and returns their start times
+func readQuery(t *testing.T, q *query.Query) (times []tsfile.TSTimeStart, events []query.Event) {
+	for {
+		event, err := q.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Entry == nil {
+			return
+		}
+
+		times = append(times, event.Deserializer.GetStartTime(event.Entry))
+		events = append(events, event)
+	}
+}
+
+func TestQueryMerge(t *testing.T) {
+	const N = 1000
+
+	cpuEntries := make([]cpuEntry, N)
+	procEntries := make([]procEntry, N/2)
+	for i := range cpuEntries {
+		cpuEntries[i] = cpuEntry{tsfile.TSTimeStart(i * 2), int32(i % 4), float64(i)}
+	}
+	for i := range procEntries {
+		procEntries[i] = procEntry{tsfile.TSTimeStart(i*4 + 1), int32(i), "init"}
+	}
+
+	tsf1 := newQueryFile(t, cpuEntries)
+	defer tsf1.Put()
+	tsf2 := newQueryFile(t, procEntries)
+	defer tsf2.Put()
+
+	// Rollups duplicate their sources and are not added with the file
+	_, err := tsf1.AddRollup(tsfile.TSFTagData, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := query.New()
+	if err := q.AddFile(0, tsf1); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.AddFile(1, tsf2); err != nil {
+		t.Fatal(err)
+	}
+
+	times, events := readQuery(t, q)
+	if len(times) != N+N/2 {
+		t.Fatalf("Unexpected number of events: %d", len(times))
+	}
+	for i := 1; i < len(times); i++ {
+		if times[i] < times[i-1] {
+			t.Fatalf("Events are not ordered: #%d %d < %d", i, times[i], times[i-1])
+		}
+	}
+	if events[1].Source != 1 || events[1].Series != 1 {
+		t.Errorf("Unexpected source of event: %v", events[1])
+	}
+	if _, name := events[1].Deserializer.Get(events[1].Entry, 2); name != "init" {
+		t.Errorf("Unexpected name: %v", name)
+	}
+}
+
+func TestQueryFilter(t *testing.T) {
+	const N = 1000
+
+	cpuEntries := make([]cpuEntry, N)
+	procEntries := make([]procEntry, N)
+	for i := range cpuEntries {
+		cpuEntries[i] = cpuEntry{tsfile.TSTimeStart(i), int32(i % 4), float64(i)}
+		procEntries[i] = procEntry{tsfile.TSTimeStart(i), int32(i), "bash"}
+	}
+	procEntries[500].Name = "init"
+
+	tsf := newQueryFile(t, cpuEntries, procEntries)
+	defer tsf.Put()
+
+	q := query.New()
+	q.AddFile(0, tsf)
+	q.SetTimeRange(100, 200)
+	filter, err := query.ParseFilter("Cpu=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.AddFilter(filter)
+
+	// Proc series doesn't have Cpu field and shouldn't be read
+	times, events := readQuery(t, q)
+	if len(times) != 25 || times[0] != 101 || times[24] != 197 {
+		t.Errorf("Unexpected events: %v", times)
+	}
+	for _, event := range events {
+		if event.Series != 0 {
+			t.Errorf("Unexpected event of series #%d", event.Series)
+		}
+	}
+
+	q = query.New()
+	q.AddFile(0, tsf)
+	filter, _ = query.ParseFilter("Name=init")
+	q.AddFilter(filter)
+
+	times, _ = readQuery(t, q)
+	if len(times) != 1 || times[0] != 500 {
+		t.Errorf("Unexpected events for string filter: %v", times)
+	}
+
+	_, err = query.ParseFilter("Name")
+	if err == nil {
+		t.Error("Filter without operator is parsed")
+	}
+}
+
+func TestQueryResume(t *testing.T) {
+	const N = 100
+
+	cpuEntries := make([]cpuEntry, N)
+	for i := range cpuEntries {
+		cpuEntries[i] = cpuEntry{tsfile.TSTimeStart(i), 0, 0}
+	}
+	tsf := newQueryFile(t, cpuEntries, cpuEntries)
+	defer tsf.Put()
+
+	q := query.New()
+	q.AddFile(0, tsf)
+	for i := 0; i < 11; i++ {
+		q.Next()
+	}
+
+	q2 := query.New()
+	q2.AddFile(0, tsf)
+	for series := 0; series < q.Len(); series++ {
+		q2.SetStart(series, q.Position(series))
+	}
+
+	times, _ := readQuery(t, q2)
+	if len(times) != 2*N-11 || times[0] != 5 {
+		t.Errorf("Unexpected events of resumed query: %d %v", len(times), times[:1])
+	}
+}
+
+func TestQueryAggregate(t *testing.T) {
+	const N = 1000
+
+	cpuEntries := make([]cpuEntry, N)
+	for i := range cpuEntries {
+		cpuEntries[i] = cpuEntry{tsfile.TSTimeStart(i), int32(i % 4), float64(i)}
+	}
+	tsf := newQueryFile(t, cpuEntries)
+	defer tsf.Put()
+
+	var aggregations []query.Aggregation
+	for _, expr := range []string{"count", "min(Load)", "max(Cpu)", "avg(Load)", "sum(Cpu)"} {
+		aggr, err := query.ParseAggregation(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aggregations = append(aggregations, aggr)
+	}
+
+	q := query.New()
+	q.AddFile(0, tsf)
+	buckets, err := q.Aggregate(100, aggregations...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 10 {
+		t.Fatalf("Unexpected number of buckets: %d", len(buckets))
+	}
+
+	bucket := buckets[3]
+	expected := []float64{100, 300, 3, 349.5, 150}
+	if bucket.Start != 300 || !reflect.DeepEqual(bucket.Values, expected) {
+		t.Errorf("Unexpected bucket: %v", bucket)
+	}
+
+	_, err = query.ParseAggregation("avg")
+	if err == nil {
+		t.Error("Aggregation without field is parsed")
+	}
+}
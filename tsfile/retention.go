@@ -0,0 +1,278 @@
+package tsfile
+
+import (
+	"fmt"
+)
+
+// Retention -- limits size of the file for continuous monitoring. When file
+// reaches the limit, new pages are not appended to it, but oldest data pages
+// are reclaimed: they are dropped from their series (marked as TSFTagEmpty)
+// and reused for the new pages. Pages are reused in ring order, position of
+// the next page to be reused is kept in superblocks, so LoadTSFile() may
+// restore order of entries in series which crossed the end of file.
+//
+// Header and schema pages are never reused, and data pages which are still
+// open for writing are skipped. Heap pages are reused when no data pages refer
+// strings in them: references are counted when entries are added, and are
+// dropped when data page is reused. As references are not saved to the file,
+// heap pages which existed when file was loaded are kept until all data pages
+// with variable-length strings loaded with them are reused. Dropping pages
+// shifts indices of entries in series like dropping damaged pages does, so
+// readers which keep indices (i.e. subscriptions) may skip entries which were
+// added while pages were reused. Only supported by V2 and V3.
+
+const (
+	// Minimum number of pages in file with retention
+	minRetentionPages = 8
+)
+
+// Limits size of the file to maxSize bytes after which oldest data pages
+// are reused. Zero maxSize disables retention unless pages were already
+// reused, in which case file keeps its current size
+func (tsf *TSFile) SetRetention(maxSize int64) error {
+	if err := tsf.checkWritable(); err != nil {
+		return err
+	}
+	if !tsf.formatFlags.hasExtents() {
+		return fmt.Errorf("Retention is not supported by TSFile V1")
+	}
+
+	maxPages := TSFPageId(maxSize / int64(tsf.pageSize))
+	if maxSize > 0 && maxPages < minRetentionPages {
+		return fmt.Errorf("Retention limit %d is too small, at least %d pages are needed",
+			maxSize, minRetentionPages)
+	}
+
+	tsf.mu.Lock()
+	defer tsf.mu.Unlock()
+
+	if maxPages == 0 && tsf.reusePageId != 0 {
+		// Ring of pages cannot be unrolled
+		maxPages = loadPageId(&tsf.pageCount)
+	}
+	tsf.maxPages = maxPages
+	return nil
+}
+
+// Checks if new page should be allocated by reusing oldest data page
+func (tsf *TSFile) shouldReusePage() bool {
+	tsf.mu.RLock()
+	defer tsf.mu.RUnlock()
+
+	return tsf.maxPages > 0 && loadPageId(&tsf.pageCount) >= tsf.maxPages
+}
+
+// Finds oldest data page which can be reused, drops it from its series and
+// returns its id. Returns false if there are no such pages
+func (tsf *TSFile) reusePage() (TSFPageId, bool) {
+	tsf.mu.Lock()
+	defer tsf.mu.Unlock()
+
+	pageCount := loadPageId(&tsf.pageCount)
+	pageId := tsf.reusePageId
+	for i := TSFPageId(0); i < pageCount; i++ {
+		if pageId == 0 || pageId >= pageCount {
+			// Page #0 is always a header
+			pageId = 1
+		}
+
+		hdr := tsf.pageHeaders[pageId]
+		if tsf.isReusablePage(pageId, hdr) {
+			if page, ok := tsf.pageCache[pageId]; ok {
+				tsf.evictPage(page, pageId)
+			}
+			tsf.pageHeaders[pageId] = TSFPageHeader{Tag: uint16(TSFTagEmpty)}
+			tsf.removePageIndex(pageId, hdr)
+			tsf.dropHeapRefs(pageId)
+
+			tsf.reusePageId = pageId + 1
+			return pageId, true
+		}
+
+		pageId++
+	}
+
+	return 0, false
+}
+
+// Checks if page may be reused. Call with tsf.mu held
+func (tsf *TSFile) isReusablePage(pageId TSFPageId, hdr TSFPageHeader) bool {
+	tag := hdr.getTag()
+	if tag == TSFTagEmpty {
+		return true
+	}
+	if hdr.Flags == 0 && tag == TSFTagHeap {
+		return tsf.isReusableHeapPage(pageId)
+	}
+	if hdr.Flags != 0 || !tag.isDataTag() {
+		return false
+	}
+
+	// Pages which are written or are still open for writing keep newest
+	// entries of the series
+	if page, ok := tsf.pageCache[pageId]; ok {
+		page.mu.Lock()
+		dirty := page.dirty
+		page.mu.Unlock()
+
+		if dirty {
+			return false
+		}
+	}
+	for _, dataPageId := range tsf.dataPagesCache[tag] {
+		if dataPageId == pageId {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks if heap page may be reused: it should be already retired and written
+// and no data pages may refer strings in it. Call with tsf.mu held
+func (tsf *TSFile) isReusableHeapPage(pageId TSFPageId) bool {
+	if page, ok := tsf.pageCache[pageId]; ok {
+		// Heap pages which are not full yet may get new strings
+		page.mu.Lock()
+		busy := page.dirty || !page.full
+		page.mu.Unlock()
+
+		if busy {
+			return false
+		}
+	}
+
+	tsf.heapRefsMu.Lock()
+	defer tsf.heapRefsMu.Unlock()
+
+	return tsf.heapRefs[pageId] == 0 && !tsf.loadedHeapPages[pageId]
+}
+
+// Takes reference to heap page while string is added to it and appends its
+// id to the list of heap pages referred by entry
+func (tsf *TSFile) holdHeapPage(heapRefs []TSFPageId, pageId TSFPageId) []TSFPageId {
+	tsf.heapRefsMu.Lock()
+	defer tsf.heapRefsMu.Unlock()
+
+	tsf.heapRefs[pageId]++
+	return append(heapRefs, pageId)
+}
+
+// Accounts references to heap pages taken by holdHeapPage() to data page
+// to which entries were written
+func (tsf *TSFile) addHeapRefs(dataPageId TSFPageId, heapRefs [][]TSFPageId) {
+	tsf.heapRefsMu.Lock()
+	defer tsf.heapRefsMu.Unlock()
+
+	refs := tsf.dataHeapRefs[dataPageId]
+	if refs == nil {
+		refs = make(map[TSFPageId]int)
+		tsf.dataHeapRefs[dataPageId] = refs
+	}
+	for _, pageIds := range heapRefs {
+		for _, pageId := range pageIds {
+			refs[pageId]++
+		}
+	}
+}
+
+// Releases references to heap pages taken by holdHeapPage() for entries which
+// were not added to the file
+func (tsf *TSFile) releaseHeapRefs(heapRefs [][]TSFPageId) {
+	tsf.heapRefsMu.Lock()
+	defer tsf.heapRefsMu.Unlock()
+
+	for _, pageIds := range heapRefs {
+		for _, pageId := range pageIds {
+			tsf.heapRefs[pageId]--
+		}
+	}
+}
+
+// Drops references to heap pages from the reused page. Call with tsf.mu held
+func (tsf *TSFile) dropHeapRefs(pageId TSFPageId) {
+	tsf.heapRefsMu.Lock()
+	defer tsf.heapRefsMu.Unlock()
+
+	for heapPageId, count := range tsf.dataHeapRefs[pageId] {
+		tsf.heapRefs[heapPageId] -= count
+		if tsf.heapRefs[heapPageId] <= 0 {
+			delete(tsf.heapRefs, heapPageId)
+		}
+	}
+	delete(tsf.dataHeapRefs, pageId)
+
+	if tsf.loadedDataPages[pageId] {
+		delete(tsf.loadedDataPages, pageId)
+		if len(tsf.loadedDataPages) == 0 {
+			// Entries which could refer loaded heap pages are gone
+			tsf.loadedHeapPages = nil
+		}
+	}
+}
+
+// Keeps heap pages which existed when file was loaded from being reused as
+// long as there are loaded data pages which may refer them
+func (tsf *TSFile) pinLoadedHeapPages() {
+	tsf.heapRefsMu.Lock()
+	defer tsf.heapRefsMu.Unlock()
+
+	tsf.loadedHeapPages = make(map[TSFPageId]bool)
+	tsf.loadedDataPages = make(map[TSFPageId]bool)
+	for pageId, hdr := range tsf.pageHeaders[:loadPageId(&tsf.pageCount)] {
+		tag := hdr.getTag()
+		switch {
+		case hdr.Flags != 0:
+		case tag == TSFTagHeap:
+			tsf.loadedHeapPages[TSFPageId(pageId)] = true
+		case tag.isDataTag() && tsf.isValidSchemaId(tag.toSchemaId()) &&
+			tsf.schemas[tag.toSchemaId()].varStrings:
+			tsf.loadedDataPages[TSFPageId(pageId)] = true
+		}
+	}
+	if len(tsf.loadedDataPages) == 0 {
+		tsf.loadedHeapPages = nil
+	}
+}
+
+// Returns ids of all pages in the order they were written: if pages were
+// reused, pages starting with the next page to be reused are older than
+// pages preceding it
+func (tsf *TSFile) getPageOrder() []TSFPageId {
+	pageCount := loadPageId(&tsf.pageCount)
+	pageIds := make([]TSFPageId, 0, pageCount)
+	start := tsf.reusePageId
+	if start == 0 || start > pageCount {
+		start = pageCount
+	}
+
+	for pageId := start; pageId < pageCount; pageId++ {
+		pageIds = append(pageIds, pageId)
+	}
+	for pageId := TSFPageId(0); pageId < start; pageId++ {
+		pageIds = append(pageIds, pageId)
+	}
+	return pageIds
+}
+
+// Rebuilds indices of series in the order pages were written after file
+// with reused pages was loaded
+func (tsf *TSFile) reindexPages() error {
+	for schemaId := range tsf.schemas {
+		tsf.schemas[schemaId].count = 0
+		tsf.schemas[schemaId].pageIndex = nil
+	}
+
+	for _, pageId := range tsf.getPageOrder() {
+		hdr := tsf.pageHeaders[pageId]
+		if hdr.Flags == 0 && hdr.getTag().isDataTag() {
+			err := tsf.loadDataTagV2(pageId, hdr)
+			if err != nil {
+				return fmt.Errorf("Error reading data tag #%d: %v", pageId, err)
+			}
+		}
+	}
+
+	// Keep reusing pages when file is written again
+	tsf.maxPages = loadPageId(&tsf.pageCount)
+	return nil
+}
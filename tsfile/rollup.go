@@ -0,0 +1,292 @@
+package tsfile
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"encoding/binary"
+)
+
+// Rollups are derived series which keep aggregated values of the source
+// series per time window: number of entries in the window and minimum,
+// maximum and average value of each numeric field. They are stored as
+// regular schemas in the same file, but their schema header refers source
+// series tag and the window, so they can be found by FindRollup().
+//
+// Rollup is built from the entries which are in the source series at the
+// moment of AddRollup() call, entries added later are not accounted.
+
+const (
+	// Number of source entries read at once while building rollup
+	rollupBatchSize = 1024
+
+	rollupCountField = "count"
+)
+
+// Aggregated values of numeric field within a window
+type tsfRollupField struct {
+	index   int
+	isFloat bool
+
+	minInt, maxInt     int64
+	minFloat, maxFloat float64
+	sum                float64
+}
+
+type tsfRollupBuilder struct {
+	header       *TSFSchemaHeader
+	deserializer *TSFDeserializer
+	fields       []tsfRollupField
+
+	window int64
+	start  int64
+	count  int64
+
+	entries [][]byte
+}
+
+// Creates schema of rollup for source schema with aggregation window
+// specified in nanoseconds
+func NewRollupSchema(source *TSFSchemaHeader, sourceTag TSFPageTag,
+	window int64) (*TSFSchemaHeader, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("Invalid rollup window %d", window)
+	}
+	if source.SourceTag != 0 {
+		return nil, fmt.Errorf("Cannot build rollup of derived series")
+	}
+
+	fields := []TSFSchemaField{NewStartTimeField(), NewEndTimeField(),
+		newRollupField(rollupCountField, TSFFieldInt)}
+	hasStartTime := false
+	for _, field := range source.Fields[:source.FieldCount] {
+		name := DecodeCStr(field.FieldName[:])
+		switch field.FieldType {
+		case TSFFieldStartTime:
+			hasStartTime = true
+		case TSFFieldInt, TSFFieldFloat:
+			fields = append(fields,
+				newRollupField(name+"_min", int(field.FieldType)),
+				newRollupField(name+"_max", int(field.FieldType)),
+				newRollupField(name+"_avg", TSFFieldFloat))
+		}
+	}
+	if !hasStartTime {
+		return nil, fmt.Errorf("Cannot build rollup for series without start time")
+	}
+
+	name := fmt.Sprintf("%s@%v", DecodeCStr(source.Name[:]), time.Duration(window))
+	header, err := NewSchema(name, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	header.SourceTag = uint16(sourceTag)
+	header.Window = window
+	return header, nil
+}
+
+// Creates 64-bit integer or float field of rollup
+func newRollupField(name string, fieldType int) TSFSchemaField {
+	field := TSFSchemaField{FieldType: uint64(fieldType), Size: 8}
+	EncodeCStr(name, field.FieldName[:])
+	return field
+}
+
+// Builds rollup of series tag with the aggregation window in nanoseconds and
+// adds it to the file. If such rollup already exists, returns its tag
+func (tsf *TSFile) AddRollup(tag TSFPageTag, window int64) (TSFPageTag, error) {
+	tsf.rollupMu.Lock()
+	defer tsf.rollupMu.Unlock()
+
+	rollupTag := tsf.FindRollup(tag, window)
+	if rollupTag != TSFTagEmpty {
+		return rollupTag, nil
+	}
+
+	source, err := tsf.GetSchema(tag)
+	if err != nil {
+		return TSFTagEmpty, err
+	}
+	header, err := NewRollupSchema(source, tag, window)
+	if err != nil {
+		return TSFTagEmpty, err
+	}
+
+	builder := newRollupBuilder(source, header)
+	count := tsf.GetEntryCount(tag)
+	for start := 0; start < count; start += rollupBatchSize {
+		batchSize := count - start
+		if batchSize > rollupBatchSize {
+			batchSize = rollupBatchSize
+		}
+
+		entries := make([][]byte, batchSize)
+		err = tsf.GetEntries(tag, entries, start)
+		if err != nil {
+			return TSFTagEmpty, err
+		}
+		for _, entry := range entries {
+			builder.add(entry)
+		}
+	}
+	builder.flush()
+
+	rollupTag, err = tsf.AddSchema(header)
+	if err != nil {
+		return TSFTagEmpty, err
+	}
+	if len(builder.entries) > 0 {
+		err = tsf.AddEntries(rollupTag, builder.entries)
+	}
+	return rollupTag, err
+}
+
+// Returns tag of the rollup of series tag with specified window or
+// TSFTagEmpty if it wasn't built
+func (tsf *TSFile) FindRollup(tag TSFPageTag, window int64) TSFPageTag {
+	tsf.mu.RLock()
+	defer tsf.mu.RUnlock()
+
+	for schemaId, schema := range tsf.schemas {
+		header := &schema.header
+		if TSFPageTag(header.SourceTag) == tag && header.Window == window {
+			return TSFSchemaId(schemaId).toTag()
+		}
+	}
+	return TSFTagEmpty
+}
+
+// Returns tags of all rollups built for series tag
+func (tsf *TSFile) GetRollups(tag TSFPageTag) (tags []TSFPageTag) {
+	tsf.mu.RLock()
+	defer tsf.mu.RUnlock()
+
+	for schemaId, schema := range tsf.schemas {
+		if schema.header.Window > 0 && TSFPageTag(schema.header.SourceTag) == tag {
+			tags = append(tags, TSFSchemaId(schemaId).toTag())
+		}
+	}
+	return
+}
+
+func newRollupBuilder(source, header *TSFSchemaHeader) *tsfRollupBuilder {
+	builder := &tsfRollupBuilder{
+		header:       header,
+		deserializer: NewDeserializer(source),
+		window:       header.Window,
+	}
+
+	for fi, field := range source.Fields[:source.FieldCount] {
+		switch field.FieldType {
+		case TSFFieldInt, TSFFieldFloat:
+			builder.fields = append(builder.fields, tsfRollupField{
+				index:   fi,
+				isFloat: field.FieldType == TSFFieldFloat,
+			})
+		}
+	}
+	return builder
+}
+
+// Accounts entry in the current window or starts a new window if entry
+// doesn't belong to it
+func (builder *tsfRollupBuilder) add(entry []byte) {
+	st := int64(builder.deserializer.GetStartTime(entry))
+	start := st - st%builder.window
+	if st < 0 && start != st {
+		start -= builder.window
+	}
+
+	if builder.count > 0 && start != builder.start {
+		builder.flush()
+	}
+	if builder.count == 0 {
+		builder.start = start
+		for i := range builder.fields {
+			field := &builder.fields[i]
+			field.minInt, field.maxInt = math.MaxInt64, math.MinInt64
+			field.minFloat, field.maxFloat = math.Inf(1), math.Inf(-1)
+			field.sum = 0
+		}
+	}
+
+	builder.count++
+	for i := range builder.fields {
+		field := &builder.fields[i]
+		_, value := builder.deserializer.Get(entry, field.index)
+		if field.isFloat {
+			f := toFloat64(value)
+			field.minFloat = math.Min(field.minFloat, f)
+			field.maxFloat = math.Max(field.maxFloat, f)
+			field.sum += f
+			continue
+		}
+
+		n := toInt64(value)
+		if n < field.minInt {
+			field.minInt = n
+		}
+		if n > field.maxInt {
+			field.maxInt = n
+		}
+		field.sum += float64(n)
+	}
+}
+
+// Encodes aggregated values of the current window as rollup entry
+func (builder *tsfRollupBuilder) flush() {
+	if builder.count == 0 {
+		return
+	}
+
+	entry := make([]byte, builder.header.EntrySize)
+	binary.LittleEndian.PutUint64(entry, uint64(builder.start))
+	binary.LittleEndian.PutUint64(entry[8:], uint64(builder.start+builder.window))
+	binary.LittleEndian.PutUint64(entry[16:], uint64(builder.count))
+
+	off := 24
+	for _, field := range builder.fields {
+		if field.isFloat {
+			binary.LittleEndian.PutUint64(entry[off:], math.Float64bits(field.minFloat))
+			binary.LittleEndian.PutUint64(entry[off+8:], math.Float64bits(field.maxFloat))
+		} else {
+			binary.LittleEndian.PutUint64(entry[off:], uint64(field.minInt))
+			binary.LittleEndian.PutUint64(entry[off+8:], uint64(field.maxInt))
+		}
+
+		avg := field.sum / float64(builder.count)
+		binary.LittleEndian.PutUint64(entry[off+16:], math.Float64bits(avg))
+		off += 24
+	}
+
+	builder.entries = append(builder.entries, entry)
+	builder.count = 0
+}
+
+func toInt64(value interface{}) int64 {
+	switch v := value.(type) {
+	case int:
+		return int64(v)
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case int64:
+		return v
+	}
+	return 0
+}
+
+func toFloat64(value interface{}) float64 {
+	switch v := value.(type) {
+	case float32:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
@@ -2,6 +2,7 @@ package tsfile
 
 import (
 	"fmt"
+	"io"
 
 	"encoding/binary"
 	"encoding/json"
@@ -22,6 +23,9 @@ const (
 
 	TSFFieldEnumerable
 
+	// Variable-length string kept in heap pages (see varstring.go)
+	TSFFieldVarString
+
 	TSFInvalidField
 )
 
@@ -55,13 +59,47 @@ type TSFSchemaHeader struct {
 	// Number of fields in this schema
 	FieldCount uint16
 
-	Pad1 uint32
-	Pad2 uint64
+	// Tag of the series this series is derived from and its aggregation
+	// window in nanoseconds (only for rollups, see rollup.go)
+	SourceTag uint16
+	Window    int64
 
-	Fields [maxFieldCount]TSFSchemaField
+	Fields []TSFSchemaField
 
 	// Name of the schema (only used in V2 header, but doesn't break V1)
 	Name [schemaNameLength]byte
+
+	// Labels of values of enumerable fields per field name. They are kept
+	// in dictionary pages, not in schema page (see enum.go)
+	Enums map[string]TSFEnumDictionary
+}
+
+// On-disk representation of schema in V1 and V2: fixed array of fields.
+// Rollup parameters are kept in what used to be padding
+type tsfSchemaHeaderV2 struct {
+	EntrySize  uint16
+	FieldCount uint16
+
+	SourceTag uint32
+	Window    int64
+
+	Fields [maxFieldCount]TSFSchemaField
+
+	Name [schemaNameLength]byte
+}
+
+// On-disk representation of schema in V3 which is followed by FieldCount
+// fields, so number of fields is only limited by page size. Source tag of
+// rollup is kept in what used to be padding and if it is set, header is
+// followed by aggregation window before fields
+type tsfSchemaHeaderV3 struct {
+	EntrySize  uint16
+	FieldCount uint16
+
+	SourceTag uint16
+	Pad       uint16
+
+	Name [schemaNameLength]byte
 }
 
 // Decoded representation of schema
@@ -69,6 +107,7 @@ type TSFSchemaFieldInfo struct {
 	FieldName string
 	FieldType int
 	Size      uint
+	Offset    uint
 }
 
 type TSFSchemaInfo struct {
@@ -83,6 +122,12 @@ func NewField(name string, goType reflect.Type) TSFSchemaField {
 	field.FieldType = TSFInvalidField
 	field.Size = uint64(goType.Size())
 
+	if goType == reflect.TypeOf(TSVarString("")) {
+		field.FieldType = TSFFieldVarString
+		field.Size = varStringRefSize
+		return field
+	}
+
 	switch goType.Kind() {
 	case reflect.Uint32:
 		switch goType {
@@ -141,27 +186,49 @@ func NewStringField(name string, maxLength int) TSFSchemaField {
 	return field
 }
 
+func NewVarStringField(name string) TSFSchemaField {
+	return NewField(name, reflect.TypeOf(TSVarString("")))
+}
+
+// Creates enumerable field of integer type. Labels of its values may be
+// registered with RegisterEnum()
+func NewEnumField(name string, goType reflect.Type) TSFSchemaField {
+	field := NewField(name, goType)
+	if field.FieldType != TSFFieldInt {
+		field.FieldType = TSFInvalidField
+		return field
+	}
+
+	field.FieldType = TSFFieldEnumerable
+	return field
+}
+
 // Creates new schema header with fields
 func NewSchema(name string, fields []TSFSchemaField) (*TSFSchemaHeader, error) {
 	schema := new(TSFSchemaHeader)
 	copy(schema.Name[:], []byte(name))
+	if len(fields) > math.MaxUint16 {
+		return nil, fmt.Errorf("Invalid schema: too many fields")
+	}
 
+	schema.Fields = make([]TSFSchemaField, 0, len(fields))
+	entrySize := uint64(0)
 	for _, field := range fields {
-		fieldId := schema.FieldCount
-		if fieldId >= maxFieldCount {
-			return nil, fmt.Errorf("Invalid schema: too many fields")
-		}
 		if field.FieldType == TSFInvalidField {
 			return nil, fmt.Errorf("Invalid field type or size %s", DecodeCStr(field.FieldName[:]))
 		}
 
-		field.Offset = uint64(schema.EntrySize)
+		field.Offset = entrySize
+		entrySize += field.Size
+		if entrySize > math.MaxUint16 {
+			return nil, fmt.Errorf("Invalid schema: entry size exceeds %d bytes", math.MaxUint16)
+		}
 
-		schema.Fields[fieldId] = field
-		schema.EntrySize += uint16(field.Size)
-		schema.FieldCount++
+		schema.Fields = append(schema.Fields, field)
 	}
 
+	schema.EntrySize = uint16(entrySize)
+	schema.FieldCount = uint16(len(fields))
 	return schema, nil
 }
 
@@ -197,6 +264,7 @@ func (schema *TSFSchemaHeader) Info() (info TSFSchemaInfo) {
 			FieldName: DecodeCStr(field.FieldName[:]),
 			FieldType: int(field.FieldType),
 			Size:      uint(field.Size),
+			Offset:    uint(field.Offset),
 		})
 	}
 
@@ -205,8 +273,9 @@ func (schema *TSFSchemaHeader) Info() (info TSFSchemaInfo) {
 
 // Checks validity of schema and returns error
 func (schema *TSFSchemaHeader) Check(allowExt bool) error {
-	if schema.FieldCount > maxFieldCount {
-		return fmt.Errorf("Invalid schema: %d fields is too many for TSFile", schema.FieldCount)
+	if int(schema.FieldCount) > len(schema.Fields) {
+		return fmt.Errorf("Invalid schema: %d fields declared, but only %d fields defined",
+			schema.FieldCount, len(schema.Fields))
 	}
 
 	for fieldId := 0; fieldId < int(schema.FieldCount); fieldId++ {
@@ -222,6 +291,16 @@ func (schema *TSFSchemaHeader) Check(allowExt bool) error {
 		case TSFFieldString:
 			// break;
 
+		case TSFFieldVarString:
+			if !allowExt {
+				return fmt.Errorf("Invalid schema field %s: variable-length strings are not supported without extension",
+					DecodeCStr(field.FieldName[:]))
+			}
+			if field.Size != varStringRefSize {
+				return fmt.Errorf("Invalid schema field %s: incorrect size of string reference %d",
+					DecodeCStr(field.FieldName[:]), field.Size)
+			}
+
 		case TSFFieldStartTime, TSFFieldEndTime:
 			if !allowExt {
 				return fmt.Errorf("Invalid schema field %s: times are not supported without extension",
@@ -251,6 +330,86 @@ func (schema *TSFSchemaHeader) Check(allowExt bool) error {
 	return nil
 }
 
+// Writes on-disk representation of schema for the specified format version
+func (schema *TSFSchemaHeader) encode(w io.Writer, version TSFFormatFlags) error {
+	fields := schema.Fields[:schema.FieldCount]
+	if version == TSFFormatV3 {
+		err := binary.Write(w, binary.LittleEndian, &tsfSchemaHeaderV3{
+			EntrySize:  schema.EntrySize,
+			FieldCount: schema.FieldCount,
+			SourceTag:  schema.SourceTag,
+			Name:       schema.Name,
+		})
+		if err == nil && schema.SourceTag != 0 {
+			err = binary.Write(w, binary.LittleEndian, schema.Window)
+		}
+		if err != nil {
+			return err
+		}
+		return binary.Write(w, binary.LittleEndian, fields)
+	}
+
+	if len(fields) > maxFieldCount {
+		return fmt.Errorf("Invalid schema: too many fields (%d) for TSFile V1/V2", len(fields))
+	}
+
+	header := tsfSchemaHeaderV2{
+		EntrySize:  schema.EntrySize,
+		FieldCount: schema.FieldCount,
+		SourceTag:  uint32(schema.SourceTag),
+		Window:     schema.Window,
+		Name:       schema.Name,
+	}
+	copy(header.Fields[:], fields)
+	return binary.Write(w, binary.LittleEndian, &header)
+}
+
+// Reads schema from its on-disk representation for the format version
+func decodeSchema(r io.Reader, version TSFFormatFlags) (*TSFSchemaHeader, error) {
+	schema := new(TSFSchemaHeader)
+	if version == TSFFormatV3 {
+		var header tsfSchemaHeaderV3
+		err := binary.Read(r, binary.LittleEndian, &header)
+		if err != nil {
+			return nil, err
+		}
+
+		schema.EntrySize = header.EntrySize
+		schema.FieldCount = header.FieldCount
+		schema.SourceTag = header.SourceTag
+		schema.Name = header.Name
+		if schema.SourceTag != 0 {
+			err = binary.Read(r, binary.LittleEndian, &schema.Window)
+			if err != nil {
+				return nil, err
+			}
+		}
+		schema.Fields = make([]TSFSchemaField, header.FieldCount)
+		err = binary.Read(r, binary.LittleEndian, schema.Fields)
+		if err != nil {
+			return nil, err
+		}
+		return schema, nil
+	}
+
+	var header tsfSchemaHeaderV2
+	err := binary.Read(r, binary.LittleEndian, &header)
+	if err != nil {
+		return nil, err
+	}
+	if header.FieldCount > maxFieldCount {
+		return nil, fmt.Errorf("Invalid schema: %d fields is too many for TSFile", header.FieldCount)
+	}
+
+	schema.EntrySize = header.EntrySize
+	schema.FieldCount = header.FieldCount
+	schema.SourceTag = uint16(header.SourceTag)
+	schema.Window = header.Window
+	schema.Name = header.Name
+	schema.Fields = append([]TSFSchemaField(nil), header.Fields[:header.FieldCount]...)
+	return schema, nil
+}
+
 // Validates that schema matches with other schema or returns error
 // if not. Useful for checking versioning of files
 func (schema *TSFSchemaHeader) Validate(other *TSFSchemaHeader) error {
@@ -297,12 +456,14 @@ func (schema *TSFSchemaHeader) MarshalJSON() ([]byte, error) {
 		Name      string                        `json:"name"`
 		EntrySize uint16                        `json:"entry_size"`
 		Fields    map[string]jsonTSFSchemaField `json:"fields"`
+		Enums     map[string]TSFEnumDictionary  `json:"enums,omitempty"`
 	}
 
 	jsonSchema := jsonTSFSchemaHeader{
 		Name:      DecodeCStr(schema.Name[:]),
 		EntrySize: schema.EntrySize,
 		Fields:    make(map[string]jsonTSFSchemaField),
+		Enums:     schema.Enums,
 	}
 	for fieldId := 0; fieldId < int(schema.FieldCount); fieldId++ {
 		field := &schema.Fields[fieldId]
@@ -316,10 +477,14 @@ func (schema *TSFSchemaHeader) MarshalJSON() ([]byte, error) {
 			jsonField.FieldType = "bool"
 		case TSFFieldInt:
 			jsonField.FieldType = "int"
+		case TSFFieldEnumerable:
+			jsonField.FieldType = "enum"
 		case TSFFieldFloat:
 			jsonField.FieldType = "float"
 		case TSFFieldString:
 			jsonField.FieldType = "str"
+		case TSFFieldVarString:
+			jsonField.FieldType = "varstr"
 		case TSFFieldStartTime:
 			jsonField.FieldType = "start_time"
 		case TSFFieldEndTime:
@@ -343,10 +508,19 @@ type tsFieldDeserializer struct {
 
 	impl    tsFieldDeserializerFunc
 	implI64 tsFieldDeserializerI64Func
+
+	// Index of variable-length string among such fields of entry
+	varString      bool
+	varStringIndex int
 }
 
 type TSFDeserializer struct {
-	fields []tsFieldDeserializer
+	fields    []tsFieldDeserializer
+	entrySize uint64
+
+	// Offsets of references of all variable-length strings in entry which
+	// are needed to locate strings even if deserializer is projected
+	varStringOffsets []uint64
 
 	StartTimeIndex int
 	EndTimeIndex   int
@@ -355,6 +529,7 @@ type TSFDeserializer struct {
 func NewDeserializer(schema *TSFSchemaHeader) *TSFDeserializer {
 	deserializer := new(TSFDeserializer)
 	deserializer.fields = make([]tsFieldDeserializer, schema.FieldCount)
+	deserializer.entrySize = uint64(schema.EntrySize)
 	deserializer.StartTimeIndex = -1
 	deserializer.EndTimeIndex = -1
 
@@ -432,18 +607,79 @@ func NewDeserializer(schema *TSFSchemaHeader) *TSFDeserializer {
 			}
 		case TSFFieldString:
 			field.impl = func(buf []byte) interface{} { return DecodeCStr(buf) }
+		case TSFFieldVarString:
+			// Handled by Get() as string is kept after the fixed part of entry
+			field.varString = true
+			field.varStringIndex = len(deserializer.varStringOffsets)
+			deserializer.varStringOffsets = append(deserializer.varStringOffsets,
+				field.offset)
+		}
+
+		labels := schema.Enums[field.name]
+		if fieldHdr.FieldType == TSFFieldEnumerable && len(labels) > 0 {
+			// Return label instead of integer value if it is known
+			impl := field.impl
+			field.impl = func(buf []byte) interface{} {
+				value := impl(buf)
+				if label, ok := labels[toInt64(value)]; ok {
+					return label
+				}
+				return value
+			}
 		}
 	}
 
 	return deserializer
 }
 
+// Creates deserializer which only returns the specified fields in the
+// specified order. Projected deserializer works on the same entries
+func (deserializer *TSFDeserializer) Project(names ...string) (*TSFDeserializer, error) {
+	projection := &TSFDeserializer{
+		fields:           make([]tsFieldDeserializer, 0, len(names)),
+		entrySize:        deserializer.entrySize,
+		varStringOffsets: deserializer.varStringOffsets,
+		StartTimeIndex:   -1,
+		EndTimeIndex:     -1,
+	}
+
+	for _, name := range names {
+		fi := deserializer.FieldIndex(name)
+		if fi < 0 {
+			return nil, fmt.Errorf("Field '%s' is not found in schema", name)
+		}
+
+		switch fi {
+		case deserializer.StartTimeIndex:
+			projection.StartTimeIndex = len(projection.fields)
+		case deserializer.EndTimeIndex:
+			projection.EndTimeIndex = len(projection.fields)
+		}
+		projection.fields = append(projection.fields, deserializer.fields[fi])
+	}
+
+	return projection, nil
+}
+
+// Returns index of the field with the specified name or -1
+func (deserializer *TSFDeserializer) FieldIndex(name string) int {
+	for fi := range deserializer.fields {
+		if deserializer.fields[fi].name == name {
+			return fi
+		}
+	}
+	return -1
+}
+
 func (deserializer *TSFDeserializer) Len() int {
 	return len(deserializer.fields)
 }
 
 func (deserializer *TSFDeserializer) Get(buf []byte, idx int) (string, interface{}) {
 	field := deserializer.fields[idx]
+	if field.varString {
+		return field.name, deserializer.getVarString(buf, idx)
+	}
 	buf = buf[field.offset : field.offset+field.size]
 
 	return field.name, field.impl(buf)
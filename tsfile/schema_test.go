@@ -6,6 +6,8 @@ import (
 	"testing"
 
 	"bytes"
+	"io/ioutil"
+	"os"
 	"reflect"
 	"strings"
 
@@ -72,12 +74,36 @@ func TestLongSchema(t *testing.T) {
 	}
 
 	s, err := tsfile.NewStructSchema(reflect.TypeOf(S{}))
-	if s != nil {
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.FieldCount != 65 {
 		t.Errorf("Unexpected struct w/ %d fields", s.FieldCount)
 	}
-	t.Log(err)
-	if !strings.Contains(err.Error(), "too many fields") {
-		t.Error(err)
+
+	// V2 cannot keep such schema, but V3 can
+	for _, flags := range []tsfile.TSFFormatFlags{tsfile.TSFFormatV2, tsfile.TSFFormatV3} {
+		f, err := ioutil.TempFile("", "tsftest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(f.Name())
+
+		tsf, err := tsfile.NewTSFile(f, flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = tsf.AddSchema(s)
+		t.Log(err)
+		if flags == tsfile.TSFFormatV2 {
+			if err == nil || !strings.Contains(err.Error(), "too many fields") {
+				t.Errorf("Unexpected error for V2: %v", err)
+			}
+		} else if err != nil {
+			t.Error(err)
+		}
+		tsf.Put()
 	}
 }
 
@@ -152,3 +178,159 @@ func TestSchemaInterpreter(t *testing.T) {
 	}
 
 }
+
+func TestStructCodec(t *testing.T) {
+	type S struct {
+		I8  int8
+		I16 int16
+		I32 int32
+		_   int32
+		I64 int64
+		F32 float32
+		F64 float64
+		S   [3]byte
+		B   tsfile.TSBoolean
+		T   tsfile.TSTimeStart
+	}
+
+	codec, err := tsfile.NewStructCodec(reflect.TypeOf(S{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := make([]S, 4)
+	for i := range entries {
+		entries[i] = S{I8: int8(-i), I16: int16(i * 1000), I32: int32(-i * 100000),
+			I64: int64(i) << 40, F32: float32(i) / 3, F64: float64(i) / 7,
+			B: tsfile.FromBoolean(i%2 == 0), T: tsfile.TSTimeStart(i)}
+		tsfile.EncodeCStr("ab", entries[i].S[:])
+	}
+
+	// Codec should produce exactly the same output as encoding/binary
+	buf := bytes.NewBuffer([]byte{})
+	binary.Write(buf, binary.LittleEndian, entries[1:])
+	if codec.EntrySize()*3 != buf.Len() {
+		t.Fatalf("Unexpected entry size %d", codec.EntrySize())
+	}
+
+	raw := make([]byte, buf.Len())
+	codec.Encode(raw, entries, 1, 3)
+	if !bytes.Equal(raw, buf.Bytes()) {
+		t.Errorf("Encoded entries are differ:\n%v\n%v", raw, buf.Bytes())
+	}
+
+	decoded := make([]S, 4)
+	codec.Decode(raw, decoded, 1, 3)
+	if !reflect.DeepEqual(decoded[1:], entries[1:]) {
+		t.Errorf("Decoded entries are differ: %v", decoded)
+	}
+
+	type N struct {
+		S S
+	}
+	_, err = tsfile.NewStructCodec(reflect.TypeOf(N{}))
+	if err == nil {
+		t.Errorf("Codec shouldn't be generated for nested struct")
+	}
+}
+
+func TestSchemaMapping(t *testing.T) {
+	type S1 struct {
+		I   int32
+		Old int64
+		S   [8]byte
+	}
+	type S2 struct {
+		I   int64
+		New int16
+		S   [4]byte
+		V   tsfile.TSVarString
+	}
+
+	s1, _ := tsfile.NewStructSchema(reflect.TypeOf(S1{}))
+	s2, _ := tsfile.NewStructSchema(reflect.TypeOf(S2{}))
+
+	mapping, err := tsfile.NewSchemaMapping(s1, s2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapping.Identical() {
+		t.Errorf("Schemas shouldn't be identical")
+	}
+	if missing := mapping.Missing(); !reflect.DeepEqual(missing, []string{"New", "V"}) {
+		t.Errorf("Unexpected missing fields: %v", missing)
+	}
+
+	err = mapping.SetDefault("New", 10)
+	if err != nil {
+		t.Error(err)
+	}
+	err = mapping.SetDefault("V", "default")
+	if err != nil {
+		t.Error(err)
+	}
+	if mapping.SetDefault("I", 1) == nil || mapping.SetDefault("New", "str") == nil {
+		t.Errorf("SetDefault should fail for present fields and wrong types")
+	}
+
+	s := S1{I: -5, Old: 3}
+	tsfile.EncodeCStr("abcdefg", s.S[:])
+	buf := bytes.NewBuffer([]byte{})
+	binary.Write(buf, binary.LittleEndian, &s)
+
+	entry := mapping.Map(buf.Bytes())
+	deserializer := tsfile.NewDeserializer(s2)
+	for fi, expected := range []interface{}{int64(-5), int16(10), "abc", "default"} {
+		if _, value := deserializer.Get(entry, fi); value != expected {
+			t.Errorf("Unexpected value of field #%d: %v", fi, value)
+		}
+	}
+
+	type S3 struct {
+		I float32
+	}
+	s3, _ := tsfile.NewStructSchema(reflect.TypeOf(S3{}))
+	_, err = tsfile.NewSchemaMapping(s1, s3)
+	if err == nil {
+		t.Errorf("Mapping shouldn't be created for field of different type")
+	}
+}
+
+func TestDeserializerProject(t *testing.T) {
+	type S struct {
+		T  tsfile.TSTimeStart
+		V1 tsfile.TSVarString
+		I  int32
+		V2 tsfile.TSVarString
+	}
+
+	schema, _ := tsfile.NewStructSchema(reflect.TypeOf(S{}))
+	entry := make([]byte, schema.EntrySize)
+	binary.LittleEndian.PutUint64(entry, 100)
+	binary.LittleEndian.PutUint32(entry[16:], 7)
+	entry = tsfile.EncodeVarString(entry, 8, "first")
+	entry = tsfile.EncodeVarString(entry, 20, "second")
+
+	deserializer, err := tsfile.NewDeserializer(schema).Project("V2", "I", "T")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deserializer.Len() != 3 || deserializer.StartTimeIndex != 2 {
+		t.Errorf("Unexpected projection: %d fields, start time #%d",
+			deserializer.Len(), deserializer.StartTimeIndex)
+	}
+	if name, value := deserializer.Get(entry, 0); name != "V2" || value != "second" {
+		t.Errorf("Unexpected field #0: %s = %v", name, value)
+	}
+	if _, value := deserializer.Get(entry, 1); value != int32(7) {
+		t.Errorf("Unexpected field #1: %v", value)
+	}
+	if deserializer.GetStartTime(entry) != 100 {
+		t.Errorf("Unexpected start time: %v", deserializer.GetStartTime(entry))
+	}
+
+	_, err = tsfile.NewDeserializer(schema).Project("X")
+	if err == nil {
+		t.Errorf("Projection of unknown field should fail")
+	}
+}
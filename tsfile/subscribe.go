@@ -0,0 +1,167 @@
+package tsfile
+
+import (
+	"io"
+	"time"
+)
+
+// Subscriptions -- allow readers to follow series while writer is still
+// appending entries to it. Subscription is notified each time AddEntries() or
+// AddFile() commit new entries, so readers do not need to poll the file. When
+// last reference to the file is put, all subscriptions are closed
+
+type TSFSubscription struct {
+	tsf *TSFile
+	tag TSFPageTag
+
+	// Index of the next entry to be read
+	next int
+
+	notify chan struct{}
+	closed bool
+}
+
+// Subscribes to entries of series tag starting with entry start. If entries
+// are already available, subscription is notified immediately
+func (tsf *TSFile) Subscribe(tag TSFPageTag, start int) (*TSFSubscription, error) {
+	_, err := tsf.GetSchema(tag)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := &TSFSubscription{
+		tsf:    tsf,
+		tag:    tag,
+		next:   start,
+		notify: make(chan struct{}, 1),
+	}
+
+	tsf.subMu.Lock()
+	defer tsf.subMu.Unlock()
+
+	tsf.subscriptions = append(tsf.subscriptions, sub)
+	if sub.Pending() > 0 {
+		sub.signal()
+	}
+	return sub, nil
+}
+
+// Notifies subscribers of the series about new entries
+func (tsf *TSFile) notifySubscribers(tag TSFPageTag) {
+	tsf.subMu.Lock()
+	defer tsf.subMu.Unlock()
+
+	for _, sub := range tsf.subscriptions {
+		if sub.tag == tag {
+			sub.signal()
+		}
+	}
+}
+
+func (tsf *TSFile) closeSubscriptions() {
+	tsf.subMu.Lock()
+	defer tsf.subMu.Unlock()
+
+	for _, sub := range tsf.subscriptions {
+		sub.closeNoLock()
+	}
+	tsf.subscriptions = nil
+}
+
+// Returns channel which receives a value when new entries are committed and
+// which is closed when subscription or file is closed
+func (sub *TSFSubscription) C() <-chan struct{} {
+	return sub.notify
+}
+
+// Returns page tag of subscribed series
+func (sub *TSFSubscription) Tag() TSFPageTag {
+	return sub.tag
+}
+
+// Returns number of entries which were committed but not read yet
+func (sub *TSFSubscription) Pending() int {
+	count := sub.tsf.GetEntryCount(sub.tag) - sub.next
+	if count < 0 {
+		return 0
+	}
+	return count
+}
+
+// Reads up to max (or all if max is 0) raw entries which were committed but
+// not read yet. Doesn't block if there are no such entries
+func (sub *TSFSubscription) Read(max int) ([][]byte, error) {
+	count := sub.Pending()
+	if max > 0 && count > max {
+		count = max
+	}
+	if count == 0 {
+		return nil, nil
+	}
+
+	entries := make([][]byte, count)
+	err := sub.tsf.GetEntries(sub.tag, entries, sub.next)
+	if err != nil {
+		return nil, err
+	}
+
+	sub.next += count
+	return entries, nil
+}
+
+// Reads entries like Read(), but if there are no entries, waits for them up
+// to timeout. Returns io.EOF if subscription was closed
+func (sub *TSFSubscription) Wait(max int, timeout time.Duration) ([][]byte, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		entries, err := sub.Read(max)
+		if err != nil || len(entries) > 0 {
+			return entries, err
+		}
+
+		select {
+		case _, ok := <-sub.notify:
+			if !ok {
+				return nil, io.EOF
+			}
+		case <-timer.C:
+			return nil, nil
+		}
+	}
+}
+
+// Unsubscribes from series
+func (sub *TSFSubscription) Close() {
+	tsf := sub.tsf
+	tsf.subMu.Lock()
+	defer tsf.subMu.Unlock()
+
+	for i, other := range tsf.subscriptions {
+		if other == sub {
+			tsf.subscriptions = append(tsf.subscriptions[:i], tsf.subscriptions[i+1:]...)
+			break
+		}
+	}
+	sub.closeNoLock()
+}
+
+func (sub *TSFSubscription) signal() {
+	if sub.closed {
+		return
+	}
+
+	select {
+	case sub.notify <- struct{}{}:
+	default:
+		// Notification is already pending
+	}
+}
+
+func (sub *TSFSubscription) closeNoLock() {
+	if !sub.closed {
+		sub.closed = true
+		close(sub.notify)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"flag"
+
+	"tsfile"
+)
+
+var usage string = `
+TSFile checker (TSFCK)
+
+Usage: tsfck [-r] [-v] file.tsf...
+	-r	repair damaged files
+	-v	show series in files
+`
+
+func main() {
+	flags := flag.NewFlagSet("tsfck", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, usage)
+	}
+	repair := flags.Bool("r", false, "repair damaged files")
+	verbose := flags.Bool("v", false, "show series in files")
+
+	flags.Parse(os.Args[1:])
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	status := 0
+	for _, path := range flags.Args() {
+		damaged, err := checkFile(path, *repair, *verbose)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			status = 1
+		} else if damaged && !*repair {
+			status = 1
+		}
+	}
+
+	os.Exit(status)
+}
+
+// Checks file and returns true if it is damaged
+func checkFile(path string, repair, verbose bool) (bool, error) {
+	var file *os.File
+	var err error
+	if repair {
+		file, err = os.OpenFile(path, os.O_RDWR, 0)
+	} else {
+		file, err = os.Open(path)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	tsf, err := tsfile.LoadTSFile(file)
+	if err != nil {
+		return false, err
+	}
+
+	if verbose {
+		for _, series := range tsf.GetStats().Series {
+			fmt.Printf("%s: series #%d %s: %d entries\n", path, series.Tag,
+				series.Name, series.Count)
+		}
+	}
+
+	damage := tsf.Verify()
+	for _, pageDamage := range damage {
+		fmt.Printf("%s: page #%d is damaged: %v\n", path, pageDamage.PageId,
+			pageDamage.Error)
+	}
+	if len(damage) == 0 {
+		fmt.Printf("%s: OK\n", path)
+		return false, nil
+	}
+
+	if repair {
+		err = tsf.Repair()
+		if err != nil {
+			return true, fmt.Errorf("Cannot repair file: %v", err)
+		}
+		fmt.Printf("%s: repaired\n", path)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"flag"
+
+	"tsfile"
+	"tsfile/export"
+)
+
+var usage string = `
+TSFile dumper (TSFDUMP)
+
+Usage: tsfdump [-f format] [-o output] [-s series] file.tsf
+	-f	output format: %s (default: csv)
+	-o	output file (default: stdout)
+	-s	name or tag of the series to dump. If omitted,
+		lists series in file
+`
+
+func main() {
+	flags := flag.NewFlagSet("tsfdump", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage, strings.Join(export.Formats, ", "))
+	}
+	format := flags.String("f", export.FormatCSV, "output format")
+	outFile := flags.String("o", "", "output file")
+	series := flags.String("s", "", "series name or tag")
+
+	flags.Parse(os.Args[1:])
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	err := dumpFile(flags.Arg(0), *series, *format, *outFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func dumpFile(path, series, format, outFile string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	tsf, err := tsfile.LoadTSFile(file)
+	if err != nil {
+		return err
+	}
+
+	if len(series) == 0 {
+		for _, stats := range tsf.GetStats().Series {
+			fmt.Printf("%d\t%s\t%d\n", stats.Tag, stats.Name, stats.Count)
+		}
+		return nil
+	}
+
+	tag, err := export.FindSeries(tsf, series)
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if len(outFile) > 0 {
+		out, err = os.Create(outFile)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	exporter, err := export.NewExporter(format, out)
+	if err != nil {
+		return err
+	}
+
+	return export.ExportSeries(exporter, tsf, tag)
+}
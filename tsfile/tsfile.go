@@ -14,6 +14,7 @@ import (
 	"strconv"
 
 	"encoding/binary"
+	"hash/crc32"
 	"reflect"
 )
 
@@ -35,12 +36,30 @@ import (
 //	 +-  TSFHeader					 + TSFHeader #1					  + TSFHeader #2
 //                                  <----------- extent ------------>
 //
-// In V2 format each page may contain schema, header or multiple entries
+// In V2 format each page may contain schema, header, multiple entries or
+// variable-length strings (see varstring.go). If TSFFormatCompressed flag is
+// set, data pages are compressed (see compress.go)
+//
+// V3 has same layout as V2, but size of the pages is chosen when file is
+// created and is kept in TSFHeaderExt which follows TSFHeader, so number of
+// page headers in header page depends on page size. Schema pages keep number
+// of fields followed by fields, so schemas are only limited by page size.
+//
+// Headers are always written after pages they refer and only describe state
+// of pages which were already written, so if writer crashes in the middle,
+// file is still consistent. If TSFFormatChecksum flag is set, page headers
+// keep checksums of pages, so damaged pages are detected (see verify.go)
 //
 
 const (
+	// Size of pages in V1 and V2
 	pageSize = 4096
 
+	// Range of page sizes supported by V3
+	defaultPageSizeV3 = 16384
+	minPageSizeV3     = 4096
+	maxPageSizeV3     = 65536
+
 	tsFileMagic       = "TSFILE"
 	tsFileMagicLength = 6
 
@@ -52,8 +71,16 @@ const (
 
 	superBlockCount = 4
 
-	hdrByteCount  = 72
-	tagsPerHeader = 240
+	hdrByteCount    = 72
+	hdrExtByteCount = 8
+	tagsPerHeader   = 240
+
+	pageHeaderSize = 16
+
+	// Sizes of V3 schema header, window of rollup and schema field
+	schemaHeaderV3Size = 40
+	schemaWindowSize   = 8
+	schemaFieldSize    = 56
 
 	maxCachedPagesHigh = 24
 	maxCachedPagesLow  = 16
@@ -65,10 +92,12 @@ type TSFSuperBlock struct {
 	// Time stamp of writing this super block in nanoseconds
 	Time uint64
 
-	// Total number of entries (V1) or pages (V2)
+	// Total number of entries (V1) or pages (V2 and V3)
 	Count uint32
 
-	Pad uint32
+	// Id of the next page to be reused if file has retention limit and
+	// pages were already reused or zero (see retention.go)
+	ReusePageId uint32
 }
 
 type TSFHeader struct {
@@ -79,7 +108,16 @@ type TSFHeader struct {
 
 	SuperBlocks [superBlockCount]TSFSuperBlock
 
-	// Header is either followed by schema (V1) or page headers (V2)
+	// Header is either followed by schema (V1), page headers (V2) or
+	// TSFHeaderExt and page headers (V3)
+}
+
+type TSFHeaderExt struct {
+	// Size of all pages in file
+	PageSize uint32
+
+	// Number of page headers following header
+	TagsPerHeader uint32
 }
 
 type TSFPageTag int
@@ -92,16 +130,28 @@ const (
 	// not supported by TSLoad 1.0, but implemented in 1.1
 	TSFFormatV1  TSFFormatFlags = 0x1
 	TSFFormatV2  TSFFormatFlags = 0x2
+	TSFFormatV3  TSFFormatFlags = 0x4
 	TSFFormatExt TSFFormatFlags = 0x10
 
-	tsFileFormatVersionFlags   TSFFormatFlags = (TSFFormatV1 | TSFFormatV2)
+	// Data pages are compressed (only supported by V2 and V3)
+	TSFFormatCompressed TSFFormatFlags = 0x20
+
+	// Page headers contain checksums of pages (only supported by V2 and V3)
+	TSFFormatChecksum TSFFormatFlags = 0x40
+
+	tsFileFormatVersionFlags   TSFFormatFlags = (TSFFormatV1 | TSFFormatV2 | TSFFormatV3)
 	tsFileSupportedFormatFlags TSFFormatFlags = (tsFileFormatVersionFlags |
-		TSFFormatExt)
+		TSFFormatExt | TSFFormatCompressed | TSFFormatChecksum)
+	tsFileV2OnlyFormatFlags TSFFormatFlags = (TSFFormatCompressed | TSFFormatChecksum)
 )
 
 const (
 	// Flag meaning that this page contains schema, not the actual data
 	TSFSchemaPage = 1 << iota
+
+	// Flag meaning that this page contains labels of enumerable values of
+	// the series (see enum.go)
+	TSFDictionaryPage
 )
 
 const (
@@ -113,6 +163,9 @@ const (
 	// A header tag
 	TSFTagHeader TSFPageTag = 1
 
+	// Heap page with variable-length strings
+	TSFTagHeap TSFPageTag = 2
+
 	// First data page tag
 	TSFTagData TSFPageTag = 32
 )
@@ -126,7 +179,12 @@ type TSFPageHeader struct {
 
 	// Number of entries in this page
 	Count uint32
-	Pad   uint64
+
+	// Size of compressed data in page (zero for raw pages)
+	Size uint32
+
+	// CRC32 of page contents (if TSFFormatChecksum is set)
+	Checksum uint32
 }
 
 type tsfPage struct {
@@ -147,6 +205,23 @@ type tsfPage struct {
 
 	// Does this page filled up with entries?
 	full bool
+
+	// Codec for compressed data pages, number of entries which were checked
+	// to fit into compressed page and their compressed size
+	codec    *tsfPageCodec
+	fitCount int
+	fitSize  int
+
+	// Contents of the page which is prepared before writing page, number of
+	// entries in page which were written to file and flag which says that
+	// page has entries which are not accounted in header yet
+	output    []byte
+	diskCount uint32
+	pending   bool
+
+	// Page buffer references file mapping, so page is read-only and
+	// is not kept in page cache (see mmap.go)
+	mapped bool
 }
 
 type tsfPageIndex struct {
@@ -155,6 +230,11 @@ type tsfPageIndex struct {
 
 	// Starting entry index
 	start uint32
+
+	// Range of start times of entries in this page. It is lazily loaded by
+	// time lookups and valid only while timeCount matches number of entries
+	minTime, maxTime TSTimeStart
+	timeCount        uint32
 }
 
 type tsfSchema struct {
@@ -168,6 +248,15 @@ type tsfSchema struct {
 
 	// index of page ids per starting index
 	pageIndex []tsfPageIndex
+
+	// codec used for compressing data pages
+	codec *tsfPageCodec
+
+	// entries contain variable-length strings
+	varStrings bool
+
+	// current dictionary page, guarded by dictMu (see enum.go)
+	dictPageId TSFPageId
 }
 
 type TSFSeriesStats struct {
@@ -206,6 +295,9 @@ type TSFile struct {
 	// Default page size for data
 	pageSize uint32
 
+	// Number of page headers in a header page (V2 and V3)
+	tagsPerHeader uint32
+
 	// Index of page which contains actual header
 	headerPageId TSFPageId
 
@@ -223,6 +315,43 @@ type TSFile struct {
 
 	dataPagesCache map[TSFPageTag][]TSFPageId
 	pageCache      map[TSFPageId]*tsfPage
+
+	// Current heap page for variable-length strings (see varstring.go)
+	heapMu     sync.Mutex
+	heapPageId TSFPageId
+
+	// Number of references to strings in heap pages and their number from
+	// each data page. Heap pages which existed when file was loaded are kept
+	// until data pages which existed at that moment are reused (see
+	// retention.go)
+	heapRefsMu      sync.Mutex
+	heapRefs        map[TSFPageId]int
+	dataHeapRefs    map[TSFPageId]map[TSFPageId]int
+	loadedHeapPages map[TSFPageId]bool
+	loadedDataPages map[TSFPageId]bool
+
+	// Serializes registration of enum values (see enum.go)
+	dictMu sync.Mutex
+
+	// Serializes building of rollups (see rollup.go)
+	rollupMu sync.Mutex
+
+	// Maximum number of pages in file and id of the next page to be reused
+	// after it is reached (see retention.go)
+	maxPages    TSFPageId
+	reusePageId TSFPageId
+
+	// Contents of the file mapped into memory in read-only mode and pages
+	// which checksums were already verified (see mmap.go)
+	mapping       []byte
+	mappedChecked []uint32
+
+	// Pages which were found damaged
+	damage []TSFDamage
+
+	// Readers which follow series (see subscribe.go)
+	subMu         sync.Mutex
+	subscriptions []*TSFSubscription
 }
 
 func newTSFile(file TSFileStorage) *TSFile {
@@ -230,7 +359,10 @@ func newTSFile(file TSFileStorage) *TSFile {
 	tsf.file = file
 	tsf.pageCache = make(map[TSFPageId]*tsfPage)
 	tsf.dataPagesCache = make(map[TSFPageTag][]TSFPageId)
+	tsf.heapRefs = make(map[TSFPageId]int)
+	tsf.dataHeapRefs = make(map[TSFPageId]map[TSFPageId]int)
 	tsf.pageSize = pageSize
+	tsf.tagsPerHeader = tagsPerHeader
 	tsf.refCount = int32(1)
 
 	return tsf
@@ -238,15 +370,36 @@ func newTSFile(file TSFileStorage) *TSFile {
 
 // Creates new TSFile object for writing
 func NewTSFile(file TSFileStorage, formatFlags TSFFormatFlags) (*TSFile, error) {
-	if (formatFlags & ^tsFileSupportedFormatFlags) != 0 ||
-		(formatFlags&tsFileFormatVersionFlags) == 0 {
+	if formatFlags.getVersion() == TSFFormatV3 {
+		return NewTSFileWithPageSize(file, formatFlags, defaultPageSizeV3)
+	}
+	return NewTSFileWithPageSize(file, formatFlags, pageSize)
+}
 
+// Creates new TSFile object for writing with specified page size. Only V3
+// supports page sizes other than 4096
+func NewTSFileWithPageSize(file TSFileStorage, formatFlags TSFFormatFlags,
+	size uint32) (*TSFile, error) {
+	switch formatFlags.getVersion() {
+	case TSFFormatV1, TSFFormatV2, TSFFormatV3:
+	default:
+		return nil, fmt.Errorf("Unsupported TSFile format flags %x", formatFlags)
+	}
+	if (formatFlags & ^tsFileSupportedFormatFlags) != 0 {
 		return nil, fmt.Errorf("Unsupported TSFile format flags %x", formatFlags)
 	}
+	if (formatFlags&tsFileV2OnlyFormatFlags) != 0 && !formatFlags.hasExtents() {
+		return nil, fmt.Errorf("Compression and checksums are not supported by TSFile V1")
+	}
 
 	tsf := newTSFile(file)
 	tsf.formatFlags = TSFFormatFlags(formatFlags)
 
+	err := tsf.setPageSize(size)
+	if err != nil {
+		return nil, err
+	}
+
 	// Initialize header basic fields
 	copy(tsf.header.Magic[:], []byte(tsFileMagic))
 	tsf.header.FormatFlags = uint16(formatFlags)
@@ -261,25 +414,35 @@ func NewTSFile(file TSFileStorage, formatFlags TSFFormatFlags) (*TSFile, error)
 func LoadTSFile(file TSFileStorage) (*TSFile, error) {
 	tsf := newTSFile(file)
 
+	err := tsf.load()
+	if err != nil {
+		return nil, err
+	}
+	return tsf, nil
+}
+
+// Loads headers and schemas of file depending on its version
+func (tsf *TSFile) load() error {
 	// Read first header
 	hdrPage, err := tsf.loadHeader(0)
 	if err != nil {
-		return nil, fmt.Errorf("Error reading first header: %v", err)
+		return fmt.Errorf("Error reading first header: %v", err)
 	}
 
 	switch tsf.formatFlags.getVersion() {
 	case TSFFormatV1:
-		err = tsf.loadFileV1(hdrPage)
+		return tsf.loadFileV1(hdrPage)
 	case TSFFormatV2:
-		err = tsf.loadFileV2(hdrPage)
-	default:
-		return nil, fmt.Errorf("Unsupported TSFile format flags %x", tsf.formatFlags)
+		return tsf.loadFileV2(hdrPage)
+	case TSFFormatV3:
+		hdrPage, err = tsf.loadHeaderExt(hdrPage)
+		if err != nil {
+			return err
+		}
+		return tsf.loadFileV2(hdrPage)
 	}
 
-	if err != nil {
-		return nil, err
-	}
-	return tsf, nil
+	return fmt.Errorf("Unsupported TSFile format flags %x", tsf.formatFlags)
 }
 
 // Functions for convert primitive values
@@ -313,6 +476,36 @@ func (flags TSFFormatFlags) hasFlag(flag TSFFormatFlags) bool {
 func (flags TSFFormatFlags) getVersion() TSFFormatFlags {
 	return flags & tsFileFormatVersionFlags
 }
+func (flags TSFFormatFlags) hasExtents() bool {
+	version := flags.getVersion()
+	return version == TSFFormatV2 || version == TSFFormatV3
+}
+
+// Sets page size and computes layout of header pages
+func (tsf *TSFile) setPageSize(size uint32) error {
+	if tsf.formatFlags.getVersion() != TSFFormatV3 {
+		if size != pageSize {
+			return fmt.Errorf("Page size %d is only supported by TSFile V3", size)
+		}
+		return nil
+	}
+
+	if size < minPageSizeV3 || size > maxPageSizeV3 || (size&(size-1)) != 0 {
+		return fmt.Errorf("Invalid page size %d", size)
+	}
+
+	tsf.pageSize = size
+	tsf.tagsPerHeader = (size - hdrByteCount - hdrExtByteCount) / pageHeaderSize
+	return nil
+}
+
+// Returns offset of page headers in header page
+func (tsf *TSFile) getPageHeadersOffset() int64 {
+	if tsf.formatFlags.getVersion() == TSFFormatV3 {
+		return hdrByteCount + hdrExtByteCount
+	}
+	return hdrByteCount
+}
 
 func (tsf *TSFile) loadFileV1(hdrPage *tsfPage) error {
 	sb := tsf.header.findSuperBlock()
@@ -321,9 +514,11 @@ func (tsf *TSFile) loadFileV1(hdrPage *tsfPage) error {
 	}
 
 	// There is a single schema in v1, so load it and set entry count
-	var schemaHdr TSFSchemaHeader
-	hdrPage.read(&schemaHdr, hdrByteCount)
-	tag, err := tsf.AddSchema(&schemaHdr)
+	schemaHdr, err := hdrPage.readSchema(hdrByteCount, TSFFormatV1)
+	if err != nil {
+		return err
+	}
+	tag, err := tsf.AddSchema(schemaHdr)
 	if err != nil {
 		return err
 	}
@@ -355,6 +550,8 @@ func (tsf *TSFile) loadFileV1(hdrPage *tsfPage) error {
 
 func (tsf *TSFile) loadFileV2(hdrPage *tsfPage) error {
 	// Load all page headers and headers first...
+	var sbTime uint64
+	var dictPageIds []TSFPageId
 	haveHeader := true
 	for haveHeader {
 		sb := tsf.header.findSuperBlock()
@@ -362,6 +559,13 @@ func (tsf *TSFile) loadFileV2(hdrPage *tsfPage) error {
 			return fmt.Errorf("Cannot find valid superblock in header #%d", tsf.headerPageId)
 		}
 
+		// Headers of the reused pages could be updated after the last
+		// header, so pick position of reused page from the newest superblock
+		if sb.Time > sbTime {
+			sbTime = sb.Time
+			tsf.reusePageId = TSFPageId(sb.ReusePageId)
+		}
+
 		pageCount := TSFPageId(sb.Count)
 		if pageCount < tsf.pageCount {
 			return fmt.Errorf("Unexpected count of pages %d in newer sb in header #%d",
@@ -375,7 +579,7 @@ func (tsf *TSFile) loadFileV2(hdrPage *tsfPage) error {
 		hdrPageCount := (pageCount - oldPageCount)
 
 		pageHeaders := make([]TSFPageHeader, hdrPageCount)
-		err := hdrPage.read(pageHeaders, hdrByteCount)
+		err := hdrPage.read(pageHeaders, tsf.getPageHeadersOffset())
 		if err != nil {
 			return fmt.Errorf("Error reading %d page headers from header #%d: %v",
 				hdrPageCount, tsf.headerPageId, err)
@@ -391,7 +595,12 @@ func (tsf *TSFile) loadFileV2(hdrPage *tsfPage) error {
 			if pageTag == TSFTagHeader {
 				hdrPage, err = tsf.loadHeader(pageId)
 				if err != nil {
-					return fmt.Errorf("Error loading header from page #%d: %v", pageId, err)
+					// Writer might crash before writing new header, so only
+					// pages referred by previous headers are consistent
+					tsf.truncatePages(pageId,
+						fmt.Errorf("Error loading header: %v", err))
+					haveHeader = false
+					break
 				}
 
 				haveHeader = true
@@ -401,8 +610,15 @@ func (tsf *TSFile) loadFileV2(hdrPage *tsfPage) error {
 			} else if (hdr.Flags & TSFSchemaPage) != 0 {
 				err := tsf.loadSchemaV2(pageId, hdr)
 				if err != nil {
-					return fmt.Errorf("Error reading schema page #%d: %v", pageId, err)
+					tsf.truncatePages(pageId,
+						fmt.Errorf("Error reading schema page: %v", err))
+					haveHeader = false
+					break
 				}
+			} else if (hdr.Flags & TSFDictionaryPage) != 0 {
+				// Reused pages may precede schema pages, so dictionaries
+				// are loaded after all schemas are known
+				dictPageIds = append(dictPageIds, pageId)
 			} else if hdr.Flags == 0 && pageTag.isDataTag() {
 				// Data page, account number of entries from this page
 				err := tsf.loadDataTagV2(pageId, hdr)
@@ -413,17 +629,37 @@ func (tsf *TSFile) loadFileV2(hdrPage *tsfPage) error {
 		}
 	}
 
+	for _, pageId := range dictPageIds {
+		if pageId >= tsf.pageCount {
+			continue
+		}
+
+		err := tsf.loadDictionary(pageId)
+		if err != nil {
+			// Labels are not essential for reading entries
+			tsf.dropPage(pageId, fmt.Errorf("Error reading dictionary page: %v", err))
+		}
+	}
+
+	if tsf.reusePageId != 0 {
+		err := tsf.reindexPages()
+		if err != nil {
+			return err
+		}
+	}
+
+	tsf.pinLoadedHeapPages()
+	tsf.verifyLastExtent()
 	return nil
 }
 
 func (tsf *TSFile) loadSchemaV2(pageId TSFPageId, hdr TSFPageHeader) error {
-	var schema TSFSchemaHeader
 	schemaPage, err := tsf.readPage(pageId)
 	if err != nil {
 		return err
 	}
 
-	err = schemaPage.read(&schema, 0)
+	schema, err := schemaPage.readSchema(0, tsf.formatFlags.getVersion())
 	if err != nil {
 		return err
 	}
@@ -433,7 +669,13 @@ func (tsf *TSFile) loadSchemaV2(pageId TSFPageId, hdr TSFPageHeader) error {
 		return err
 	}
 
-	tsf.insertSchema(hdr.getTag().toSchemaId(), &schema)
+	schemaId := hdr.getTag().toSchemaId()
+	tsf.insertSchema(schemaId, schema)
+
+	// Keep schema counter so schemas added after load get new ids
+	if uint32(schemaId) >= tsf.schemaCount {
+		tsf.schemaCount = uint32(schemaId) + 1
+	}
 	return nil
 }
 
@@ -456,12 +698,40 @@ func (tsf *TSFile) loadHeader(pageId TSFPageId) (*tsfPage, error) {
 	} else if tsf.formatFlags != TSFFormatFlags(header.FormatFlags) {
 		return nil, fmt.Errorf("unsupported format flags %x", header.FormatFlags)
 	}
+	if header.findSuperBlock() == nil {
+		return nil, fmt.Errorf("cannot find valid superblock")
+	}
 
 	tsf.headerPageId = pageId
 	tsf.header = header
 	return page, nil
 }
 
+// Reads header extension of V3 file from first header page. Since first header
+// was read as 4096 bytes page, it is re-read using actual page size
+func (tsf *TSFile) loadHeaderExt(hdrPage *tsfPage) (*tsfPage, error) {
+	var ext TSFHeaderExt
+	err := hdrPage.read(&ext, hdrByteCount)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading header extension: %v", err)
+	}
+
+	err = tsf.setPageSize(ext.PageSize)
+	if err != nil {
+		return nil, err
+	}
+	if ext.TagsPerHeader != tsf.tagsPerHeader {
+		return nil, fmt.Errorf("Unexpected number of page headers %d for %d bytes pages",
+			ext.TagsPerHeader, ext.PageSize)
+	}
+
+	tsf.mu.Lock()
+	delete(tsf.pageCache, 0)
+	tsf.mu.Unlock()
+
+	return tsf.loadHeader(0)
+}
+
 func (tsf *TSFile) loadDataTagV2(pageId TSFPageId, hdr TSFPageHeader) error {
 	schemaId := hdr.getTag().toSchemaId()
 	if !tsf.isValidSchemaId(schemaId) {
@@ -511,6 +781,10 @@ func (tsf *TSFile) Get() *TSFile {
 func (tsf *TSFile) Detach() (TSFileStorage, error) {
 	err := tsf.writePages(true)
 	if atomic.AddInt32(&tsf.refCount, -1) <= 0 {
+		tsf.closeSubscriptions()
+		if err2 := tsf.unmap(); err == nil {
+			err = err2
+		}
 		return tsf.file, err
 	}
 
@@ -532,10 +806,18 @@ func (tsf *TSFile) Put() error {
 
 // Adds new schema to a file and returns allocated tag
 func (tsf *TSFile) AddSchema(header *TSFSchemaHeader) (TSFPageTag, error) {
-	err := header.Check(tsf.formatFlags.hasFlag(TSFFormatExt))
+	err := tsf.checkWritable()
+	if err != nil {
+		return -1, err
+	}
+	err = header.Check(tsf.formatFlags.hasFlag(TSFFormatExt))
 	if err != nil {
 		return -1, err
 	}
+	if maxFields := tsf.getMaxFieldCount(); int(header.FieldCount) > maxFields {
+		return -1, fmt.Errorf("Invalid schema: too many fields (%d), file supports up to %d fields",
+			header.FieldCount, maxFields)
+	}
 
 	schemaId := TSFSchemaId(atomic.AddUint32(&tsf.schemaCount, 1) - 1)
 	entrySize := uint32(header.EntrySize)
@@ -546,16 +828,19 @@ func (tsf *TSFile) AddSchema(header *TSFSchemaHeader) (TSFPageTag, error) {
 		if schemaId > 0 {
 			return -1, fmt.Errorf("Cannot add more than one schema to TSFv1")
 		}
+		if schema.varStrings {
+			return -1, fmt.Errorf("Variable-length strings are not supported by TSFv1")
+		}
 		// In v1 -- align page size by object size
 		tsf.pageSize = (pageSize + entrySize - 1) / entrySize * entrySize
-	case TSFFormatV2:
+	case TSFFormatV2, TSFFormatV3:
 		if tsf.pageSize < entrySize {
 			return -1, fmt.Errorf("Entry is too big for %d bytes pages", tsf.pageSize)
 		}
 
 		// Bonus -- allocate a page to keep schema
 		page, _ := tsf.allocateDataPage(schema.tag, TSFSchemaPage)
-		binary.Write(page.buf, binary.LittleEndian, header)
+		header.encode(page.buf, tsf.formatFlags.getVersion())
 		page.full = true
 		page.dirty = true
 	}
@@ -572,6 +857,12 @@ func (tsf *TSFile) insertSchema(schemaId TSFSchemaId, header *TSFSchemaHeader) *
 		tag:       schemaId.toTag(),
 		pageIndex: make([]tsfPageIndex, 0),
 	}
+	schema.header.Fields = append([]TSFSchemaField(nil), header.Fields[:header.FieldCount]...)
+	schema.header.Enums = nil
+	if tsf.formatFlags.hasFlag(TSFFormatCompressed) {
+		schema.codec = newPageCodec(header, tsf.pageSize)
+	}
+	schema.varStrings = header.hasVarStrings()
 
 	// We want to get schemaId early (for V2 allocatePage), but if AddSchema
 	// is called concurrently, we may append into wrong index
@@ -584,6 +875,10 @@ func (tsf *TSFile) insertSchema(schemaId TSFSchemaId, header *TSFSchemaHeader) *
 
 // Adds entries to the file (write is deferred)
 func (tsf *TSFile) AddEntries(tag TSFPageTag, entries interface{}) error {
+	if err := tsf.checkWritable(); err != nil {
+		return err
+	}
+
 	schemaId := tag.toSchemaId()
 	if !tsf.isValidSchemaId(schemaId) {
 		return fmt.Errorf("Undefined schema #%d", schemaId)
@@ -591,6 +886,14 @@ func (tsf *TSFile) AddEntries(tag TSFPageTag, entries interface{}) error {
 	if reflect.TypeOf(entries).Kind() != reflect.Slice {
 		return fmt.Errorf("Invalid AddEntries() argument, slice is expected")
 	}
+	var heapRefs [][]TSFPageId
+	if tsf.hasVarStrings(schemaId) {
+		var err error
+		entries, heapRefs, err = tsf.storeVarStrings(schemaId, entries)
+		if err != nil {
+			return err
+		}
+	}
 
 	start := 0
 	entrySize := tsf.getEntrySize(schemaId)
@@ -602,6 +905,12 @@ func (tsf *TSFile) AddEntries(tag TSFPageTag, entries interface{}) error {
 		}
 
 		count, err := page.writeEntries(start, entries, entrySize)
+		if heapRefs != nil {
+			tsf.addHeapRefs(pageId, heapRefs[start:start+count])
+			if err != nil {
+				tsf.releaseHeapRefs(heapRefs[start+count:])
+			}
+		}
 		if err != nil {
 			return err
 		}
@@ -611,19 +920,106 @@ func (tsf *TSFile) AddEntries(tag TSFPageTag, entries interface{}) error {
 		start += count
 	}
 
-	return tsf.writePages(false)
+	err := tsf.writePages(false)
+	tsf.notifySubscribers(tag)
+	return err
 }
 
 // Adds content of the other file to current file
 func (tsfOut *TSFile) AddFile(tsfIn *TSFile) (err error) {
+	return tsfOut.addFile(tsfIn, false)
+}
+
+// Adds content of the other file to current file merging series which have
+// the same names. If schemas of such series differ, entries are converted
+// using schema mapping (see mapping.go). Rollups of input file are not
+// merged, they should be rebuilt. Entries are appended to the merged series,
+// so both files should use the same time origin and entries of input series
+// shouldn't be older than the last entry of the series in current file
+func (tsfOut *TSFile) MergeFile(tsfIn *TSFile) (err error) {
+	err = tsfOut.checkMergeOrder(tsfIn)
+	if err != nil {
+		return err
+	}
+	return tsfOut.addFile(tsfIn, true)
+}
+
+// Checks that entries of series merged from the other file follow entries
+// which are already in the current file
+func (tsfOut *TSFile) checkMergeOrder(tsfIn *TSFile) error {
+	for inTag, tagEnd := tsfIn.GetDataTags(); inTag < tagEnd; inTag++ {
+		header, err := tsfIn.GetSchema(inTag)
+		if err != nil {
+			return err
+		}
+		if header.SourceTag != 0 || tsfIn.GetEntryCount(inTag) == 0 {
+			continue
+		}
+
+		outTag, _, err := tsfOut.mapSeries(header)
+		if err != nil {
+			return err
+		}
+		if outTag == TSFTagEmpty {
+			continue
+		}
+		count := tsfOut.GetEntryCount(outTag)
+		if count == 0 {
+			continue
+		}
+
+		first, err := tsfIn.getSeriesTime(inTag, 0)
+		if err != nil {
+			return err
+		}
+		last, err := tsfOut.getSeriesTime(outTag, count-1)
+		if err != nil {
+			return err
+		}
+		if first < last {
+			return fmt.Errorf("Cannot merge series %s: entries start at %d before last entry at %d",
+				DecodeCStr(header.Name[:]), first, last)
+		}
+	}
+
+	return nil
+}
+
+func (tsfOut *TSFile) addFile(tsfIn *TSFile, merge bool) (err error) {
 	tsfIn.mu.RLock()
 	defer tsfIn.mu.RUnlock()
 
 	// Import all schemas
 	schemaMap := make(map[TSFPageTag]TSFPageTag)
+	mappings := make(map[TSFPageTag]*TSFSchemaMapping)
 	for schemaIndex, schema := range tsfIn.schemas {
 		inTag := TSFSchemaId(schemaIndex).toTag()
-		outTag, err := tsfOut.AddSchema(&schema.header)
+		header := schema.header
+		if header.SourceTag != 0 {
+			if merge {
+				schemaMap[inTag] = TSFTagEmpty
+				continue
+			}
+
+			// Rollups are always added after their sources
+			header.SourceTag = uint16(schemaMap[TSFPageTag(header.SourceTag)])
+		}
+
+		if merge {
+			outTag, mapping, err := tsfOut.mapSeries(&header)
+			if err != nil {
+				return err
+			}
+			if outTag != TSFTagEmpty {
+				schemaMap[inTag] = outTag
+				if !mapping.Identical() {
+					mappings[inTag] = mapping
+				}
+				continue
+			}
+		}
+
+		outTag, err := tsfOut.AddSchema(&header)
 		if err != nil {
 			return err
 		}
@@ -631,8 +1027,10 @@ func (tsfOut *TSFile) AddFile(tsfIn *TSFile) (err error) {
 		schemaMap[inTag] = outTag
 	}
 
-	// Import all data pages (excluding schemas, headers...)
-	for pageIndex, pageHeader := range tsfIn.pageHeaders {
+	// Import all data pages (excluding schemas, headers...) in the order
+	// they were written
+	for _, inPageId := range tsfIn.getPageOrder() {
+		pageHeader := tsfIn.pageHeaders[inPageId]
 		inTag := TSFPageTag(pageHeader.Tag)
 		if inTag < TSFTagData || pageHeader.Flags != 0 {
 			continue
@@ -644,16 +1042,19 @@ func (tsfOut *TSFile) AddFile(tsfIn *TSFile) (err error) {
 			return fmt.Errorf("unexpected page tag #%d: it's schema wasn't imported",
 				pageHeader.Tag)
 		}
+		if outTag == TSFTagEmpty {
+			continue
+		}
 
+		mapping := mappings[inTag]
 		entrySize := tsfIn.getEntrySizeImpl(inTag.toSchemaId())
 		outEntrySize := tsfOut.getEntrySize(outTag.toSchemaId())
-		if entrySize != outEntrySize {
+		if entrySize != outEntrySize && mapping == nil {
 			return fmt.Errorf("page entry size for tag #%d is differing: %d != %d",
 				inTag, entrySize, outEntrySize)
 		}
 
 		// Read page with entries from input file
-		inPageId := TSFPageId(pageIndex)
 		inPage := tsfIn.tryGetPage(inPageId)
 		if inPage == nil {
 			inPage = tsfIn.newPage(tsfIn.getPageSize(inPageId))
@@ -663,6 +1064,16 @@ func (tsfOut *TSFile) AddFile(tsfIn *TSFile) (err error) {
 			return err
 		}
 
+		if tsfIn.schemas[inTag.toSchemaId()].varStrings || mapping != nil {
+			// Strings should be moved to heap pages of output file and
+			// entries of differing schemas have to be converted
+			err = tsfOut.addConvertedPage(outTag, tsfIn, inTag, inPage, entrySize, mapping)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
 		for start := 0; start < int(inPage.count); {
 			outPage, outPageId := tsfOut.getDataPage(outTag)
 			if outPage == nil {
@@ -679,9 +1090,50 @@ func (tsfOut *TSFile) AddFile(tsfIn *TSFile) (err error) {
 		}
 	}
 
+	// Import labels of enumerable fields. Merged series may lack some
+	// of the fields of input series, so their labels are dropped
+	for schemaIndex, schema := range tsfIn.schemas {
+		outTag := schemaMap[TSFSchemaId(schemaIndex).toTag()]
+		if outTag == TSFTagEmpty {
+			continue
+		}
+
+		for fieldName, dict := range schema.header.Enums {
+			err = tsfOut.RegisterEnum(outTag, fieldName, dict)
+			if err != nil && !merge {
+				return err
+			}
+		}
+	}
+
+	for _, outTag := range schemaMap {
+		if outTag != TSFTagEmpty {
+			tsfOut.notifySubscribers(outTag)
+		}
+	}
 	return nil
 }
 
+// Finds series (which is not a rollup) with the same name as in header and
+// creates mapping for its entries. Returns empty tag if there is no such series
+func (tsf *TSFile) mapSeries(header *TSFSchemaHeader) (TSFPageTag, *TSFSchemaMapping, error) {
+	name := DecodeCStr(header.Name[:])
+	for tag, tagEnd := tsf.GetDataTags(); tag < tagEnd; tag++ {
+		schema, err := tsf.GetSchema(tag)
+		if err != nil || schema.SourceTag != 0 || DecodeCStr(schema.Name[:]) != name {
+			continue
+		}
+
+		mapping, err := NewSchemaMapping(header, schema)
+		if err != nil {
+			return TSFTagEmpty, nil, fmt.Errorf("Cannot merge series %s: %v", name, err)
+		}
+		return tag, mapping, nil
+	}
+
+	return TSFTagEmpty, nil, nil
+}
+
 func (tsf *TSFile) getEntrySize(schemaId TSFSchemaId) uint32 {
 	tsf.mu.RLock()
 	defer tsf.mu.RUnlock()
@@ -689,6 +1141,23 @@ func (tsf *TSFile) getEntrySize(schemaId TSFSchemaId) uint32 {
 	return tsf.getEntrySizeImpl(schemaId)
 }
 
+func (tsf *TSFile) getSchemaCodec(schemaId TSFSchemaId) *tsfPageCodec {
+	tsf.mu.RLock()
+	defer tsf.mu.RUnlock()
+
+	if !tsf.isValidSchemaId(schemaId) {
+		return nil
+	}
+	return tsf.schemas[schemaId].codec
+}
+
+func (tsf *TSFile) hasVarStrings(schemaId TSFSchemaId) bool {
+	tsf.mu.RLock()
+	defer tsf.mu.RUnlock()
+
+	return tsf.isValidSchemaId(schemaId) && tsf.schemas[schemaId].varStrings
+}
+
 func (tsf *TSFile) getEntrySizeImpl(schemaId TSFSchemaId) uint32 {
 	return uint32(tsf.schemas[schemaId].header.EntrySize)
 }
@@ -730,7 +1199,7 @@ func (tsf *TSFile) accountPageEntries(page *tsfPage, count uint32,
 	}
 
 	atomic.AddUint32(&schema.count, count)
-	page.count = atomic.AddUint32(&tsf.pageHeaders[pageId].Count, count)
+	atomic.StoreUint32(&page.count, atomic.AddUint32(&tsf.pageHeaders[pageId].Count, count))
 
 	if page.full {
 		atomic.AddUint32(&tsf.fullPages, 1)
@@ -745,32 +1214,54 @@ func (page *tsfPage) writeEntries(start int, entries interface{}, entrySize uint
 	page.dirty = true
 
 	buf := page.buf
+	base := buf.Len() / int(entrySize)
 	count := 0
 	value := reflect.ValueOf(entries)
-	for (start + count) < value.Len() {
-		if (uint32(buf.Len()) + entrySize) > page.size {
-			// No more space for entries in this page (and this page
-			// is eligible for commiting)
+	if codec := getCodec(value.Type().Elem()); codec != nil {
+		if codec.EntrySize() != int(entrySize) {
+			return count, fmt.Errorf("Invalid entry of size %d, %d is expected",
+				codec.EntrySize(), entrySize)
+		}
+
+		// Encode as much entries as fit into page at once
+		count = value.Len() - start
+		if free := int(page.size) - buf.Len(); count*int(entrySize) > free {
+			count = free / int(entrySize)
 			page.full = true
-			break
 		}
 
-		size := buf.Len()
-		v := value.Index(start + count).Interface()
-		err := binary.Write(buf, binary.LittleEndian, v)
-		n := buf.Len() - size
+		raw := make([]byte, count*int(entrySize))
+		codec.Encode(raw, entries, start, count)
+		buf.Write(raw)
+	} else {
+		for (start + count) < value.Len() {
+			if (uint32(buf.Len()) + entrySize) > page.size {
+				// No more space for entries in this page (and this page
+				// is eligible for commiting)
+				page.full = true
+				break
+			}
 
-		if err != nil {
-			return count, err
-		}
-		if uint32(n) != entrySize {
-			buf.Truncate(buf.Len() - n)
-			return count, fmt.Errorf("Invalid entry of size %d, %d is expected", n, entrySize)
-		}
+			size := buf.Len()
+			v := value.Index(start + count).Interface()
+			err := binary.Write(buf, binary.LittleEndian, v)
+			n := buf.Len() - size
+
+			if err != nil {
+				return count, err
+			}
+			if uint32(n) != entrySize {
+				buf.Truncate(buf.Len() - n)
+				return count, fmt.Errorf("Invalid entry of size %d, %d is expected", n, entrySize)
+			}
 
-		count++
+			count++
+		}
 	}
 
+	if page.codec != nil && count > 0 {
+		return page.fitCompressed(base, count)
+	}
 	return count, nil
 }
 
@@ -807,65 +1298,234 @@ func (outPage *tsfPage) copyRawEntries(start int, inPage *tsfPage, entrySize uin
 
 	outPage.dirty = true
 	outPage.full = (outPage.size - outPage.count*entrySize) < entrySize
+	if outPage.codec != nil && count > 0 {
+		return outPage.fitCompressed(int(outPage.count), count)
+	}
 	return count, nil
 }
 
 // Writes and evicts full pages (or if sync is set, all pages), updates
-// header and writes it too
+// headers and writes them too
 func (tsf *TSFile) writePages(sync bool) error {
+	if tsf.isMapped() {
+		// Nothing could be changed in read-only file
+		return nil
+	}
 	if atomic.SwapUint32(&tsf.fullPages, 0) == 0 && !sync {
 		// There is no full data pages at the moment (or concurrent writer
 		// is running)
 		return nil
 	}
 
-	tsf.updateHeader(loadPageId(&tsf.headerPageId))
-
 	tsf.mu.Lock()
 	defer tsf.mu.Unlock()
 
+	// Prepare contents of pages (compress them and compute checksums) before
+	// updating headers, so they will refer actual state of pages in file
+	pageIds, err := tsf.preparePages(sync)
+	if err != nil {
+		return err
+	}
+
+	err = tsf.updateHeaders(pageIds)
+	if err != nil {
+		return err
+	}
+
+	for _, pageId := range pageIds {
+		err := tsf.writePage(tsf.pageCache[pageId], pageId)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Headers are written last, so if we crash before that, they still refer
+	// previous (consistent) state of the pages
+	err = tsf.writeHeaders()
+	if err != nil {
+		return err
+	}
+
 	for pageId, page := range tsf.pageCache {
-		if page.dirty && (page.full || sync) {
-			err := tsf.writePage(page, pageId)
+		if page.full && !page.dirty {
+			// Evict full data pages & page we don't need anymore
+			tsf.evictPage(page, pageId)
+		}
+	}
+
+	return nil
+}
+
+// Prepares contents of non-header pages which are going to be written and
+// returns their ids. Call with tsf.mu held
+func (tsf *TSFile) preparePages(sync bool) ([]TSFPageId, error) {
+	var pageIds, heapPageIds []TSFPageId
+
+	for pageId, page := range tsf.pageCache {
+		hdr := &tsf.pageHeaders[pageId]
+		isHeap := hdr.getTag() == TSFTagHeap || (hdr.Flags&TSFDictionaryPage) != 0
+		if !page.dirty || !(page.full || sync || isHeap) {
+			continue
+		}
+
+		if hdr.getTag() == TSFTagHeader {
+			continue
+		}
+		if isHeap {
+			// Heap pages are prepared after data pages, so they will contain
+			// all strings referred by entries being written. Dictionary
+			// pages are written together with them
+			heapPageIds = append(heapPageIds, pageId)
+			continue
+		}
+		if tsf.formatFlags.hasExtents() {
+			err := tsf.preparePage(page, hdr)
+			if err != nil {
+				return nil, fmt.Errorf("Cannot prepare page #%d: %v", pageId, err)
+			}
+		}
+
+		pageIds = append(pageIds, pageId)
+	}
+
+	for _, pageId := range heapPageIds {
+		err := tsf.preparePage(tsf.pageCache[pageId], &tsf.pageHeaders[pageId])
+		if err != nil {
+			return nil, fmt.Errorf("Cannot prepare page #%d: %v", pageId, err)
+		}
+	}
+
+	return append(pageIds, heapPageIds...), nil
+}
+
+// Prepares contents of V2/V3 page: compresses data pages and computes checksum
+func (tsf *TSFile) preparePage(page *tsfPage, hdr *TSFPageHeader) error {
+	page.mu.Lock()
+	defer page.mu.Unlock()
+
+	buf := page.buf.Bytes()
+	if hdr.Flags == 0 && hdr.getTag().isDataTag() {
+		// Only write entries which are accounted in header, concurrent writer
+		// will account the rest and they will be written later
+		count := atomic.LoadUint32(&hdr.Count)
+		size := count * tsf.getEntrySizeImpl(hdr.getTag().toSchemaId())
+		page.pending = uint32(len(buf)) > size
+		buf = buf[:size]
+
+		if page.codec != nil {
+			var err error
+			buf, err = page.codec.encode(buf)
 			if err != nil {
 				return err
 			}
+			if len(buf) > int(tsf.pageSize) {
+				return fmt.Errorf("Compressed page of %d entries takes %d bytes", count, len(buf))
+			}
+			hdr.Size = uint32(len(buf))
+		}
+		page.diskCount = count
+	} else {
+		if hdr.getTag() == TSFTagHeap || (hdr.Flags&TSFDictionaryPage) != 0 {
+			// Keep size of heap in header, strings which are added
+			// concurrently will be written next time
+			hdr.Count = uint32(len(buf))
+			page.pending = false
+		}
+		if len(buf) < int(tsf.pageSize) {
+			// Schema pages are read entirely, so checksum should cover padding
+			padded := make([]byte, tsf.pageSize)
+			copy(padded, buf)
+			buf = padded
 		}
+	}
 
-		if page.full {
-			// Evict full data pages & page we don't need anymore
-			tsf.evictPage(page, pageId)
+	if tsf.formatFlags.hasFlag(TSFFormatChecksum) {
+		hdr.Checksum = crc32.ChecksumIEEE(buf)
+	}
+	page.output = buf
+	return nil
+}
+
+// Updates current header and headers of extents which contain written pages
+// as data pages may be written after new extent started. Call with tsf.mu held
+func (tsf *TSFile) updateHeaders(pageIds []TSFPageId) error {
+	headerPageId := loadPageId(&tsf.headerPageId)
+
+	if tsf.formatFlags.hasExtents() {
+		updated := make(map[TSFPageId]bool)
+		for _, pageId := range pageIds {
+			extHeaderPageId := tsf.getHeaderPageId(pageId)
+			if extHeaderPageId == headerPageId || updated[extHeaderPageId] {
+				continue
+			}
+
+			_, err := tsf.readPageNoLock(extHeaderPageId, tsf.newPage(tsf.pageSize))
+			if err != nil {
+				return fmt.Errorf("Cannot read header #%d: %v", extHeaderPageId, err)
+			}
+			tsf.updateHeaderNoLock(extHeaderPageId)
+			updated[extHeaderPageId] = true
 		}
 	}
 
+	// Current header should be updated last, so it will get the newest
+	// superblock which refers all of its pages
+	tsf.updateHeaderNoLock(headerPageId)
 	return nil
 }
 
-func (tsf *TSFile) getPageOffset(pageId TSFPageId) int64 {
-	// Number of headers going prior to page #pageId
-	numHeaders := TSFPageId(0)
-	if pageId > 0 {
-		switch tsf.formatFlags.getVersion() {
-		case TSFFormatV1:
-			numHeaders = 1
-		case TSFFormatV2:
-			numHeaders = (pageId + tagsPerHeader - 1) / tagsPerHeader
+// Writes all dirty header pages. Call with tsf.mu held
+func (tsf *TSFile) writeHeaders() error {
+	for pageId, page := range tsf.pageCache {
+		if page.dirty && tsf.pageHeaders[pageId].getTag() == TSFTagHeader {
+			err := tsf.writePage(page, pageId)
+			if err != nil {
+				return err
+			}
 		}
 	}
-	offset := uint32(pageId-numHeaders)*tsf.pageSize + uint32(numHeaders)*pageSize
 
-	return int64(offset)
+	return nil
 }
 
-func (tsf *TSFile) getPageSize(pageId TSFPageId) uint32 {
+// Returns id of the header page which refers page pageId in V2 and V3
+func (tsf *TSFile) getHeaderPageId(pageId TSFPageId) TSFPageId {
+	perHeader := TSFPageId(tsf.tagsPerHeader)
+	if pageId < perHeader {
+		return 0
+	}
+
+	// See allocateDataPage() -- second header has index tagsPerHeader-1
+	return (pageId-perHeader)/perHeader*perHeader + perHeader - 1
+}
+
+func (tsf *TSFile) getPageOffset(pageId TSFPageId) int64 {
 	if tsf.formatFlags.getVersion() == TSFFormatV1 {
+		// All pages except header are aligned by entry size
 		if pageId == 0 {
-			return pageSize
+			return 0
 		}
-		return tsf.pageSize
+		return pageSize + int64(pageId-1)*int64(tsf.pageSize)
 	}
 
-	return pageSize
+	// Headers and data pages have same size in V2 and V3
+	return int64(pageId) * int64(tsf.pageSize)
+}
+
+func (tsf *TSFile) getPageSize(pageId TSFPageId) uint32 {
+	if tsf.formatFlags.getVersion() == TSFFormatV1 && pageId == 0 {
+		return pageSize
+	}
+
+	return tsf.pageSize
+}
+
+// Returns maximum number of fields in schema supported by this file
+func (tsf *TSFile) getMaxFieldCount() int {
+	if tsf.formatFlags.getVersion() == TSFFormatV3 {
+		return int(tsf.pageSize-schemaHeaderV3Size-schemaWindowSize) / schemaFieldSize
+	}
+	return maxFieldCount
 }
 
 // Write page (call with tsf.mu locked)
@@ -879,18 +1539,26 @@ func (tsf *TSFile) writePage(page *tsfPage, pageId TSFPageId) error {
 		return err
 	}
 
-	// Pad page up to its size for v2+
 	buf := page.buf.Bytes()
-	if tsf.formatFlags.getVersion() == TSFFormatV2 {
-		padLength := int(page.size) - len(buf)
+	if page.output != nil {
+		buf = page.output
+		page.output = nil
+	}
+	_, err = tsf.file.Write(buf)
+
+	// Pad page up to its size for v2+
+	if err == nil && tsf.formatFlags.hasExtents() {
+		padLength := int(tsf.getPageSize(pageId)) - len(buf)
 		if padLength > 0 {
-			buf = append(buf, bytes.Repeat([]byte{0}, padLength)...)
+			_, err = tsf.file.Write(make([]byte, padLength))
 		}
 	}
 
-	_, err = tsf.file.Write(buf)
-
-	page.dirty = false
+	// If page has entries which are not written yet, it is still dirty
+	page.mu.Lock()
+	page.dirty = page.pending
+	page.pending = false
+	page.mu.Unlock()
 	return err
 }
 
@@ -912,7 +1580,9 @@ func (tsf *TSFile) GetSchema(pageTag TSFPageTag) (*TSFSchemaHeader, error) {
 		return nil, fmt.Errorf("Schema #%d doesn't exist", schemaId)
 	}
 
-	return &tsf.schemas[schemaId].header, nil
+	// Return a copy as enum dictionaries may be replaced concurrently
+	header := tsf.schemas[schemaId].header
+	return &header, nil
 }
 
 // Get number of entries for schema. If schema doesn't exist,
@@ -957,7 +1627,11 @@ func (tsf *TSFile) GetEntries(tag TSFPageTag, entries interface{}, start int) er
 	count := value.Len()
 	isBufferSlice := (value.Type().Elem() == reflect.TypeOf([]byte{}))
 	entrySize := 1
-	data := value
+
+	varStrings := tsf.hasVarStrings(tag.toSchemaId())
+	if varStrings && !isBufferSlice {
+		return tsf.getVarStringEntries(tag, value, start)
+	}
 
 	if isBufferSlice {
 		// binary.Read doesn't natively supports [][]uint8, so we're implementing
@@ -968,7 +1642,6 @@ func (tsf *TSFile) GetEntries(tag TSFPageTag, entries interface{}, start int) er
 		}
 
 		entrySize = int(schema.EntrySize)
-		data = reflect.MakeSlice(reflect.TypeOf([]uint8{}), count*entrySize, count*entrySize)
 	}
 
 	var offset int
@@ -983,17 +1656,23 @@ func (tsf *TSFile) GetEntries(tag TSFPageTag, entries interface{}, start int) er
 			return err
 		}
 
-		// Determine how many entries we can read from this page
-		pageCount := count
-		if pageCount > int(page.count) {
-			pageCount = int(page.count)
+		// Determine how many entries we can read from this page (reading
+		// may start in the middle of the page)
+		pageCount := int(atomic.LoadUint32(&page.count)) -
+			int(byteOffset)/int(tsf.getEntrySize(tag.toSchemaId()))
+		if pageCount > count {
+			pageCount = count
 		}
 		if pageCount == 0 {
 			return fmt.Errorf("Page #%d is empty, this is unexpected", pageId)
 		}
 
-		slice := data.Slice(offset*entrySize, (offset+pageCount)*entrySize)
-		err = page.read(slice.Interface(), byteOffset)
+		slice := value.Slice(offset, offset+pageCount).Interface()
+		if isBufferSlice {
+			err = page.readBuffers(slice.([][]byte), byteOffset, entrySize)
+		} else {
+			err = page.read(slice, byteOffset)
+		}
 		if err != nil {
 			return fmt.Errorf("Error reading page #%d: %v", pageId, err)
 		}
@@ -1003,11 +1682,9 @@ func (tsf *TSFile) GetEntries(tag TSFPageTag, entries interface{}, start int) er
 		offset += pageCount
 	}
 
-	if isBufferSlice {
-		// Cut buffer into smaller slices and assign them to buffer
-		for i := 0; i < value.Len(); i++ {
-			value.Index(i).Set(data.Slice(i*entrySize, (i+1)*entrySize))
-		}
+	if varStrings {
+		schema, _ := tsf.GetSchema(tag)
+		return resolveVarStrings(schema, entries.([][]byte), tsf.pageSize, tsf.readHeapPage)
 	}
 
 	return nil
@@ -1044,8 +1721,8 @@ func (tsf *TSFile) findDataPage(tag TSFPageTag, index int) (TSFPageId, int64, er
 	for b > a {
 		med := a + (b-a)/2
 		pageIndex := schema.pageIndex[med]
-		count := int(tsf.pageHeaders[pageIndex.pageId].Count)
-		start := int(pageIndex.start)
+		count := int(atomic.LoadUint32(&tsf.pageHeaders[pageIndex.pageId].Count))
+		start := int(atomic.LoadUint32(&schema.pageIndex[med].start))
 
 		if start <= index {
 			if index < (start + count) {
@@ -1085,6 +1762,13 @@ func (tsf *TSFile) evictPage(page *tsfPage, pageId TSFPageId) {
 
 // Fetch page from file or take it from page cache
 func (tsf *TSFile) readPage(pageId TSFPageId) (*tsfPage, error) {
+	if tsf.isMapped() {
+		page, err := tsf.readMappedPage(pageId)
+		if page != nil || err != nil {
+			return page, err
+		}
+	}
+
 	page := tsf.tryGetPage(pageId)
 	if page != nil {
 		return page, nil
@@ -1110,28 +1794,50 @@ func (tsf *TSFile) readPageNoLock(pageId TSFPageId, page *tsfPage) (*tsfPage, er
 	// allocate buffer -- in the case of data page which is not full,
 	// buffer size should be partial (so we can append to buffer)
 	pageSize := page.size
+	var codec *tsfPageCodec
+	var hdr *TSFPageHeader
 	if pageId > 0 {
-		hdr := &tsf.pageHeaders[pageId]
+		hdr = &tsf.pageHeaders[pageId]
 		if hdr.Flags == 0 && hdr.getTag().isDataTag() {
 			pageSize = hdr.Count * tsf.getEntrySizeImpl(hdr.getTag().toSchemaId())
+			if hdr.Size > 0 {
+				// Compressed page: only read compressed data
+				codec = tsf.schemas[hdr.getTag().toSchemaId()].codec
+				pageSize = hdr.Size
+			}
 		}
 		page.count = hdr.Count
+		page.diskCount = hdr.Count
 	}
 	buf := make([]byte, pageSize)
 
 	// really read from file
-	_, err := tsf.file.Seek(tsf.getPageOffset(pageId), io.SeekStart)
+	n, err := tsf.readPageData(pageId, buf)
 	if err != nil {
 		return nil, err
 	}
+	if uint32(n) != pageSize && tsf.formatFlags.hasExtents() {
+		return nil, fmt.Errorf("Invalid read of size %d for page %d (requested size: %d)",
+			n, pageId, pageSize)
+	}
 
-	n, err := tsf.file.Read(buf)
+	err = tsf.checkPageChecksum(pageId, hdr, buf)
 	if err != nil {
 		return nil, err
 	}
-	if uint32(n) != pageSize && (tsf.formatFlags.getVersion() == TSFFormatV2) {
-		return nil, fmt.Errorf("Invalid read of size %d for page %d (requested size: %d)",
-			n, pageId, pageSize)
+
+	if codec != nil {
+		raw, err := codec.decode(buf)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot decode page %d: %v", pageId, err)
+		}
+
+		rawSize := int(page.count) * codec.entrySize
+		if len(raw) < rawSize {
+			return nil, fmt.Errorf("Page %d contains only %d bytes of %d entries",
+				pageId, len(raw), page.count)
+		}
+		buf = raw[:rawSize]
 	}
 
 	// setup page and return it. header #0 is a special case...
@@ -1142,6 +1848,31 @@ func (tsf *TSFile) readPageNoLock(pageId TSFPageId, page *tsfPage) (*tsfPage, er
 	return page, nil
 }
 
+// Reads contents of the page from file or its mapping into buf
+func (tsf *TSFile) readPageData(pageId TSFPageId, buf []byte) (int, error) {
+	if tsf.isMapped() {
+		return tsf.readMappedData(pageId, buf)
+	}
+
+	_, err := tsf.file.Seek(tsf.getPageOffset(pageId), io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	return tsf.file.Read(buf)
+}
+
+// Verifies checksum of page contents if file has checksums
+func (tsf *TSFile) checkPageChecksum(pageId TSFPageId, hdr *TSFPageHeader, buf []byte) error {
+	if hdr != nil && hdr.getTag() != TSFTagHeader && tsf.formatFlags.hasFlag(TSFFormatChecksum) {
+		checksum := crc32.ChecksumIEEE(buf)
+		if checksum != hdr.Checksum {
+			return fmt.Errorf("Checksum mismatch for page %d: %08x, expected %08x",
+				pageId, checksum, hdr.Checksum)
+		}
+	}
+	return nil
+}
+
 func (tsf *TSFile) tryGetPage(pageId TSFPageId) *tsfPage {
 	tsf.mu.RLock()
 	defer tsf.mu.RUnlock()
@@ -1171,21 +1902,74 @@ func (page *tsfPage) read(data interface{}, off int64) error {
 	page.mu.Lock()
 	defer page.mu.Unlock()
 
+	value := reflect.ValueOf(data)
+	if value.Kind() == reflect.Slice {
+		if codec := getCodec(value.Type().Elem()); codec != nil {
+			raw := page.buf.Bytes()
+			end := int(off) + value.Len()*codec.EntrySize()
+			if end > len(raw) {
+				return io.ErrUnexpectedEOF
+			}
+
+			codec.Decode(raw[off:end], data, 0, value.Len())
+			return nil
+		}
+	}
+
 	reader := bytes.NewReader(page.buf.Bytes())
 	reader.Seek(off, 0)
 
 	return binary.Read(reader, binary.LittleEndian, data)
 }
 
+// Reads raw entries of size entrySize starting at offset off into bufs. Entries
+// of mapped pages refer mapping directly, others are copied from page
+func (page *tsfPage) readBuffers(bufs [][]byte, off int64, entrySize int) error {
+	page.mu.Lock()
+	defer page.mu.Unlock()
+
+	data := page.buf.Bytes()
+	end := int(off) + len(bufs)*entrySize
+	if end > len(data) {
+		return io.ErrUnexpectedEOF
+	}
+
+	data = data[off:end]
+	if !page.mapped {
+		data = append([]byte(nil), data...)
+	}
+	for i := range bufs {
+		// Limit capacity so appending to entry won't overwrite next one
+		bufs[i] = data[i*entrySize : (i+1)*entrySize : (i+1)*entrySize]
+	}
+	return nil
+}
+
+// Reads schema header of the specified format version at offset off
+func (page *tsfPage) readSchema(off int64, version TSFFormatFlags) (*TSFSchemaHeader, error) {
+	page.mu.Lock()
+	defer page.mu.Unlock()
+
+	reader := bytes.NewReader(page.buf.Bytes())
+	reader.Seek(off, 0)
+
+	return decodeSchema(reader, version)
+}
+
 // Rewrites header page and marks it as full
 func (tsf *TSFile) updateHeader(pageId TSFPageId) *tsfPage {
+	tsf.mu.Lock()
+	defer tsf.mu.Unlock()
+
+	return tsf.updateHeaderNoLock(pageId)
+}
+
+func (tsf *TSFile) updateHeaderNoLock(pageId TSFPageId) *tsfPage {
 	// Update super block (up to 4 can do it concurrently)
 	sbIndex := atomic.AddUint32(&tsf.sbIndex, 1)
 	sb := &tsf.header.SuperBlocks[sbIndex%superBlockCount]
 	sb.Time = uint64(time.Now().UnixNano())
-
-	tsf.mu.Lock()
-	defer tsf.mu.Unlock()
+	sb.ReusePageId = uint32(tsf.reusePageId)
 
 	if page, ok := tsf.pageCache[pageId]; ok {
 		buf := page.buf
@@ -1194,7 +1978,7 @@ func (tsf *TSFile) updateHeader(pageId TSFPageId) *tsfPage {
 		switch tsf.formatFlags.getVersion() {
 		case TSFFormatV1:
 			tsf.updateHeaderV1(pageId, sb, buf)
-		case TSFFormatV2:
+		case TSFFormatV2, TSFFormatV3:
 			tsf.updateHeaderV2(pageId, sb, buf)
 		}
 
@@ -1210,7 +1994,7 @@ func (tsf *TSFile) updateHeaderV1(pageId TSFPageId, sb *TSFSuperBlock, buf *byte
 	sb.Count = atomic.LoadUint32(&tsf.schemas[0].count)
 
 	binary.Write(buf, binary.LittleEndian, tsf.header)
-	binary.Write(buf, binary.LittleEndian, tsf.schemas[0].header)
+	tsf.schemas[0].header.encode(buf, TSFFormatV1)
 }
 
 func (tsf *TSFile) updateHeaderV2(pageId TSFPageId, sb *TSFSuperBlock, buf *bytes.Buffer) {
@@ -1222,34 +2006,67 @@ func (tsf *TSFile) updateHeaderV2(pageId TSFPageId, sb *TSFSuperBlock, buf *byte
 		startPage++
 	}
 	endPage := len(tsf.pageHeaders)
-	if endPage > startPage+tagsPerHeader {
-		endPage = startPage + tagsPerHeader
+	if endPage > startPage+int(tsf.tagsPerHeader) {
+		endPage = startPage + int(tsf.tagsPerHeader)
 	}
 
 	// Cannot use pageCount here as we might allocate some pages that are referred
 	// by a new header, not this header
 	sb.Count = uint32(endPage)
 
+	// Data pages which were not written yet should be referred in the
+	// state they have on disk
+	pageHeaders := make([]TSFPageHeader, endPage-startPage)
+	copy(pageHeaders, tsf.pageHeaders[startPage:endPage])
+	for dataPageId, page := range tsf.pageCache {
+		relId := int(dataPageId) - startPage
+		if page.dirty && relId >= 0 && relId < len(pageHeaders) {
+			hdr := &pageHeaders[relId]
+			if hdr.Flags == 0 && hdr.getTag().isDataTag() {
+				hdr.Count = page.diskCount
+			}
+		}
+	}
+
 	binary.Write(buf, binary.LittleEndian, tsf.header)
-	binary.Write(buf, binary.LittleEndian, tsf.pageHeaders[startPage:endPage])
+	if tsf.formatFlags.getVersion() == TSFFormatV3 {
+		binary.Write(buf, binary.LittleEndian, TSFHeaderExt{
+			PageSize:      tsf.pageSize,
+			TagsPerHeader: tsf.tagsPerHeader,
+		})
+	}
+	binary.Write(buf, binary.LittleEndian, pageHeaders)
 }
 
 // Allocates new page: inserts page header to and page object and returns
 // page along with its index
 func (tsf *TSFile) allocateDataPage(tag TSFPageTag, flags uint) (*tsfPage, TSFPageId) {
 	page := tsf.newPage(tsf.pageSize)
+	if tsf.formatFlags.hasFlag(TSFFormatCompressed) && tag.isDataTag() && flags == 0 {
+		// Compressed pages may hold more entries than raw pages
+		page.codec = tsf.getSchemaCodec(tag.toSchemaId())
+		if page.codec != nil {
+			page.size = tsf.pageSize * maxCompressionRatio
+		}
+	}
+
+	if tsf.shouldReusePage() {
+		if pageId, ok := tsf.reusePage(); ok {
+			return tsf.insertPage(page, pageId, tag, flags)
+		}
+	}
 
 	pageId := nextPageId(&tsf.pageCount)
-	nextHeaderId := loadPageId(&tsf.headerPageId) + TSFPageId(tagsPerHeader)
-	if nextHeaderId == tagsPerHeader {
+	nextHeaderId := loadPageId(&tsf.headerPageId) + TSFPageId(tsf.tagsPerHeader)
+	if nextHeaderId == TSFPageId(tsf.tagsPerHeader) {
 		// First header has index 0, but second should fit to first header's
 		// area, so it has index tagsPerHeader-1
 		nextHeaderId--
 	}
-	if (tsf.formatFlags&TSFFormatV2) != 0 && pageId == nextHeaderId {
+	if tsf.formatFlags.hasExtents() && pageId == nextHeaderId {
 		// This should be a header page, so we can start new extent
 		oldHeaderPageId := swapPageId(&tsf.headerPageId, pageId)
-		tsf.insertPage(tsf.newPage(pageSize), pageId, TSFTagHeader, 0)
+		tsf.insertPage(tsf.newPage(tsf.pageSize), pageId, TSFTagHeader, 0)
 
 		pageId = nextPageId(&tsf.pageCount)
 
@@ -1296,7 +2113,7 @@ func (tsf *TSFile) insertPage(page *tsfPage, pageId TSFPageId, tag TSFPageTag, f
 	tsf.pageHeaders[pageId].Flags = uint16(flags)
 	tsf.pageCache[pageId] = page
 
-	if tag >= 0 && flags == 0 {
+	if tag.isDataTag() && flags == 0 {
 		// If we accidentally created copy of data page, it is not bad,
 		// we're simply save second page for convenience and take first
 		pages := tsf.dataPagesCache[tag]
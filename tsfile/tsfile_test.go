@@ -6,12 +6,18 @@ import (
 	"testing"
 	_ "testing/iotest"
 
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 
+	"encoding/binary"
 	"reflect"
 
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func runTsfTest(t *testing.T, create func(t *testing.T, f *os.File) *tsfile.TSFile,
@@ -479,3 +485,1362 @@ func TestFileRWParallel(t *testing.T) {
 		}
 	})
 }
+
+func TestFileFindByTime(t *testing.T) {
+	type S struct {
+		T tsfile.TSTimeStart
+		I int64
+	}
+	var tag tsfile.TSFPageTag
+
+	// Enough entries to fill multiple pages
+	N := 2000
+
+	runTsfTest(t, func(t *testing.T, f *os.File) *tsfile.TSFile {
+		tsf, err := tsfile.NewTSFile(f, tsfile.TSFFormatV2|tsfile.TSFFormatExt)
+		if err != nil {
+			t.Error(err)
+		}
+
+		schema, err := tsfile.NewStructSchema(reflect.TypeOf(S{}))
+		if err != nil {
+			t.Error(err)
+		}
+		tag, err = tsf.AddSchema(schema)
+		if err != nil {
+			t.Error(err)
+		}
+
+		entries := make([]S, N)
+		for i := range entries {
+			entries[i] = S{T: tsfile.TSTimeStart(i * 10), I: int64(i)}
+		}
+		err = tsf.AddEntries(tag, entries)
+		if err != nil {
+			t.Error(err)
+		}
+
+		return tsf
+	}, func(t *testing.T, tsf *tsfile.TSFile) {
+		for _, tc := range []struct {
+			t     tsfile.TSTimeStart
+			index int
+		}{
+			{-5, 0}, {0, 0}, {5, 1}, {10, 1}, {2555, 256}, {2560, 256},
+			{19990, N - 1}, {19995, N}, {100000, N},
+		} {
+			index, err := tsf.FindEntryByTime(tag, tc.t)
+			if err != nil {
+				t.Error(err)
+			}
+			if index != tc.index {
+				t.Errorf("Unexpected index for time %d: %d != %d", tc.t, index, tc.index)
+			}
+		}
+
+		bufs, err := tsf.GetEntriesInRange(tag, 15000, 15050)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(bufs) != 5 {
+			t.Errorf("Unexpected number of entries in range: %d != 5", len(bufs))
+			return
+		}
+
+		schema, _ := tsf.GetSchema(tag)
+		deserializer := tsfile.NewDeserializer(schema)
+		if st := deserializer.GetStartTime(bufs[0]); st != 15000 {
+			t.Errorf("Unexpected start time of first entry in range: %d", st)
+		}
+	})
+}
+
+func TestFileCompressed(t *testing.T) {
+	type S struct {
+		T tsfile.TSTimeStart
+		I int32
+		F float64
+		S [8]byte
+	}
+	var tag tsfile.TSFPageTag
+
+	N := 5000
+	newEntry := func(i int) (s S) {
+		s = S{T: tsfile.TSTimeStart(i * 100), I: int32(i % 7), F: float64(i) / 3}
+		tsfile.EncodeCStr("abc", s.S[:])
+		return
+	}
+
+	runTsfTest(t, func(t *testing.T, f *os.File) *tsfile.TSFile {
+		tsf, err := tsfile.NewTSFile(f, tsfile.TSFFormatV2|tsfile.TSFFormatExt|
+			tsfile.TSFFormatCompressed)
+		if err != nil {
+			t.Error(err)
+		}
+
+		schema, err := tsfile.NewStructSchema(reflect.TypeOf(S{}))
+		if err != nil {
+			t.Error(err)
+		}
+		tag, err = tsf.AddSchema(schema)
+		if err != nil {
+			t.Error(err)
+		}
+
+		for i := 0; i < N; i += 100 {
+			entries := make([]S, 100)
+			for j := range entries {
+				entries[j] = newEntry(i + j)
+			}
+
+			err = tsf.AddEntries(tag, entries)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+
+		return tsf
+	}, func(t *testing.T, tsf *tsfile.TSFile) {
+		if tsf.GetEntryCount(tag) != N {
+			t.Errorf("tsfile has invalid number of entries: %d", tsf.GetEntryCount(tag))
+		}
+
+		entries := make([]S, N)
+		err := tsf.GetEntries(tag, entries, 0)
+		if err != nil {
+			t.Error(err)
+		}
+		for i, entry := range entries {
+			if entry != newEntry(i) {
+				t.Errorf("Unexpected entry #%d: %v", i, entry)
+				return
+			}
+		}
+
+		index, err := tsf.FindEntryByTime(tag, 250050)
+		if index != 2501 {
+			t.Errorf("Unexpected index for time 250050: %d (%v)", index, err)
+		}
+	})
+}
+
+func TestFileCompressedAppend(t *testing.T) {
+	type S struct {
+		T tsfile.TSTimeStart
+		I int64
+		U int64
+	}
+	var tag tsfile.TSFPageTag
+
+	// Entries are appended one by one, so page size is estimated many times,
+	// random values make some pages hardly compressible
+	N := 30000
+	newEntry := func(i int) S {
+		u := uint64(i) * 0x9E3779B97F4A7C15
+		if (i/3000)%2 == 1 {
+			u = uint64(i % 3)
+		}
+		return S{T: tsfile.TSTimeStart(i * 10), I: int64(i / 100), U: int64(u)}
+	}
+
+	runTsfTest(t, func(t *testing.T, f *os.File) *tsfile.TSFile {
+		tsf, err := tsfile.NewTSFileWithPageSize(f, tsfile.TSFFormatV3|tsfile.TSFFormatExt|
+			tsfile.TSFFormatCompressed, 65536)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		schema, err := tsfile.NewStructSchema(reflect.TypeOf(S{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tag, err = tsf.AddSchema(schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < N; i++ {
+			err = tsf.AddEntries(tag, []S{newEntry(i)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return tsf
+	}, func(t *testing.T, tsf *tsfile.TSFile) {
+		if tsf.GetEntryCount(tag) != N {
+			t.Fatalf("tsfile has invalid number of entries: %d", tsf.GetEntryCount(tag))
+		}
+
+		entries := make([]S, N)
+		err := tsf.GetEntries(tag, entries, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, entry := range entries {
+			if entry != newEntry(i) {
+				t.Fatalf("Unexpected entry #%d: %v", i, entry)
+			}
+		}
+	})
+}
+
+func TestFileAddFileCompressed(t *testing.T) {
+	type S struct {
+		I int64
+	}
+	var tag1 tsfile.TSFPageTag
+
+	N := 3000
+
+	runTsfTest(t, func(t *testing.T, f *os.File) (tsf1 *tsfile.TSFile) {
+		tsf1, err := tsfile.NewTSFile(f, tsfile.TSFFormatV2)
+		if err != nil {
+			t.Error(err)
+		}
+
+		runTsfTest(t, func(t *testing.T, f *os.File) (tsf2 *tsfile.TSFile) {
+			tsf2, err := tsfile.NewTSFile(f, tsfile.TSFFormatV2|tsfile.TSFFormatCompressed)
+			if err != nil {
+				t.Error(err)
+			}
+
+			schema, _ := tsfile.NewStructSchema(reflect.TypeOf(S{}))
+			tag2, err := tsf2.AddSchema(schema)
+			if err != nil {
+				t.Error(err)
+			}
+
+			entries := make([]S, N)
+			for i := range entries {
+				entries[i].I = int64(i)
+			}
+			err = tsf2.AddEntries(tag2, entries)
+			if err != nil {
+				t.Error(err)
+			}
+
+			err = tsf1.AddFile(tsf2)
+			if err != nil {
+				t.Error(err)
+			}
+
+			return tsf2
+		}, func(t *testing.T, tsf2 *tsfile.TSFile) {
+		})
+
+		tag1, _ = tsf1.GetDataTags()
+		return tsf1
+	}, func(t *testing.T, tsf1 *tsfile.TSFile) {
+		if tsf1.GetEntryCount(tag1) != N {
+			t.Errorf("tsfile has invalid number of entries: %d", tsf1.GetEntryCount(tag1))
+		}
+
+		entries := make([]S, N)
+		err := tsf1.GetEntries(tag1, entries, 0)
+		if err != nil {
+			t.Error(err)
+		}
+		for i, entry := range entries {
+			if entry.I != int64(i) {
+				t.Errorf("Unexpected entry #%d: %v", i, entry)
+				return
+			}
+		}
+	})
+}
+
+func TestFileChecksum(t *testing.T) {
+	type S struct {
+		T tsfile.TSTimeStart
+		I int64
+	}
+
+	// 256 entries per page, so last page contains 208 entries
+	N := 2000
+	NFull := 1792
+
+	f, err := ioutil.TempFile("", "tsftest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	tsf, err := tsfile.NewTSFile(f, tsfile.TSFFormatV2|tsfile.TSFFormatExt|
+		tsfile.TSFFormatChecksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, _ := tsfile.NewStructSchema(reflect.TypeOf(S{}))
+	tag, err := tsf.AddSchema(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := make([]S, N)
+	for i := range entries {
+		entries[i] = S{T: tsfile.TSTimeStart(i), I: int64(i)}
+	}
+	err = tsf.AddEntries(tag, entries)
+	if err != nil {
+		t.Error(err)
+	}
+
+	checkFile := func(count int, damaged int) *tsfile.TSFile {
+		tsf, err := tsfile.LoadTSFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tsf.GetDamage()) != damaged {
+			t.Errorf("Unexpected damage: %v", tsf.GetDamage())
+		}
+		if tsf.GetEntryCount(tag) != count {
+			t.Errorf("tsfile has invalid number of entries: %d != %d",
+				tsf.GetEntryCount(tag), count)
+		}
+
+		entries := make([]S, count)
+		err = tsf.GetEntries(tag, entries, 0)
+		if err != nil {
+			t.Error(err)
+		}
+		for i, entry := range entries {
+			if entry.I != int64(i) {
+				t.Errorf("Unexpected entry #%d: %v", i, entry)
+				break
+			}
+		}
+		return tsf
+	}
+
+	// Writer didn't close file, so only full pages are written
+	checkFile(NFull, 0)
+
+	_, err = tsf.Detach()
+	if err != nil {
+		t.Error(err)
+	}
+	checkFile(N, 0)
+
+	// Damage last page and repair file
+	stat, _ := f.Stat()
+	_, err = f.WriteAt([]byte{0xff, 0xff}, stat.Size()-4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tsf = checkFile(NFull, 1)
+	err = tsf.Repair()
+	if err != nil {
+		t.Error(err)
+	}
+	checkFile(NFull, 0)
+}
+
+func TestFileSubscribe(t *testing.T) {
+	type S struct {
+		I int64
+	}
+
+	N := 1000
+	batchSize := 10
+
+	f, err := ioutil.TempFile("", "tsftest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	tsf, tag := newFileWithSchema(t, f, S{})
+	err = tsf.AddEntries(tag, []S{{0}})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Subscribe to series and read all entries while writer is running. Keep
+	// reference for reader, so file won't be closed by the writer
+	reader := tsf.Get()
+	sub, err := reader.Subscribe(tag, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for i := 1; i < N; i += batchSize {
+			entries := make([]S, batchSize)
+			for j := range entries {
+				entries[j].I = int64(i + j)
+			}
+
+			tsf.AddEntries(tag, entries)
+			runtime.Gosched()
+		}
+		tsf.Put()
+	}()
+
+	for count := 0; count < N; {
+		entries, err := sub.Wait(0, 10*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 0 {
+			t.Fatal("Timed out waiting for entries")
+		}
+
+		for _, entry := range entries {
+			if binary.LittleEndian.Uint64(entry) != uint64(count) {
+				t.Fatalf("Unexpected entry #%d: %v", count, entry)
+			}
+			count++
+		}
+	}
+
+	// Once last reference is put, subscription is closed
+	reader.Put()
+	_, err = sub.Wait(0, 10*time.Second)
+	if err != io.EOF {
+		t.Errorf("Subscription wasn't closed: %v", err)
+	}
+}
+
+func TestFileAppend(t *testing.T) {
+	type S1 struct {
+		I int64
+	}
+	type S2 struct {
+		F float64
+	}
+	N := 300
+
+	f, err := ioutil.TempFile("", "tsftest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	tsf, tag1 := newFileWithSchema(t, f, S1{})
+	entries1 := make([]S1, N)
+	for i := range entries1 {
+		entries1[i].I = int64(i)
+	}
+	err = tsf.AddEntries(tag1, entries1)
+	if err != nil {
+		t.Error(err)
+	}
+	storage, err := tsf.Detach()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen file and add both entries to existing series and a new series
+	tsf, err = tsfile.LoadTSFile(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range entries1 {
+		entries1[i].I = int64(N + i)
+	}
+	err = tsf.AddEntries(tag1, entries1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	schema2, _ := tsfile.NewStructSchema(reflect.TypeOf(S2{}))
+	tag2, err := tsf.AddSchema(schema2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag2 == tag1 {
+		t.Fatalf("Schema tag %d is reused", tag2)
+	}
+	err = tsf.AddEntries(tag2, []S2{S2{0.5}})
+	if err != nil {
+		t.Error(err)
+	}
+	storage, err = tsf.Detach()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tsf, err = tsfile.LoadTSFile(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tsf.GetEntryCount(tag1) != 2*N || tsf.GetEntryCount(tag2) != 1 {
+		t.Errorf("tsfile has invalid number of entries: %d, %d",
+			tsf.GetEntryCount(tag1), tsf.GetEntryCount(tag2))
+	}
+
+	entries := make([]S1, 2*N)
+	err = tsf.GetEntries(tag1, entries, 0)
+	if err != nil {
+		t.Error(err)
+	}
+	for i, entry := range entries {
+		if entry.I != int64(i) {
+			t.Errorf("Unexpected entry #%d: %v", i, entry)
+			break
+		}
+	}
+}
+
+func TestFileVarString(t *testing.T) {
+	type S struct {
+		I    int64
+		Name tsfile.TSVarString
+		Path tsfile.TSVarString
+	}
+
+	// Strings take more than an extent of heap pages
+	N := 4000
+	name := func(i int) string {
+		return strings.Repeat(strconv.Itoa(i), i%200)
+	}
+
+	f, err := ioutil.TempFile("", "tsftest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	tsf, err := tsfile.NewTSFile(f, tsfile.TSFFormatV2|tsfile.TSFFormatExt|
+		tsfile.TSFFormatChecksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, err := tsfile.NewStructSchema(reflect.TypeOf(S{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := tsf.AddSchema(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := make([]S, N)
+	for i := range entries {
+		entries[i] = S{I: int64(i), Name: tsfile.TSVarString(name(i)), Path: "/"}
+	}
+	// Long strings are chained across heap pages
+	longPath := strings.Repeat("x", 5000)
+	longerPath := strings.Repeat("путь/", 3000)
+	entries[1].Path = tsfile.TSVarString(longPath)
+	entries[3].Path = tsfile.TSVarString(longerPath)
+	err = tsf.AddEntries(tag, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tsf.AddEntries(tag, []S{{Path: tsfile.TSVarString(strings.Repeat("x", 70000))}})
+	if err == nil {
+		t.Error("String which is longer than 64k is added")
+	}
+
+	checkFile := func(tsf *tsfile.TSFile) {
+		count := tsf.GetEntryCount(tag)
+		if count < 1 {
+			t.Fatalf("tsfile has no entries")
+		}
+
+		entries := make([]S, count)
+		err := tsf.GetEntries(tag, entries, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, entry := range entries {
+			if entry.I != int64(i) || string(entry.Name) != name(i) {
+				t.Errorf("Unexpected entry #%d: %v", i, entry)
+				break
+			}
+		}
+		if string(entries[1].Path) != longPath || string(entries[3].Path) != longerPath ||
+			entries[2].Path != "/" {
+			t.Errorf("Unexpected paths: %d, %s, %d", len(entries[1].Path), entries[2].Path,
+				len(entries[3].Path))
+		}
+
+		bufs := make([][]byte, 1)
+		err = tsf.GetEntries(tag, bufs, count-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deserializer := tsfile.NewDeserializer(schema)
+		_, value := deserializer.Get(bufs[0], 1)
+		if value != name(count-1) {
+			t.Errorf("Unexpected deserialized value: %v", value)
+		}
+	}
+
+	// Writer didn't close file, but strings of written entries are on disk
+	tsf2, err := tsfile.LoadTSFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tsf2.GetDamage()) != 0 {
+		t.Errorf("Unexpected damage: %v", tsf2.GetDamage())
+	}
+	checkFile(tsf2)
+
+	storage, err := tsf.Detach()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tsf, err = tsfile.LoadTSFile(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tsf.GetEntryCount(tag) != N {
+		t.Errorf("tsfile has invalid number of entries: %d", tsf.GetEntryCount(tag))
+	}
+	checkFile(tsf)
+
+	// Strings are copied to the heap of other file
+	f2, err := ioutil.TempFile("", "tsftest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f2.Name())
+
+	tsfOut, err := tsfile.NewTSFile(f2, tsfile.TSFFormatV2|tsfile.TSFFormatExt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tsfOut.AddFile(tsf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(tsfOut)
+}
+
+func TestFileV3(t *testing.T) {
+	type S struct {
+		T tsfile.TSTimeStart
+		I int64
+	}
+	var tag tsfile.TSFPageTag
+
+	// Each entry takes a page, so entries span several extents which have
+	// 251 page headers each for 4096 bytes pages
+	N := 600
+	runTsfTest(t, func(t *testing.T, f *os.File) *tsfile.TSFile {
+		tsf, err := tsfile.NewTSFileWithPageSize(f, tsfile.TSFFormatV3|tsfile.TSFFormatExt|
+			tsfile.TSFFormatChecksum, 4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		schema, _ := tsfile.NewStructSchema(reflect.TypeOf(S{}))
+		tag, err = tsf.AddSchema(schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Fill pages one by one to make them all full
+		for i := 0; i < N; i++ {
+			entries := make([]S, 4096/16)
+			for j := range entries {
+				entries[j] = S{tsfile.TSTimeStart(i*len(entries) + j), int64(i)}
+			}
+
+			err = tsf.AddEntries(tag, entries)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return tsf
+	}, func(t *testing.T, tsf *tsfile.TSFile) {
+		count := tsf.GetEntryCount(tag)
+		if count != N*4096/16 {
+			t.Errorf("tsfile has invalid number of entries: %d", count)
+		}
+
+		entries := make([]S, count)
+		err := tsf.GetEntries(tag, entries, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, entry := range entries {
+			if entry.T != tsfile.TSTimeStart(i) || entry.I != int64(i/256) {
+				t.Errorf("Unexpected entry #%d: %v", i, entry)
+				break
+			}
+		}
+	})
+}
+
+func TestFileV3WideSchema(t *testing.T) {
+	// Per-CPU schema for 1024 CPUs
+	M := 1024
+	fields := []tsfile.TSFSchemaField{tsfile.NewStartTimeField()}
+	for cpu := 0; cpu < M; cpu++ {
+		fields = append(fields, tsfile.NewField("cpu"+strconv.Itoa(cpu), reflect.TypeOf(int32(0))))
+	}
+	schema, err := tsfile.NewSchema("percpu", fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	N := 100
+	newEntry := func(i int) []byte {
+		entry := make([]byte, schema.EntrySize)
+		binary.LittleEndian.PutUint64(entry, uint64(i))
+		for cpu := 0; cpu < M; cpu++ {
+			binary.LittleEndian.PutUint32(entry[8+4*cpu:], uint32(i*cpu))
+		}
+		return entry
+	}
+
+	var tag tsfile.TSFPageTag
+	runTsfTest(t, func(t *testing.T, f *os.File) *tsfile.TSFile {
+		_, err := tsfile.NewTSFileWithPageSize(f, tsfile.TSFFormatV3, 5000)
+		if err == nil {
+			t.Error("Page size which is not power of two should be rejected")
+		}
+		_, err = tsfile.NewTSFileWithPageSize(f, tsfile.TSFFormatV2, 65536)
+		if err == nil {
+			t.Error("Page size other than 4096 should be rejected by V2")
+		}
+
+		tsf, err := tsfile.NewTSFileWithPageSize(f, tsfile.TSFFormatV3|tsfile.TSFFormatExt|
+			tsfile.TSFFormatCompressed, 65536)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tag, err = tsf.AddSchema(schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries := make([][]byte, N)
+		for i := range entries {
+			entries[i] = newEntry(i)
+		}
+		err = tsf.AddEntries(tag, entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tsf
+	}, func(t *testing.T, tsf *tsfile.TSFile) {
+		loaded, err := tsf.GetSchema(tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = loaded.Validate(schema)
+		if err != nil {
+			t.Error(err)
+		}
+
+		info := loaded.Info()
+		if len(info.Fields) != M+1 || info.Fields[M].FieldName != "cpu1023" {
+			t.Errorf("Unexpected schema: %d fields", len(info.Fields))
+		}
+
+		entries := make([][]byte, N)
+		err = tsf.GetEntries(tag, entries, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, entry := range entries {
+			if string(entry) != string(newEntry(i)) {
+				t.Errorf("Unexpected entry #%d", i)
+				break
+			}
+		}
+	})
+}
+
+func TestFileRollup(t *testing.T) {
+	// V3 keeps window of rollup in optional part of schema header
+	formats := map[string]tsfile.TSFFormatFlags{
+		"V2": tsfile.TSFFormatV2,
+		"V3": tsfile.TSFFormatV3,
+	}
+	for name, format := range formats {
+		t.Run(name, func(t *testing.T) {
+			testFileRollup(t, format)
+		})
+	}
+}
+
+func testFileRollup(t *testing.T, format tsfile.TSFFormatFlags) {
+	type S struct {
+		T tsfile.TSTimeStart
+		I int32
+		F float64
+		N [8]byte
+	}
+	type R struct {
+		Start      tsfile.TSTimeStart
+		End        tsfile.TSTimeEnd
+		Count      int64
+		IMin, IMax int64
+		IAvg       float64
+		FMin, FMax float64
+		FAvg       float64
+	}
+	var tag, rollupTag tsfile.TSFPageTag
+
+	N := 1000
+	window := int64(time.Second)
+	runTsfTest(t, func(t *testing.T, f *os.File) *tsfile.TSFile {
+		tsf, err := tsfile.NewTSFile(f, format|tsfile.TSFFormatExt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		schema, _ := tsfile.NewStructSchema(reflect.TypeOf(S{}))
+		tag, err = tsf.AddSchema(schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries := make([]S, N)
+		for i := range entries {
+			entries[i] = S{T: tsfile.TSTimeStart(i * int(100*time.Millisecond)),
+				I: int32(i % 10), F: float64(i) / 2}
+		}
+		err = tsf.AddEntries(tag, entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rollupTag, err = tsf.AddRollup(tag, window)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Rollup is built only once
+		rollupTag2, err := tsf.AddRollup(tag, window)
+		if err != nil || rollupTag2 != rollupTag {
+			t.Errorf("Unexpected second rollup %d: %v", rollupTag2, err)
+		}
+
+		_, err = tsf.AddRollup(rollupTag, 10*window)
+		if err == nil {
+			t.Error("Rollup of rollup shouldn't be allowed")
+		}
+		return tsf
+	}, func(t *testing.T, tsf *tsfile.TSFile) {
+		if tsf.FindRollup(tag, window) != rollupTag {
+			t.Fatalf("Rollup not found for tag %d", tag)
+		}
+		if tags := tsf.GetRollups(tag); len(tags) != 1 || tags[0] != rollupTag {
+			t.Errorf("Unexpected rollups: %v", tags)
+		}
+
+		schema, _ := tsf.GetSchema(rollupTag)
+		if tsfile.DecodeCStr(schema.Name[:]) != "S@1s" || schema.Window != window {
+			t.Errorf("Unexpected rollup schema: %s", schema.Name)
+		}
+		info := schema.Info()
+		if info.Fields[3].FieldName != "I_min" || info.Fields[8].FieldName != "F_avg" {
+			t.Errorf("Unexpected rollup fields: %v", info.Fields)
+		}
+
+		count := tsf.GetEntryCount(rollupTag)
+		if count != N/10 {
+			t.Fatalf("Unexpected number of rollup entries: %d", count)
+		}
+
+		entries := make([]R, count)
+		err := tsf.GetEntries(rollupTag, entries, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := entries[3]
+		expected := R{Start: 3000000000, End: 4000000000, Count: 10, IMin: 0, IMax: 9,
+			IAvg: 4.5, FMin: 15, FMax: 19.5, FAvg: 17.25}
+		if r != expected {
+			t.Errorf("Unexpected rollup entry: %v", r)
+		}
+
+		index, err := tsf.FindEntryByTime(rollupTag, 50500000000)
+		if index != 51 {
+			t.Errorf("Unexpected index for time 50.5s: %d (%v)", index, err)
+		}
+	})
+}
+
+func TestFileRetention(t *testing.T) {
+	type S struct {
+		T tsfile.TSTimeStart
+		I int64
+	}
+	const perPage = 4096 / 16
+	const maxPages = 64
+
+	f, err := ioutil.TempFile("", "tsftest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	tsf, err := tsfile.NewTSFileWithPageSize(f, tsfile.TSFFormatV3|tsfile.TSFFormatExt|
+		tsfile.TSFFormatChecksum, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tsf.SetRetention(maxPages * 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schema, _ := tsfile.NewStructSchema(reflect.TypeOf(S{}))
+	tag, err := tsf.AddSchema(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Adds N pages of entries and checks that file keeps newest entries
+	next := 0
+	addPages := func(tsf *tsfile.TSFile, N int) {
+		for i := 0; i < N; i++ {
+			entries := make([]S, perPage)
+			for j := range entries {
+				entries[j] = S{tsfile.TSTimeStart(next), int64(next)}
+				next++
+			}
+
+			err := tsf.AddEntries(tag, entries)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	checkEntries := func(tsf *tsfile.TSFile) {
+		count := tsf.GetEntryCount(tag)
+		if count > maxPages*perPage || count < (maxPages-4)*perPage {
+			t.Errorf("Unexpected number of entries: %d", count)
+		}
+
+		entries := make([]S, count)
+		err := tsf.GetEntries(tag, entries, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, entry := range entries {
+			if entry.I != int64(next-count+i) {
+				t.Errorf("Unexpected entry #%d: %v", i, entry)
+				break
+			}
+		}
+
+		index, err := tsf.FindEntryByTime(tag, tsfile.TSTimeStart(next-perPage))
+		if index != count-perPage {
+			t.Errorf("Unexpected index of last page: %d (%v)", index, err)
+		}
+	}
+
+	addPages(tsf, 3*maxPages+10)
+	checkEntries(tsf)
+
+	storage, err := tsf.Detach()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reload file and continue writing: pages should be reused in the
+	// same order without setting retention again
+	tsf, err = tsfile.LoadTSFile(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if damage := tsf.Verify(); len(damage) > 0 {
+		t.Errorf("Unexpected damage: %v", damage)
+	}
+	checkEntries(tsf)
+
+	addPages(tsf, maxPages/2+3)
+	checkEntries(tsf)
+
+	storage, err = tsf.Detach()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tsf, err = tsfile.LoadTSFile(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(tsf)
+	tsf.Put()
+
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() > (maxPages+1)*4096 {
+		t.Errorf("File size %d exceeds retention limit", fi.Size())
+	}
+}
+
+func TestFileRetentionVarString(t *testing.T) {
+	type S struct {
+		T   tsfile.TSTimeStart
+		I   int64
+		Msg tsfile.TSVarString
+	}
+	const maxPages = 64
+
+	f, err := ioutil.TempFile("", "tsftest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	tsf, err := tsfile.NewTSFileWithPageSize(f, tsfile.TSFFormatV3|tsfile.TSFFormatExt|
+		tsfile.TSFFormatChecksum, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tsf.SetRetention(maxPages * 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schema, _ := tsfile.NewStructSchema(reflect.TypeOf(S{}))
+	tag, err := tsf.AddSchema(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every 100th string is chained over several heap pages
+	message := func(i int) string {
+		if i%100 == 99 {
+			return strings.Repeat(fmt.Sprintf("%08d", i), 1000)
+		}
+		return fmt.Sprintf("message %032d", i)
+	}
+
+	next := 0
+	addEntries := func(tsf *tsfile.TSFile, N int) {
+		for i := 0; i < N; i++ {
+			err := tsf.AddEntries(tag, []S{{tsfile.TSTimeStart(next), int64(next),
+				tsfile.TSVarString(message(next))}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			next++
+		}
+	}
+	checkEntries := func(tsf *tsfile.TSFile) {
+		count := tsf.GetEntryCount(tag)
+		if count < 500 {
+			t.Errorf("Unexpected number of entries: %d", count)
+		}
+
+		entries := make([]S, count)
+		err := tsf.GetEntries(tag, entries, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, entry := range entries {
+			index := next - count + i
+			if entry.I != int64(index) || string(entry.Msg) != message(index) {
+				t.Errorf("Unexpected entry #%d: %d %.40s", i, entry.I, entry.Msg)
+				break
+			}
+		}
+	}
+
+	addEntries(tsf, 20000)
+	checkEntries(tsf)
+
+	storage, err := tsf.Detach()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tsf, err = tsfile.LoadTSFile(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if damage := tsf.Verify(); len(damage) > 0 {
+		t.Errorf("Unexpected damage: %v", damage)
+	}
+	checkEntries(tsf)
+
+	// Heap pages loaded from file are reused too once data pages which
+	// were loaded with them are reused
+	addEntries(tsf, 20000)
+	checkEntries(tsf)
+	tsf.Put()
+
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() > (maxPages+1)*4096 {
+		t.Errorf("File size %d exceeds retention limit", fi.Size())
+	}
+}
+
+func TestFileMapped(t *testing.T) {
+	type S struct {
+		T tsfile.TSTimeStart
+		I int64
+	}
+	const N = 5000
+
+	for _, flags := range []tsfile.TSFFormatFlags{
+		tsfile.TSFFormatV3 | tsfile.TSFFormatExt | tsfile.TSFFormatChecksum,
+		tsfile.TSFFormatV2 | tsfile.TSFFormatExt | tsfile.TSFFormatCompressed,
+	} {
+		f, err := ioutil.TempFile("", "tsftest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+
+		tsf, err := tsfile.NewTSFile(f, flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		schema, _ := tsfile.NewStructSchema(reflect.TypeOf(S{}))
+		tag, err := tsf.AddSchema(schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries := make([]S, N)
+		for i := range entries {
+			entries[i] = S{tsfile.TSTimeStart(i * 10), int64(i)}
+		}
+		err = tsf.AddEntries(tag, entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tsf.Put()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err = os.Open(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tsf, err = tsfile.LoadTSFileMapped(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Read entries twice so pages are taken both from mapping and cache
+		for pass := 0; pass < 2; pass++ {
+			entries2 := make([]S, N)
+			err = tsf.GetEntries(tag, entries2, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(entries, entries2) {
+				t.Errorf("Entries of mapped file are differ (flags: %x)", flags)
+			}
+
+			bufs := make([][]byte, 300)
+			err = tsf.GetEntries(tag, bufs, 1000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, buf := range bufs {
+				index := binary.LittleEndian.Uint64(buf[8:])
+				if len(buf) != 16 || index != uint64(1000+i) {
+					t.Errorf("Unexpected entry #%d: %v", 1000+i, buf)
+					break
+				}
+			}
+		}
+
+		err = tsf.AddEntries(tag, entries[:1])
+		if err == nil {
+			t.Errorf("Adding entries to mapped file should fail")
+		}
+		_, err = tsf.AddSchema(schema)
+		if err == nil {
+			t.Errorf("Adding schema to mapped file should fail")
+		}
+
+		err = tsf.Put()
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestFileMergeFile(t *testing.T) {
+	type S1 struct {
+		T    tsfile.TSTimeStart
+		A    int32
+		B    float32
+		Name tsfile.TSVarString
+	}
+	type S2 struct {
+		T    tsfile.TSTimeStart
+		A    int64
+		C    int64
+		B    float64
+		Name tsfile.TSVarString
+	}
+	const N = 1000
+
+	newFile := func(v interface{}, name string) (*tsfile.TSFile, tsfile.TSFPageTag) {
+		f, err := ioutil.TempFile("", "tsftest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(f.Name())
+
+		tsf, err := tsfile.NewTSFile(f, tsfile.TSFFormatV2|tsfile.TSFFormatExt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		schema, _ := tsfile.NewStructSchema(reflect.TypeOf(v))
+		tsfile.EncodeCStr(name, schema.Name[:])
+		tag, err := tsf.AddSchema(schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tsf, tag
+	}
+
+	// Newer entries written with previous version of schema
+	tsfIn, tagIn := newFile(S1{}, "stat")
+	defer tsfIn.Put()
+	entries1 := make([]S1, N)
+	for i := range entries1 {
+		entries1[i] = S1{tsfile.TSTimeStart(i + 1), int32(-i), float32(i) / 2,
+			tsfile.TSVarString(strconv.Itoa(i))}
+	}
+	err := tsfIn.AddEntries(tagIn, entries1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tsfOut, tagOut := newFile(S2{}, "stat")
+	defer tsfOut.Put()
+	err = tsfOut.AddEntries(tagOut, []S2{{T: 0, A: 1 << 40, C: 1, B: 0.25, Name: "first"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tsfOut.MergeFile(tsfIn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tag, tagEnd := tsfOut.GetDataTags(); tagEnd-tag != 1 {
+		t.Errorf("Series weren't merged: tags [%d:%d]", tag, tagEnd)
+	}
+	if count := tsfOut.GetEntryCount(tagOut); count != N+1 {
+		t.Fatalf("Unexpected number of entries: %d", count)
+	}
+
+	entries2 := make([]S2, N+1)
+	err = tsfOut.GetEntries(tagOut, entries2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries2[0].A != 1<<40 || entries2[0].Name != "first" {
+		t.Errorf("Unexpected entry #0: %v", entries2[0])
+	}
+	for i, entry := range entries2[1:] {
+		if entry.T != tsfile.TSTimeStart(i+1) || entry.A != int64(-i) || entry.C != 0 ||
+			entry.B != float64(i)/2 || entry.Name != tsfile.TSVarString(strconv.Itoa(i)) {
+			t.Errorf("Unexpected merged entry #%d: %v", i, entry)
+			break
+		}
+	}
+
+	// Entries of merged series cannot go back in time
+	err = tsfOut.MergeFile(tsfIn)
+	if err == nil || !strings.Contains(err.Error(), "before last entry") {
+		t.Errorf("Unexpected error for overlapping series: %v", err)
+	}
+	if count := tsfOut.GetEntryCount(tagOut); count != N+1 {
+		t.Errorf("Entries were added on error: %d", count)
+	}
+
+	// Series with conflicting types of fields cannot be merged
+	type S3 struct {
+		T tsfile.TSTimeStart
+		A float64
+	}
+	tsfConflict, _ := newFile(S3{}, "stat")
+	defer tsfConflict.Put()
+
+	err = tsfOut.MergeFile(tsfConflict)
+	if err == nil || !strings.Contains(err.Error(), "type mismatch") {
+		t.Errorf("Unexpected error for conflicting schemas: %v", err)
+	}
+}
+
+func TestFileEnumDictionary(t *testing.T) {
+	type S struct {
+		T     tsfile.TSTimeStart
+		State int16
+		Count int32
+	}
+	var tag tsfile.TSFPageTag
+
+	runTsfTest(t, func(t *testing.T, f *os.File) *tsfile.TSFile {
+		tsf, err := tsfile.NewTSFile(f, tsfile.TSFFormatV2|tsfile.TSFFormatExt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		schema, _ := tsfile.NewStructSchema(reflect.TypeOf(S{}))
+		schema.Fields[1].FieldType = tsfile.TSFFieldEnumerable
+		tag, err = tsf.AddSchema(schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = tsf.RegisterEnum(tag, "State", tsfile.TSFEnumDictionary{
+			0: "idle", 1: "running"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tsf.RegisterEnum(tag, "Count", tsfile.TSFEnumDictionary{0: "zero"})
+		if err == nil {
+			t.Error("Labels are registered for non-enumerable field")
+		}
+
+		err = tsf.AddEntries(tag, []S{{0, 0, 10}, {1, 1, 20}, {2, 2, 30}, {3, -1, 40}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Labels may be added after entries which use them
+		err = tsf.RegisterEnum(tag, "State", tsfile.TSFEnumDictionary{
+			2: "blocked", -1: "dead"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tsf
+	}, func(t *testing.T, tsf *tsfile.TSFile) {
+		schema, err := tsf.GetSchema(tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(schema.Enums["State"]) != 4 || len(schema.Enums["Count"]) != 0 {
+			t.Fatalf("Unexpected dictionaries: %v", schema.Enums)
+		}
+
+		entries := make([][]byte, 4)
+		err = tsf.GetEntries(tag, entries, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		deserializer := tsfile.NewDeserializer(schema)
+		for i, label := range []string{"idle", "running", "blocked", "dead"} {
+			if _, value := deserializer.Get(entries[i], 1); value != label {
+				t.Errorf("Unexpected value of entry #%d: %v", i, value)
+			}
+		}
+		if _, value := deserializer.GetInt64(entries[1], 1); value != 1 {
+			t.Errorf("Unexpected integer value: %v", value)
+		}
+		if _, value := deserializer.Get(entries[2], 2); value != int32(30) {
+			t.Errorf("Unexpected value of non-enumerable field: %v", value)
+		}
+	})
+}
@@ -0,0 +1,539 @@
+package tsfile
+
+import (
+	"fmt"
+
+	"bytes"
+	"reflect"
+
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// Variable-length strings (TSFFieldVarString) -- entry only keeps a fixed-size
+// reference to the string while string itself is appended to a heap page
+// (TSFTagHeap) shared by all series. New heap page is started when current
+// page is full or when new extent is started, so heap pages are local to the
+// extents (only supported by V2 and V3).
+//
+// Strings which are longer than a heap page are split into chunks which are
+// chained across heap pages: each chunk starts with id of the page holding the
+// next chunk (zero for the last one). Chained string starts at the reference
+// offset and its chunks fill heap pages entirely except for the last one, so
+// strings longer than page size are always chained. Length of the string is
+// limited to 64k by the reference.
+//
+// Heap pages are written along with every batch of data pages before the
+// headers, so written entries never refer strings which are not on disk.
+// Number of references to strings in each heap page from each data page is
+// counted, so heap pages could be reused along with the data pages when file
+// has retention limit (see retention.go).
+//
+// In the entries returned by GetEntries() as raw buffers references are
+// resolved: strings are appended to the entry after its fixed part in the
+// order of fields, so TSFDeserializer may decode them without accessing file.
+// Raw entries passed to AddEntries() should have same layout (see
+// EncodeVarString()). Go structures should use TSVarString type for such
+// fields.
+
+const (
+	varStringRefSize = 8
+
+	// Size of the header of chunk of chained string (id of the next page)
+	varStringChunkHeaderSize = 4
+
+	// Maximum length of string which can be kept in the reference
+	maxVarStringLength = 0xffff
+
+	// Page id in the reference to string which is too long to be stored
+	varStringTooLong TSFPageId = 0xffffffff
+)
+
+type TSVarString string
+
+// Reference to a string in entry: in entries stored in file it refers
+// heap page and offset of the string in it, resolved references have zero
+// page id and the string follows entry
+type tsfVarStringRef struct {
+	PageId TSFPageId
+	Offset uint16
+	Length uint16
+}
+
+func decodeVarStringRef(buf []byte) (ref tsfVarStringRef) {
+	ref.PageId = TSFPageId(binary.LittleEndian.Uint32(buf))
+	ref.Offset = binary.LittleEndian.Uint16(buf[4:])
+	ref.Length = binary.LittleEndian.Uint16(buf[6:])
+	return
+}
+
+func (ref tsfVarStringRef) encode(buf []byte) {
+	binary.LittleEndian.PutUint32(buf, uint32(ref.PageId))
+	binary.LittleEndian.PutUint16(buf[4:], ref.Offset)
+	binary.LittleEndian.PutUint16(buf[6:], ref.Length)
+}
+
+// Encodes variable-length string into raw entry: writes reference into field
+// at offset and appends string to the entry. Strings should be encoded in the
+// order of fields. Strings longer than 64k are not appended, AddEntries() will
+// return an error for such entries. Returns updated entry
+func EncodeVarString(entry []byte, offset uint, value string) []byte {
+	if len(value) > maxVarStringLength {
+		tsfVarStringRef{PageId: varStringTooLong}.encode(entry[offset : offset+varStringRefSize])
+		return entry
+	}
+
+	ref := tsfVarStringRef{Length: uint16(len(value))}
+	ref.encode(entry[offset : offset+varStringRefSize])
+	return append(entry, value...)
+}
+
+// Returns true if schema contains variable-length strings
+func (schema *TSFSchemaHeader) hasVarStrings() bool {
+	for fieldId := 0; fieldId < int(schema.FieldCount); fieldId++ {
+		if schema.Fields[fieldId].FieldType == TSFFieldVarString {
+			return true
+		}
+	}
+	return false
+}
+
+// Decodes string of resolved entry. Returns empty string if reference
+// is not resolved
+func (deserializer *TSFDeserializer) getVarString(buf []byte, idx int) string {
+	field := &deserializer.fields[idx]
+	offset := deserializer.entrySize
+	for _, refOffset := range deserializer.varStringOffsets[:field.varStringIndex] {
+		offset += uint64(decodeVarStringRef(buf[refOffset:]).Length)
+	}
+
+	ref := decodeVarStringRef(buf[field.offset:])
+	end := offset + uint64(ref.Length)
+	if ref.PageId != 0 || end > uint64(len(buf)) {
+		return ""
+	}
+	return string(buf[offset:end])
+}
+
+// Converts entries passed to AddEntries() (raw buffers or go structures)
+// to raw entries which refer strings added to heap pages. Also returns ids of
+// heap pages referred by each entry which should be passed to addHeapRefs()
+// after entries are added to data page
+func (tsf *TSFile) storeVarStrings(schemaId TSFSchemaId, entries interface{}) (
+	rawEntries [][]byte, heapRefs [][]TSFPageId, err error) {
+	tsf.mu.RLock()
+	header := tsf.schemas[schemaId].header
+	tsf.mu.RUnlock()
+
+	value := reflect.ValueOf(entries)
+	isBufferSlice := (value.Type().Elem() == reflect.TypeOf([]byte{}))
+
+	rawEntries = make([][]byte, value.Len())
+	heapRefs = make([][]TSFPageId, value.Len())
+	defer func() {
+		if err != nil {
+			tsf.releaseHeapRefs(heapRefs)
+		}
+	}()
+
+	for i := range rawEntries {
+		var entry []byte
+		if isBufferSlice {
+			entry = value.Index(i).Bytes()
+		} else {
+			entry, err = encodeVarStringStruct(&header, value.Index(i))
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		if len(entry) < int(header.EntrySize) {
+			return nil, nil, fmt.Errorf("Invalid entry of size %d, at least %d is expected",
+				len(entry), header.EntrySize)
+		}
+
+		// Copy fixed part of entry and replace its references
+		rawEntry := make([]byte, header.EntrySize)
+		copy(rawEntry, entry)
+
+		offset := int(header.EntrySize)
+		for fieldId := 0; fieldId < int(header.FieldCount); fieldId++ {
+			field := &header.Fields[fieldId]
+			if field.FieldType != TSFFieldVarString {
+				continue
+			}
+
+			refBuf := rawEntry[field.Offset : field.Offset+varStringRefSize]
+			ref := decodeVarStringRef(refBuf)
+			end := offset + int(ref.Length)
+			if ref.PageId == varStringTooLong {
+				return nil, nil, fmt.Errorf("String in field %s is longer than %d bytes",
+					DecodeCStr(field.FieldName[:]), maxVarStringLength)
+			}
+			if ref.PageId != 0 || end > len(entry) {
+				return nil, nil, fmt.Errorf("Invalid reference to string in field %s",
+					DecodeCStr(field.FieldName[:]))
+			}
+
+			ref, err = tsf.putVarString(entry[offset:end], &heapRefs[i])
+			if err != nil {
+				return nil, nil, err
+			}
+			ref.encode(refBuf)
+			offset = end
+		}
+
+		rawEntries[i] = rawEntry
+	}
+
+	return rawEntries, heapRefs, nil
+}
+
+// Encodes go structure which contains TSVarString fields as raw entry
+func encodeVarStringStruct(header *TSFSchemaHeader, value reflect.Value) ([]byte, error) {
+	if value.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("Unexpected entry of type %s, struct is expected",
+			value.Type().Name())
+	}
+
+	entry := make([]byte, header.EntrySize)
+	fieldId := 0
+	for i := 0; i < value.NumField(); i++ {
+		if value.Type().Field(i).Anonymous {
+			continue
+		}
+		if fieldId >= int(header.FieldCount) {
+			return nil, fmt.Errorf("Struct %s has more fields than schema",
+				value.Type().Name())
+		}
+
+		field := &header.Fields[fieldId]
+		fieldId++
+
+		fieldValue := value.Field(i)
+		if field.FieldType == TSFFieldVarString {
+			entry = EncodeVarString(entry, uint(field.Offset), fieldValue.String())
+			continue
+		}
+
+		buf := bytes.NewBuffer(make([]byte, 0, field.Size))
+		err := binary.Write(buf, binary.LittleEndian, fieldValue.Interface())
+		if err != nil {
+			return nil, err
+		}
+		if uint64(buf.Len()) != field.Size {
+			return nil, fmt.Errorf("Invalid field %s of size %d, %d is expected",
+				DecodeCStr(field.FieldName[:]), buf.Len(), field.Size)
+		}
+		copy(entry[field.Offset:], buf.Bytes())
+	}
+
+	return entry, nil
+}
+
+// Decodes resolved raw entry into go structure which contains TSVarString fields
+func decodeVarStringStruct(deserializer *TSFDeserializer, entry []byte, value reflect.Value) error {
+	fieldId := 0
+	for i := 0; i < value.NumField(); i++ {
+		if value.Type().Field(i).Anonymous {
+			continue
+		}
+		if fieldId >= deserializer.Len() {
+			return fmt.Errorf("Struct %s has more fields than schema",
+				value.Type().Name())
+		}
+
+		field := &deserializer.fields[fieldId]
+		fieldId++
+
+		fieldValue := value.Field(i)
+		if field.varString {
+			_, str := deserializer.Get(entry, fieldId-1)
+			fieldValue.SetString(str.(string))
+			continue
+		}
+
+		reader := bytes.NewReader(entry[field.offset : field.offset+field.size])
+		err := binary.Read(reader, binary.LittleEndian, fieldValue.Addr().Interface())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Adds string to current heap page and returns reference to it. Ids of heap
+// pages which keep the string are appended to heapRefs
+func (tsf *TSFile) putVarString(data []byte, heapRefs *[]TSFPageId) (tsfVarStringRef, error) {
+	if len(data) == 0 {
+		return tsfVarStringRef{}, nil
+	}
+	if len(data) > maxVarStringLength {
+		return tsfVarStringRef{}, fmt.Errorf("String is longer than %d bytes", maxVarStringLength)
+	}
+	if !tsf.formatFlags.hasExtents() {
+		return tsfVarStringRef{}, fmt.Errorf("Variable-length strings are not supported by TSFile V1")
+	}
+
+	tsf.heapMu.Lock()
+	defer tsf.heapMu.Unlock()
+
+	if len(data) <= int(tsf.pageSize) {
+		page, pageId := tsf.getHeapPage(len(data))
+		*heapRefs = tsf.holdHeapPage(*heapRefs, pageId)
+
+		page.mu.Lock()
+		ref := tsfVarStringRef{
+			PageId: pageId,
+			Offset: uint16(page.buf.Len()),
+			Length: uint16(len(data)),
+		}
+		page.buf.Write(data)
+		page.markHeapDirty()
+		page.mu.Unlock()
+
+		return ref, nil
+	}
+
+	// Long string, start chain from the current page if it has some space
+	page, pageId := tsf.getHeapPage(varStringChunkHeaderSize + 1)
+	ref := tsfVarStringRef{PageId: pageId, Length: uint16(len(data))}
+	*heapRefs = tsf.holdHeapPage(*heapRefs, pageId)
+
+	chunkHeader := make([]byte, varStringChunkHeaderSize)
+	for first := true; len(data) > 0; first = false {
+		// Allocate page for the next chunk before writing this one, so
+		// the chunk will refer it
+		page.mu.Lock()
+		chunkSize := int(tsf.pageSize) - page.buf.Len() - varStringChunkHeaderSize
+		page.mu.Unlock()
+
+		var nextPage *tsfPage
+		var nextPageId TSFPageId
+		if chunkSize < len(data) {
+			nextPage, nextPageId = tsf.allocateDataPage(TSFTagHeap, 0)
+			*heapRefs = tsf.holdHeapPage(*heapRefs, nextPageId)
+		} else {
+			chunkSize = len(data)
+		}
+
+		page.mu.Lock()
+		if first {
+			ref.Offset = uint16(page.buf.Len())
+		}
+		binary.LittleEndian.PutUint32(chunkHeader, uint32(nextPageId))
+		page.buf.Write(chunkHeader)
+		page.buf.Write(data[:chunkSize])
+		page.markHeapDirty()
+		page.mu.Unlock()
+
+		data = data[chunkSize:]
+		if nextPage != nil {
+			tsf.retireHeapPage(page)
+			page = nextPage
+			swapPageId(&tsf.heapPageId, nextPageId)
+		}
+	}
+
+	return ref, nil
+}
+
+// Heap page is written each time pages are written, so make sure that
+// strings added while it is written will be written too. Call with page.mu held
+func (page *tsfPage) markHeapDirty() {
+	page.dirty = true
+	page.pending = true
+}
+
+// Returns heap page which has enough space for string of the specified
+// size or allocates a new one. Call with tsf.heapMu held
+func (tsf *TSFile) getHeapPage(size int) (*tsfPage, TSFPageId) {
+	if tsf.heapPageId != 0 {
+		page := tsf.tryGetPage(tsf.heapPageId)
+		if page != nil {
+			page.mu.Lock()
+			fits := page.buf.Len()+size <= int(tsf.pageSize)
+			page.mu.Unlock()
+
+			// Heap pages are local to extents unless pages are reused
+			if fits && (tsf.shouldReusePage() ||
+				tsf.getHeaderPageId(tsf.heapPageId) == loadPageId(&tsf.headerPageId)) {
+				return page, tsf.heapPageId
+			}
+
+			tsf.retireHeapPage(page)
+		}
+	}
+
+	page, pageId := tsf.allocateDataPage(TSFTagHeap, 0)
+	swapPageId(&tsf.heapPageId, pageId)
+	return page, pageId
+}
+
+// Marks heap page as full as it is no longer needed after it is written.
+// Call with tsf.heapMu held
+func (tsf *TSFile) retireHeapPage(page *tsfPage) {
+	page.mu.Lock()
+	page.full = true
+	page.mu.Unlock()
+	atomic.AddUint32(&tsf.fullPages, 1)
+}
+
+// Replaces entries read from file with resolved entries. getPage is used
+// to read heap pages of file with the specified page size
+func resolveVarStrings(header *TSFSchemaHeader, entries [][]byte, pageSize uint32,
+	getPage func(pageId TSFPageId) (*tsfPage, error)) error {
+	for i, entry := range entries {
+		resolved := make([]byte, header.EntrySize)
+		copy(resolved, entry)
+
+		for fieldId := 0; fieldId < int(header.FieldCount); fieldId++ {
+			field := &header.Fields[fieldId]
+			if field.FieldType != TSFFieldVarString {
+				continue
+			}
+
+			ref := decodeVarStringRef(resolved[field.Offset:])
+			if ref.PageId == 0 {
+				continue
+			}
+
+			var err error
+			resolved, err = appendVarString(resolved, ref, pageSize, getPage)
+			if err != nil {
+				return err
+			}
+
+			(tsfVarStringRef{Length: ref.Length}).encode(resolved[field.Offset:])
+		}
+
+		entries[i] = resolved
+	}
+
+	return nil
+}
+
+// Appends string referred by ref to the entry. Follows chain of heap pages if
+// string is longer than a page
+func appendVarString(entry []byte, ref tsfVarStringRef, pageSize uint32,
+	getPage func(pageId TSFPageId) (*tsfPage, error)) ([]byte, error) {
+	chained := uint32(ref.Length) > pageSize
+
+	pageId, offset, length := ref.PageId, int(ref.Offset), int(ref.Length)
+	for length > 0 {
+		if pageId == 0 {
+			return nil, fmt.Errorf("Chain of string at #%d:%d is broken", ref.PageId, ref.Offset)
+		}
+
+		page, err := getPage(pageId)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read string heap page #%d: %v", pageId, err)
+		}
+
+		page.mu.Lock()
+		heap := page.buf.Bytes()
+		start, end := offset, offset+length
+		nextPageId := TSFPageId(0)
+		if chained {
+			start += varStringChunkHeaderSize
+			if start <= len(heap) {
+				nextPageId = TSFPageId(binary.LittleEndian.Uint32(heap[offset:]))
+			}
+			if end = start + length; end > int(pageSize) {
+				end = int(pageSize)
+			}
+		}
+		ok := start < end && end <= len(heap)
+		if ok {
+			entry = append(entry, heap[start:end]...)
+		}
+		page.mu.Unlock()
+
+		if !ok {
+			return nil, fmt.Errorf("String at %d:%d is out of heap page #%d",
+				offset, length, pageId)
+		}
+
+		length -= end - start
+		pageId, offset = nextPageId, 0
+	}
+
+	return entry, nil
+}
+
+// Reads heap page with validating its tag
+func (tsf *TSFile) readHeapPage(pageId TSFPageId) (*tsfPage, error) {
+	tsf.mu.RLock()
+	isHeap := int(pageId) < len(tsf.pageHeaders) &&
+		tsf.pageHeaders[pageId].getTag() == TSFTagHeap
+	tsf.mu.RUnlock()
+
+	if !isHeap {
+		return nil, fmt.Errorf("page #%d is not a heap page", pageId)
+	}
+	return tsf.readPage(pageId)
+}
+
+// Reads entries into go structures which contain TSVarString fields
+func (tsf *TSFile) getVarStringEntries(tag TSFPageTag, value reflect.Value, start int) error {
+	schema, err := tsf.GetSchema(tag)
+	if err != nil {
+		return err
+	}
+
+	rawEntries := make([][]byte, value.Len())
+	err = tsf.GetEntries(tag, rawEntries, start)
+	if err != nil {
+		return err
+	}
+
+	deserializer := NewDeserializer(schema)
+	for i, entry := range rawEntries {
+		err = decodeVarStringStruct(deserializer, entry, value.Index(i))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Adds entries from the page of input file, which contain references to its
+// heap pages or have to be converted using mapping, to the output file.
+// Called from AddFile() with tsfIn.mu held
+func (tsfOut *TSFile) addConvertedPage(outTag TSFPageTag, tsfIn *TSFile,
+	inTag TSFPageTag, inPage *tsfPage, entrySize uint32, mapping *TSFSchemaMapping) error {
+	inPage.mu.Lock()
+	buf := inPage.buf.Bytes()
+	entries := make([][]byte, inPage.count)
+	for i := range entries {
+		entries[i] = buf[uint32(i)*entrySize : uint32(i+1)*entrySize]
+	}
+	inPage.mu.Unlock()
+
+	if tsfIn.schemas[inTag.toSchemaId()].varStrings {
+		err := resolveVarStrings(&tsfIn.schemas[inTag.toSchemaId()].header, entries,
+			tsfIn.pageSize, func(pageId TSFPageId) (*tsfPage, error) {
+				if int(pageId) >= len(tsfIn.pageHeaders) ||
+					tsfIn.pageHeaders[pageId].getTag() != TSFTagHeap {
+					return nil, fmt.Errorf("page #%d is not a heap page", pageId)
+				}
+
+				page := tsfIn.tryGetPage(pageId)
+				if page == nil {
+					page = tsfIn.newPage(tsfIn.pageSize)
+				}
+				return tsfIn.readPageNoLock(pageId, page)
+			})
+		if err != nil {
+			return err
+		}
+	}
+
+	if mapping != nil {
+		for i, entry := range entries {
+			entries[i] = mapping.Map(entry)
+		}
+	}
+	return tsfOut.AddEntries(outTag, entries)
+}
@@ -0,0 +1,161 @@
+package tsfile
+
+import (
+	"fmt"
+)
+
+// Verification and repair of files -- if TSFFormatChecksum is set, checksums
+// of pages are verified each time page is read. Data pages of the last extent
+// are most likely to be damaged if writer crashed (or system crashed before
+// flushing them), so LoadTSFile() verifies them eagerly. Damaged data pages
+// are dropped from series, while if header or schema page is damaged, file is
+// truncated to the last consistent header before that page
+
+// Describes damaged page which was found in file
+type TSFDamage struct {
+	// Id of the damaged page. All pages starting with this one are dropped
+	// if it is header or schema page
+	PageId TSFPageId
+
+	// Reason why page is considered to be damaged
+	Error error
+}
+
+// Returns list of damaged pages found so far
+func (tsf *TSFile) GetDamage() []TSFDamage {
+	tsf.mu.RLock()
+	defer tsf.mu.RUnlock()
+
+	return append([]TSFDamage(nil), tsf.damage...)
+}
+
+// Reads all data pages of file and drops damaged ones. Returns all damaged
+// pages found in file including ones which were found by LoadTSFile()
+func (tsf *TSFile) Verify() []TSFDamage {
+	tsf.verifyPages(1)
+	return tsf.GetDamage()
+}
+
+// Rewrites headers so they won't refer damaged pages which were dropped from
+// file and truncates underlying storage (if it supports truncation) after the
+// last consistent page. Shouldn't be called while file is being written
+func (tsf *TSFile) Repair() error {
+	if err := tsf.checkWritable(); err != nil {
+		return err
+	}
+
+	tsf.mu.Lock()
+	defer tsf.mu.Unlock()
+
+	if len(tsf.damage) == 0 {
+		return nil
+	}
+	if !tsf.formatFlags.hasExtents() {
+		return fmt.Errorf("Repair is only supported by TSFile V2 and V3")
+	}
+
+	var pageIds []TSFPageId
+	for _, damage := range tsf.damage {
+		if damage.PageId < tsf.pageCount {
+			pageIds = append(pageIds, damage.PageId)
+		}
+	}
+
+	err := tsf.updateHeaders(pageIds)
+	if err == nil {
+		err = tsf.writeHeaders()
+	}
+	if err != nil {
+		return err
+	}
+
+	if truncater, ok := tsf.file.(interface {
+		Truncate(size int64) error
+	}); ok {
+		err = truncater.Truncate(tsf.getPageOffset(tsf.pageCount))
+		if err != nil {
+			return fmt.Errorf("Cannot truncate file: %v", err)
+		}
+	}
+
+	tsf.damage = nil
+	return nil
+}
+
+func (tsf *TSFile) verifyLastExtent() {
+	if tsf.formatFlags.hasFlag(TSFFormatChecksum) {
+		tsf.verifyPages(tsf.headerPageId + 1)
+	}
+}
+
+// Reads data pages starting with startPageId and drops ones that are damaged
+func (tsf *TSFile) verifyPages(startPageId TSFPageId) {
+	for pageId := startPageId; pageId < loadPageId(&tsf.pageCount); pageId++ {
+		tsf.mu.RLock()
+		hdr := tsf.pageHeaders[pageId]
+		tsf.mu.RUnlock()
+
+		if hdr.Flags != 0 || !hdr.getTag().isDataTag() {
+			continue
+		}
+
+		_, err := tsf.readPage(pageId)
+		if err != nil {
+			tsf.dropPage(pageId, err)
+		}
+	}
+}
+
+// Drops data page from series, so its entries are no longer accessible
+func (tsf *TSFile) dropPage(pageId TSFPageId, err error) {
+	tsf.mu.Lock()
+	defer tsf.mu.Unlock()
+
+	tsf.damage = append(tsf.damage, TSFDamage{PageId: pageId, Error: err})
+	if page, ok := tsf.pageCache[pageId]; ok {
+		tsf.evictPage(page, pageId)
+	}
+
+	hdr := tsf.pageHeaders[pageId]
+	tsf.pageHeaders[pageId] = TSFPageHeader{Tag: uint16(TSFTagEmpty)}
+	tsf.removePageIndex(pageId, hdr)
+}
+
+// Removes data page from index of its series and shifts indices of the
+// following pages. Call with tsf.mu held
+func (tsf *TSFile) removePageIndex(pageId TSFPageId, hdr TSFPageHeader) {
+	schemaId := hdr.getTag().toSchemaId()
+	if !hdr.getTag().isDataTag() || !tsf.isValidSchemaId(schemaId) {
+		return
+	}
+
+	schema := &tsf.schemas[schemaId]
+	for i := range schema.pageIndex {
+		if schema.pageIndex[i].pageId != pageId {
+			continue
+		}
+
+		for j := i + 1; j < len(schema.pageIndex); j++ {
+			schema.pageIndex[j].start -= hdr.Count
+		}
+		schema.pageIndex = append(schema.pageIndex[:i], schema.pageIndex[i+1:]...)
+		schema.count -= hdr.Count
+		break
+	}
+}
+
+// Drops all pages starting with pageId. Only used while loading file
+func (tsf *TSFile) truncatePages(pageId TSFPageId, err error) {
+	tsf.mu.Lock()
+	defer tsf.mu.Unlock()
+
+	tsf.damage = append(tsf.damage, TSFDamage{PageId: pageId, Error: err})
+	for cachedPageId := range tsf.pageCache {
+		if cachedPageId >= pageId {
+			delete(tsf.pageCache, cachedPageId)
+		}
+	}
+
+	tsf.pageHeaders = tsf.pageHeaders[:pageId]
+	tsf.pageCount = pageId
+}